@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// Build metadata, injected with -ldflags, as in:
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD)"
+//
+// Unset values are taken from the build info embedded by the Go tool.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// readBuildInfo returns the build info embedded in the binary. It is a
+// variable so that tests can stub it.
+var readBuildInfo = debug.ReadBuildInfo
+
+// buildInfo describes the build of the server.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuildInfo returns the build metadata injected with -ldflags,
+// falling back to the module version and VCS settings recorded by the
+// Go tool, and otherwise "unknown".
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if embedded, ok := readBuildInfo(); ok {
+		if info.Version == "" && embedded.Main.Version != "(devel)" {
+			info.Version = embedded.Main.Version
+		}
+		for _, setting := range embedded.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	for _, value := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *value == "" {
+			*value = "unknown"
+		}
+	}
+	return info
+}
+
+// setServiceVersion sets the service version reported by tracer to the
+// build version, unless configured with ELASTIC_APM_SERVICE_VERSION. It
+// must be called before the tracer is used.
+func setServiceVersion(tracer *apm.Tracer, info buildInfo) {
+	if tracer.Service.Version == "" {
+		tracer.Service.Version = info.Version
+	}
+}
+
+// about describes the running server.
+type about struct {
+	Service         string          `json:"service"`
+	Version         string          `json:"version"`
+	Commit          string          `json:"commit"`
+	BuildDate       string          `json:"build_date"`
+	GoVersion       string          `json:"go_version"`
+	Features        map[string]bool `json:"features"`
+	Demo            map[string]bool `json:"demo"`
+	Scenario        scenarioStatus  `json:"scenario"`
+	DatabaseDialect string          `json:"database_dialect"`
+}
+
+// handleAbout returns a handler which describes the server: its build,
+// the optional features enabled in its configuration, the demo modes
+// and chaos scenario enabled at runtime, and the dialect of db. The service name and version are those reported by tracer, so that
+// they agree with its traces.
+func handleAbout(tracer *apm.Tracer, info buildInfo, reloader *configReloader, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, about{
+			Service:         tracer.Service.Name,
+			Version:         tracer.Service.Version,
+			Commit:          info.Commit,
+			BuildDate:       info.BuildDate,
+			GoVersion:       info.GoVersion,
+			Features:        enabledFeatures(reloader.config()),
+			Demo:            map[string]bool{"n_plus_one": reloader.settings.nPlusOne()},
+			Scenario:        reloader.settings.scenario().status(),
+			DatabaseDialect: db.DriverName(),
+		})
+	}
+}
+
+// enabledFeatures reports whether each of the optional features is
+// enabled by cfg.
+func enabledFeatures(cfg *config.Config) map[string]bool {
+	return map[string]bool{
+		"tls":                cfg.Server.TLSCert != "",
+		"mtls":               cfg.Server.TLSClientCA != "",
+		"h2c":                cfg.Server.H2C,
+		"grpc":               cfg.Server.GRPCListen != "",
+		"proxy":              len(cfg.Proxy.Services) > 0,
+		"capture_headers":    cfg.APM.CaptureHeaders,
+		"cors":               len(cfg.HTTP.CORSOrigins) > 0,
+		"graphql_dataloader": cfg.GraphQL.Dataloader,
+		"api_keys":           len(cfg.Auth.APIKeys) > 0,
+		"rate_limit":         cfg.Limits.RateLimit.Rate > 0 || cfg.Limits.APIKeyRateLimit.Rate > 0,
+		"webhooks":           len(cfg.Events.Webhooks.URLs) > 0,
+		"kafka":              len(cfg.Events.Kafka.Brokers) > 0,
+		"amqp":               cfg.Events.AMQP.URL.URL != nil,
+		"reports":            cfg.Reports.SMTPURL.URL != nil,
+		"pprof":              cfg.Diagnostics.Pprof,
+		"metrics_auth":       cfg.Diagnostics.MetricsAuth,
+		"self_load":          cfg.SelfLoad.Enabled,
+		"payment":            cfg.Payment.Enabled,
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// stubBuildInfo replaces the embedded build info with info until the
+// test completes. If info is nil, there is no build info.
+func stubBuildInfo(t *testing.T, info *debug.BuildInfo) {
+	orig := readBuildInfo
+	readBuildInfo = func() (*debug.BuildInfo, bool) { return info, info != nil }
+	t.Cleanup(func() { readBuildInfo = orig })
+}
+
+var testBuildInfo = &debug.BuildInfo{
+	Main: debug.Module{Path: "github.com/elastic/opbeans-go", Version: "v1.4.0"},
+	Settings: []debug.BuildSetting{
+		{Key: "vcs.revision", Value: "0123abcd"},
+		{Key: "vcs.time", Value: "2026-01-02T03:04:05Z"},
+	},
+}
+
+func TestCurrentBuildInfo(t *testing.T) {
+	stubBuildInfo(t, testBuildInfo)
+	assert.Equal(t, buildInfo{
+		Version:   "v1.4.0",
+		Commit:    "0123abcd",
+		BuildDate: "2026-01-02T03:04:05Z",
+		GoVersion: runtime.Version(),
+	}, currentBuildInfo())
+
+	// Values injected with -ldflags take precedence.
+	version, commit = "1.5.0-rc1", "feedface"
+	defer func() { version, commit = "", "" }()
+	info := currentBuildInfo()
+	assert.Equal(t, "1.5.0-rc1", info.Version)
+	assert.Equal(t, "feedface", info.Commit)
+	assert.Equal(t, "2026-01-02T03:04:05Z", info.BuildDate)
+}
+
+func TestCurrentBuildInfoMissing(t *testing.T) {
+	stubBuildInfo(t, nil)
+	info := currentBuildInfo()
+	assert.Equal(t, buildInfo{
+		Version:   "unknown",
+		Commit:    "unknown",
+		BuildDate: "unknown",
+		GoVersion: runtime.Version(),
+	}, info)
+
+	// Development builds do not record a module version.
+	stubBuildInfo(t, &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}})
+	assert.Equal(t, "unknown", currentBuildInfo().Version)
+}
+
+func TestAbout(t *testing.T) {
+	setTestStartupFlags(t)
+	stubBuildInfo(t, testBuildInfo)
+	t.Setenv("OPBEANS_GRAPHQL_DATALOADER", "true")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	setServiceVersion(tracer, currentBuildInfo())
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/about", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.ElementsMatch(t, []string{
+		"service", "version", "commit", "build_date", "go_version", "features", "demo", "scenario", "database_dialect",
+	}, keys(body))
+	assert.Equal(t, "v1.4.0", body["version"])
+	assert.Equal(t, "0123abcd", body["commit"])
+	assert.Equal(t, "2026-01-02T03:04:05Z", body["build_date"])
+	assert.Equal(t, runtime.Version(), body["go_version"])
+	assert.Equal(t, "sqlite3", body["database_dialect"])
+	features := body["features"].(map[string]interface{})
+	assert.Equal(t, true, features["graphql_dataloader"])
+	assert.Equal(t, false, features["pprof"])
+	assert.Equal(t, map[string]interface{}{"n_plus_one": false}, body["demo"])
+	assert.Equal(t, map[string]interface{}{"active": false}, body["scenario"])
+
+	// The tracer reports the same service name and version.
+	tracer.Flush(nil)
+	_, _, service := recorder.Metadata()
+	assert.Equal(t, body["service"], service.Name)
+	assert.Equal(t, "v1.4.0", service.Version)
+}
+
+func keys(m map[string]interface{}) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestSetServiceVersionConfigured(t *testing.T) {
+	t.Setenv("ELASTIC_APM_SERVICE_VERSION", "configured")
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(t, err)
+	defer tracer.Close()
+	tracer.Transport = &transporttest.RecorderTransport{}
+	setServiceVersion(tracer, buildInfo{Version: "v1.4.0"})
+	assert.Equal(t, "configured", tracer.Service.Version)
+}
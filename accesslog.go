@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+const (
+	// accessLogDataset is the event.dataset of access log entries.
+	accessLogDataset = "opbeans-go.access"
+
+	// ecsVersion is the version of the Elastic Common Schema with
+	// which access log entries comply.
+	ecsVersion = "1.6.0"
+)
+
+// openAccessLog opens the destination of the access log configured by
+// c, returning the access logger and a function which closes the
+// destination.
+func openAccessLog(c config.AccessLog) (*accessLogger, func(), error) {
+	if c.Path == config.DefaultAccessLog {
+		return newAccessLogger(os.Stdout, c.SampleRate, nil), func() {}, nil
+	}
+	f, err := os.OpenFile(c.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open access log")
+	}
+	return newAccessLogger(f, c.SampleRate, nil), func() { f.Close() }, nil
+}
+
+// accessLogger writes an entry for each request to an access log, as a
+// line of JSON with Elastic Common Schema fields.
+type accessLogger struct {
+	sampleRate float64
+
+	mu     sync.Mutex
+	out    io.Writer
+	random *rand.Rand
+}
+
+// newAccessLogger returns an accessLogger writing to out, and logging
+// sampleRate of 2xx responses, sampled using source. If source is nil,
+// responses are sampled using a source seeded with the current time.
+func newAccessLogger(out io.Writer, sampleRate float64, source rand.Source) *accessLogger {
+	if source == nil {
+		source = rand.NewSource(time.Now().UnixNano())
+	}
+	return &accessLogger{sampleRate: sampleRate, out: out, random: rand.New(source)}
+}
+
+// accessLogEntry is an access log entry. Field names are those of the
+// Elastic Common Schema, with the API client's name as a custom label.
+type accessLogEntry struct {
+	Timestamp     time.Time `json:"@timestamp"`
+	ECSVersion    string    `json:"ecs.version"`
+	Dataset       string    `json:"event.dataset"`
+	Duration      int64     `json:"event.duration"`
+	Method        string    `json:"http.request.method"`
+	RequestID     string    `json:"http.request.id,omitempty"`
+	StatusCode    int       `json:"http.response.status_code"`
+	BodyBytes     int       `json:"http.response.body.bytes"`
+	Path          string    `json:"url.path"`
+	Query         string    `json:"url.query,omitempty"`
+	ClientIP      string    `json:"client.ip"`
+	UserAgent     string    `json:"user_agent.original,omitempty"`
+	TraceID       string    `json:"trace.id,omitempty"`
+	TransactionID string    `json:"transaction.id,omitempty"`
+
+	// APIClient holds only the name of the API client, never its key.
+	APIClient string `json:"labels.api_client,omitempty"`
+}
+
+// middleware logs each request once it has been handled. It must be
+// installed after tracingMiddleware, so that entries record the trace
+// context of the request's transaction.
+func (l *accessLogger) middleware(c *gin.Context) {
+	start := time.Now()
+	method := c.Request.Method
+	path := c.Request.URL.Path
+	query := c.Request.URL.RawQuery
+	c.Next()
+
+	status := c.Writer.Status()
+	if status >= 200 && status < 300 && !l.sample() {
+		return
+	}
+	entry := accessLogEntry{
+		Timestamp:  start.UTC(),
+		ECSVersion: ecsVersion,
+		Dataset:    accessLogDataset,
+		Duration:   time.Since(start).Nanoseconds(),
+		Method:     method,
+		RequestID:  requestIDFromContext(c.Request.Context()),
+		StatusCode: status,
+		BodyBytes:  c.Writer.Size(),
+		Path:       path,
+		Query:      query,
+		ClientIP:   c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		APIClient:  authenticatedAPIClient(c),
+	}
+	if entry.BodyBytes < 0 {
+		entry.BodyBytes = 0
+	}
+	if tx := apm.TransactionFromContext(c.Request.Context()); tx != nil {
+		traceContext := tx.TraceContext()
+		entry.TraceID = traceContext.Trace.String()
+		entry.TransactionID = traceContext.Span.String()
+	}
+	l.write(entry)
+}
+
+// sample reports whether a 2xx response should be logged.
+func (l *accessLogger) sample() bool {
+	if l.sampleRate >= 1 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.random.Float64() < l.sampleRate
+}
+
+// write writes entry to the access log as a line of JSON.
+func (l *accessLogger) write(entry accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logrus.WithError(err).Error("failed to encode access log entry")
+		return
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		logrus.WithError(err).Error("failed to write access log entry")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// newTestAccessLogRouter returns a router traced by tracer and logging
+// requests with l, which responds to "/status/:code" with the given
+// status code.
+func newTestAccessLogRouter(tracer *apm.Tracer, l *accessLogger) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(l.middleware)
+	r.GET("/status/:code", func(c *gin.Context) {
+		var code int
+		fmt.Sscan(c.Param("code"), &code)
+		c.String(code, "hello")
+	})
+	return r
+}
+
+func decodeAccessLog(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for decoder := json.NewDecoder(buf); decoder.More(); {
+		var entry map[string]interface{}
+		require.NoError(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLogECSFields(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	var buf bytes.Buffer
+	r := newTestAccessLogRouter(tracer, newAccessLogger(&buf, 1, nil))
+	req := httptest.NewRequest("GET", "/status/200?sort=name", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.Header.Set("User-Agent", "opbeans-test")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Flush(nil)
+	tx := recorder.Payloads().Transactions[0]
+
+	entries := decodeAccessLog(t, &buf)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, ecsVersion, entry["ecs.version"])
+	assert.Equal(t, accessLogDataset, entry["event.dataset"])
+	assert.Equal(t, "GET", entry["http.request.method"])
+	assert.Equal(t, 200.0, entry["http.response.status_code"])
+	assert.Equal(t, 5.0, entry["http.response.body.bytes"])
+	assert.Equal(t, "/status/200", entry["url.path"])
+	assert.Equal(t, "sort=name", entry["url.query"])
+	assert.Equal(t, "203.0.113.1", entry["client.ip"])
+	assert.Equal(t, "opbeans-test", entry["user_agent.original"])
+	assert.Contains(t, entry, "@timestamp")
+	assert.Contains(t, entry, "event.duration")
+	assert.Equal(t, fmt.Sprintf("%x", tx.TraceID[:]), entry["trace.id"])
+	assert.Equal(t, fmt.Sprintf("%x", tx.ID[:]), entry["transaction.id"])
+
+	// Fields which do not apply to a request are omitted.
+	buf.Reset()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/404", nil))
+	entries = decodeAccessLog(t, &buf)
+	require.Len(t, entries, 1)
+	assert.NotContains(t, entries[0], "url.query")
+	assert.NotContains(t, entries[0], "labels.api_client")
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	const seed, sampleRate, requests = 42, 0.25, 200
+	var buf bytes.Buffer
+	r := newTestAccessLogRouter(apm.DefaultTracer, newAccessLogger(&buf, sampleRate, rand.NewSource(seed)))
+
+	// Only 2xx responses consume the sampler, so the number sampled is
+	// that of the seeded sequence, and all errors are logged.
+	random := rand.New(rand.NewSource(seed))
+	var expectSampled int
+	for i := 0; i < requests; i++ {
+		if random.Float64() < sampleRate {
+			expectSampled++
+		}
+		for _, code := range []int{200, 404, 500} {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/status/%d", code), nil))
+		}
+	}
+
+	counts := make(map[float64]int)
+	for _, entry := range decodeAccessLog(t, &buf) {
+		counts[entry["http.response.status_code"].(float64)]++
+	}
+	assert.Equal(t, map[float64]int{200: expectSampled, 404: requests, 500: requests}, counts)
+	assert.InDelta(t, sampleRate*requests, expectSampled, 0.1*requests)
+
+	// A sample rate of 0 logs only errors.
+	buf.Reset()
+	r = newTestAccessLogRouter(apm.DefaultTracer, newAccessLogger(&buf, 0, rand.NewSource(seed)))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/204", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/503", nil))
+	entries := decodeAccessLog(t, &buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, float64(http.StatusServiceUnavailable), entries[0]["http.response.status_code"])
+}
+
+func TestAccessLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, closeLog, err := openAccessLog(config.AccessLog{Path: path, SampleRate: 1})
+	require.NoError(t, err)
+	r := newTestAccessLogRouter(apm.DefaultTracer, l)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/200", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/201", nil))
+	closeLog()
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	entries := decodeAccessLog(t, bytes.NewBuffer(data))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "/status/201", entries[1]["url.path"])
+}
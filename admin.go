@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const defaultAPMServerURL = "http://localhost:8200"
+
+// authenticatedUsernameKey is the gin context key under which adminAuth
+// records the username of authenticated requests.
+const authenticatedUsernameKey = "opbeans.authenticated_username"
+
+// addAdminHandlers adds the admin API handlers to r, which must be
+// protected by adminAuth. Request bodies are never captured for the
+// admin routes, as they may carry credentials.
+func addAdminHandlers(r tracedGroup, tracer *apm.Tracer, reloader *configReloader, db *sqlx.DB, exports *exportStore, reports *reporter, apiKeys *apiKeyring, maintenance *maintenanceMode, backends *backendPool) {
+	r.GET("/apm", handleTracerStatus(tracer)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/config", handleGetConfig(reloader)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/config/reload", handleReloadConfig(reloader, db)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/exports/orders", handleCreateOrdersExport(exports, db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/jobs", handleGetJobs(db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/maintenance", handleGetMaintenance(maintenance)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/maintenance", handleSetMaintenance(maintenance, db)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/reports/send", handleSendReport(reports, db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/apikeys/usage", handleGetAPIKeyUsage(apiKeys)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/audit", handleGetAuditLog(db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/proxy", handleGetProxy(backends)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/runtime", handleRuntimeStatus).CaptureBody(apm.CaptureBodyOff)
+}
+
+// isAdminRequest reports whether req is for the operational routes: the
+// admin API, the metrics and the profiles.
+func isAdminRequest(req *http.Request) bool {
+	path := req.URL.Path
+	return path == "/api/admin" || strings.HasPrefix(path, "/api/admin/") ||
+		path == metricsPath || isPprofRequest(req)
+}
+
+// adminAuth returns a middleware which requires requests to be
+// authenticated with HTTP basic authentication, using the given
+// credentials. If password is empty, all requests are rejected. The
+// username of authenticated requests is recorded as the user of their
+// transactions and errors; rejected requests are not reported as errors.
+func adminAuth(username, password string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestUsername, requestPassword, ok := c.Request.BasicAuth()
+		if !ok || password == "" ||
+			subtle.ConstantTimeCompare([]byte(requestUsername), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(requestPassword), []byte(password)) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="opbeans admin"`)
+			abortWithStatus(c, http.StatusUnauthorized)
+			return
+		}
+		c.Set(authenticatedUsernameKey, requestUsername)
+		c.Next()
+	}
+}
+
+// tracerStatus describes the state of the tracer, for diagnosing
+// problems with sending data to the APM Server.
+type tracerStatus struct {
+	Active     bool              `json:"active"`
+	ServerURLs []string          `json:"server_urls"`
+	SampleRate float64           `json:"sample_rate"`
+	LastSend   *sendStatus       `json:"last_send,omitempty"`
+	Stats      tracerStatusStats `json:"stats"`
+}
+
+type tracerStatusStats struct {
+	TransactionsSent    uint64 `json:"transactions_sent"`
+	TransactionsDropped uint64 `json:"transactions_dropped"`
+	SpansSent           uint64 `json:"spans_sent"`
+	SpansDropped        uint64 `json:"spans_dropped"`
+	ErrorsSent          uint64 `json:"errors_sent"`
+	ErrorsDropped       uint64 `json:"errors_dropped"`
+	SendErrors          uint64 `json:"send_errors"`
+}
+
+// handleTracerStatus returns a handler which reports the status of
+// tracer. The agent does not expose the number of buffered events, so
+// they are not reported.
+//
+// The server URLs and sample rate are taken from the environment, in
+// the same manner as the agent. The result of the last send is only
+// reported if tracer.Transport is a *sendStatusTransport.
+func handleTracerStatus(tracer *apm.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats := tracer.Stats()
+		status := tracerStatus{
+			Active:     tracer.Active(),
+			ServerURLs: redactedServerURLs(),
+			SampleRate: transactionSampleRate(),
+			Stats: tracerStatusStats{
+				TransactionsSent:    stats.TransactionsSent,
+				TransactionsDropped: stats.TransactionsDropped,
+				SpansSent:           stats.SpansSent,
+				SpansDropped:        stats.SpansDropped,
+				ErrorsSent:          stats.ErrorsSent,
+				ErrorsDropped:       stats.ErrorsDropped,
+				SendErrors:          stats.Errors.SendStream,
+			},
+		}
+		if t, ok := tracer.Transport.(*sendStatusTransport); ok {
+			status.LastSend = t.lastSend()
+		}
+		renderJSON(c, http.StatusOK, status)
+	}
+}
+
+// handleGetConfig reports the effective configuration, with its
+// secrets redacted.
+func handleGetConfig(reloader *configReloader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, reloader.config())
+	}
+}
+
+// handleReloadConfig returns a handler which reloads the configuration,
+// reporting the options reloaded and those which require a restart.
+func handleReloadConfig(reloader *configReloader, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := reloader.reload()
+		if err != nil {
+			abortWithError(c, apperr.Wrap(err, apperr.Invalid))
+			return
+		}
+		auditAdminAction(c, db, auditActionReloadConfig)
+		renderJSON(c, http.StatusOK, result)
+	}
+}
+
+// redactedServerURLs returns the configured APM Server URLs, with any
+// user info and query removed.
+func redactedServerURLs() []string {
+	value := os.Getenv("ELASTIC_APM_SERVER_URLS")
+	if value == "" {
+		value = os.Getenv("ELASTIC_APM_SERVER_URL")
+	}
+	var urls []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		u, err := url.Parse(field)
+		if err != nil {
+			urls = append(urls, "[INVALID]")
+			continue
+		}
+		u.User = nil
+		u.RawQuery = ""
+		urls = append(urls, u.String())
+	}
+	if len(urls) == 0 {
+		urls = []string{defaultAPMServerURL}
+	}
+	return urls
+}
+
+// transactionSampleRate returns the transaction sample rate configured
+// by $ELASTIC_APM_TRANSACTION_SAMPLE_RATE. As with the agent, invalid
+// values are ignored.
+func transactionSampleRate() float64 {
+	value := os.Getenv("ELASTIC_APM_TRANSACTION_SAMPLE_RATE")
+	if value == "" {
+		return 1
+	}
+	ratio, err := strconv.ParseFloat(value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return 1
+	}
+	return ratio
+}
+
+// sendStatusTransport is a transport.Transport which records the result
+// of the most recent send.
+type sendStatusTransport struct {
+	transport.Transport
+
+	mu   sync.Mutex
+	last *sendStatus
+}
+
+type sendStatus struct {
+	Time  time.Time `json:"time"`
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+}
+
+func (t *sendStatusTransport) SendStream(ctx context.Context, r io.Reader) error {
+	err := t.Transport.SendStream(ctx, r)
+	status := &sendStatus{Time: time.Now(), OK: err == nil}
+	if err != nil {
+		status.Error = redactSecretToken(err.Error())
+	}
+	t.mu.Lock()
+	t.last = status
+	t.mu.Unlock()
+	return err
+}
+
+func (t *sendStatusTransport) lastSend() *sendStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
+
+// redactSecretToken replaces occurrences of the configured APM Server
+// secret token in s.
+func redactSecretToken(s string) string {
+	if token := os.Getenv("ELASTIC_APM_SECRET_TOKEN"); token != "" {
+		s = strings.Replace(s, token, "[REDACTED]", -1)
+	}
+	return s
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const (
+	// amqpPrefetch is the number of unacknowledged messages the
+	// server delivers to the consumer at a time.
+	amqpPrefetch = 10
+
+	// amqpInitialBackoff is the delay before reconnecting after the
+	// connection is lost, or fails. The delay doubles with each failed
+	// reconnection, up to amqpMaxBackoff.
+	amqpInitialBackoff = time.Second
+	amqpMaxBackoff     = 30 * time.Second
+)
+
+// AMQP message headers from which the trace context of the publisher is
+// taken, in order of preference.
+var amqpTraceparentHeaders = []string{"elastic-apm-traceparent", "traceparent"}
+
+// amqpChannel is the part of an AMQP channel used by amqpConsumer. It is
+// implemented by amqpSession, and faked in tests.
+type amqpChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Close() error
+}
+
+// amqpSession is an AMQP channel, and the connection it belongs to,
+// which is closed with the channel.
+type amqpSession struct {
+	*amqp.Channel
+	conn *amqp.Connection
+}
+
+func (s amqpSession) Close() error {
+	s.Channel.Close()
+	return s.conn.Close()
+}
+
+// dialAMQP connects to the AMQP server at amqpURL, returning a channel
+// limited to amqpPrefetch unacknowledged messages.
+func dialAMQP(amqpURL string) (amqpChannel, error) {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := ch.Qos(amqpPrefetch, 0, false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return amqpSession{Channel: ch, conn: conn}, nil
+}
+
+// amqpConsumer consumes orders published to an AMQP queue by other
+// opbeans services, and stores them in the database.
+type amqpConsumer struct {
+	tracer *apm.Tracer
+	db     *sqlx.DB
+	queue  string
+	dial   func() (amqpChannel, error)
+
+	// maintenance pauses consumption while enabled. It may be nil.
+	maintenance *maintenanceMode
+
+	// cache holds the ETag data version and the cached product
+	// responses, invalidated by the orders stored. It may be nil.
+	cache persistence.CacheStore
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// newAMQPConsumer returns an amqpConsumer consuming orders from queue on
+// the AMQP server at amqpURL, storing them in db, and traced by tracer.
+func newAMQPConsumer(tracer *apm.Tracer, db *sqlx.DB, amqpURL, queue string) *amqpConsumer {
+	return &amqpConsumer{
+		tracer:         tracer,
+		db:             db,
+		queue:          queue,
+		dial:           func() (amqpChannel, error) { return dialAMQP(amqpURL) },
+		initialBackoff: amqpInitialBackoff,
+		maxBackoff:     amqpMaxBackoff,
+	}
+}
+
+// run consumes messages until ctx is cancelled, reconnecting with
+// exponential backoff when the connection fails or is lost. A message
+// being processed when ctx is cancelled is processed to completion.
+func (c *amqpConsumer) run(ctx context.Context) {
+	backoff := c.initialBackoff
+	for {
+		connected, err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = c.initialBackoff
+		}
+		logrus.WithError(err).WithField("backoff", backoff).Warn("AMQP consumer disconnected, reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// consume connects to the server and consumes messages until ctx is
+// cancelled or the connection is lost, reporting whether it connected.
+// Messages are not handled in maintenance mode.
+func (c *amqpConsumer) consume(ctx context.Context) (bool, error) {
+	ch, err := c.dial()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to connect to AMQP server")
+	}
+	defer ch.Close()
+	if _, err := ch.QueueDeclare(c.queue, true, false, false, false, nil); err != nil {
+		return false, errors.Wrapf(err, "failed to declare AMQP queue %q", c.queue)
+	}
+	deliveries, err := ch.Consume(c.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to consume AMQP queue %q", c.queue)
+	}
+	logrus.Infof("consuming remote orders from AMQP queue %q", c.queue)
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return true, errors.New("AMQP delivery channel closed")
+			}
+			if !c.maintenance.wait(ctx) {
+				// The unacknowledged delivery is requeued when the
+				// channel is closed.
+				return true, ctx.Err()
+			}
+			c.handleDelivery(context.Background(), d)
+		}
+	}
+}
+
+// handleDelivery stores the order in d, invalidating the cached
+// responses it changes, and acknowledges it.
+//
+// The delivery is traced as a "messaging" transaction, continuing the
+// trace of the publisher if the message headers carry its trace context.
+// Messages which are malformed, or refer to unknown customers or
+// products, are acknowledged so that they are not redelivered, and their
+// errors reported. Messages which fail to be stored due to database
+// errors are requeued.
+func (c *amqpConsumer) handleDelivery(ctx context.Context, d amqp.Delivery) {
+	tx := c.tracer.StartTransactionOptions("RabbitMQ RECEIVE from "+c.queue, "messaging", apm.TransactionOptions{
+		TraceContext: amqpTraceContext(d.Headers),
+	})
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("queue", c.queue)
+		if d.MessageId != "" {
+			tx.Context.SetLabel("message_id", d.MessageId)
+		}
+	})
+
+	orderID, err := c.storeOrder(ctx, d.Body)
+	if err == nil {
+		tx.Result = "success"
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("order_id", orderID)
+		})
+		c.invalidateCaches(ctx)
+		if err := d.Ack(false); err != nil {
+			logrus.WithError(err).Error("failed to acknowledge AMQP message")
+		}
+		return
+	}
+
+	if e := apm.CaptureError(ctx, err); e != nil {
+		e.Send()
+	}
+	if appErr, ok := apperr.As(err); ok && appErr.Kind == apperr.DB {
+		tx.Result = "failure"
+		logrus.WithError(err).Error("failed to store remote order, requeueing")
+		err = d.Nack(false, true)
+	} else {
+		tx.Result = "rejected"
+		logrus.WithError(err).Warn("discarding invalid remote order")
+		err = d.Ack(false)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("failed to acknowledge AMQP message")
+	}
+}
+
+// invalidateCaches invalidates the ETags and the cached product
+// responses once an order has been stored, as orders placed through the
+// API do. The order is not failed if they cannot be invalidated.
+func (c *amqpConsumer) invalidateCaches(ctx context.Context) {
+	if err := rotateDataVersion(ctx, c.cache); err != nil {
+		err := errors.Wrap(err, "failed to rotate data version")
+		loggerFromContext(ctx).WithError(err).Error("stale ETags may match")
+	}
+	invalidateCachedProductResponses(ctx, c.cache)
+}
+
+// amqpTraceContext returns the trace context in headers, or a zero
+// TraceContext if there is no valid one.
+func amqpTraceContext(headers amqp.Table) apm.TraceContext {
+	for _, key := range amqpTraceparentHeaders {
+		var value string
+		switch v := headers[key].(type) {
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		}
+		if traceContext, ok := parseTraceparent(value); ok {
+			return traceContext
+		}
+	}
+	return apm.TraceContext{}
+}
+
+// remoteOrder is an order published by another opbeans service.
+type remoteOrder struct {
+	CustomerID int `json:"customer_id"`
+	Lines      []struct {
+		ID     int `json:"id"`
+		Amount int `json:"amount"`
+	} `json:"lines"`
+}
+
+// storeOrder validates and stores the remote order encoded in body,
+// returning its local ID. Errors are *apperr.Errors, with the DB kind if
+// the message may be retried.
+func (c *amqpConsumer) storeOrder(ctx context.Context, body []byte) (int, error) {
+	var order remoteOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		err := errors.Wrap(err, "failed to decode remote order")
+		return 0, apperr.Wrap(err, apperr.Validation)
+	}
+	if order.CustomerID <= 0 {
+		return 0, apperr.New(apperr.Validation, "remote order has no customer_id")
+	}
+	if len(order.Lines) == 0 {
+		return 0, apperr.New(apperr.Validation, "remote order has no lines", "customer_id", order.CustomerID)
+	}
+
+	customer, err := getCustomer(ctx, c.db, order.CustomerID)
+	if err != nil {
+		return 0, apperr.Wrap(err, apperr.DB, "customer_id", order.CustomerID)
+	}
+	if customer == nil {
+		return 0, apperr.New(apperr.NotFound, "customer not found", "customer_id", order.CustomerID)
+	}
+	lines := make([]ProductOrderLine, len(order.Lines))
+	for i, line := range order.Lines {
+		if line.Amount <= 0 {
+			return 0, apperr.New(apperr.Validation, "invalid order line amount", "product_id", line.ID, "amount", line.Amount)
+		}
+		product, err := getProduct(ctx, c.db, line.ID)
+		if err == errProductNotFound {
+			return 0, apperr.New(apperr.NotFound, "product not found", "product_id", line.ID)
+		} else if err != nil {
+			return 0, apperr.Wrap(err, apperr.DB, "product_id", line.ID)
+		}
+		lines[i] = ProductOrderLine{Product: *product, Amount: line.Amount}
+	}
+
+	orderID, _, err := createOrder(ctx, c.db, customer, lines)
+	if err != nil {
+		err := errors.Wrap(err, "failed to create order")
+		return 0, apperr.Wrap(err, apperr.DB, "customer_id", order.CustomerID)
+	}
+	return orderID, nil
+}
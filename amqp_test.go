@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// fakeAMQPChannel is an in-memory AMQP channel, delivering the messages
+// sent to deliveries. Closing deliveries simulates connection loss.
+type fakeAMQPChannel struct {
+	deliveries chan amqp.Delivery
+	closed     chan struct{}
+	queue      string
+}
+
+func newFakeAMQPChannel() *fakeAMQPChannel {
+	return &fakeAMQPChannel{
+		deliveries: make(chan amqp.Delivery),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (ch *fakeAMQPChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.queue = name
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeAMQPChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return ch.deliveries, nil
+}
+
+func (ch *fakeAMQPChannel) Close() error {
+	close(ch.closed)
+	return nil
+}
+
+// fakeAcknowledger records the acknowledgements of deliveries.
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	acked   []uint64
+	nacked  []uint64
+	updated chan struct{}
+}
+
+func newFakeAcknowledger() *fakeAcknowledger {
+	return &fakeAcknowledger{updated: make(chan struct{}, 100)}
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+	a.updated <- struct{}{}
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if requeue {
+		a.nacked = append(a.nacked, tag)
+	} else {
+		a.acked = append(a.acked, tag)
+	}
+	a.updated <- struct{}{}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// wait waits for n deliveries to be acknowledged, positively or not.
+func (a *fakeAcknowledger) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-a.updated:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for acknowledgement")
+		}
+	}
+}
+
+// startTestAMQPConsumer runs a consumer connecting with dial, returning
+// a function which stops it, and waits for it to return.
+func startTestAMQPConsumer(t *testing.T, tracer *apm.Tracer, db *sqlx.DB, dial func() (amqpChannel, error)) func() {
+	c := newAMQPConsumer(tracer, db, "", "orders")
+	c.dial = dial
+	c.initialBackoff = time.Millisecond
+	c.maxBackoff = 4 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run(ctx)
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for consumer to stop")
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func countOrders(t *testing.T, db *sqlx.DB) int {
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&n))
+	return n
+}
+
+func TestAMQPConsumer(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	ch := newFakeAMQPChannel()
+	stop := startTestAMQPConsumer(t, tracer, db, func() (amqpChannel, error) { return ch, nil })
+
+	publisher := tracer.StartTransaction("POST /api/orders", "request")
+	traceparent := apmhttp.FormatTraceparentHeader(publisher.TraceContext())
+	publisher.End()
+	ack := newFakeAcknowledger()
+	ch.deliveries <- amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  1,
+		MessageId:    "message-1",
+		Headers:      amqp.Table{"elastic-apm-traceparent": traceparent},
+		Body:         []byte(`{"customer_id": 1, "lines": [{"id": 1, "amount": 2}, {"id": 2, "amount": 1}]}`),
+	}
+	ack.wait(t, 1)
+	assert.Equal(t, []uint64{1}, ack.acked)
+	assert.Equal(t, "orders", ch.queue)
+
+	// Stopping the consumer closes the channel.
+	stop()
+	select {
+	case <-ch.closed:
+	default:
+		t.Fatal("channel not closed")
+	}
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	tx := payloads.Transactions[1]
+	assert.Equal(t, "RabbitMQ RECEIVE from orders", tx.Name)
+	assert.Equal(t, "messaging", tx.Type)
+	assert.Equal(t, "success", tx.Result)
+	assert.Equal(t, payloads.Transactions[0].TraceID, tx.TraceID)
+	assert.Equal(t, payloads.Transactions[0].ID, tx.ParentID)
+	labels := transactionLabels(tx)
+	assert.Equal(t, "message-1", labels["message_id"])
+
+	orderID, ok := labels["order_id"].(float64)
+	require.True(t, ok)
+	order, err := getOrder(context.Background(), db, int(orderID))
+	require.NoError(t, err)
+	assert.Equal(t, 1, order.CustomerID)
+	assert.Len(t, order.Lines, 2)
+	assert.Empty(t, payloads.Errors)
+}
+
+func TestAMQPConsumerInvalidMessages(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	ch := newFakeAMQPChannel()
+	startTestAMQPConsumer(t, tracer, db, func() (amqpChannel, error) { return ch, nil })
+	orders := countOrders(t, db)
+
+	ack := newFakeAcknowledger()
+	bodies := []string{
+		`not json`,
+		`{"lines": [{"id": 1, "amount": 1}]}`,
+		`{"customer_id": 1, "lines": []}`,
+		`{"customer_id": 1, "lines": [{"id": 1, "amount": 0}]}`,
+		`{"customer_id": 999999, "lines": [{"id": 1, "amount": 1}]}`,
+		`{"customer_id": 1, "lines": [{"id": 999999, "amount": 1}]}`,
+	}
+	for i, body := range bodies {
+		ch.deliveries <- amqp.Delivery{
+			Acknowledger: ack,
+			DeliveryTag:  uint64(i + 1),
+			Headers:      amqp.Table{"traceparent": []byte("garbage")},
+			Body:         []byte(body),
+		}
+	}
+	ack.wait(t, len(bodies))
+
+	// Invalid messages are acknowledged, so they are not redelivered.
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, ack.acked)
+	assert.Empty(t, ack.nacked)
+	assert.Equal(t, orders, countOrders(t, db))
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, len(bodies))
+	for _, tx := range payloads.Transactions {
+		assert.Equal(t, "rejected", tx.Result)
+		assert.Zero(t, tx.ParentID)
+	}
+	require.Len(t, payloads.Errors, len(bodies))
+	assert.Contains(t, payloads.Errors[0].Exception.Message, "failed to decode remote order")
+	assert.Equal(t, "customer not found", payloads.Errors[4].Exception.Message)
+	assert.Equal(t, "product not found", payloads.Errors[5].Exception.Message)
+}
+
+func TestAMQPConsumerInvalidatesCaches(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	r, store := newPrecomputedTestRouter(tracer, db, newPrecomputedResponses())
+	getTop := func() []Product {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/top", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var products []Product
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &products))
+		require.NotEmpty(t, products)
+		return products
+	}
+	ctx := context.Background()
+	top := getTop()
+	version, err := cacheVersion(ctx, store, productResponsesVersionKey)
+	require.NoError(t, err)
+
+	c := newAMQPConsumer(tracer, db, "", "orders")
+	c.cache = store
+	ack := newFakeAcknowledger()
+	c.handleDelivery(ctx, amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  1,
+		Body:         []byte(fmt.Sprintf(`{"customer_id": 1, "lines": [{"id": %d, "amount": 1}]}`, top[0].ID)),
+	})
+	require.Equal(t, []uint64{1}, ack.acked)
+
+	// Consumed orders invalidate the precomputed and cached product
+	// responses, as orders placed through the API do.
+	after := getTop()
+	assert.Equal(t, top[0].ID, after[0].ID)
+	assert.Equal(t, top[0].Sold+1, after[0].Sold)
+	newVersion, err := cacheVersion(ctx, store, productResponsesVersionKey)
+	require.NoError(t, err)
+	assert.NotEqual(t, version, newVersion)
+}
+
+func TestAMQPConsumerRequeue(t *testing.T) {
+	db := newTestDB(t)
+	ch := newFakeAMQPChannel()
+	startTestAMQPConsumer(t, apm.DefaultTracer, db, func() (amqpChannel, error) { return ch, nil })
+
+	// Messages which fail due to database errors are requeued.
+	require.NoError(t, db.Close())
+	ack := newFakeAcknowledger()
+	ch.deliveries <- amqp.Delivery{
+		Acknowledger: ack,
+		DeliveryTag:  1,
+		Body:         []byte(`{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`),
+	}
+	ack.wait(t, 1)
+	assert.Equal(t, []uint64{1}, ack.nacked)
+	assert.Empty(t, ack.acked)
+}
+
+func TestAMQPConsumerReconnect(t *testing.T) {
+	db := newTestDB(t)
+	channels := make(chan *fakeAMQPChannel, 2)
+	var mu sync.Mutex
+	var dials int
+	startTestAMQPConsumer(t, apm.DefaultTracer, db, func() (amqpChannel, error) {
+		mu.Lock()
+		dials++
+		failed := dials == 1
+		mu.Unlock()
+		if failed {
+			return nil, errors.New("connection refused")
+		}
+		ch := newFakeAMQPChannel()
+		channels <- ch
+		return ch, nil
+	})
+
+	// The first dial fails, and the consumer retries.
+	ack := newFakeAcknowledger()
+	body := []byte(`{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`)
+	first := <-channels
+	first.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: body}
+	ack.wait(t, 1)
+
+	// Losing the connection closes the channel, and the consumer
+	// reconnects.
+	close(first.deliveries)
+	<-first.closed
+	second := <-channels
+	second.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, Body: body}
+	ack.wait(t, 1)
+	assert.Equal(t, []uint64{1, 2}, ack.acked)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, dials)
+}
@@ -1,23 +1,43 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/csv"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
-	"time"
 
-	"github.com/gin-contrib/cache"
 	"github.com/gin-contrib/cache/persistence"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 
 	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/payment"
+	"github.com/elastic/opbeans-go/validate"
 )
 
-func addAPIHandlers(r *gin.RouterGroup, db *sqlx.DB) {
-	h := apiHandlers{db}
+// addAPIHandlers adds the API handlers to r. New orders are published
+// to events, which may be nil, and their payments authorized by
+// payments, unless nil. Checkouts are failed on purpose by shortages,
+// unless nil. Concurrent lookups of the same product or order share
+// their query, and the responses of the product types and top products
+// are precomputed.
+func addAPIHandlers(r *gin.RouterGroup, db *sqlx.DB, metrics *businessMetrics, events *orderEventHub, settings *runtimeSettings, payments *payment.Client, shortages *stockShortageInjector) {
+	h := apiHandlers{
+		db:          db,
+		metrics:     metrics,
+		events:      events,
+		settings:    settings,
+		payments:    payments,
+		shortages:   shortages,
+		lookups:     newEntityLookups(),
+		precomputed: newPrecomputedResponses(),
+	}
 	r.GET("/stats", h.getStats)
 	r.GET("/products", h.getProducts)
 	r.GET("/products/:id", h.getProductDetails)
@@ -28,83 +48,101 @@ func addAPIHandlers(r *gin.RouterGroup, db *sqlx.DB) {
 	r.GET("/customers/:id", h.getCustomerDetails)
 	r.GET("/orders", h.getOrders)
 	r.GET("/orders/:id", h.getOrderDetails)
-	r.POST("/orders", h.postOrder)
-	r.POST("/orders/csv", h.postOrderCSV)
+	r.POST("/orders", csrfProtect, h.postOrder)
+	r.POST("/orders/csv", csrfProtect, h.postOrderCSV)
+	r.GET("/cart", h.getCart)
+	r.GET("/changes", h.getChanges)
 }
 
 type apiHandlers struct {
-	db *sqlx.DB
+	db          *sqlx.DB
+	metrics     *businessMetrics
+	events      *orderEventHub
+	settings    *runtimeSettings
+	payments    *payment.Client
+	shortages   *stockShortageInjector
+	lookups     *entityLookups
+	precomputed *precomputedResponses
 }
 
+// statsCacheKey is the key under which the stats are cached.
+const statsCacheKey = "shop-stats"
+
 func (h apiHandlers) getStats(c *gin.Context) {
-	cacheValue, _ := c.Get(cache.CACHE_MIDDLEWARE_KEY)
-	cache := *cacheValue.(*persistence.CacheStore)
+	if checkNotModified(c, "stats") {
+		return
+	}
+	cache := contextCacheStore(c)
 
-	const cacheKey = "shop-stats"
 	var stats *Stats
-	err := cache.Get(cacheKey, &stats)
+	err := cacheGet(c.Request.Context(), cache, statsCacheKey, &stats)
 	switch err {
 	case nil:
 		contextLogger(c).Debug("serving stats from cache")
-		c.JSON(http.StatusOK, stats)
-		if tx := apm.TransactionFromContext(c.Request.Context()); tx != nil {
-			tx.Context.SetTag("served_from_cache", "true")
-		}
+		h.metrics.cacheLookup(true)
+		renderJSON(c, http.StatusOK, stats)
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("served_from_cache", true)
+		})
 		return
 	case persistence.ErrCacheMiss:
 		// fetch and cache below
-		if tx := apm.TransactionFromContext(c.Request.Context()); tx != nil {
-			tx.Context.SetTag("served_from_cache", "false")
-		}
+		h.metrics.cacheLookup(false)
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("served_from_cache", false)
+		})
 		break
 	default:
 		err := errors.Wrap(err, "failed to get stats from cache")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
 
 	stats, err = getStats(c.Request.Context(), h.db)
 	if err != nil {
 		err := errors.Wrap(err, "failed to query stats")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
-	if err := cache.Set(cacheKey, stats, time.Minute); err != nil {
+	if err := cacheSet(c.Request.Context(), cache, statsCacheKey, stats, h.settings.cacheTTL()); err != nil {
 		err := errors.Wrap(err, "failed to cache stats")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
 	contextLogger(c).Debug("cached stats")
-	c.JSON(http.StatusOK, stats)
+	renderJSON(c, http.StatusOK, stats)
 }
 
 func (h apiHandlers) getProducts(c *gin.Context) {
+	if checkNotModified(c, "products") {
+		return
+	}
+	if responseFormat(c) == ndjsonMediaType {
+		streamNDJSON(c, ndjsonFlushRows, func(ctx context.Context, emit func(interface{}) error) error {
+			return scanProducts(ctx, h.db, "", 0, nil, func(p Product) error { return emit(p) })
+		})
+		return
+	}
 	products, err := getProducts(c.Request.Context(), h.db)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
-	c.JSON(http.StatusOK, products)
+	renderJSON(c, http.StatusOK, products)
 }
 
 func (h apiHandlers) getTopProducts(c *gin.Context) {
-	products, err := getTopProducts(c.Request.Context(), h.db)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-	c.JSON(http.StatusOK, products)
+	h.precomputed.render(c, "top-products", func(ctx context.Context) (interface{}, error) {
+		return getTopProducts(ctx, h.db)
+	})
 }
 
 func (h apiHandlers) getProductDetails(c *gin.Context) {
 	idString := c.Param("id")
 	if idString == "top" {
-		products, err := getTopProducts(c.Request.Context(), h.db)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		c.JSON(http.StatusOK, products)
+		h.getTopProducts(c)
 		return
 	}
 
@@ -112,139 +150,172 @@ func (h apiHandlers) getProductDetails(c *gin.Context) {
 	id, err := strconv.Atoi(idString)
 	if err != nil {
 		err := errors.Wrap(err, "failed to parse product ID")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.Validation, "product_id", idString))
 		return
 	}
-	product, err := getProduct(c.Request.Context(), h.db, id)
-	if err != nil {
-		err := errors.Wrap(err, "failed to get product")
-		c.AbortWithError(http.StatusInternalServerError, err)
+	product, err := h.lookups.getProduct(c, h.db, id)
+	if err == errProductNotFound {
+		abortWithStatus(c, http.StatusNotFound)
 		return
-	}
-	if product == nil {
-		c.AbortWithStatus(http.StatusNotFound)
+	} else if err != nil {
+		err := errors.Wrap(err, "failed to get product")
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "product_id", id))
 		return
 	}
-	c.JSON(http.StatusOK, product)
+	renderJSON(c, http.StatusOK, product)
 }
 
 func (h apiHandlers) getProductCustomers(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		err := errors.Wrap(err, "failed to parse product ID")
+		abortWithError(c, apperr.Wrap(err, apperr.Validation, "product_id", c.Param("id")))
 		return
 	}
 	limit := 1000
 	if countString := c.Param("count"); countString != "" {
 		limit, err = strconv.Atoi(countString)
 		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+			err := errors.Wrap(err, "failed to parse count")
+			abortWithError(c, apperr.Wrap(err, apperr.Validation, "count", countString))
 			return
 		}
 	}
 	customers, err := getProductCustomers(c.Request.Context(), h.db, id, limit)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
-	c.JSON(http.StatusOK, customers)
+	renderJSON(c, http.StatusOK, customers)
 }
 
 func (h apiHandlers) getProductTypes(c *gin.Context) {
-	productTypes, err := getProductTypes(c.Request.Context(), h.db)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	if checkNotModified(c, "types") {
 		return
 	}
-	c.JSON(http.StatusOK, productTypes)
+	h.precomputed.render(c, "types", func(ctx context.Context) (interface{}, error) {
+		return getProductTypes(ctx, h.db)
+	})
 }
 
 func (h apiHandlers) getProductTypeDetails(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		err := errors.Wrap(err, "failed to parse product type ID")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.Validation, "type_id", c.Param("id")))
 		return
 	}
 	productType, err := getProductType(c.Request.Context(), h.db, id)
 	if err != nil {
 		err := errors.Wrap(err, "failed to get product type details")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "type_id", id))
 		return
 	}
 	if productType == nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		abortWithStatus(c, http.StatusNotFound)
 		return
 	}
-	c.JSON(http.StatusOK, productType)
+	renderJSON(c, http.StatusOK, productType)
 }
 
 func (h apiHandlers) getCustomers(c *gin.Context) {
 	customers, err := getCustomers(c.Request.Context(), h.db)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
-	c.JSON(http.StatusOK, customers)
+	renderJSON(c, http.StatusOK, customers)
 }
 
 func (h apiHandlers) getCustomerDetails(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		err := errors.Wrap(err, "failed to parse customer ID")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.Validation, "customer_id", c.Param("id")))
 		return
 	}
 	customer, err := getCustomer(c.Request.Context(), h.db, id)
 	if err != nil {
 		err := errors.Wrap(err, "failed to get customer details")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", id))
 		return
 	}
 	if customer == nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		abortWithStatus(c, http.StatusNotFound)
 		return
 	}
-	c.JSON(http.StatusOK, customer)
+	renderJSON(c, http.StatusOK, customer)
 }
 
 func (h apiHandlers) getOrders(c *gin.Context) {
+	if responseFormat(c) == ndjsonMediaType {
+		// Streamed orders are not limited, as they are not
+		// held in memory.
+		streamNDJSON(c, ndjsonFlushRows, func(ctx context.Context, emit func(interface{}) error) error {
+			return scanOrders(ctx, h.db, 0, func(o Order) error { return emit(o) })
+		})
+		return
+	}
 	orders, err := getOrders(c.Request.Context(), h.db)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
 		return
 	}
-	c.JSON(http.StatusOK, orders)
+	renderJSON(c, http.StatusOK, orders)
 }
 
 func (h apiHandlers) getOrderDetails(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		err := errors.Wrap(err, "failed to parse order ID")
+		abortWithError(c, apperr.Wrap(err, apperr.Validation, "order_id", c.Param("id")))
 		return
 	}
-	customer, err := getOrder(c.Request.Context(), h.db, id)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	customer, err := h.lookups.getOrder(c, h.db, id)
+	if errors.Cause(err) == sql.ErrNoRows {
+		abortWithError(c, apperr.Wrap(err, apperr.NotFound, "order_id", id))
+		return
+	} else if err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "order_id", id))
 		return
 	}
 	if customer == nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		abortWithStatus(c, http.StatusNotFound)
 		return
 	}
-	c.JSON(http.StatusOK, customer)
+	renderJSON(c, http.StatusOK, customer)
+}
+
+const (
+	// maxOrderLines is the maximum number of lines in an order.
+	maxOrderLines = 100
+
+	// maxOrderLineAmount is the maximum amount of an order line.
+	maxOrderLineAmount = 1000
+)
+
+// checkOrder checks an order for the customer with the ID given by
+// customerField, with the given lines. Fields which have already failed
+// to parse are not checked.
+func checkOrder(v *validate.Validator, customerField string, customerID int, lines []ProductOrderLine) {
+	v.Check(customerField, customerID, validate.Required())
+	v.Check("lines", lines, validate.Required(), validate.Length(1, maxOrderLines))
+	for i, line := range lines {
+		v.Check(fmt.Sprintf("lines[%d].id", i), line.Product.ID, validate.Required())
+		v.Check(fmt.Sprintf("lines[%d].amount", i), line.Amount, validate.Range(1, maxOrderLineAmount))
+	}
 }
 
 func (h apiHandlers) postOrder(c *gin.Context) {
 	type line struct {
-		ID     int `json:"id" binding:"required"`
-		Amount int `json:"amount" binding:"required"`
+		ID     int `json:"id"`
+		Amount int `json:"amount"`
 	}
 	var order struct {
-		CustomerID int    `json:"customer_id" binding:"required"`
-		Lines      []line `json:"lines" binding:"required"`
+		CustomerID int    `json:"customer_id"`
+		Lines      []line `json:"lines"`
 	}
-	if err := c.BindJSON(&order); err != nil {
+	if !bindJSON(c, &order) {
 		return
 	}
 	lines := make([]ProductOrderLine, len(order.Lines))
@@ -254,77 +325,134 @@ func (h apiHandlers) postOrder(c *gin.Context) {
 			Amount:  line.Amount,
 		}
 	}
-	h.postOrderCommon(c, order.CustomerID, lines)
+	var v validate.Validator
+	h.postOrderCommon(c, &v, "customer_id", order.CustomerID, lines)
 }
 
+// postOrderCSV creates an order from a form holding the customer ID,
+// and a CSV file of the order's lines, each holding a product ID and
+// amount. Errors in the file's rows are reported as errors in the
+// corresponding lines.
 func (h apiHandlers) postOrderCSV(c *gin.Context) {
-	customerID, err := strconv.Atoi(c.PostForm("customer"))
-	if err != nil {
-		err := errors.Wrap(err, "failed to parse customer ID")
-		c.AbortWithError(http.StatusBadRequest, err)
+	// The form is parsed up front, as PostForm ignores errors.
+	if _, err := c.MultipartForm(); abortBodyReadError(c, err) {
 		return
 	}
+	var v validate.Validator
+	var customerID int
+	if customer := c.PostForm("customer"); customer != "" {
+		var err error
+		if customerID, err = strconv.Atoi(customer); err != nil {
+			v.Add("customer", codeFormat, "customer must be an integer")
+		}
+	}
 	fileHeader, err := c.FormFile("file")
 	if err != nil {
-		err := errors.Wrap(err, "failed get CSV file")
-		c.AbortWithError(http.StatusBadRequest, err)
+		v.Check("customer", customerID, validate.Required())
+		v.Add("file", validate.CodeRequired, "file is required")
+		abortWithError(c, apperr.Wrap(v.Err(), apperr.Invalid))
 		return
 	}
 	file, err := fileHeader.Open()
 	if err != nil {
 		err := errors.Wrap(err, "failed open CSV file")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, err)
 		return
 	}
 	defer file.Close()
 
 	var lines []ProductOrderLine
 	r := csv.NewReader(file)
-	for {
+	// Rows beyond the maximum number of lines are not read, as the
+	// order is rejected anyway.
+	for len(lines) <= maxOrderLines {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			err := errors.Wrap(err, "failed to parse CSV file")
-			c.AbortWithError(http.StatusBadRequest, err)
-			return
-		}
-		productID, err := strconv.Atoi(record[0])
-		if err != nil {
-			err := errors.Wrap(err, "failed to parse product ID")
-			c.AbortWithError(http.StatusBadRequest, err)
-			return
+			v.Add("file", codeFormat, "file must be a CSV file with a product ID and amount per row")
+			break
 		}
-		amount, err := strconv.Atoi(record[1])
-		if err != nil {
-			err := errors.Wrap(err, "failed to parse order amount")
-			c.AbortWithError(http.StatusBadRequest, err)
-			return
+		var line ProductOrderLine
+		for i, field := range []struct {
+			name  string
+			value *int
+		}{{"id", &line.Product.ID}, {"amount", &line.Amount}} {
+			var err error
+			if i < len(record) {
+				*field.value, err = strconv.Atoi(record[i])
+			}
+			if i >= len(record) || err != nil {
+				name := fmt.Sprintf("lines[%d].%s", len(lines), field.name)
+				v.Add(name, codeFormat, name+" must be an integer")
+			}
 		}
-		lines = append(lines, ProductOrderLine{
-			Product: Product{ID: productID},
-			Amount:  amount,
-		})
+		lines = append(lines, line)
 	}
-	h.postOrderCommon(c, customerID, lines)
+	h.postOrderCommon(c, &v, "customer", customerID, lines)
 }
 
-func (h apiHandlers) postOrderCommon(c *gin.Context, customerID int, lines []ProductOrderLine) {
+// postOrderCommon checks and creates an order for the customer with the
+// ID given by customerField, with the given lines. Errors found while
+// parsing the order are recorded in v, and reported along with those
+// found by checkOrder.
+func (h apiHandlers) postOrderCommon(c *gin.Context, v *validate.Validator, customerField string, customerID int, lines []ProductOrderLine) {
+	defer h.metrics.cartOpened()()
+
+	checkOrder(v, customerField, customerID, lines)
+	if err := v.Err(); err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.Invalid))
+		return
+	}
+
+	// Authenticated customers may only place orders for themselves.
+	if claims := authenticatedCustomer(c); claims != nil && claims.CustomerID != customerID {
+		abortWithError(c, apperr.New(apperr.Forbidden, "order is for another customer",
+			"customer_id", customerID, "authenticated_customer_id", claims.CustomerID,
+		))
+		return
+	}
+
 	customer, err := getCustomer(c.Request.Context(), h.db, customerID)
 	if err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+		contextLogger(c).WithError(err).Error("failed to get customer")
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customerID))
 		return
 	}
-	orderID, err := createOrder(c.Request.Context(), h.db, customer, lines)
+	if customer == nil {
+		abortWithError(c, apperr.New(apperr.NotFound, "customer not found", "customer_id", customerID))
+		return
+	}
+	if err := h.shortages.check(lines); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if h.payments != nil && !h.authorizePayment(c, customer, lines) {
+		return
+	}
+	orderID, revenue, err := createOrder(c.Request.Context(), h.db, customer, lines)
 	if err != nil {
 		err := errors.Wrap(err, "failed to create order")
-		c.AbortWithError(http.StatusInternalServerError, err)
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customerID))
 		return
 	}
+	h.metrics.orderCreated(revenue)
+	dataChanged(c)
+	invalidateProductResponses(c)
+	h.events.publish(orderEvent{
+		Type:         orderEventCreated,
+		OrderID:      orderID,
+		Status:       jobStatePending,
+		traceContext: apm.TransactionFromContext(c.Request.Context()).TraceContext(),
+	})
 
-	if tx := apm.TransactionFromContext(c.Request.Context()); tx != nil {
-		tx.Context.SetTag("customer_name", customer.FullName)
-		tx.Context.SetTag("customer_email", customer.Email)
-	}
-	c.JSON(http.StatusOK, gin.H{"id": orderID})
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("customer_name", customer.FullName)
+		tx.Context.SetLabel("customer_email", customer.Email)
+		tx.Context.SetLabel("order_id", orderID)
+		tx.Context.SetLabel("order_lines", len(lines))
+		tx.Context.SetLabel("order_revenue", revenue)
+	})
+	renderJSON(c, http.StatusOK, gin.H{"id": orderID})
 }
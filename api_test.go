@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/validate"
+)
+
+func BenchmarkProductsHandler(b *testing.B) {
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(b, err)
+	defer tracer.Close()
+	tracer.Transport = transporttest.Discard
+
+	r := newTestAPIRouter(tracer, newTestDB(b))
+	req := httptest.NewRequest("GET", "/api/products", nil)
+	req.Header.Set("User-Agent", "opbeans-loadgen")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", w.Code)
+		}
+	}
+}
+
+func TestNotFoundErrorEnvelope(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	r := newTestAPIRouter(tracer, newTestDB(t))
+	for _, url := range []string{
+		"/api/products/999999",   // not found by the handler
+		"/api/orders/999999",     // not found by the error middleware
+		"/api/products/notanint", // validation error
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		tracer.Flush(nil)
+
+		payloads := recorder.Payloads()
+		require.NotEmpty(t, payloads.Transactions)
+		tx := payloads.Transactions[len(payloads.Transactions)-1]
+		traceID := fmt.Sprintf("%x", tx.TraceID[:])
+		assert.Equal(t, traceID, w.Header().Get("X-Trace-Id"), url)
+
+		body := decodeErrorEnvelope(t, w.Body.Bytes())
+		assert.Equal(t, apperr.KindForStatus(w.Code), body.Code, url)
+		assert.NotEmpty(t, body.Message, url)
+		assert.Equal(t, traceID, body.TraceID, url)
+	}
+}
+
+func TestOrderAndStatsLabels(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	r := newTestAPIRouter(tracer, newTestDB(t))
+	body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 2}, {"id": 2, "amount": 1}]}`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var order struct {
+		ID int `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 3)
+	labels := make([]map[string]interface{}, len(payloads.Transactions))
+	for i, tx := range payloads.Transactions {
+		labels[i] = make(map[string]interface{})
+		for _, label := range tx.Context.Tags {
+			labels[i][label.Key] = label.Value
+		}
+	}
+
+	// Numeric and boolean labels are decoded from JSON numbers
+	// and booleans, rather than strings.
+	assert.Equal(t, float64(order.ID), labels[0]["order_id"])
+	assert.Equal(t, float64(2), labels[0]["order_lines"])
+	assert.IsType(t, float64(0), labels[0]["order_revenue"])
+	assert.NotZero(t, labels[0]["order_revenue"])
+	assert.Equal(t, false, labels[1]["served_from_cache"])
+	assert.Equal(t, true, labels[2]["served_from_cache"])
+}
+
+func TestDatabaseSpanDestination(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	r := newTestAPIRouter(tracer, newTestDB(t))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tracer.Flush(nil)
+
+	var dbSpans int
+	for _, span := range recorder.Payloads().Spans {
+		if span.Type != "db" {
+			continue
+		}
+		dbSpans++
+		require.NotNil(t, span.Context)
+		assert.Equal(t, &model.DestinationSpanContext{
+			Service: &model.DestinationServiceSpanContext{
+				Type:     "db",
+				Name:     "sqlite3",
+				Resource: "sqlite3",
+			},
+		}, span.Context.Destination)
+	}
+	assert.NotZero(t, dbSpans)
+}
+
+func TestPostOrderValidation(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	for name, test := range map[string]struct {
+		body   string
+		expect validate.Errors
+	}{
+		"missing_customer": {
+			body:   `{"lines": [{"id": 1, "amount": 1}]}`,
+			expect: validate.Errors{{Field: "customer_id", Code: "required", Message: "customer_id is required"}},
+		},
+		"missing_lines": {
+			body:   `{"customer_id": 1, "lines": []}`,
+			expect: validate.Errors{{Field: "lines", Code: "required", Message: "lines is required"}},
+		},
+		"too_many_lines": {
+			body:   `{"customer_id": 1, "lines": [` + strings.TrimSuffix(strings.Repeat(`{"id": 1, "amount": 1},`, 101), ",") + `]}`,
+			expect: validate.Errors{{Field: "lines", Code: "length", Message: "lines must be between 1 and 100 elements"}},
+		},
+		"invalid_lines": {
+			body: `{"customer_id": 1, "lines": [{"id": 1, "amount": 0}, {"amount": 1001}]}`,
+			expect: validate.Errors{
+				{Field: "lines[0].amount", Code: "range", Message: "lines[0].amount must be between 1 and 1000"},
+				{Field: "lines[1].id", Code: "required", Message: "lines[1].id is required"},
+				{Field: "lines[1].amount", Code: "range", Message: "lines[1].amount must be between 1 and 1000"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serveJSON(r, "POST", "/api/orders", test.body)
+			assert.Equal(t, test.expect, decodeFieldErrors(t, w))
+		})
+	}
+
+	// Malformed JSON is not a validation failure.
+	w := serveJSON(r, "POST", "/api/orders", `{"customer_id": "one"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPostOrderCSVValidation(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	for name, test := range map[string]struct {
+		customer string
+		file     *string
+		expect   validate.Errors
+	}{
+		"malformed_customer": {
+			customer: "one",
+			file:     stringPtr("1,1\n"),
+			expect:   validate.Errors{{Field: "customer", Code: "format", Message: "customer must be an integer"}},
+		},
+		"missing_file": {
+			expect: validate.Errors{
+				{Field: "customer", Code: "required", Message: "customer is required"},
+				{Field: "file", Code: "required", Message: "file is required"},
+			},
+		},
+		"malformed_rows": {
+			customer: "1",
+			file:     stringPtr("1,1\nx,2\n3,1001\n"),
+			expect: validate.Errors{
+				{Field: "lines[1].id", Code: "format", Message: "lines[1].id must be an integer"},
+				{Field: "lines[2].amount", Code: "range", Message: "lines[2].amount must be between 1 and 1000"},
+			},
+		},
+		"missing_column": {
+			customer: "1",
+			file:     stringPtr("1\n"),
+			expect:   validate.Errors{{Field: "lines[0].amount", Code: "format", Message: "lines[0].amount must be an integer"}},
+		},
+		"malformed_csv": {
+			customer: "1",
+			file:     stringPtr("1,1\n2\n"),
+			expect:   validate.Errors{{Field: "file", Code: "format", Message: "file must be a CSV file with a product ID and amount per row"}},
+		},
+		"empty_file": {
+			customer: "1",
+			file:     stringPtr(""),
+			expect:   validate.Errors{{Field: "lines", Code: "required", Message: "lines is required"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			if test.customer != "" {
+				mw.WriteField("customer", test.customer)
+			}
+			if test.file != nil {
+				fw, err := mw.CreateFormFile("file", "order.csv")
+				require.NoError(t, err)
+				io.WriteString(fw, *test.file)
+			}
+			mw.Close()
+
+			req := httptest.NewRequest("POST", "/api/orders/csv", &buf)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.expect, decodeFieldErrors(t, w))
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// authenticatedAPIClientKey is the gin context key under which
+// apiKeyAuth records the name of the client whose API key authenticated
+// the request.
+const authenticatedAPIClientKey = "opbeans.authenticated_api_client"
+
+// apiKeyErrorInvalid is the reason returned in 401 error envelopes for
+// requests with an unknown API key.
+const apiKeyErrorInvalid = "api_key_invalid"
+
+// apiKey is a machine client's API key. Only its digest is held, so
+// that keys are compared in constant time regardless of their length.
+type apiKey struct {
+	name     string
+	digest   [sha256.Size]byte
+	requests int64 // accessed atomically
+	lastUsed int64 // accessed atomically; Unix nanoseconds
+}
+
+// apiKeyUsage summarizes the requests authenticated by an API key.
+type apiKeyUsage struct {
+	Name       string     `json:"name"`
+	Requests   int64      `json:"requests"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// apiKeyring holds the API keys of machine clients, and counts the
+// requests they authenticate.
+type apiKeyring struct {
+	keys []*apiKey
+}
+
+// newAPIKeyring returns a keyring holding keys, or nil if keys is empty.
+// Only the digests of the keys are held.
+func newAPIKeyring(keys []config.APIKey) *apiKeyring {
+	if len(keys) == 0 {
+		return nil
+	}
+	var ring apiKeyring
+	for _, key := range keys {
+		ring.keys = append(ring.keys, &apiKey{name: key.Name, digest: sha256.Sum256([]byte(string(key.Key)))})
+	}
+	return &ring
+}
+
+// lookup returns the API key matching key, or nil if there is none. All
+// keys are compared, in constant time.
+func (r *apiKeyring) lookup(key string) *apiKey {
+	digest := sha256.Sum256([]byte(key))
+	var found *apiKey
+	for _, k := range r.keys {
+		if subtle.ConstantTimeCompare(k.digest[:], digest[:]) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+// usage returns the usage of each API key, in the order they were
+// configured.
+func (r *apiKeyring) usage() []apiKeyUsage {
+	usage := make([]apiKeyUsage, len(r.keys))
+	for i, k := range r.keys {
+		usage[i] = apiKeyUsage{Name: k.name, Requests: atomic.LoadInt64(&k.requests)}
+		if lastUsed := atomic.LoadInt64(&k.lastUsed); lastUsed != 0 {
+			t := time.Unix(0, lastUsed).UTC()
+			usage[i].LastUsedAt = &t
+		}
+	}
+	return usage
+}
+
+// apiKeyAuth returns a middleware which authenticates requests carrying
+// an "ApiKey" authorization header with the keys in ring, recording the
+// client's name in the gin context. Requests with an unknown key are
+// rejected with 401, and are not reported as errors. Requests without an
+// API key, or all requests if ring is nil, are passed through.
+func apiKeyAuth(ring *apiKeyring) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if ring == nil || !strings.HasPrefix(header, "ApiKey ") {
+			c.Next()
+			return
+		}
+		k := ring.lookup(strings.TrimPrefix(header, "ApiKey "))
+		if k == nil {
+			abortUnauthorized(c, "ApiKey", apiKeyErrorInvalid)
+			return
+		}
+		atomic.AddInt64(&k.requests, 1)
+		atomic.StoreInt64(&k.lastUsed, time.Now().UnixNano())
+		c.Set(authenticatedAPIClientKey, k.name)
+		c.Next()
+	}
+}
+
+// authenticatedAPIClient returns the name of the client recorded by
+// apiKeyAuth, or "" if the request was not authenticated by an API key.
+func authenticatedAPIClient(c *gin.Context) string {
+	return c.GetString(authenticatedAPIClientKey)
+}
+
+// handleGetAPIKeyUsage serves the usage of each API key since the
+// server started, or 404 if no API keys are configured.
+func handleGetAPIKeyUsage(ring *apiKeyring) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ring == nil {
+			abortWithStatus(c, http.StatusNotFound)
+			return
+		}
+		renderJSON(c, http.StatusOK, gin.H{"keys": ring.usage()})
+	}
+}
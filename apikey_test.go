@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+)
+
+func newTestAPIKeyring(t *testing.T) *apiKeyring {
+	return newAPIKeyring([]config.APIKey{
+		{Name: "loadgen", Key: "hunter2"},
+		{Name: "monitor", Key: "correct-horse"},
+	})
+}
+
+// newTestAPIKeyRouter returns a router authenticating API keys in ring,
+// logging requests to accessLog if it is non-nil.
+func newTestAPIKeyRouter(tracer *apm.Tracer, ring *apiKeyring, l *rateLimiter, accessLog io.Writer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	if accessLog != nil {
+		r.Use(newAccessLogger(accessLog, 1, nil).middleware)
+	}
+	limited := r.Group("/api", apiKeyAuth(ring), l.middleware)
+	limited.GET("/", func(c *gin.Context) {})
+	adminGroup := r.Group("/api/admin", adminAuth("admin", "secret"))
+	addAdminHandlers(make(routeOptionsMap).group(adminGroup), tracer, nil, nil, nil, nil, ring, nil, nil)
+	return r
+}
+
+func serveWithAPIKey(r http.Handler, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	if key != "" {
+		req.Header.Set("Authorization", "ApiKey "+key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPIKeyAttribution(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestAPIKeyRouter(tracer, newTestAPIKeyring(t), nil, nil)
+
+	w := serveWithAPIKey(r, "correct-horse")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithAPIKey(r, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Unknown keys are rejected, and not reported as errors.
+	w = serveWithAPIKey(r, "guess")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `ApiKey realm="opbeans"`, w.Header().Get("WWW-Authenticate"))
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.Unauthenticated, body.Code)
+	assert.Equal(t, apiKeyErrorInvalid, body.Reason)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 3)
+	assert.Equal(t, &model.User{ID: "monitor"}, payloads.Transactions[0].Context.User)
+	assert.Nil(t, payloads.Transactions[1].Context.User)
+	assert.Nil(t, payloads.Transactions[2].Context.User)
+	assert.Empty(t, payloads.Errors)
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	ring := newTestAPIKeyring(t)
+	l, _ := newTestRateLimiter(apm.DefaultTracer)
+	l.apiKeys = rateLimit{rate: 1, burst: 5}
+	r := newTestAPIKeyRouter(apm.DefaultTracer, ring, l, nil)
+
+	// Exhaust the limit for the address.
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, serveWithAPIKey(r, "").Code)
+	}
+	require.Equal(t, http.StatusTooManyRequests, serveWithAPIKey(r, "").Code)
+
+	// Clients with an API key are limited by key, not address.
+	for i := 0; i < 5; i++ {
+		w := serveWithAPIKey(r, "hunter2")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serveWithAPIKey(r, "hunter2").Code)
+	assert.Equal(t, http.StatusOK, serveWithAPIKey(r, "correct-horse").Code)
+
+	// A zero per-key rate leaves API keys unlimited.
+	l.apiKeys = rateLimit{}
+	w := serveWithAPIKey(r, "hunter2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+func TestAPIKeyUsage(t *testing.T) {
+	r := newTestAPIKeyRouter(apm.DefaultTracer, newTestAPIKeyring(t), nil, nil)
+	for i := 0; i < 3; i++ {
+		serveWithAPIKey(r, "hunter2")
+	}
+	serveWithAPIKey(r, "guess")
+
+	req := httptest.NewRequest("GET", "/api/admin/apikeys/usage", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var usage struct {
+		Keys []apiKeyUsage `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	require.Len(t, usage.Keys, 2)
+	assert.Equal(t, "loadgen", usage.Keys[0].Name)
+	assert.Equal(t, int64(3), usage.Keys[0].Requests)
+	assert.NotNil(t, usage.Keys[0].LastUsedAt)
+	assert.Equal(t, apiKeyUsage{Name: "monitor"}, usage.Keys[1])
+	assert.NotContains(t, w.Body.String(), "hunter2")
+
+	// Usage is not found if no keys are configured.
+	r = newTestAPIKeyRouter(apm.DefaultTracer, nil, nil, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAPIKeyLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	r := newTestAPIKeyRouter(apm.DefaultTracer, newTestAPIKeyring(t), nil, &buf)
+	serveWithAPIKey(r, "hunter2")
+	serveWithAPIKey(r, "guess")
+
+	var entries []map[string]interface{}
+	for decoder := json.NewDecoder(&buf); decoder.More(); {
+		var entry map[string]interface{}
+		require.NoError(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2)
+	assert.Equal(t, "loadgen", entries[0]["labels.api_client"])
+	assert.NotContains(t, entries[1], "labels.api_client")
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.NotContains(t, buf.String(), "guess")
+}
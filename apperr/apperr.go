@@ -0,0 +1,240 @@
+// Package apperr provides application errors, classified by kind and
+// annotated with the function in which they originated, and with fields
+// describing the context in which they occurred.
+package apperr
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"go.elastic.co/apm/stacktrace"
+)
+
+// Kind classifies an application error.
+type Kind string
+
+const (
+	// Validation is the kind of errors caused by malformed input.
+	Validation Kind = "validation"
+
+	// Invalid is the kind of errors caused by well-formed input with
+	// invalid field values, such as validate.Errors.
+	Invalid Kind = "invalid"
+
+	// NotFound is the kind of errors caused by a missing entity.
+	NotFound Kind = "not_found"
+
+	// Conflict is the kind of errors caused by a conflicting update.
+	Conflict Kind = "conflict"
+
+	// Forbidden is the kind of errors caused by an authenticated client
+	// acting on an entity it does not own.
+	Forbidden Kind = "forbidden"
+
+	// DB is the kind of errors returned by the database.
+	DB Kind = "db"
+
+	// Upstream is the kind of errors returned by upstream services.
+	Upstream Kind = "upstream"
+
+	// GatewayTimeout is the kind of errors caused by upstream services
+	// failing to respond in time.
+	GatewayTimeout Kind = "gateway_timeout"
+
+	// PaymentRequired is the kind of errors caused by the payment of an
+	// order being declined.
+	PaymentRequired Kind = "payment_required"
+
+	// Unauthenticated is the kind of errors caused by missing or
+	// invalid credentials.
+	Unauthenticated Kind = "unauthenticated"
+
+	// MethodNotAllowed is the kind of errors caused by requesting a
+	// resource with a method it does not support.
+	MethodNotAllowed Kind = "method_not_allowed"
+
+	// RequestTimeout is the kind of errors caused by a client taking
+	// too long to send its request.
+	RequestTimeout Kind = "request_timeout"
+
+	// TooLarge is the kind of errors caused by oversized requests.
+	TooLarge Kind = "too_large"
+
+	// RateLimited is the kind of errors caused by a client exceeding
+	// its rate limit.
+	RateLimited Kind = "rate_limited"
+
+	// Unavailable is the kind of errors caused by the server being
+	// temporarily unable to handle requests.
+	Unavailable Kind = "unavailable"
+
+	// Internal is the kind of unclassified errors.
+	Internal Kind = "internal"
+)
+
+// HTTPStatus returns the HTTP status code corresponding to k.
+// Unknown kinds map to 500 (Internal Server Error).
+func (k Kind) HTTPStatus() int {
+	switch k {
+	case Validation:
+		return http.StatusBadRequest
+	case Invalid:
+		return http.StatusUnprocessableEntity
+	case NotFound:
+		return http.StatusNotFound
+	case Conflict:
+		return http.StatusConflict
+	case Forbidden:
+		return http.StatusForbidden
+	case Upstream:
+		return http.StatusBadGateway
+	case GatewayTimeout:
+		return http.StatusGatewayTimeout
+	case PaymentRequired:
+		return http.StatusPaymentRequired
+	case Unauthenticated:
+		return http.StatusUnauthorized
+	case MethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case RequestTimeout:
+		return http.StatusRequestTimeout
+	case TooLarge:
+		return http.StatusRequestEntityTooLarge
+	case RateLimited:
+		return http.StatusTooManyRequests
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// KindForStatus returns the kind of errors responded to with the given
+// HTTP status code, the inverse of HTTPStatus. Status 500 maps to
+// Internal, other unknown client error statuses to Validation, and other
+// unknown statuses to Internal.
+func KindForStatus(status int) Kind {
+	for _, kind := range []Kind{
+		Validation, Invalid, NotFound, Conflict, Forbidden, Upstream,
+		GatewayTimeout, PaymentRequired, Unauthenticated,
+		MethodNotAllowed, RequestTimeout, TooLarge, RateLimited,
+		Unavailable,
+	} {
+		if kind.HTTPStatus() == status {
+			return kind
+		}
+	}
+	if status >= 400 && status < 500 {
+		return Validation
+	}
+	return Internal
+}
+
+// Field is a key/value pair describing the context of an error. The
+// value keeps its type, so that it is reported as such; it must be
+// encodable as JSON.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Error is an application error.
+type Error struct {
+	// Kind holds the kind of error.
+	Kind Kind
+
+	// Culprit holds the name of the function which created the error.
+	Culprit string
+
+	// Fields holds fields describing the context of the error.
+	Fields []Field
+
+	// Message holds the message describing the error to clients, given
+	// to New or WrapMessage. It is empty for errors created by Wrap, as
+	// the messages of their causes may expose internal details.
+	Message string
+
+	err error
+}
+
+// Wrap returns an error of the given kind wrapping err, with fields
+// given as alternating keys and values. The error's culprit is set to
+// the function calling Wrap.
+//
+// If err is nil, Wrap returns nil.
+func Wrap(err error, kind Kind, fields ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return newError(err, kind, fields)
+}
+
+// WrapMessage returns an error of the given kind wrapping err, as Wrap
+// does, described to clients by message rather than by err. If message
+// is empty, the error is described by its status text, as for Wrap.
+//
+// If err is nil, WrapMessage returns nil.
+func WrapMessage(err error, kind Kind, message string, fields ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e := newError(err, kind, fields)
+	e.Message = message
+	return e
+}
+
+// New returns an error of the given kind with the given message, and
+// with fields given as alternating keys and values. The error's culprit
+// is set to the function calling New. The message is exposed to clients
+// as that of the error.
+func New(kind Kind, message string, fields ...interface{}) error {
+	e := newError(fmt.Errorf("%s", message), kind, fields)
+	e.Message = message
+	return e
+}
+
+func newError(err error, kind Kind, fields []interface{}) *Error {
+	e := &Error{Kind: kind, err: err}
+	if pc, _, _, ok := runtime.Caller(2); ok {
+		if f := runtime.FuncForPC(pc); f != nil {
+			_, e.Culprit = stacktrace.SplitFunctionName(f.Name())
+		}
+	}
+	for i := 0; i < len(fields); i += 2 {
+		field := Field{Key: fmt.Sprint(fields[i])}
+		if i+1 < len(fields) {
+			field.Value = fields[i+1]
+		}
+		e.Fields = append(e.Fields, field)
+	}
+	return e
+}
+
+// Error returns the message of the wrapped error.
+func (e *Error) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the wrapped error.
+func (e *Error) Cause() error {
+	return e.err
+}
+
+// As returns the first *Error in err's chain of causes,
+// as defined by github.com/pkg/errors, if any.
+func As(err error) (*Error, bool) {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e, true
+		}
+		cause, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return nil, false
+}
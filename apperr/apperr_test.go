@@ -0,0 +1,93 @@
+package apperr_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestWrap(t *testing.T) {
+	cause := fmt.Errorf("boom")
+	err := errors.Wrap(apperr.Wrap(cause, apperr.Conflict, "order_id", 123, "dangling"), "context")
+
+	e, ok := apperr.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperr.Conflict, e.Kind)
+	assert.Equal(t, "TestWrap", e.Culprit)
+	assert.Equal(t, []apperr.Field{
+		{Key: "order_id", Value: 123},
+		{Key: "dangling"},
+	}, e.Fields)
+	assert.Equal(t, cause, errors.Cause(err))
+	assert.EqualError(t, err, "context: boom")
+}
+
+func TestMessage(t *testing.T) {
+	cause := fmt.Errorf("querying order: sql: no rows in result set")
+	for name, test := range map[string]struct {
+		err     error
+		message string
+	}{
+		"new":          {err: apperr.New(apperr.Conflict, "out of stock"), message: "out of stock"},
+		"wrap":         {err: apperr.Wrap(cause, apperr.NotFound)},
+		"wrap_message": {err: apperr.WrapMessage(cause, apperr.NotFound, "order not found"), message: "order not found"},
+	} {
+		e, ok := apperr.As(test.err)
+		require.True(t, ok, name)
+		assert.Equal(t, test.message, e.Message, name)
+	}
+	assert.EqualError(t, apperr.WrapMessage(cause, apperr.NotFound, "order not found"), cause.Error())
+	assert.NoError(t, apperr.WrapMessage(nil, apperr.NotFound, "order not found"))
+}
+
+func TestWrapNil(t *testing.T) {
+	assert.NoError(t, apperr.Wrap(nil, apperr.DB))
+}
+
+func TestAsNotFound(t *testing.T) {
+	_, ok := apperr.As(errors.New("boom"))
+	assert.False(t, ok)
+}
+
+func TestKindHTTPStatus(t *testing.T) {
+	for kind, status := range map[apperr.Kind]int{
+		apperr.Validation:      http.StatusBadRequest,
+		apperr.Invalid:         http.StatusUnprocessableEntity,
+		apperr.NotFound:        http.StatusNotFound,
+		apperr.Conflict:        http.StatusConflict,
+		apperr.Forbidden:       http.StatusForbidden,
+		apperr.DB:              http.StatusInternalServerError,
+		apperr.Upstream:        http.StatusBadGateway,
+		apperr.GatewayTimeout:  http.StatusGatewayTimeout,
+		apperr.PaymentRequired: http.StatusPaymentRequired,
+		apperr.Kind("what"):    http.StatusInternalServerError,
+	} {
+		assert.Equal(t, status, kind.HTTPStatus(), "%s", kind)
+	}
+}
+
+func TestKindForStatus(t *testing.T) {
+	for status, kind := range map[int]apperr.Kind{
+		http.StatusBadRequest:              apperr.Validation,
+		http.StatusUnauthorized:            apperr.Unauthenticated,
+		http.StatusNotFound:                apperr.NotFound,
+		http.StatusMethodNotAllowed:        apperr.MethodNotAllowed,
+		http.StatusRequestEntityTooLarge:   apperr.TooLarge,
+		http.StatusUnprocessableEntity:     apperr.Invalid,
+		http.StatusTooManyRequests:         apperr.RateLimited,
+		http.StatusTeapot:                  apperr.Validation,
+		http.StatusInternalServerError:     apperr.Internal,
+		http.StatusServiceUnavailable:      apperr.Unavailable,
+		http.StatusPaymentRequired:         apperr.PaymentRequired,
+		http.StatusGatewayTimeout:          apperr.GatewayTimeout,
+		http.StatusHTTPVersionNotSupported: apperr.Internal,
+	} {
+		assert.Equal(t, kind, apperr.KindForStatus(status), "%d", status)
+	}
+}
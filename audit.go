@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Audited admin actions. Entity mutations are audited under their
+// change operation.
+const (
+	auditActionExportOrders       = "export_orders"
+	auditActionSendReport         = "send_report"
+	auditActionReloadConfig       = "reload_config"
+	auditActionEnableMaintenance  = "enable_maintenance"
+	auditActionDisableMaintenance = "disable_maintenance"
+	auditActionEnableNPlusOne     = "enable_n_plus_one"
+	auditActionDisableNPlusOne    = "disable_n_plus_one"
+
+	auditActionEnableGoroutineLeak  = "enable_goroutine_leak"
+	auditActionDisableGoroutineLeak = "disable_goroutine_leak"
+	auditActionStopGoroutineLeak    = "stop_goroutine_leak"
+	auditActionStartContention      = "start_contention"
+	auditActionStopContention       = "stop_contention"
+	auditActionActivateScenario     = "activate_scenario"
+	auditActionScheduleErrorBurst   = "schedule_error_burst"
+)
+
+// Audit actors other than authenticated clients.
+const (
+	// auditActorSystem is the actor of mutations made outside of
+	// requests, such as by the fulfillment worker.
+	auditActorSystem = "system"
+
+	// auditActorAnonymous is the actor of mutations made by
+	// unauthenticated requests.
+	auditActorAnonymous = "anonymous"
+)
+
+const (
+	// defaultAuditPageSize and maxAuditPageSize are the default and
+	// maximum number of entries returned by a request to the audit log.
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+
+	// auditCursorPrefix prefixes the entry ID encoded in audit cursors.
+	auditCursorPrefix = "audit:"
+
+	// auditRedacted replaces the values of personal data in audit diffs.
+	auditRedacted = "[REDACTED]"
+)
+
+// auditDerivedFields holds, for each entity type, the fields derived
+// from other fields, which are omitted from audit diffs.
+var auditDerivedFields = map[string][]string{
+	changeEntityProduct: {"sold", "type_name"},
+}
+
+// auditPersonalFields holds, for each entity type, the fields holding
+// personal data. Changes to them are audited with their values redacted.
+var auditPersonalFields = map[string][]string{
+	changeEntityCustomer: {"full_name", "email", "address", "postal_code"},
+}
+
+// AuditEntry is an entry in the audit log, recording an admin action or
+// a mutation of an entity.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Entity    string    `json:"entity,omitempty"`
+	EntityID  int       `json:"entity_id,omitempty"`
+	Diff      auditDiff `json:"diff,omitempty"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// auditDiff maps the names of the changed fields of an entity to their
+// values before and after the change.
+type auditDiff map[string]auditFieldChange
+
+// auditFieldChange holds the values of a field before and after a
+// change. Fields added or removed by the change have no value before or
+// after it, respectively.
+type auditFieldChange struct {
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// diffAudit returns the fields which differ between before and after,
+// which are the states of an entity of the given type, as encoded in
+// JSON. Either may be nil, for entities being created or deleted. The ID
+// and derived fields are omitted, and personal data is redacted.
+func diffAudit(entity string, before, after interface{}) (auditDiff, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	omit := map[string]bool{"id": true}
+	for _, field := range auditDerivedFields[entity] {
+		omit[field] = true
+	}
+	personal := make(map[string]bool)
+	for _, field := range auditPersonalFields[entity] {
+		personal[field] = true
+	}
+
+	diff := make(auditDiff)
+	for _, fields := range []map[string]interface{}{beforeFields, afterFields} {
+		for field := range fields {
+			if omit[field] {
+				continue
+			}
+			beforeValue, inBefore := beforeFields[field]
+			afterValue, inAfter := afterFields[field]
+			if inBefore == inAfter && reflect.DeepEqual(beforeValue, afterValue) {
+				continue
+			}
+			change := auditFieldChange{Before: beforeValue, After: afterValue}
+			if personal[field] {
+				if change.Before != nil {
+					change.Before = auditRedacted
+				}
+				if change.After != nil {
+					change.After = auditRedacted
+				}
+			}
+			diff[field] = change
+		}
+	}
+	return diff, nil
+}
+
+// auditFields returns the fields of the JSON encoding of v, which must
+// encode as an object or null.
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+type auditActorKey struct{}
+
+// auditActorMiddleware records the authenticated client of each request
+// as the actor of the mutations made while serving it. It must be
+// installed after the authentication middleware.
+func auditActorMiddleware(c *gin.Context) {
+	ctx := context.WithValue(c.Request.Context(), auditActorKey{}, requestAuditActor(c))
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// requestAuditActor returns the audit actor for the client of c:
+// "admin:<username>", "customer:<id>", "api-client:<name>", or
+// auditActorAnonymous.
+func requestAuditActor(c *gin.Context) string {
+	if username := c.GetString(authenticatedUsernameKey); username != "" {
+		return "admin:" + username
+	}
+	if claims := authenticatedCustomer(c); claims != nil {
+		return "customer:" + strconv.Itoa(claims.CustomerID)
+	}
+	if name := authenticatedAPIClient(c); name != "" {
+		return "api-client:" + name
+	}
+	return auditActorAnonymous
+}
+
+// auditActorFromContext returns the actor recorded in ctx by
+// auditActorMiddleware, or auditActorSystem if there is none.
+func auditActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok {
+		return actor
+	}
+	return auditActorSystem
+}
+
+// recordAudit records an action in the audit log, attributed to the
+// actor and transaction in ctx. If tx is non-nil, the entry is recorded
+// within tx, so that it is kept if and only if tx is committed.
+//
+// Entity mutations are recorded with the entity type and ID, and the
+// diff between the entity's states before and after; admin actions
+// which do not mutate an entity have no entity type or states.
+func recordAudit(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, action, entity string, entityID int, before, after interface{}) error {
+	var entityType, diff sql.NullString
+	var id sql.NullInt64
+	if entity != "" {
+		d, err := diffAudit(entity, before, after)
+		if err != nil {
+			return errors.Wrapf(err, "diffing audited %s", entity)
+		}
+		encoded, err := json.Marshal(d)
+		if err != nil {
+			return errors.Wrapf(err, "encoding audited %s diff", entity)
+		}
+		entityType = sql.NullString{String: entity, Valid: true}
+		id = sql.NullInt64{Int64: int64(entityID), Valid: true}
+		diff = sql.NullString{String: string(encoded), Valid: true}
+	}
+	var traceID sql.NullString
+	if apmTx := apm.TransactionFromContext(ctx); apmTx != nil {
+		if traceContext := apmTx.TraceContext(); traceContext.Trace.Validate() == nil {
+			traceID = sql.NullString{String: traceContext.Trace.String(), Valid: true}
+		}
+	}
+
+	query := db.Rebind(`
+INSERT INTO audit_log (actor, action, entity, entity_id, diff, trace_id, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	args := []interface{}{auditActorFromContext(ctx), action, entityType, id, diff, traceID, time.Now().UTC()}
+	var err error
+	defer startQuery(ctx)()
+	if tx != nil {
+		_, err = tx.ExecContext(ctx, query, args...)
+	} else {
+		_, err = db.ExecContext(ctx, query, args...)
+	}
+	return errors.Wrapf(err, "recording %s audit entry", action)
+}
+
+// auditAdminAction records an admin action which does not mutate an
+// entity. The action is not failed if it cannot be recorded.
+func auditAdminAction(c *gin.Context, db *sqlx.DB, action string) {
+	if err := recordAudit(c.Request.Context(), db, nil, action, "", 0, nil, nil); err != nil {
+		contextLogger(c).WithError(err).Error("failed to audit admin action")
+	}
+}
+
+// getAuditLog returns up to limit audit entries recorded before the
+// entry with the given ID, or from the most recent if before is 0, most
+// recent first. If entity is non-empty, only mutations of entities of
+// that type, and with the given ID if entityID is non-zero, are returned.
+func getAuditLog(ctx context.Context, db *sqlx.DB, entity string, entityID int, before int64, limit int) ([]AuditEntry, error) {
+	query := `SELECT id, actor, action, entity, entity_id, diff, trace_id, created_at FROM audit_log WHERE 1=1`
+	var args []interface{}
+	if before > 0 {
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	if entity != "" {
+		query += " AND entity = ?"
+		args = append(args, entity)
+	}
+	if entityID != 0 {
+		query += " AND entity_id = ?"
+		args = append(args, entityID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying audit log")
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var entityType, diff, traceID sql.NullString
+		var id sql.NullInt64
+		if err := rows.Scan(
+			&entry.ID, &entry.Actor, &entry.Action, &entityType, &id,
+			&diff, &traceID, &entry.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		entry.Entity = entityType.String
+		entry.EntityID = int(id.Int64)
+		entry.TraceID = traceID.String
+		if diff.Valid {
+			if err := json.Unmarshal([]byte(diff.String), &entry.Diff); err != nil {
+				return nil, errors.Wrapf(err, "decoding diff of audit entry %d", entry.ID)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// handleGetAuditLog returns a handler which serves the audit log, most
+// recent first, optionally filtered by "entity" and "entity_id". Pages
+// hold up to "limit" entries; the "cursor" of a full page identifies
+// the next page.
+func handleGetAuditLog(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entity := c.Query("entity")
+		var entityID int
+		if value := c.Query("entity_id"); value != "" {
+			var err error
+			if entityID, err = strconv.Atoi(value); err != nil || entityID <= 0 {
+				abortWithError(c, apperr.New(apperr.Validation, "entity_id must be a positive integer", "entity_id", value))
+				return
+			}
+			if entity == "" {
+				abortWithError(c, apperr.New(apperr.Validation, "entity_id requires entity", "entity_id", value))
+				return
+			}
+		}
+		limit := defaultAuditPageSize
+		if value := c.Query("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxAuditPageSize {
+				abortWithError(c, apperr.New(apperr.Validation, "limit must be between 1 and "+strconv.Itoa(maxAuditPageSize), "limit", value))
+				return
+			}
+		}
+		var before int64
+		if cursor := c.Query("cursor"); cursor != "" {
+			var err error
+			if before, err = decodeCursor(auditCursorPrefix, cursor); err != nil {
+				abortWithError(c, apperr.Wrap(err, apperr.Validation, "cursor", cursor))
+				return
+			}
+		}
+
+		entries, err := getAuditLog(c.Request.Context(), db, entity, entityID, before, limit)
+		if err != nil {
+			err := errors.Wrap(err, "failed to get audit log")
+			abortWithError(c, apperr.Wrap(err, apperr.DB))
+			return
+		}
+		response := gin.H{"entries": entries}
+		if len(entries) == limit {
+			response["cursor"] = encodeCursor(auditCursorPrefix, entries[len(entries)-1].ID)
+		}
+		renderJSON(c, http.StatusOK, response)
+	}
+}
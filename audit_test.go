@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestDiffAudit(t *testing.T) {
+	product := Product{
+		ID: 1, SKU: "OP-TST-1", Name: "Test Roast", Description: "Tastes of tests.",
+		TypeID: 1, TypeName: "Light Roast Coffee", Stock: 10, Cost: 100, SellingPrice: 250,
+	}
+	restocked := product
+	restocked.Stock = 0
+	restocked.Sold = 10
+	restocked.TypeName = ""
+	customer := Customer{ID: 1, FullName: "Terry Test", Email: "terry@example.com", City: "Testville"}
+	moved := customer
+	moved.FullName = "Toni Test"
+	moved.City = "Testburg"
+
+	for name, test := range map[string]struct {
+		entity        string
+		before, after interface{}
+		expect        auditDiff
+	}{
+		"create": {
+			entity: changeEntityProduct,
+			after:  &product,
+			expect: auditDiff{
+				"sku":           {After: "OP-TST-1"},
+				"name":          {After: "Test Roast"},
+				"description":   {After: "Tastes of tests."},
+				"type_id":       {After: 1.0},
+				"stock":         {After: 10.0},
+				"cost":          {After: 100.0},
+				"selling_price": {After: 250.0},
+			},
+		},
+		"update": {
+			entity: changeEntityProduct,
+			before: &product,
+			after:  &restocked,
+			expect: auditDiff{"stock": {Before: 10.0, After: 0.0}},
+		},
+		"unchanged": {
+			entity: changeEntityProduct,
+			before: &product,
+			after:  &product,
+			expect: auditDiff{},
+		},
+		"redacted": {
+			entity: changeEntityCustomer,
+			before: &customer,
+			after:  &moved,
+			expect: auditDiff{
+				"full_name": {Before: auditRedacted, After: auditRedacted},
+				"city":      {Before: "Testville", After: "Testburg"},
+			},
+		},
+		"redacted_create": {
+			entity: changeEntityCustomer,
+			after:  Customer{ID: 2, FullName: "Terry Test"},
+			expect: auditDiff{
+				"full_name":    {After: auditRedacted},
+				"company_name": {After: ""},
+				"email":        {After: auditRedacted},
+				"address":      {After: auditRedacted},
+				"postal_code":  {After: auditRedacted},
+				"city":         {After: ""},
+				"country":      {After: ""},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			diff, err := diffAudit(test.entity, test.before, test.after)
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, diff)
+		})
+	}
+}
+
+func newTestAuditRouter(tracer *apm.Tracer, db *sqlx.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	adminGroup := make(routeOptionsMap).group(r.Group("/api/admin", adminAuth("admin", "secret"), auditActorMiddleware))
+	addAdminHandlers(adminGroup, tracer, nil, db, nil, nil, nil, nil, nil)
+	addCatalogHandlers(adminGroup, db)
+	return r
+}
+
+func serveAdmin(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+type auditLogResponse struct {
+	Entries []AuditEntry `json:"entries"`
+	Cursor  string       `json:"cursor"`
+}
+
+func getTestAuditLog(t *testing.T, r http.Handler, query string) auditLogResponse {
+	w := serveAdmin(r, "GET", "/api/admin/audit?"+query, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp auditLogResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestAuditProductMutation(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestAuditRouter(tracer, newTestDB(t))
+
+	w := serveAdmin(r, "POST", "/api/admin/products", testProductJSON)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created Product
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	createTx := lastTransaction(t, tracer, recorder)
+
+	update := strings.Replace(testProductJSON, `"stock": 10`, `"stock": 3`, 1)
+	w = serveAdmin(r, "PUT", "/api/admin/products/"+strconv.Itoa(created.ID), update)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	updateTx := lastTransaction(t, tracer, recorder)
+
+	// Failed mutations are not audited.
+	w = serveAdmin(r, "PUT", "/api/admin/products/100000", strings.Replace(update, "OP-TST-1", "OP-TST-2", 1))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	resp := getTestAuditLog(t, r, "entity=product&entity_id="+strconv.Itoa(created.ID))
+	require.Len(t, resp.Entries, 2)
+	assert.Empty(t, resp.Cursor)
+	updated, createdEntry := resp.Entries[0], resp.Entries[1]
+
+	assert.Equal(t, "admin:admin", updated.Actor)
+	assert.Equal(t, changeOpUpdate, updated.Action)
+	assert.Equal(t, changeEntityProduct, updated.Entity)
+	assert.Equal(t, created.ID, updated.EntityID)
+	assert.Equal(t, auditDiff{"stock": {Before: 10.0, After: 3.0}}, updated.Diff)
+	assert.Equal(t, hex.EncodeToString(updateTx.TraceID[:]), updated.TraceID)
+	assert.NotZero(t, updated.CreatedAt)
+
+	assert.Equal(t, changeOpCreate, createdEntry.Action)
+	assert.Equal(t, "OP-TST-1", createdEntry.Diff["sku"].After)
+	assert.Equal(t, hex.EncodeToString(createTx.TraceID[:]), createdEntry.TraceID)
+}
+
+func TestGetAuditLog(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestAuditRouter(apm.DefaultTracer, db)
+	ctx := context.Background()
+	for id := 1; id <= 3; id++ {
+		require.NoError(t, recordAudit(ctx, db, nil, changeOpUpdate, changeEntityOrder, id, nil, nil))
+	}
+	require.NoError(t, recordAudit(ctx, db, nil, auditActionExportOrders, "", 0, nil, nil))
+
+	// Entries are paged most recent first.
+	resp := getTestAuditLog(t, r, "limit=3")
+	require.Len(t, resp.Entries, 3)
+	assert.Equal(t, auditActionExportOrders, resp.Entries[0].Action)
+	assert.Equal(t, auditActorSystem, resp.Entries[0].Actor)
+	assert.Equal(t, 3, resp.Entries[1].EntityID)
+	assert.Equal(t, 2, resp.Entries[2].EntityID)
+	require.NotEmpty(t, resp.Cursor)
+
+	resp = getTestAuditLog(t, r, "limit=3&cursor="+resp.Cursor)
+	require.Len(t, resp.Entries, 1)
+	assert.Equal(t, 1, resp.Entries[0].EntityID)
+	assert.Empty(t, resp.Cursor)
+
+	resp = getTestAuditLog(t, r, "entity=order&entity_id=2")
+	require.Len(t, resp.Entries, 1)
+	assert.Equal(t, 2, resp.Entries[0].EntityID)
+
+	resp = getTestAuditLog(t, r, "entity=customer")
+	assert.Empty(t, resp.Entries)
+
+	for _, query := range []string{"entity_id=2", "entity=order&entity_id=x", "limit=0", "limit=501", "cursor=x"} {
+		w := serveAdmin(r, "GET", "/api/admin/audit?"+query, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
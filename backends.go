@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// States of the circuits of the backends to which requests are proxied,
+// as labeled on the requests' spans.
+const (
+	// circuitClosed is the state of backends which have failed fewer
+	// consecutive requests than the failure threshold.
+	circuitClosed = "closed"
+
+	// circuitOpen is the state of backends which reached the failure
+	// threshold, skipped until the cooldown expires.
+	circuitOpen = "open"
+
+	// circuitHalfOpen is the state of backends whose cooldown has
+	// expired, which are sent a single trial request: they are closed
+	// if it succeeds, and opened again if it fails.
+	circuitHalfOpen = "half_open"
+)
+
+// Health states of the backends, as reported by the admin API, derived
+// from their circuits.
+const (
+	// backendHealthy is the state of backends whose circuit is closed,
+	// and whose last request succeeded.
+	backendHealthy = "healthy"
+
+	// backendDegraded is the state of backends whose circuit is closed,
+	// but whose last requests failed.
+	backendDegraded = "degraded"
+
+	// backendRecovering is the state of backends whose circuit is
+	// half-open.
+	backendRecovering = "recovering"
+
+	// backendUnhealthy is the state of backends whose circuit is open.
+	backendUnhealthy = "unhealthy"
+)
+
+// maxCircuitTransitions is the number of the latest circuit transitions
+// kept for the admin API.
+const maxCircuitTransitions = 50
+
+// backend is a service to which requests are proxied, behind a circuit
+// breaker.
+type backend struct {
+	url    *url.URL
+	weight int
+
+	stats backendStats
+
+	circuit  string
+	failures int       // consecutive failures
+	openedAt time.Time // when the circuit was last opened
+	trial    bool      // whether the trial of a half-open circuit is in flight
+}
+
+// circuitTransition is a change of the circuit state of a backend.
+type circuitTransition struct {
+	Backend string    `json:"backend"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Time    time.Time `json:"time"`
+}
+
+// backendAttempt is a request proxied to a backend, recording the state
+// of its circuit when selected and the request's result.
+type backendAttempt struct {
+	backend *backend
+
+	// circuit is the state of the backend's circuit when selected, or
+	// circuitOpen if the attempt is short-circuited, as all backends
+	// are skipped.
+	circuit string
+	trial   bool
+
+	sent      bool
+	failed    bool
+	simulated bool // whether a failure was simulated by proxyFaults
+
+	// span is the span of the request's latest attempt, if traced, and
+	// transferred the bytes of its response copied to the client.
+	span          *apm.Span
+	transferred   int64
+	transferEnded bool
+}
+
+// record records the result of the request sent for a.
+func (a *backendAttempt) record(failed bool) {
+	a.sent = true
+	a.failed = failed
+}
+
+// backendPool selects the backends to which requests are proxied with a
+// configured strategy, skipping those whose circuit is open.
+type backendPool struct {
+	strategy         string
+	failureThreshold int
+	cooldown         time.Duration
+	now              func() time.Time
+
+	mu          sync.Mutex
+	backends    []*backend
+	next        int      // index of the next backend for round-robin
+	ring        hashRing // of the backends, for sticky routing
+	random      *rand.Rand
+	transitions []circuitTransition
+}
+
+// newBackendPool returns a backendPool selecting from the services
+// configured by cfg.
+func newBackendPool(cfg config.Proxy) *backendPool {
+	p := &backendPool{
+		strategy:         cfg.Strategy,
+		failureThreshold: cfg.FailureThreshold,
+		cooldown:         time.Duration(cfg.Cooldown),
+		now:              time.Now,
+		random:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i, u := range cfg.Services {
+		b := &backend{url: u.URL, weight: 1, circuit: circuitClosed}
+		if i < len(cfg.Weights) {
+			b.weight = cfg.Weights[i]
+		}
+		p.backends = append(p.backends, b)
+	}
+	if p.strategy == config.ProxySticky {
+		p.ring = newHashRing(p.backends)
+	}
+	return p
+}
+
+// transition changes the circuit state of b, logging and keeping the
+// transition. p.mu must be held.
+func (p *backendPool) transition(b *backend, to string, at time.Time) {
+	t := circuitTransition{Backend: b.url.Host, From: b.circuit, To: to, Time: at}
+	b.circuit = to
+	if len(p.transitions) == maxCircuitTransitions {
+		p.transitions = append(p.transitions[:0], p.transitions[1:]...)
+	}
+	p.transitions = append(p.transitions, t)
+	logger := logrus.WithFields(logrus.Fields{"backend": t.Backend, "from": t.From, "to": t.To})
+	switch to {
+	case circuitOpen:
+		logger.Warnf("backend circuit opened after %d consecutive failures, skipping it for %s", b.failures, p.cooldown)
+	case circuitHalfOpen:
+		logger.Info("backend circuit half-open, sending a trial request")
+	default:
+		logger.Info("backend circuit closed")
+	}
+}
+
+// available reports whether b may be selected at now, moving its circuit
+// to half-open once the cooldown has expired. p.mu must be held.
+func (p *backendPool) available(b *backend, now time.Time) bool {
+	if b.circuit == circuitOpen {
+		resetAt := b.openedAt.Add(p.cooldown)
+		if now.Before(resetAt) {
+			return false
+		}
+		p.transition(b, circuitHalfOpen, resetAt)
+	}
+	return b.circuit == circuitClosed || !b.trial
+}
+
+// pick selects a backend which is available, for a request routed by
+// key with the sticky strategy. If none is, the attempt selects one of
+// all the backends, short-circuited.
+func (p *backendPool) pick(key string) *backendAttempt {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	var candidates []*backend
+	for _, b := range p.backends {
+		if p.available(b, now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return &backendAttempt{backend: p.choose(p.backends, key), circuit: circuitOpen}
+	}
+	b := p.choose(candidates, key)
+	a := &backendAttempt{backend: b, circuit: b.circuit}
+	if b.circuit == circuitHalfOpen {
+		b.trial = true
+		a.trial = true
+	}
+	return a
+}
+
+// choose selects one of candidates with the strategy. Requests without
+// a key are routed at random by the sticky strategy. p.mu must be held.
+func (p *backendPool) choose(candidates []*backend, key string) *backend {
+	switch p.strategy {
+	case config.ProxySticky:
+		if key != "" {
+			return p.ring.locate(key, candidates)
+		}
+	case config.ProxyRoundRobin:
+		// The candidate following the last backend selected.
+		for i := range p.backends {
+			b := p.backends[(p.next+i)%len(p.backends)]
+			for _, c := range candidates {
+				if c == b {
+					p.next = (p.next + i + 1) % len(p.backends)
+					return b
+				}
+			}
+		}
+	case config.ProxyWeighted:
+		var totalWeight int
+		for _, c := range candidates {
+			totalWeight += c.weight
+		}
+		n := p.random.Intn(totalWeight)
+		for _, c := range candidates {
+			if n < c.weight {
+				return c
+			}
+			n -= c.weight
+		}
+	}
+	return candidates[p.random.Intn(len(candidates))]
+}
+
+// done records the result of a, once its request has completed. Attempts
+// whose request was not sent leave the circuit unchanged, though a trial
+// may then be sent by another.
+func (p *backendPool) done(a *backendAttempt) {
+	if a.circuit == circuitOpen {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := a.backend
+	if a.trial {
+		b.trial = false
+	}
+	switch {
+	case !a.sent:
+	case !a.failed:
+		b.failures = 0
+		if b.circuit != circuitClosed {
+			p.transition(b, circuitClosed, p.now())
+		}
+	default:
+		b.failures++
+		if b.circuit == circuitHalfOpen || (b.circuit == circuitClosed && b.failures >= p.failureThreshold) {
+			b.openedAt = p.now()
+			p.transition(b, circuitOpen, b.openedAt)
+		}
+	}
+}
+
+// proxyStatus is the state of the backends reported by the admin API.
+type proxyStatus struct {
+	Strategy         string              `json:"strategy"`
+	FailureThreshold int                 `json:"failure_threshold"`
+	Cooldown         string              `json:"cooldown"`
+	Backends         []backendStatus     `json:"backends"`
+	Transitions      []circuitTransition `json:"transitions"`
+}
+
+type backendStatus struct {
+	URL      string     `json:"url"`
+	Weight   int        `json:"weight"`
+	Health   string     `json:"health"`
+	Circuit  string     `json:"circuit"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+
+	// Successes and Errors count the requests sent to the backend, and
+	// LatencyP95 is the 95th percentile of the latest latencies, in
+	// milliseconds.
+	Successes  int64         `json:"successes"`
+	Errors     int64         `json:"errors"`
+	LatencyP95 *float64      `json:"latency_p95_ms,omitempty"`
+	LastError  *backendError `json:"last_error,omitempty"`
+}
+
+// health returns the health state of b. p.mu must be held.
+func (b *backend) health() string {
+	switch {
+	case b.circuit == circuitOpen:
+		return backendUnhealthy
+	case b.circuit == circuitHalfOpen:
+		return backendRecovering
+	case b.failures > 0:
+		return backendDegraded
+	}
+	return backendHealthy
+}
+
+// status returns the state of the backends, and the latest transitions
+// of their circuits.
+func (p *backendPool) status() proxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	status := proxyStatus{
+		Strategy:         p.strategy,
+		FailureThreshold: p.failureThreshold,
+		Cooldown:         p.cooldown.String(),
+		Backends:         []backendStatus{},
+		Transitions:      append([]circuitTransition{}, p.transitions...),
+	}
+	for _, b := range p.backends {
+		p.available(b, now)
+		bs := backendStatus{
+			URL:       b.url.String(),
+			Weight:    b.weight,
+			Health:    b.health(),
+			Circuit:   b.circuit,
+			Failures:  b.failures,
+			Successes: atomic.LoadInt64(&b.stats.successes),
+			Errors:    atomic.LoadInt64(&b.stats.errors),
+		}
+		if b.circuit != circuitClosed {
+			openedAt := b.openedAt
+			bs.OpenedAt = &openedAt
+		}
+		if p95, ok := b.stats.percentile(0.95); ok {
+			ms := float64(p95) / float64(time.Millisecond)
+			bs.LatencyP95 = &ms
+		}
+		if e, ok := b.stats.last(); ok {
+			bs.LastError = &e
+		}
+		status.Backends = append(status.Backends, bs)
+	}
+	return status
+}
+
+// handleGetProxy reports the health, circuits and request statistics of
+// the backends to which requests are proxied.
+func handleGetProxy(p *backendPool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, p.status())
+	}
+}
+
+type backendKey struct{}
+
+// contextWithBackend returns a copy of ctx holding a, the attempt of a
+// request proxied to a backend.
+func contextWithBackend(ctx context.Context, a *backendAttempt) context.Context {
+	return context.WithValue(ctx, backendKey{}, a)
+}
+
+// shortCircuit records a span for a, an attempt short-circuited rather
+// than sent, with the outcome "failure" and the circuit "open".
+func shortCircuit(req *http.Request, a *backendAttempt) {
+	span, _ := apm.StartSpan(req.Context(), req.Method+" "+a.backend.url.Host, "external.http")
+	if !span.Dropped() {
+		span.Context.SetTag("backend", a.backend.url.Host)
+		span.Context.SetTag("circuit", circuitOpen)
+		span.Context.SetTag("outcome", outcomeFailure)
+	}
+	span.End()
+}
+
+// backendLabels is an http.RoundTripper tagging the spans of requests
+// proxied to backends, given by their contexts as by contextWithBackend,
+// with the backend's host as "backend", and its circuit state when
+// selected as "circuit". The span is recorded on the attempt, and tagged
+// with the bytes transferred once its response is copied; see
+// transferBody. It must be wrapped by apmhttp.WrapRoundTripper.
+type backendLabels struct {
+	next http.RoundTripper
+}
+
+func (t backendLabels) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if a, ok := ctx.Value(backendKey{}).(*backendAttempt); ok {
+		if span := apm.SpanFromContext(ctx); span != nil {
+			span.Context.SetTag("backend", a.backend.url.Host)
+			span.Context.SetTag("circuit", a.circuit)
+			a.span = span
+		}
+		resp, err := t.next.RoundTrip(req)
+		if err == nil {
+			resp.Body = transferBody{ReadCloser: resp.Body, attempt: a}
+		}
+		return resp, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// backendHealth is an http.RoundTripper recording the results of
+// requests proxied to backends on their attempts, given by their
+// contexts, and in the statistics of the backends, with their latency to
+// the response's header. Requests fail if they cannot be sent, time out,
+// or are responded to with a server error; those cancelled by their
+// clients are not recorded. It must be wrapped by proxyFaults, so that
+// the failures simulated before sending requests are not recorded, as
+// the backends have not failed.
+type backendHealth struct {
+	next http.RoundTripper
+}
+
+func (t backendHealth) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	a, ok := ctx.Value(backendKey{}).(*backendAttempt)
+	if !ok || ctx.Err() == context.Canceled {
+		return resp, err
+	}
+	var failure string
+	switch {
+	case err != nil:
+		failure = err.Error()
+	case resp.StatusCode >= http.StatusInternalServerError:
+		failure = "responded with " + resp.Status
+	}
+	a.record(failure != "")
+	now := time.Now()
+	a.backend.stats.record(now.Sub(start), failure, now)
+	return resp, err
+}
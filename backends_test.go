@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func newTestBackendPool(strategy string, weights []int, hosts ...string) *backendPool {
+	var services []config.URL
+	for _, host := range hosts {
+		services = append(services, config.URL{URL: &url.URL{Scheme: "http", Host: host}})
+	}
+	return newBackendPool(config.Proxy{
+		Services:         services,
+		Strategy:         strategy,
+		Weights:          weights,
+		FailureThreshold: 1,
+		Cooldown:         config.Duration(time.Minute),
+	})
+}
+
+// pickHosts returns the hosts and circuit states of n backends picked
+// from p, completing none of the attempts.
+func pickHosts(p *backendPool, n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		a := p.pick("")
+		hosts[i] = a.backend.url.Host + ":" + a.circuit
+	}
+	return hosts
+}
+
+// recordAttempt records the result of a request sent to b.
+func recordAttempt(p *backendPool, b *backend, failed bool) {
+	a := &backendAttempt{backend: b, circuit: b.circuit}
+	a.record(failed)
+	p.done(a)
+}
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	p := newTestBackendPool(config.ProxyRoundRobin, nil, "a", "b", "c")
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	assert.Equal(t, []string{"a:closed", "b:closed", "c:closed", "a:closed"}, pickHosts(p, 4))
+
+	// Failed backends are skipped for the cooldown, and are then sent a
+	// single trial, skipped until it completes.
+	b := p.backends[1]
+	recordAttempt(p, b, true)
+	assert.Equal(t, []string{"c:closed", "a:closed", "c:closed"}, pickHosts(p, 3))
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"a:closed", "b:half_open", "c:closed", "a:closed", "c:closed"}, pickHosts(p, 5))
+	p.done(&backendAttempt{backend: b, circuit: circuitHalfOpen, trial: true, sent: true})
+	assert.Equal(t, []string{"a:closed", "b:closed", "c:closed"}, pickHosts(p, 3))
+
+	// Attempts are short-circuited while all circuits are open.
+	for _, b := range p.backends {
+		recordAttempt(p, b, true)
+	}
+	assert.Equal(t, []string{"a:open", "b:open"}, pickHosts(p, 2))
+}
+
+func TestBackendPoolWeighted(t *testing.T) {
+	p := newTestBackendPool(config.ProxyWeighted, []int{3, 1}, "a", "b")
+	counts := make(map[string]int)
+	for _, host := range pickHosts(p, 4000) {
+		counts[host]++
+	}
+	assert.InDelta(t, 3000, counts["a:closed"], 200)
+	assert.InDelta(t, 1000, counts["b:closed"], 200)
+
+	// The weights of open backends are ignored.
+	recordAttempt(p, p.backends[0], true)
+	assert.Equal(t, []string{"b:closed", "b:closed"}, pickHosts(p, 2))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	p := newTestBackendPool(config.ProxyRandom, nil, "a")
+	p.failureThreshold = 2
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	p.now = func() time.Time { return now }
+	attempt := func(failed bool) string {
+		a := p.pick("")
+		if a.circuit != circuitOpen {
+			a.record(failed)
+		}
+		p.done(a)
+		return a.circuit
+	}
+	b := p.backends[0]
+
+	// The circuit opens once the backend fails consecutive requests
+	// reaching the threshold.
+	assert.Equal(t, circuitClosed, attempt(true))
+	assert.Equal(t, circuitClosed, attempt(false))
+	assert.Equal(t, circuitClosed, attempt(true))
+	assert.Equal(t, circuitClosed, b.circuit)
+	assert.Equal(t, circuitClosed, attempt(true))
+	assert.Equal(t, circuitOpen, b.circuit)
+	assert.Equal(t, circuitOpen, attempt(false))
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, circuitOpen, attempt(false))
+
+	// Once the cooldown expires, a single trial is sent, opening the
+	// circuit again if it fails.
+	now = now.Add(time.Second)
+	trial := p.pick("")
+	assert.Equal(t, circuitHalfOpen, trial.circuit)
+	assert.True(t, trial.trial)
+	assert.Equal(t, circuitOpen, attempt(false))
+	trial.record(true)
+	p.done(trial)
+	assert.Equal(t, circuitOpen, b.circuit)
+	assert.Equal(t, circuitOpen, attempt(false))
+
+	// A trial which is not sent leaves the circuit half-open, for
+	// another trial, which closes it if it succeeds.
+	now = now.Add(time.Minute)
+	p.done(p.pick(""))
+	assert.Equal(t, circuitHalfOpen, b.circuit)
+	assert.Equal(t, circuitHalfOpen, attempt(false))
+	assert.Equal(t, circuitClosed, b.circuit)
+	assert.Equal(t, circuitClosed, attempt(true))
+
+	status := p.status()
+	assert.Equal(t, []backendStatus{{URL: "http://a", Weight: 1, Health: backendDegraded, Circuit: circuitClosed, Failures: 1}}, status.Backends)
+	assert.Equal(t, []circuitTransition{
+		{Backend: "a", From: circuitClosed, To: circuitOpen, Time: start},
+		{Backend: "a", From: circuitOpen, To: circuitHalfOpen, Time: start.Add(time.Minute)},
+		{Backend: "a", From: circuitHalfOpen, To: circuitOpen, Time: start.Add(time.Minute)},
+		{Backend: "a", From: circuitOpen, To: circuitHalfOpen, Time: start.Add(2 * time.Minute)},
+		{Backend: "a", From: circuitHalfOpen, To: circuitClosed, Time: start.Add(2 * time.Minute)},
+	}, status.Transitions)
+}
+
+func TestBackendPoolRandom(t *testing.T) {
+	p := newTestBackendPool(config.ProxyRandom, nil, "a", "b")
+	counts := make(map[string]int)
+	for _, host := range pickHosts(p, 2000) {
+		counts[host]++
+	}
+	assert.InDelta(t, 1000, counts["a:closed"], 150)
+	assert.InDelta(t, 1000, counts["b:closed"], 150)
+}
+
+func TestProxyBackendHealth(t *testing.T) {
+	setTestStartupFlags(t)
+	var healthy, failing int64
+	healthyBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&healthy, 1)
+		w.Write([]byte(`{"served_by": "healthy"}`))
+	}))
+	defer healthyBackend.Close()
+	failingBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&failing, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingBackend.Close()
+	t.Setenv("OPBEANS_SERVICES", healthyBackend.URL+","+failingBackend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	t.Setenv("OPBEANS_DT_STRATEGY", "round_robin")
+	t.Setenv("OPBEANS_DT_FAILURE_THRESHOLD", "1")
+	t.Setenv("OPBEANS_DT_COOLDOWN", "500ms")
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	srv := newTestProxyServer(t, r)
+	serveStats := func() (int, string) {
+		resp, err := http.Get(srv.URL + "/api/stats")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	// The circuit of the failing backend opens once it fails, skipping
+	// it until its cooldown expires.
+	status, _ := serveStats()
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = serveStats()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	for i := 0; i < 4; i++ {
+		status, _ := serveStats()
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.EqualValues(t, 5, atomic.LoadInt64(&healthy))
+	assert.EqualValues(t, 1, atomic.LoadInt64(&failing))
+	time.Sleep(500 * time.Millisecond)
+	serveStats()
+	serveStats()
+	assert.EqualValues(t, 6, atomic.LoadInt64(&healthy))
+	assert.EqualValues(t, 2, atomic.LoadInt64(&failing))
+
+	// The backends and their circuit states are labeled on the spans.
+	tracer.Flush(nil)
+	healthyHost, failingHost := hostOf(t, healthyBackend.URL), hostOf(t, failingBackend.URL)
+	var labels []string
+	for _, span := range recorder.Payloads().Spans {
+		if span.Type == "external" {
+			labels = append(labels, spanTag(span, "backend")+":"+spanTag(span, "circuit"))
+		}
+	}
+	assert.Equal(t, []string{
+		healthyHost + ":closed", failingHost + ":closed",
+		healthyHost + ":closed", healthyHost + ":closed", healthyHost + ":closed", healthyHost + ":closed",
+		failingHost + ":half_open", healthyHost + ":closed",
+	}, labels)
+
+	// Requests are short-circuited to be served locally while all
+	// circuits are open, recording a failed span without dialing.
+	healthyBackend.Close()
+	status, _ = serveStats()
+	assert.Equal(t, http.StatusBadGateway, status)
+	status, body := serveStats()
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, "served_by")
+	assert.EqualValues(t, 2, atomic.LoadInt64(&failing))
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	var fallbacks []model.Transaction
+	for _, tx := range payloads.Transactions {
+		if transactionLabels(tx)["proxy_fallback"] == true {
+			fallbacks = append(fallbacks, tx)
+		}
+	}
+	require.Len(t, fallbacks, 1)
+	assert.Equal(t, "HTTP 2xx", fallbacks[0].Result)
+	var shortCircuited []model.Span
+	for _, span := range payloads.Spans {
+		if span.TransactionID == fallbacks[0].ID && span.Type == "external" {
+			shortCircuited = append(shortCircuited, span)
+		}
+	}
+	require.Len(t, shortCircuited, 1)
+	span := shortCircuited[0]
+	assert.Equal(t, "http", span.Subtype)
+	assert.Equal(t, fallbacks[0].ID, span.ParentID)
+	assert.Equal(t, "GET "+spanTag(span, "backend"), span.Name)
+	assert.Contains(t, []string{healthyHost, failingHost}, spanTag(span, "backend"))
+	assert.Equal(t, circuitOpen, spanTag(span, "circuit"))
+	assert.Equal(t, outcomeFailure, spanTag(span, "outcome"))
+
+	// The circuits and their transitions are reported by the admin API.
+	w := serveAdmin(r, "GET", "/api/admin/proxy", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var proxy proxyStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &proxy))
+	assert.Equal(t, config.ProxyRoundRobin, proxy.Strategy)
+	require.Len(t, proxy.Backends, 2)
+	for _, b := range proxy.Backends {
+		assert.Equal(t, circuitOpen, b.Circuit)
+		assert.NotNil(t, b.OpenedAt)
+	}
+	var transitions []string
+	for _, t := range proxy.Transitions {
+		transitions = append(transitions, t.Backend+":"+t.From+"->"+t.To)
+	}
+	assert.Equal(t, []string{
+		failingHost + ":closed->open",
+		failingHost + ":open->half_open",
+		failingHost + ":half_open->open",
+		healthyHost + ":closed->open",
+	}, transitions)
+}
+
+// newTestProxyServer starts a server for r, closed once the test
+// completes. Proxied requests are served by a real server, as the reverse
+// proxy requires a response writer implementing http.CloseNotifier.
+func newTestProxyServer(t *testing.T, r http.Handler) *httptest.Server {
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hostOf(t *testing.T, rawurl string) string {
+	u, err := url.Parse(rawurl)
+	require.NoError(t, err)
+	return u.Host
+}
+
+// spanTag returns the value of the span's tag with the given key, or "".
+func spanTag(span model.Span, key string) string {
+	for _, tag := range span.Context.Tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
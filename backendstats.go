@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// backendLatencyWindow is the number of the latest request latencies of
+// a backend from which its percentiles are computed.
+const backendLatencyWindow = 128
+
+// backendStats holds the counts, latencies and last error of the
+// requests proxied to a backend. It is updated by the proxy without
+// locking, and is safe for concurrent use.
+type backendStats struct {
+	successes int64
+	errors    int64
+
+	// latencies is a ring of the latest latencies, in nanoseconds, of
+	// which there are latencyCount in total.
+	latencies    [backendLatencyWindow]int64
+	latencyCount uint64
+
+	lastError atomic.Value // backendError
+}
+
+// backendError is the last error of a backend, as reported by the admin
+// API.
+type backendError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// record records a request which took latency, failing with err if it
+// is not empty.
+func (s *backendStats) record(latency time.Duration, err string, now time.Time) {
+	if err == "" {
+		atomic.AddInt64(&s.successes, 1)
+	} else {
+		atomic.AddInt64(&s.errors, 1)
+		s.lastError.Store(backendError{Message: err, Time: now})
+	}
+	i := atomic.AddUint64(&s.latencyCount, 1) - 1
+	atomic.StoreInt64(&s.latencies[i%backendLatencyWindow], int64(latency))
+}
+
+// percentile returns the p-th percentile, by the nearest-rank method, of
+// the latest latencies, reporting false if there are none.
+func (s *backendStats) percentile(p float64) (time.Duration, bool) {
+	n := atomic.LoadUint64(&s.latencyCount)
+	if n == 0 {
+		return 0, false
+	}
+	if n > backendLatencyWindow {
+		n = backendLatencyWindow
+	}
+	latencies := make([]int64, n)
+	for i := range latencies {
+		latencies[i] = atomic.LoadInt64(&s.latencies[i])
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := int(math.Ceil(p*float64(n))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return time.Duration(latencies[rank]), true
+}
+
+// last returns the last error, reporting false if there has been none.
+func (s *backendStats) last() (backendError, bool) {
+	e, ok := s.lastError.Load().(backendError)
+	return e, ok
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestBackendStatsPercentile(t *testing.T) {
+	var s backendStats
+	_, ok := s.percentile(0.95)
+	assert.False(t, ok)
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 1; i <= 20; i++ {
+		s.record(time.Duration(i)*time.Millisecond, "", now)
+	}
+	p95, ok := s.percentile(0.95)
+	require.True(t, ok)
+	assert.Equal(t, 19*time.Millisecond, p95)
+
+	// Only the latest latencies are kept.
+	for i := 0; i < backendLatencyWindow; i++ {
+		s.record(time.Second, "", now)
+	}
+	p95, _ = s.percentile(0.95)
+	assert.Equal(t, time.Second, p95)
+	s.record(time.Millisecond, "refused", now)
+	assert.EqualValues(t, 20+backendLatencyWindow, s.successes)
+	assert.EqualValues(t, 1, s.errors)
+	last, ok := s.last()
+	require.True(t, ok)
+	assert.Equal(t, backendError{Message: "refused", Time: now}, last)
+}
+
+func TestProxyStatus(t *testing.T) {
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	t.Setenv("OPBEANS_DT_FAILURE_THRESHOLD", "5")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	srv := newTestProxyServer(t, r)
+	get := func(n int) {
+		for i := 0; i < n; i++ {
+			resp, err := http.Get(srv.URL + "/api/stats")
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+	}
+	status := func() backendStatus {
+		w := serveAdmin(r, "GET", "/api/admin/proxy", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var status proxyStatus
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		require.Len(t, status.Backends, 1)
+		return status.Backends[0]
+	}
+
+	start := time.Now()
+	get(7)
+	atomic.StoreInt32(&failing, 1)
+	get(3)
+	b := status()
+	assert.Equal(t, backendDegraded, b.Health)
+	assert.Equal(t, circuitClosed, b.Circuit)
+	assert.Equal(t, 3, b.Failures)
+	assert.EqualValues(t, 7, b.Successes)
+	assert.EqualValues(t, 3, b.Errors)
+	require.NotNil(t, b.LatencyP95)
+	assert.GreaterOrEqual(t, *b.LatencyP95, 10.0)
+	require.NotNil(t, b.LastError)
+	assert.Equal(t, "responded with 500 Internal Server Error", b.LastError.Message)
+	assert.True(t, !b.LastError.Time.Before(start) && !b.LastError.Time.After(time.Now()))
+
+	// The circuit opens once the threshold is reached, after which
+	// requests are short-circuited rather than counted.
+	get(4)
+	b = status()
+	assert.Equal(t, backendUnhealthy, b.Health)
+	assert.Equal(t, circuitOpen, b.Circuit)
+	assert.EqualValues(t, 7, b.Successes)
+	assert.EqualValues(t, 5, b.Errors)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+)
+
+// baggageHeader is the W3C baggage header, carrying the demo baggage of
+// requests between opbeans services.
+const baggageHeader = "Baggage"
+
+// maxBaggageSize bounds the size of the baggage read from requests.
+// Members beyond it are dropped, rather than the whole baggage.
+const maxBaggageSize = 512
+
+// Keys of the demo baggage. Each is recorded as a transaction label
+// prefixed with "baggage_", so as not to clash with this service's own
+// labels.
+const (
+	baggageUserID   = "synthetic_user_id"
+	baggageScenario = "demo_scenario"
+)
+
+// demoBaggageKeys holds the keys of the demo baggage, in the order in
+// which they are propagated. Other keys are ignored.
+var demoBaggageKeys = []string{baggageUserID, baggageScenario}
+
+// safeBaggageValue matches the baggage values which are honored, being
+// recorded as labels.
+var safeBaggageValue = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// baggageMember is a key-value pair of the demo baggage.
+type baggageMember struct {
+	key, value string
+}
+
+// baggageMiddleware reads the demo baggage of requests from their
+// baggage headers, ignoring unknown keys, malformed members and those
+// beyond maxBaggageSize. The baggage is labeled on the request's
+// transaction and replaces the request's header, so that proxied
+// requests carry it on. The middleware must be installed after
+// tracingMiddleware.
+func baggageMiddleware(c *gin.Context) {
+	baggage := parseBaggage(strings.Join(c.Request.Header.Values(baggageHeader), ","))
+	c.Request.Header.Del(baggageHeader)
+	if len(baggage) == 0 {
+		c.Next()
+		return
+	}
+	c.Request.Header.Set(baggageHeader, formatBaggage(baggage))
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		for _, m := range baggage {
+			tx.Context.SetLabel("baggage_"+m.key, m.value)
+		}
+	})
+	c.Next()
+}
+
+// parseBaggage returns the demo baggage of the baggage header value h,
+// in the order of demoBaggageKeys. Only the members which lie entirely
+// within the first maxBaggageSize bytes of h are read. The first valid
+// value of a key is taken, and the properties of members are ignored.
+func parseBaggage(h string) []baggageMember {
+	if len(h) > maxBaggageSize {
+		// A member cut by the cap is dropped whole.
+		cut := h[maxBaggageSize] != ','
+		h = h[:maxBaggageSize]
+		if cut {
+			h = h[:strings.LastIndexByte(h, ',')+1]
+		}
+	}
+	values := make(map[string]string)
+	for _, member := range strings.Split(h, ",") {
+		if i := strings.IndexByte(member, ';'); i >= 0 {
+			member = member[:i]
+		}
+		fields := strings.SplitN(member, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(fields[0])
+		if _, ok := values[key]; ok {
+			continue
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(fields[1]))
+		if err != nil || !safeBaggageValue.MatchString(value) {
+			continue
+		}
+		values[key] = value
+	}
+	var baggage []baggageMember
+	for _, key := range demoBaggageKeys {
+		if value, ok := values[key]; ok {
+			baggage = append(baggage, baggageMember{key: key, value: value})
+		}
+	}
+	return baggage
+}
+
+// formatBaggage returns the baggage header value encoding baggage. The
+// values need no percent-encoding, being restricted by safeBaggageValue.
+func formatBaggage(baggage []baggageMember) string {
+	members := make([]string, len(baggage))
+	for i, m := range baggage {
+		members[i] = m.key + "=" + m.value
+	}
+	return strings.Join(members, ",")
+}
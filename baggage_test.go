@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestParseBaggage(t *testing.T) {
+	for h, expected := range map[string][]baggageMember{
+		"":        nil,
+		"garbage": nil,
+		"demo_scenario=black-friday,synthetic_user_id=user-42": {
+			{key: baggageUserID, value: "user-42"},
+			{key: baggageScenario, value: "black-friday"},
+		},
+		// Unknown keys and properties are ignored, and space trimmed.
+		"vendor=x, synthetic_user_id = user-42 ;ttl=1 , other": {
+			{key: baggageUserID, value: "user-42"},
+		},
+		// Values are percent-decoded, and must be safe once decoded.
+		"synthetic_user_id=user%2D42":              {{key: baggageUserID, value: "user-42"}},
+		"synthetic_user_id=a%20b":                  nil,
+		"synthetic_user_id=%zz":                    nil,
+		"synthetic_user_id=":                       nil,
+		"demo_scenario=" + strings.Repeat("a", 65): nil,
+		// The first valid value of a key is taken.
+		"synthetic_user_id=a b,synthetic_user_id=u1,synthetic_user_id=u2": {{key: baggageUserID, value: "u1"}},
+	} {
+		assert.Equal(t, expected, parseBaggage(h), h)
+	}
+}
+
+func TestParseBaggageSizeCap(t *testing.T) {
+	member := "synthetic_user_id=user-42"
+	padding := func(n int) string {
+		return "vendor=" + strings.Repeat("x", n-len("vendor=")-1) + ","
+	}
+
+	// A member ending at the cap is read.
+	h := padding(maxBaggageSize-len(member)) + member
+	require.Len(t, h, maxBaggageSize)
+	assert.Equal(t, []baggageMember{{key: baggageUserID, value: "user-42"}}, parseBaggage(h))
+	assert.Equal(t, []baggageMember{{key: baggageUserID, value: "user-42"}}, parseBaggage(h+",demo_scenario=x"))
+
+	// Members beyond the cap, or cut by it, are dropped, but those
+	// within it are kept.
+	h = padding(maxBaggageSize-len(member)+1) + member
+	assert.Empty(t, parseBaggage(h))
+	h = "demo_scenario=black-friday," + padding(maxBaggageSize) + member
+	assert.Equal(t, []baggageMember{{key: baggageScenario, value: "black-friday"}}, parseBaggage(h))
+}
+
+func TestBaggagePropagated(t *testing.T) {
+	setTestStartupFlags(t)
+	forwarded := make(chan []string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded <- req.Header.Values(baggageHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	srv := newTestProxyServer(t, r)
+
+	serve := func(baggage ...string) map[string]interface{} {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		req, err := http.NewRequest("GET", srv.URL+"/api/stats", nil)
+		require.NoError(t, err)
+		for _, h := range baggage {
+			req.Header.Add(baggageHeader, h)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, 1)
+		return transactionLabels(transactions[0])
+	}
+
+	// The demo baggage is labeled, and carried on downstream without
+	// the unknown members, from all of the headers.
+	labels := serve("vendor=x;p=1,demo_scenario=black-friday", "synthetic_user_id=user-42")
+	assert.Equal(t, "user-42", labels["baggage_synthetic_user_id"])
+	assert.Equal(t, "black-friday", labels["baggage_demo_scenario"])
+	assert.Equal(t, []string{"synthetic_user_id=user-42,demo_scenario=black-friday"}, <-forwarded)
+
+	// Baggage without demo members is not carried on.
+	labels = serve("vendor=x")
+	assert.NotContains(t, labels, "baggage_synthetic_user_id")
+	assert.Empty(t, <-forwarded)
+}
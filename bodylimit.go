@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// bodyLimits holds the limits on reading request bodies.
+type bodyLimits struct {
+	maxBytes int64
+
+	// timeout bounds the time taken to read the body, so that slow
+	// clients cannot hold handlers indefinitely. A zero timeout is
+	// unlimited.
+	timeout time.Duration
+}
+
+// middleware limits the size of request bodies, and the time taken to
+// read them. Handlers reading the body must check for the errors
+// returned on exceeding the limits with abortBodyReadError, or use
+// bindJSON.
+//
+// The middleware must be installed before tracingMiddleware, so that
+// the request body capturer reads only up to the limit, and does not
+// capture oversized bodies.
+func (l bodyLimits) middleware(c *gin.Context) {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		c.Next()
+		return
+	}
+	body := c.Request.Body
+	if l.timeout > 0 {
+		// The read deadline is cleared once the body has been read,
+		// as the server continues reading from the connection in
+		// the background to detect clients closing it, and would
+		// otherwise cancel the request's context.
+		rc := http.NewResponseController(c.Writer)
+		if err := rc.SetReadDeadline(time.Now().Add(l.timeout)); err == nil {
+			deadlineBody := &deadlineBody{ReadCloser: body, rc: rc}
+			defer deadlineBody.clearDeadline()
+			body = deadlineBody
+		}
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, body, l.maxBytes)
+	c.Next()
+}
+
+// deadlineBody is a request body which clears the connection's read
+// deadline once it has been read.
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	cleared bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.clearDeadline()
+	}
+	return n, err
+}
+
+func (b *deadlineBody) clearDeadline() {
+	if !b.cleared {
+		b.cleared = true
+		b.rc.SetReadDeadline(time.Time{})
+	}
+}
+
+// abortBodyReadError aborts the request with 413 (Request Entity Too
+// Large) or 408 (Request Timeout) if err was caused by the request body
+// exceeding the limits set by bodyLimits, reporting whether it did so.
+// The transaction is labeled with the limit exceeded, and the request
+// is not reported as an error.
+func abortBodyReadError(c *gin.Context, err error) bool {
+	var label string
+	var status int
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		label, status = "request_too_large", http.StatusRequestEntityTooLarge
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		label, status = "request_body_timeout", http.StatusRequestTimeout
+	default:
+		return false
+	}
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel(label, true)
+	})
+	abortWithStatus(c, status)
+	return true
+}
+
+// bindJSON decodes the JSON request body into obj, and validates it, as
+// gin.Context.BindJSON does, reporting whether it succeeded. Requests
+// whose bodies exceed the limits set by bodyLimits are aborted with
+// abortBodyReadError, and other failures with a Validation error.
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err == nil {
+		return true
+	}
+	if !abortBodyReadError(c, err) {
+		abortWithError(c, apperr.Wrap(err, apperr.Validation))
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func newTestBodyLimitServer(t *testing.T, tracer *apm.Tracer, db *sqlx.DB, limits bodyLimits) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	tracer.SetCaptureBody(apm.CaptureBodyAll)
+	r := gin.New()
+	r.Use(limits.middleware)
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	addAPIHandlers(r.Group("/api"), db, &businessMetrics{}, nil, nil, nil, nil)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// lastTransaction flushes tracer, returning the last transaction recorded.
+func lastTransaction(t *testing.T, tracer *apm.Tracer, recorder *transporttest.RecorderTransport) model.Transaction {
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.NotEmpty(t, payloads.Transactions)
+	assert.Empty(t, payloads.Errors)
+	return payloads.Transactions[len(payloads.Transactions)-1]
+}
+
+func TestBodyLimitTooLarge(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	server := newTestBodyLimitServer(t, tracer, newTestDB(t), bodyLimits{maxBytes: 1024})
+
+	// Bodies within the limit are decoded and captured as usual.
+	order := `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`
+	resp, err := http.Post(server.URL+"/api/orders", "application/json", strings.NewReader(order))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	tx := lastTransaction(t, tracer, recorder)
+	assert.Equal(t, &model.RequestBody{Raw: order}, tx.Context.Request.Body)
+
+	// Oversized bodies are streamed, with no Content-Length.
+	body := io.MultiReader(
+		strings.NewReader(`{"customer_id": 1, "lines": [], "padding": "`),
+		io.LimitReader(neverEnding('a'), 1<<20),
+		strings.NewReader(`"}`),
+	)
+	resp, err = http.Post(server.URL+"/api/orders", "application/json", body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	envelope := decodeErrorEnvelope(t, respBody)
+	assert.Equal(t, apperr.TooLarge, envelope.Code)
+	assert.Equal(t, "Request Entity Too Large", envelope.Message)
+
+	tx = lastTransaction(t, tracer, recorder)
+	assert.Equal(t, "HTTP 413", tx.Result)
+	assert.Equal(t, true, transactionLabels(tx)["request_too_large"])
+	assert.Nil(t, tx.Context.Request.Body)
+}
+
+func TestBodyLimitTooLargeCSV(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	server := newTestBodyLimitServer(t, tracer, newTestDB(t), bodyLimits{maxBytes: 1024})
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("customer", "1")
+	file, err := w.CreateFormFile("file", "orders.csv")
+	require.NoError(t, err)
+	for buf.Len() < 4096 {
+		io.WriteString(file, "1,1\n")
+	}
+	w.Close()
+
+	resp, err := http.Post(server.URL+"/api/orders/csv", w.FormDataContentType(), &buf)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	tx := lastTransaction(t, tracer, recorder)
+	assert.Equal(t, true, transactionLabels(tx)["request_too_large"])
+}
+
+func TestBodyLimitSlowBody(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	server := newTestBodyLimitServer(t, tracer, newTestDB(t), bodyLimits{maxBytes: 1024, timeout: 100 * time.Millisecond})
+
+	// Send the start of the body, and then stall.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go io.WriteString(pw, `{"customer_id": 1, `)
+
+	start := time.Now()
+	resp, err := http.Post(server.URL+"/api/orders", "application/json", pr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	tx := lastTransaction(t, tracer, recorder)
+	assert.Equal(t, "HTTP 4xx", tx.Result)
+	assert.Equal(t, true, transactionLabels(tx)["request_body_timeout"])
+}
+
+func TestBodyLimitDeadlineCleared(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(bodyLimits{maxBytes: 1024, timeout: 50 * time.Millisecond}.middleware)
+	r.POST("/", func(c *gin.Context) {
+		ioutil.ReadAll(c.Request.Body)
+		// Handlers may outlive the body's deadline once they have
+		// read it, without their context being canceled.
+		time.Sleep(200 * time.Millisecond)
+		c.String(http.StatusOK, "%v", c.Request.Context().Err())
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("body"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<nil>", string(body))
+}
+
+// neverEnding is an io.Reader producing an endless stream of its byte.
+type neverEnding byte
+
+func (b neverEnding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(b)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+	"sync"
+)
+
+const (
+	// pooledBufferSize is the initial size of the pooled buffers.
+	pooledBufferSize = 4 << 10
+
+	// maxPooledBufferSize bounds the size of the buffers returned to
+	// the pool, so that buffers grown by giant responses are released
+	// rather than pinned in memory.
+	maxPooledBufferSize = 1 << 20
+
+	// csvBufferSize is the size of the buffers of pooled CSV writers.
+	csvBufferSize = 32 << 10
+)
+
+// bufferPool holds the buffers in which responses are rendered, so that
+// large responses such as big product lists do not allocate and grow a
+// buffer for each request.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, pooledBufferSize))
+	},
+}
+
+// getBuffer returns an empty buffer from the pool. It must be released
+// with putBuffer once its contents have been written, and are no longer
+// referenced.
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets buf and returns it to the pool, unless it has grown
+// beyond maxPooledBufferSize.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+var csvBufferPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriterSize(nil, csvBufferSize)
+	},
+}
+
+// newPooledCSVWriter returns a csv.Writer writing to w through a pooled
+// buffer, and a function returning the buffer to the pool, which must be
+// called once the writer has been flushed and is no longer used.
+func newPooledCSVWriter(w io.Writer) (*csv.Writer, func()) {
+	bw := csvBufferPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	// The csv.Writer writes to bw directly, rather than through a
+	// buffer of its own, as bw is large enough.
+	return csv.NewWriter(bw), func() {
+		bw.Reset(nil)
+		csvBufferPool.Put(bw)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestPooledBufferReset(t *testing.T) {
+	buf := getBuffer()
+	buf.WriteString("stale")
+	putBuffer(buf)
+	for i := 0; i < 10; i++ {
+		buf := getBuffer()
+		assert.Zero(t, buf.Len())
+		buf.WriteString("stale")
+		putBuffer(buf)
+	}
+}
+
+func TestPooledBufferSizeCap(t *testing.T) {
+	large := bytes.NewBuffer(make([]byte, 0, maxPooledBufferSize+1))
+	putBuffer(large)
+	for i := 0; i < 100; i++ {
+		require.True(t, getBuffer() != large)
+	}
+}
+
+func TestPooledBuffersConcurrent(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	gin.SetMode(gin.TestMode)
+	store := persistence.CacheStore(persistence.NewInMemoryStore(0))
+	r := gin.New()
+	r.Use(cache.Cache(&store))
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	addAPIHandlers(r.Group("/api", handlerTimeout(time.Minute)), db, &businessMetrics{}, nil, nil, nil, nil)
+	r.GET("/api/exports/orders.csv", handlerTimeout(time.Minute), handleOrdersCSV(db))
+
+	type request struct{ path, accept string }
+	requests := []request{
+		{"/api/products", "application/json"},
+		{"/api/products", jsonAPIMediaType},
+		{"/api/products", msgpackMediaType},
+		{"/api/products/1", "application/json"},
+		{"/api/products/top", msgpackMediaType},
+		{"/api/types", "application/json"},
+		{"/api/exports/orders.csv", ""},
+	}
+	serve := func(req request) []byte {
+		httpReq := httptest.NewRequest("GET", req.path, nil)
+		if req.accept != "" {
+			httpReq.Header.Set("Accept", req.accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httpReq)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s: unexpected status %d", req.path, req.accept, w.Code)
+		}
+		return w.Body.Bytes()
+	}
+	want := make([][]byte, len(requests))
+	for i, req := range requests {
+		want[i] = serve(req)
+		require.NotEmpty(t, want[i])
+	}
+
+	// Responses rendered concurrently in pooled buffers are identical to
+	// those rendered alone.
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				j := (g + i) % len(requests)
+				if body := serve(requests[j]); !bytes.Equal(want[j], body) {
+					t.Errorf("%s %s: response differs", requests[j].path, requests[j].accept)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// defaultRedisPort is the port used by redigo when the cache URL does
+// not specify one.
+const defaultRedisPort = 6379
+
+// redisCacheStore is a persistence.CacheStore backed by Redis, which
+// records the server address for the destination of cache spans.
+type redisCacheStore struct {
+	persistence.CacheStore
+	address string
+	port    int
+
+	// pool, if non-nil, is the pool backing the store, pinged by
+	// readiness checks.
+	pool *redis.Pool
+}
+
+// newRedisCacheStore returns a redisCacheStore wrapping store, using the
+// host and port from rawurl. Credentials in rawurl are never recorded.
+func newRedisCacheStore(store persistence.CacheStore, rawurl string) *redisCacheStore {
+	rs := &redisCacheStore{CacheStore: store, port: defaultRedisPort}
+	if u, err := url.Parse(rawurl); err == nil {
+		rs.address = u.Hostname()
+		if port, err := strconv.Atoi(u.Port()); err == nil {
+			rs.port = port
+		}
+	}
+	return rs
+}
+
+// ping checks that the Redis server is reachable before ctx's deadline.
+func (s *redisCacheStore) ping(ctx context.Context) error {
+	if s.pool == nil {
+		return nil
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "connecting to redis")
+	}
+	defer conn.Close()
+	timeout := healthCheckTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	_, err = redis.DoWithTimeout(conn, timeout, "PING")
+	return errors.Wrap(err, "pinging redis")
+}
+
+// cacheGet calls store.Get, recording the call as a span.
+func cacheGet(ctx context.Context, store persistence.CacheStore, key string, value interface{}) error {
+	span := startCacheSpan(ctx, store, "GET")
+	defer span.End()
+	defer startTiming(ctx, serverTimingCache)()
+	return store.Get(key, value)
+}
+
+// cacheSet calls store.Set, recording the call as a span.
+func cacheSet(ctx context.Context, store persistence.CacheStore, key string, value interface{}, expires time.Duration) error {
+	span := startCacheSpan(ctx, store, "SET")
+	defer span.End()
+	defer startTiming(ctx, serverTimingCache)()
+	return store.Set(key, value, expires)
+}
+
+// cacheAdd calls store.Add, recording the call as a span.
+func cacheAdd(ctx context.Context, store persistence.CacheStore, key string, value interface{}, expires time.Duration) error {
+	span := startCacheSpan(ctx, store, "SETNX")
+	defer span.End()
+	defer startTiming(ctx, serverTimingCache)()
+	return store.Add(key, value, expires)
+}
+
+// cacheIncrement calls store.Increment, recording the call as a span.
+func cacheIncrement(ctx context.Context, store persistence.CacheStore, key string, delta uint64) (uint64, error) {
+	span := startCacheSpan(ctx, store, "INCRBY")
+	defer span.End()
+	defer startTiming(ctx, serverTimingCache)()
+	return store.Increment(key, delta)
+}
+
+// startCacheSpan starts a span for the cache command. Spans for Redis
+// record the server as their destination, so that the cache appears in
+// the service map.
+func startCacheSpan(ctx context.Context, store persistence.CacheStore, command string) *apm.Span {
+	rs, ok := store.(*redisCacheStore)
+	if !ok {
+		span, _ := apm.StartSpan(ctx, command, "cache.inmem")
+		return span
+	}
+	span, _ := apm.StartSpan(ctx, command, "cache.redis")
+	if !span.Dropped() {
+		span.Context.SetDestinationAddress(rs.address, rs.port)
+		span.Context.SetDestinationService(apm.DestinationServiceSpanContext{
+			Name:     "redis",
+			Resource: "redis",
+		})
+	}
+	return span
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/validate"
+)
+
+const (
+	// maxProductPrice is the maximum cost and selling price of a
+	// product, in cents.
+	maxProductPrice = 100000000
+
+	// maxProductStock is the maximum stock of a product.
+	maxProductStock = 1000000
+
+	// codeFormat is the validation error code for values with an
+	// invalid format.
+	codeFormat = "format"
+
+	// codeNotFound is the validation error code for references to
+	// entities which do not exist.
+	codeNotFound = "not_found"
+
+	// codeUnique is the validation error code for values which must be
+	// unique, but are not.
+	codeUnique = "unique"
+)
+
+// skuPattern matches valid product SKUs, such as "OP-DRC-C1".
+var skuPattern = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*$`)
+
+var (
+	validSKU = validate.Func(codeFormat, "must hold letters and digits separated by hyphens", func(value interface{}) bool {
+		return skuPattern.MatchString(value.(string))
+	})
+	validEmail = validate.Func(codeFormat, "must be a valid email address", func(value interface{}) bool {
+		s := value.(string)
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	})
+)
+
+// addCatalogHandlers adds the handlers creating and updating products
+// and customers to r, which must be protected by adminAuth.
+func addCatalogHandlers(r tracedGroup, db *sqlx.DB) {
+	r.POST("/products", handleCreateProduct(db))
+	r.PUT("/products/:id", handleUpdateProduct(db))
+	r.POST("/customers", handleCreateCustomer(db))
+	r.PUT("/customers/:id", handleUpdateCustomer(db))
+}
+
+// checkProduct checks the fields of p which can be checked without
+// reference to the database.
+func checkProduct(v *validate.Validator, p *Product) {
+	v.Check("sku", p.SKU, validate.Required(), validate.Length(1, 64), validSKU)
+	v.Check("name", p.Name, validate.Required(), validate.Length(1, 255))
+	v.Check("description", p.Description, validate.Length(0, 10000))
+	v.Check("type_id", p.TypeID, validate.Required())
+	v.Check("stock", p.Stock, validate.Range(0, maxProductStock))
+	v.Check("cost", p.Cost, validate.Range(0, maxProductPrice))
+	v.Check("selling_price", p.SellingPrice, validate.Range(0, maxProductPrice))
+}
+
+// checkProductReferences checks that p's type exists, and that its SKU
+// is not taken by another product, returning any error from the
+// database.
+func checkProductReferences(ctx context.Context, db *sqlx.DB, v *validate.Validator, p *Product) error {
+	if v.Valid("type_id") {
+		productType, err := getProductType(ctx, db, p.TypeID)
+		if err != nil {
+			return err
+		}
+		if productType == nil {
+			v.Add("type_id", codeNotFound, "type_id must refer to an existing product type")
+		}
+	}
+	if v.Valid("sku") {
+		id, err := getProductIDBySKU(ctx, db, p.SKU)
+		if err != nil {
+			return err
+		}
+		if id != 0 && id != p.ID {
+			v.Add("sku", codeUnique, "sku is taken by another product")
+		}
+	}
+	return nil
+}
+
+// checkCustomer checks the fields of customer.
+func checkCustomer(v *validate.Validator, customer *Customer) {
+	v.Check("full_name", customer.FullName, validate.Required(), validate.Length(1, 255))
+	v.Check("company_name", customer.CompanyName, validate.Length(0, 255))
+	v.Check("email", customer.Email, validate.Required(), validate.Length(1, 254), validEmail)
+	v.Check("address", customer.Address, validate.Required(), validate.Length(1, 255))
+	v.Check("postal_code", customer.PostalCode, validate.Required(), validate.Length(1, 16))
+	v.Check("city", customer.City, validate.Required(), validate.Length(1, 255))
+	v.Check("country", customer.Country, validate.Required(), validate.Length(1, 255))
+}
+
+// saveProduct validates the product with the given ID decoded from the
+// request body, and saves it with save, responding with the saved
+// product and status. New products have the ID 0, and save must set
+// their ID.
+func saveProduct(c *gin.Context, db *sqlx.DB, id, status int, save func(context.Context, *sqlx.DB, *Product) error) {
+	var p Product
+	if !bindJSON(c, &p) {
+		return
+	}
+	p.ID = id
+	ctx := c.Request.Context()
+	var v validate.Validator
+	checkProduct(&v, &p)
+	if err := checkProductReferences(ctx, db, &v, &p); err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
+		return
+	}
+	if err := v.Err(); err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.Invalid))
+		return
+	}
+	if err := save(ctx, db, &p); err != nil {
+		if err == errProductNotFound {
+			abortWithError(c, apperr.Wrap(err, apperr.NotFound, "product_id", p.ID))
+			return
+		}
+		err := errors.Wrap(err, "failed to save product")
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "product_id", p.ID))
+		return
+	}
+	dataChanged(c)
+	invalidateProductResponses(c)
+	saved, err := getProduct(ctx, db, p.ID)
+	if err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "product_id", p.ID))
+		return
+	}
+	renderJSON(c, status, saved)
+}
+
+func handleCreateProduct(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		saveProduct(c, db, 0, http.StatusCreated, func(ctx context.Context, db *sqlx.DB, p *Product) error {
+			id, err := createProduct(ctx, db, p)
+			p.ID = id
+			return err
+		})
+	}
+}
+
+func handleUpdateProduct(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			err := errors.Wrap(err, "failed to parse product ID")
+			abortWithError(c, apperr.Wrap(err, apperr.Validation, "product_id", c.Param("id")))
+			return
+		}
+		saveProduct(c, db, id, http.StatusOK, updateProduct)
+	}
+}
+
+// saveCustomer validates the customer with the given ID decoded from
+// the request body, and saves it with save, responding with the saved
+// customer and status. New customers have the ID 0, and save must set
+// their ID.
+func saveCustomer(c *gin.Context, db *sqlx.DB, id, status int, save func(context.Context, *sqlx.DB, *Customer) error) {
+	var customer Customer
+	if !bindJSON(c, &customer) {
+		return
+	}
+	customer.ID = id
+	customer.Email = strings.TrimSpace(customer.Email)
+	var v validate.Validator
+	checkCustomer(&v, &customer)
+	if err := v.Err(); err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.Invalid))
+		return
+	}
+	ctx := c.Request.Context()
+	if err := save(ctx, db, &customer); err != nil {
+		if err == errCustomerNotFound {
+			abortWithError(c, apperr.Wrap(err, apperr.NotFound, "customer_id", customer.ID))
+			return
+		}
+		err := errors.Wrap(err, "failed to save customer")
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customer.ID))
+		return
+	}
+	dataChanged(c)
+	saved, err := getCustomer(ctx, db, customer.ID)
+	if err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customer.ID))
+		return
+	}
+	renderJSON(c, status, saved)
+}
+
+func handleCreateCustomer(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		saveCustomer(c, db, 0, http.StatusCreated, func(ctx context.Context, db *sqlx.DB, customer *Customer) error {
+			id, err := createCustomer(ctx, db, customer)
+			customer.ID = id
+			return err
+		})
+	}
+}
+
+func handleUpdateCustomer(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			err := errors.Wrap(err, "failed to parse customer ID")
+			abortWithError(c, apperr.Wrap(err, apperr.Validation, "customer_id", c.Param("id")))
+			return
+		}
+		saveCustomer(c, db, id, http.StatusOK, updateCustomer)
+	}
+}
+
+// dataChanged rotates the data version after a successful write, so
+// that stale ETags no longer match. The write is not failed if the
+// version cannot be rotated.
+func dataChanged(c *gin.Context) {
+	if err := rotateDataVersion(c.Request.Context(), contextCacheStore(c)); err != nil {
+		err := errors.Wrap(err, "failed to rotate data version")
+		contextLogger(c).WithError(err).Error("stale ETags may match")
+	}
+}
+
+// insertNextID inserts a row with the given columns and values into
+// table within tx, assigning it the next ID after the greatest in the
+// table, and returns the ID. IDs are assigned explicitly, rather than
+// by the ID column's sequence, as the sample data is loaded with
+// explicit IDs; concurrent inserts may therefore conflict.
+func insertNextID(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, table string, columns []string, values ...interface{}) (int, error) {
+	var id int
+	defer startQuery(ctx)()
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) + 1 FROM "+table).Scan(&id); err != nil {
+		return -1, err
+	}
+	query := "INSERT INTO " + table + " (id, " + strings.Join(columns, ", ") + ")" +
+		" VALUES (?" + strings.Repeat(", ?", len(columns)) + ")"
+	defer startQuery(ctx)()
+	if _, err := tx.ExecContext(ctx, db.Rebind(query), append([]interface{}{id}, values...)...); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/validate"
+)
+
+func newTestCatalogRouter(tracer *apm.Tracer, db *sqlx.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	addCatalogHandlers(make(routeOptionsMap).group(r.Group("/api/admin")), db)
+	return r
+}
+
+func serveJSON(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// decodeFieldErrors decodes the field errors of a 422 response.
+func decodeFieldErrors(t *testing.T, w *httptest.ResponseRecorder) validate.Errors {
+	require.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.Invalid, body.Code)
+	return body.Errors
+}
+
+const testProductJSON = `{
+  "sku": "OP-TST-1", "name": "Test Roast", "description": "Tastes of tests.",
+  "type_id": 1, "stock": 10, "cost": 100, "selling_price": 250
+}`
+
+func TestCreateProduct(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestCatalogRouter(apm.DefaultTracer, db)
+	w := serveJSON(r, "POST", "/api/admin/products", testProductJSON)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var created Product
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotZero(t, created.ID)
+	assert.Equal(t, "OP-TST-1", created.SKU)
+	assert.Equal(t, "Light Roast Coffee", created.TypeName)
+
+	// The product keeps its SKU on update.
+	w = serveJSON(r, "PUT", "/api/admin/products/"+strconv.Itoa(created.ID), strings.Replace(testProductJSON, `"stock": 10`, `"stock": 0`, 1))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated Product
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, created.ID, updated.ID)
+	assert.Equal(t, 0, updated.Stock)
+
+	var ops []string
+	require.NoError(t, db.Select(&ops, "SELECT op FROM changes WHERE entity='product' AND entity_id=? ORDER BY id", created.ID))
+	assert.Equal(t, []string{"create", "update"}, ops)
+
+	w = serveJSON(r, "PUT", "/api/admin/products/100000", strings.Replace(testProductJSON, "OP-TST-1", "OP-TST-2", 1))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serveJSON(r, "PUT", "/api/admin/products/one", testProductJSON)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestProductValidation(t *testing.T) {
+	r := newTestCatalogRouter(apm.DefaultTracer, newTestDB(t))
+	for name, test := range map[string]struct {
+		replace []string
+		expect  validate.Errors
+	}{
+		"missing_sku": {
+			replace: []string{`"OP-TST-1"`, `""`},
+			expect:  validate.Errors{{Field: "sku", Code: "required", Message: "sku is required"}},
+		},
+		"malformed_sku": {
+			replace: []string{`"OP-TST-1"`, `"OP TST"`},
+			expect:  validate.Errors{{Field: "sku", Code: "format", Message: "sku must hold letters and digits separated by hyphens"}},
+		},
+		"taken_sku": {
+			replace: []string{`"OP-TST-1"`, `"OP-DRC-C1"`},
+			expect:  validate.Errors{{Field: "sku", Code: "unique", Message: "sku is taken by another product"}},
+		},
+		"long_name": {
+			replace: []string{`"Test Roast"`, `"` + strings.Repeat("x", 256) + `"`},
+			expect:  validate.Errors{{Field: "name", Code: "length", Message: "name must be between 1 and 255 characters long"}},
+		},
+		"unknown_type": {
+			replace: []string{`"type_id": 1`, `"type_id": 99`},
+			expect:  validate.Errors{{Field: "type_id", Code: "not_found", Message: "type_id must refer to an existing product type"}},
+		},
+		"negative_stock_and_price": {
+			replace: []string{`"stock": 10, "cost": 100, "selling_price": 250`, `"stock": -1, "cost": 100, "selling_price": -250`},
+			expect: validate.Errors{
+				{Field: "stock", Code: "range", Message: "stock must be between 0 and 1000000"},
+				{Field: "selling_price", Code: "range", Message: "selling_price must be between 0 and 100000000"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := strings.Replace(testProductJSON, test.replace[0], test.replace[1], 1)
+			w := serveJSON(r, "POST", "/api/admin/products", body)
+			assert.Equal(t, test.expect, decodeFieldErrors(t, w))
+		})
+	}
+}
+
+const testCustomerJSON = `{
+  "full_name": "Terry Test", "company_name": "Testing Inc.", "email": "terry@example.com",
+  "address": "1 Test Lane", "postal_code": "1234", "city": "Testville", "country": "Testland"
+}`
+
+func TestCreateCustomer(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestCatalogRouter(apm.DefaultTracer, db)
+	w := serveJSON(r, "POST", "/api/admin/customers", testCustomerJSON)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var created Customer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.NotZero(t, created.ID)
+	assert.Equal(t, "terry@example.com", created.Email)
+
+	w = serveJSON(r, "PUT", "/api/admin/customers/"+strconv.Itoa(created.ID), strings.Replace(testCustomerJSON, "Terry", "Toni", 1))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var updated Customer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, Customer{
+		ID: created.ID, FullName: "Toni Test", CompanyName: "Testing Inc.", Email: "terry@example.com",
+		Address: "1 Test Lane", PostalCode: "1234", City: "Testville", Country: "Testland",
+	}, updated)
+
+	var ops []string
+	require.NoError(t, db.Select(&ops, "SELECT op FROM changes WHERE entity='customer' AND entity_id=? ORDER BY id", created.ID))
+	assert.Equal(t, []string{"create", "update"}, ops)
+
+	w = serveJSON(r, "PUT", "/api/admin/customers/100000", testCustomerJSON)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCustomerValidation(t *testing.T) {
+	r := newTestCatalogRouter(apm.DefaultTracer, newTestDB(t))
+	for name, test := range map[string]struct {
+		replace []string
+		expect  validate.Errors
+	}{
+		"missing_name": {
+			replace: []string{`"Terry Test"`, `" "`},
+			expect:  validate.Errors{{Field: "full_name", Code: "required", Message: "full_name is required"}},
+		},
+		"malformed_email": {
+			replace: []string{`"terry@example.com"`, `"terry at example.com"`},
+			expect:  validate.Errors{{Field: "email", Code: "format", Message: "email must be a valid email address"}},
+		},
+		"named_email": {
+			replace: []string{`"terry@example.com"`, `"Terry <terry@example.com>"`},
+			expect:  validate.Errors{{Field: "email", Code: "format", Message: "email must be a valid email address"}},
+		},
+		"long_postal_code": {
+			replace: []string{`"1234"`, `"12345678901234567"`},
+			expect:  validate.Errors{{Field: "postal_code", Code: "length", Message: "postal_code must be between 1 and 16 characters long"}},
+		},
+		"missing_address_and_city": {
+			replace: []string{`"address": "1 Test Lane", "postal_code": "1234", "city": "Testville"`, `"postal_code": "1234"`},
+			expect: validate.Errors{
+				{Field: "address", Code: "required", Message: "address is required"},
+				{Field: "city", Code: "required", Message: "city is required"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body := strings.Replace(testCustomerJSON, test.replace[0], test.replace[1], 1)
+			for _, method := range []string{"POST", "PUT"} {
+				path := "/api/admin/customers"
+				if method == "PUT" {
+					path += "/1"
+				}
+				w := serveJSON(r, method, path, body)
+				assert.Equal(t, test.expect, decodeFieldErrors(t, w), method)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+// Package catalogpb provides the gRPC product catalog service,
+// generated from catalog.proto.
+package catalogpb
+
+//go:generate protoc --go_out=plugins=grpc:. catalog.proto
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Changed entity types.
+const (
+	changeEntityProduct  = "product"
+	changeEntityCustomer = "customer"
+	changeEntityOrder    = "order"
+)
+
+// Change operations.
+const (
+	changeOpCreate = "create"
+	changeOpUpdate = "update"
+)
+
+const (
+	// changesPageSize is the maximum number of changes returned by a
+	// request to the changes feed.
+	changesPageSize = 100
+
+	// maxChangesWait is the maximum time a request to the changes feed
+	// may wait for new changes.
+	maxChangesWait = time.Minute
+
+	// changeCursorPrefix prefixes the change ID encoded in cursors.
+	changeCursorPrefix = "changes:"
+)
+
+// Change is an entry in the changes feed, recording a mutation of an
+// entity. Clients resume the feed after the change using its cursor.
+type Change struct {
+	Cursor    string    `json:"cursor"`
+	Entity    string    `json:"entity"`
+	EntityID  int       `json:"entity_id"`
+	Op        string    `json:"op"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// recordChange records a mutation of an entity within tx, so that it
+// appears in the changes feed if and only if tx is committed.
+func recordChange(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, entity string, entityID int, op string) error {
+	defer startQuery(ctx)()
+	if _, err := tx.ExecContext(ctx, db.Rebind(
+		"INSERT INTO changes (entity, entity_id, op, changed_at) VALUES (?, ?, ?, ?)",
+	), entity, entityID, op, time.Now().UTC()); err != nil {
+		return errors.Wrapf(err, "recording %s change", entity)
+	}
+	return nil
+}
+
+// encodeCursor returns the opaque cursor for the entry with the given
+// ID, in the feed whose cursors carry prefix.
+func encodeCursor(prefix string, id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(prefix + strconv.FormatInt(id, 10)))
+}
+
+// decodeCursor returns the ID of the entry identified by cursor, in the
+// feed whose cursors carry prefix.
+func decodeCursor(prefix, cursor string) (int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(decoded), prefix) {
+		return 0, errors.New("invalid cursor")
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(string(decoded), prefix), 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// getChanges returns up to limit changes recorded after the change with
+// the given ID, in the order they were recorded.
+func getChanges(ctx context.Context, db *sqlx.DB, after int64, limit int) ([]Change, error) {
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(`
+SELECT id, entity, entity_id, op, changed_at
+FROM changes WHERE id > ? ORDER BY id LIMIT ?`), after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying changes")
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var id int64
+		var change Change
+		if err := rows.Scan(&id, &change.Entity, &change.EntityID, &change.Op, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		change.Cursor = encodeCursor(changeCursorPrefix, id)
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// waitChanges returns the changes recorded after the change with the
+// given ID. If there are none, it waits up to wait for more, querying
+// again whenever an order event is published to events, which may be
+// nil. Changes which are not accompanied by an event are returned when
+// the wait ends.
+func waitChanges(ctx context.Context, db *sqlx.DB, events *orderEventHub, after int64, wait time.Duration) ([]Change, error) {
+	var wake <-chan orderEvent
+	if wait > 0 && events != nil {
+		// Subscribe before querying, so that no changes are missed.
+		sub := events.subscribe(1)
+		defer sub.unsubscribe()
+		wake = sub.events
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		changes, err := getChanges(ctx, db, after, changesPageSize)
+		if err != nil || len(changes) > 0 || wait <= 0 {
+			return changes, err
+		}
+		select {
+		case <-ctx.Done():
+			return changes, nil
+		case <-timer.C:
+			wait = 0
+		case _, ok := <-wake:
+			if !ok {
+				// The server is stopping.
+				wait = 0
+			}
+		}
+	}
+}
+
+// getChanges serves the changes feed, recorded after the change
+// identified by the "since" cursor, or from the beginning if there is
+// none. If "wait" is set to a duration and there are no new changes, the
+// request is held until changes are recorded, or the duration passes.
+func (h apiHandlers) getChanges(c *gin.Context) {
+	since := c.Query("since")
+	var after int64
+	if since != "" {
+		var err error
+		if after, err = decodeCursor(changeCursorPrefix, since); err != nil {
+			abortWithError(c, apperr.Wrap(err, apperr.Validation, "since", since))
+			return
+		}
+	}
+	var wait time.Duration
+	if value := c.Query("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 || wait > maxChangesWait {
+			abortWithError(c, apperr.New(apperr.Validation, "wait must be a duration of at most "+maxChangesWait.String(), "wait", value))
+			return
+		}
+	}
+
+	changes, err := waitChanges(c.Request.Context(), h.db, h.events, after, wait)
+	if err != nil {
+		err := errors.Wrap(err, "failed to get changes")
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
+		return
+	}
+	cursor := encodeCursor(changeCursorPrefix, after)
+	if len(changes) > 0 {
+		cursor = changes[len(changes)-1].Cursor
+	}
+	renderJSON(c, http.StatusOK, gin.H{"changes": changes, "cursor": cursor})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+)
+
+type changesResponse struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+}
+
+// getTestChanges requests the changes feed from r with the given query,
+// requiring success.
+func getTestChanges(t *testing.T, r http.Handler, query url.Values) changesResponse {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/changes?"+query.Encode(), nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp changesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestChangesCursorResumption(t *testing.T) {
+	db := newTestDB(t)
+	r := newTestAPIRouter(apm.DefaultTracer, db)
+	ids := createTestOrders(t, db, 3)
+
+	resp := getTestChanges(t, r, nil)
+	require.Len(t, resp.Changes, 3)
+	for i, change := range resp.Changes {
+		assert.Equal(t, changeEntityOrder, change.Entity)
+		assert.Equal(t, ids[i], change.EntityID)
+		assert.Equal(t, changeOpCreate, change.Op)
+		assert.NotZero(t, change.ChangedAt)
+	}
+	assert.Equal(t, resp.Changes[2].Cursor, resp.Cursor)
+
+	// Resuming from a change's cursor returns the changes after it.
+	resumed := getTestChanges(t, r, url.Values{"since": {resp.Changes[0].Cursor}})
+	assert.Equal(t, resp.Changes[1:], resumed.Changes)
+
+	// Resuming from the end returns no changes, and the same cursor.
+	end := getTestChanges(t, r, url.Values{"since": {resp.Cursor}})
+	assert.Empty(t, end.Changes)
+	assert.Equal(t, resp.Cursor, end.Cursor)
+
+	// Fulfilling an order records an update.
+	createTestOrders(t, db, 1)
+	processed, err := newFulfillmentWorker(apm.DefaultTracer, db, nil).processJob(context.Background())
+	require.NoError(t, err)
+	require.True(t, processed)
+	resp = getTestChanges(t, r, url.Values{"since": {resp.Cursor}})
+	require.Len(t, resp.Changes, 2)
+	assert.Equal(t, changeOpCreate, resp.Changes[0].Op)
+	assert.Equal(t, changeOpUpdate, resp.Changes[1].Op)
+	assert.Equal(t, ids[0], resp.Changes[1].EntityID)
+}
+
+func TestChangesInvalidParams(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	for _, query := range []string{
+		"since=garbage",
+		"since=" + url.QueryEscape(encodeCursor(changeCursorPrefix, 1)[1:]),
+		"wait=forever",
+		"wait=-1s",
+		"wait=2m",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/changes?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestChangesLongPollTimeout(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	start := time.Now()
+	resp := getTestChanges(t, r, url.Values{"wait": {"50ms"}})
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Empty(t, resp.Changes)
+	assert.Equal(t, encodeCursor(changeCursorPrefix, 0), resp.Cursor)
+}
+
+func TestChangesLongPollWakeUp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	hub := newOrderEventHub()
+	r := gin.New()
+	addAPIHandlers(r.Group("/api"), db, &businessMetrics{}, hub, nil, nil, nil)
+
+	result := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/changes?wait=30s", nil))
+		result <- w
+	}()
+
+	// Wait for the request to subscribe to the hub, so that the order
+	// is created while it is waiting.
+	for subscribed := false; !subscribed; {
+		hub.mu.Lock()
+		subscribed = len(hub.subscriptions) > 0
+		hub.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	select {
+	case w := <-result:
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp changesResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Changes, 1)
+		assert.Equal(t, changeOpCreate, resp.Changes[0].Op)
+	case <-time.After(10 * time.Second):
+		t.Fatal("long poll did not wake up")
+	}
+
+	// The request unsubscribes when it returns.
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	assert.Empty(t, hub.subscriptions)
+}
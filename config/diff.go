@@ -0,0 +1,35 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// Diff returns the options which differ between a and b, named by the
+// path of their JSON fields, such as "limits.rate_limit.rate", in the
+// order in which they are declared.
+func Diff(a, b *Config) []string {
+	var options []string
+	diff(reflect.ValueOf(*a), reflect.ValueOf(*b), "", &options)
+	return options
+}
+
+func diff(a, b reflect.Value, path string, options *[]string) {
+	// Options which encode themselves, such as URLs, are compared whole.
+	if a.Kind() != reflect.Struct || a.Type().Implements(marshalerType) {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*options = append(*options, path)
+		}
+		return
+	}
+	for i := 0; i < a.NumField(); i++ {
+		name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+		if path != "" {
+			name = path + "." + name
+		}
+		diff(a.Field(i), b.Field(i), name, options)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Limits of the database contention simulated on demand.
+const (
+	defaultContentionProducts = 3
+	maxContentionProducts     = 100
+	defaultContentionDuration = 30 * time.Second
+	maxContentionDuration     = 5 * time.Minute
+)
+
+// lockTopProducts begins a transaction in ctx holding write locks on the
+// n best-selling products, returning their IDs and a function releasing
+// the locks. The locks are also released when ctx is done.
+//
+// On Postgres the products' rows are locked with SELECT ... FOR UPDATE.
+// SQLite locks the whole database for writing instead, once the
+// transaction has written to the products.
+func lockTopProducts(ctx context.Context, db *sqlx.DB, n int) ([]int, func() error, error) {
+	var ids []int
+	endQuery := startQuery(ctx)
+	err := db.SelectContext(ctx, &ids, db.Rebind(`SELECT product_id FROM order_lines
+GROUP BY product_id ORDER BY SUM(amount) DESC, product_id LIMIT ?`), n)
+	endQuery()
+	if err != nil {
+		return nil, nil, apperr.Wrap(errors.Wrap(err, "querying top products"), apperr.DB)
+	}
+	if len(ids) == 0 {
+		return nil, nil, apperr.New(apperr.NotFound, "no products have been sold")
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, apperr.Wrap(errors.Wrap(err, "beginning transaction"), apperr.DB)
+	}
+	query, args, err := sqlx.In(productLockStatement(db.DriverName()), ids)
+	if err == nil {
+		endQuery := startQuery(ctx)
+		_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+		endQuery()
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, apperr.Wrap(errors.Wrap(err, "locking products"), apperr.DB)
+	}
+	return ids, tx.Rollback, nil
+}
+
+// productLockStatement returns the statement locking the products with
+// the IDs given by its argument, for the driver.
+func productLockStatement(driver string) string {
+	if driver == "postgres" {
+		return "SELECT id FROM products WHERE id IN (?) FOR UPDATE"
+	}
+	return "UPDATE products SET stock=stock WHERE id IN (?)"
+}
+
+// contentionSimulator holds locks on the best-selling products on
+// purpose, for demos of lock waits: orders for the products wait for
+// the locks, or on SQLite all writes. At most one simulation is active
+// at a time; it expires after its duration, or when stopped.
+type contentionSimulator struct {
+	tracer *apm.Tracer
+
+	// lock locks n products as by lockTopProducts.
+	lock func(ctx context.Context, n int) ([]int, func() error, error)
+
+	mu     sync.Mutex
+	active *contention
+}
+
+// contention is an active contention simulation.
+type contention struct {
+	productIDs []int
+	expiresAt  time.Time
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+func newContentionSimulator(tracer *apm.Tracer, db *sqlx.DB) *contentionSimulator {
+	return &contentionSimulator{
+		tracer: tracer,
+		lock: func(ctx context.Context, n int) ([]int, func() error, error) {
+			return lockTopProducts(ctx, db, n)
+		},
+	}
+}
+
+// start locks n products for d, in a transaction traced as a child of
+// the transaction in ctx. It fails with a conflict error if a simulation
+// is already active.
+func (s *contentionSimulator) start(ctx context.Context, n int, d time.Duration) (contentionStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkInactiveLocked(); err != nil {
+		return contentionStatus{}, err
+	}
+
+	var opts apm.TransactionOptions
+	if parent := apm.TransactionFromContext(ctx); parent != nil {
+		opts.TraceContext = parent.TraceContext()
+	}
+	tx := s.tracer.StartTransactionOptions("hold product locks", "task", opts)
+	lockCtx, cancel := context.WithTimeout(apm.ContextWithTransaction(context.Background(), tx), d)
+	ids, release, err := s.lock(lockCtx, n)
+	if err != nil {
+		cancel()
+		tx.Result = "failure"
+		tx.End()
+		return contentionStatus{}, err
+	}
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("products", len(ids))
+		tx.Context.SetLabel("duration", d.String())
+	})
+
+	c := &contention{
+		productIDs: ids,
+		expiresAt:  time.Now().Add(d),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	s.active = c
+	go func() {
+		defer close(c.done)
+		<-lockCtx.Done()
+		// The transaction is rolled back by the driver once its context
+		// is done, in which case releasing it again fails harmlessly.
+		if err := release(); err != nil && errors.Cause(err) != sql.ErrTxDone {
+			logrus.WithError(err).Warn("failed to release product locks")
+		}
+		tx.Result = "success"
+		tx.End()
+		s.mu.Lock()
+		if s.active == c {
+			s.active = nil
+		}
+		s.mu.Unlock()
+	}()
+	return c.status(), nil
+}
+
+// stop releases the locks of the active simulation, if any, and waits
+// until they are released. It is safe to call while the simulation
+// expires, and on shutdown.
+func (s *contentionSimulator) stop() {
+	s.mu.Lock()
+	c := s.active
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	// The lock is not held while waiting, as the simulation takes it
+	// when it ends.
+	c.cancel()
+	<-c.done
+}
+
+// checkInactive returns a conflict error if a simulation is active.
+func (s *contentionSimulator) checkInactive() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkInactiveLocked()
+}
+
+func (s *contentionSimulator) checkInactiveLocked() error {
+	if s.active != nil {
+		return apperr.New(apperr.Conflict, "database contention is already simulated")
+	}
+	return nil
+}
+
+func (s *contentionSimulator) status() contentionStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return contentionStatus{}
+	}
+	return s.active.status()
+}
+
+// contentionStatus is the body of contention responses.
+type contentionStatus struct {
+	Active     bool       `json:"active"`
+	ProductIDs []int      `json:"product_ids,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c *contention) status() contentionStatus {
+	expiresAt := c.expiresAt.UTC()
+	return contentionStatus{Active: true, ProductIDs: c.productIDs, ExpiresAt: &expiresAt}
+}
+
+// handleGetContention reports the active contention simulation, if any.
+func handleGetContention(s *contentionSimulator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, s.status())
+	}
+}
+
+// handleStartContention locks the "products" best-selling products, 3
+// by default, for "duration", 30s by default, recording the simulation
+// in the audit log. The simulation is audited before it starts, as on
+// SQLite the audit log cannot be written while one is active, and so
+// requests conflicting with an active simulation are rejected first.
+func handleStartContention(s *contentionSimulator, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n, ok := queryInt(c, "products", defaultContentionProducts, maxContentionProducts)
+		if !ok {
+			return
+		}
+		d, ok := queryDuration(c, "duration", defaultContentionDuration, maxContentionDuration)
+		if !ok {
+			return
+		}
+		if err := s.checkInactive(); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAdminAction(c, db, auditActionStartContention)
+		status, err := s.start(c.Request.Context(), n, d)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		renderJSON(c, http.StatusOK, status)
+	}
+}
+
+// handleStopContention releases the locks of the active contention
+// simulation, if any, recording the change in the audit log.
+func handleStopContention(s *contentionSimulator, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.stop()
+		auditAdminAction(c, db, auditActionStopContention)
+		renderJSON(c, http.StatusOK, s.status())
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// mockProductLocks stands in for the product locks of a database, as
+// Postgres would hold them: until released, or until their transaction's
+// context is done.
+type mockProductLocks struct {
+	held     int64 // accessed atomically
+	released int64 // accessed atomically
+	err      error
+}
+
+func (m *mockProductLocks) lock(ctx context.Context, n int) ([]int, func() error, error) {
+	if m.err != nil {
+		return nil, nil, m.err
+	}
+	atomic.AddInt64(&m.held, 1)
+	var once sync.Once
+	release := func() error {
+		once.Do(func() {
+			atomic.AddInt64(&m.held, -1)
+			atomic.AddInt64(&m.released, 1)
+		})
+		return nil
+	}
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids, release, nil
+}
+
+func TestContentionSimulator(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	locks := &mockProductLocks{}
+	s := newContentionSimulator(tracer, nil)
+	s.lock = locks.lock
+
+	// Simulations expire after their duration.
+	parent := tracer.StartTransaction("POST /api/admin/demo/contention", "request")
+	status, err := s.start(apm.ContextWithTransaction(context.Background(), parent), 2, 50*time.Millisecond)
+	require.NoError(t, err)
+	parent.End()
+	assert.True(t, status.Active)
+	assert.Equal(t, []int{1, 2}, status.ProductIDs)
+	assert.Equal(t, status, s.status())
+	assert.EqualValues(t, 1, atomic.LoadInt64(&locks.held))
+
+	// One simulation is active at a time.
+	_, err = s.start(context.Background(), 1, time.Minute)
+	e, ok := apperr.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperr.Conflict, e.Kind)
+
+	assert.Eventually(t, func() bool { return !s.status().Active }, 5*time.Second, time.Millisecond)
+	assert.EqualValues(t, 0, atomic.LoadInt64(&locks.held))
+	assert.EqualValues(t, 1, atomic.LoadInt64(&locks.released))
+
+	// The locks are held in a transaction of the request's trace.
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 2)
+	assert.Equal(t, "hold product locks", transactions[1].Name)
+	assert.Equal(t, transactions[0].TraceID, transactions[1].TraceID)
+	assert.Equal(t, transactions[0].ID, transactions[1].ParentID)
+
+	// Simulations are cancellable, stopping waits until the locks are
+	// released, and stopping again does nothing.
+	_, err = s.start(context.Background(), 3, time.Hour)
+	require.NoError(t, err)
+	s.stop()
+	assert.False(t, s.status().Active)
+	assert.EqualValues(t, 0, atomic.LoadInt64(&locks.held))
+	assert.EqualValues(t, 2, atomic.LoadInt64(&locks.released))
+	s.stop()
+
+	// Stopping a simulation as it expires does not deadlock.
+	for i := 0; i < 100; i++ {
+		_, err = s.start(context.Background(), 1, time.Duration(i%3)*time.Millisecond+time.Nanosecond)
+		require.NoError(t, err)
+		time.Sleep(time.Duration(i%2) * time.Millisecond)
+		s.stop()
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt64(&locks.held))
+
+	// Simulations which fail to lock are not active.
+	locks.err = errors.New("lock timeout")
+	_, err = s.start(context.Background(), 1, time.Minute)
+	assert.EqualError(t, err, "lock timeout")
+	assert.False(t, s.status().Active)
+}
+
+func TestProductLockStatement(t *testing.T) {
+	assert.Equal(t, "SELECT id FROM products WHERE id IN (?) FOR UPDATE", productLockStatement("postgres"))
+	assert.Equal(t, "UPDATE products SET stock=stock WHERE id IN (?)", productLockStatement("sqlite3"))
+}
+
+func TestContentionSQLite(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	r, _, cleanup, err := startup(apm.DefaultTracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	const order = `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`
+	postOrder := func() time.Duration {
+		start := time.Now()
+		w := serveJSON(r, "POST", "/api/orders", order)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return time.Since(start)
+	}
+	baseline := postOrder()
+
+	// Writes wait for the simulation's write transaction.
+	const duration = 500 * time.Millisecond
+	w := serveAdmin(r, "POST", "/api/admin/demo/contention?products=2&duration="+duration.String(), "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status contentionStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.True(t, status.Active)
+	assert.Len(t, status.ProductIDs, 2)
+	contended := postOrder()
+	assert.True(t, contended > duration/2, "%s", contended)
+	assert.True(t, contended > baseline, "%s <= %s", contended, baseline)
+
+	// The simulation has expired, and further writes are not delayed.
+	assert.Eventually(t, func() bool {
+		return serveAdmin(r, "GET", "/api/admin/demo/contention", "").Body.String() == `{"active":false}`
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, postOrder() < duration/2)
+
+	// Stopping releases the locks without waiting for the duration.
+	w = serveAdmin(r, "POST", "/api/admin/demo/contention?duration=1m", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusConflict, serveAdmin(r, "POST", "/api/admin/demo/contention", "").Code)
+	start := time.Now()
+	w = serveAdmin(r, "POST", "/api/admin/demo/contention/stop", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"active": false}`, w.Body.String())
+	postOrder()
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	for _, path := range []string{
+		"/api/admin/demo/contention?products=0",
+		"/api/admin/demo/contention?products=101",
+		"/api/admin/demo/contention?duration=0s",
+		"/api/admin/demo/contention?duration=6m",
+		"/api/admin/demo/contention?duration=long",
+	} {
+		assert.Equal(t, http.StatusBadRequest, serveAdmin(r, "POST", path, "").Code, path)
+	}
+
+	// The simulation is cancelled on shutdown, without waiting for its
+	// duration.
+	w = serveAdmin(r, "POST", "/api/admin/demo/contention?duration=1m", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	corsAllowedMethods = "GET, HEAD, POST"
+	corsMaxAge         = 10 * time.Minute
+)
+
+// corsAllowedHeaders holds the request headers which cross-origin
+// requests may set. It includes the distributed tracing headers sent by
+// the RUM agent.
+var corsAllowedHeaders = strings.Join([]string{
+	"Accept",
+	"Authorization",
+	"Content-Type",
+	"Elastic-Apm-Traceparent",
+	"If-None-Match",
+	"Traceparent",
+	"Tracestate",
+	"X-CSRF-Token",
+	"X-Request-Id",
+}, ", ")
+
+// corsExposedHeaders holds the response headers which cross-origin
+// requests may read, in addition to the CORS-safelisted headers.
+var corsExposedHeaders = strings.Join([]string{
+	"ETag",
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"Retry-After",
+	"X-Request-Id",
+	"X-Trace-Id",
+}, ", ")
+
+// corsPolicy holds the origins allowed to make cross-origin requests.
+type corsPolicy struct {
+	// allowAny allows requests from any origin, without credentials.
+	allowAny bool
+
+	// origins holds the exact origins allowed to make requests with
+	// credentials.
+	origins map[string]bool
+}
+
+// newCORSPolicy returns the CORS policy allowing origins, of the form
+// "scheme://host[:port]", or nil if origins is empty. The origin "*"
+// allows requests from any origin, without credentials.
+func newCORSPolicy(origins []string) *corsPolicy {
+	if len(origins) == 0 {
+		return nil
+	}
+	var policy corsPolicy
+	for _, origin := range origins {
+		if origin == "*" {
+			policy.allowAny = true
+			continue
+		}
+		if policy.origins == nil {
+			policy.origins = make(map[string]bool)
+		}
+		policy.origins[origin] = true
+	}
+	return &policy
+}
+
+// isCORSPreflight reports whether req is a CORS preflight request.
+func isCORSPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// middleware sets the CORS response headers for requests from allowed
+// origins, and responds to their preflight requests. Preflight requests
+// from other origins are rejected with 403; other requests are served
+// without CORS headers, so browsers will not expose the response.
+//
+// Preflight requests should be ignored by tracingMiddleware, so that
+// they do not create transactions.
+func (p *corsPolicy) middleware(c *gin.Context) {
+	if len(p.origins) > 0 {
+		// Exact origins are echoed back, so responses vary with it.
+		c.Writer.Header().Add("Vary", "Origin")
+	}
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		c.Next()
+		return
+	}
+
+	switch {
+	case p.origins[strings.ToLower(origin)]:
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Credentials", "true")
+	case p.allowAny:
+		c.Header("Access-Control-Allow-Origin", "*")
+	default:
+		if isCORSPreflight(c.Request) {
+			abortWithStatus(c, http.StatusForbidden)
+			return
+		}
+		c.Next()
+		return
+	}
+
+	if !isCORSPreflight(c.Request) {
+		c.Header("Access-Control-Expose-Headers", corsExposedHeaders)
+		c.Next()
+		return
+	}
+	c.Header("Access-Control-Allow-Methods", corsAllowedMethods)
+	c.Header("Access-Control-Allow-Headers", corsAllowedHeaders)
+	c.Header("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	c.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func newTestCORSRouter(t *testing.T, tracer *apm.Tracer, origins ...string) *gin.Engine {
+	policy := newCORSPolicy(origins)
+	require.NotNil(t, policy)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{ignore: isCORSPreflight}))
+	r.Use(policy.middleware)
+	r.GET("/api/stats", func(c *gin.Context) {})
+	return r
+}
+
+func serveCORS(r http.Handler, method, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/stats", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "traceparent")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestCORSRouter(t, tracer, "https://shop.example.com", "http://localhost:3000")
+
+	w := serveCORS(r, "OPTIONS", "http://localhost:3000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://localhost:3000", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, corsAllowedMethods, w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Traceparent")
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+	assert.Equal(t, []string{"Origin"}, w.Header()["Vary"])
+
+	w = serveCORS(r, "GET", "https://shop.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://shop.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "X-Trace-Id")
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "X-Request-Id")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, []string{"Origin"}, w.Header()["Vary"])
+
+	// Preflight requests are not traced.
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 1)
+	assert.Equal(t, "GET /api/stats", transactions[0].Name)
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	r := newTestCORSRouter(t, apm.DefaultTracer, "https://shop.example.com")
+
+	w := serveCORS(r, "OPTIONS", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Requests are served without CORS headers, so browsers will not
+	// expose the response.
+	w = serveCORS(r, "GET", "https://evil.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, []string{"Origin"}, w.Header()["Vary"])
+
+	// Same-origin requests are unaffected.
+	w = serveCORS(r, "GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSWildcard(t *testing.T) {
+	r := newTestCORSRouter(t, apm.DefaultTracer, "*")
+
+	w := serveCORS(r, "OPTIONS", "https://anywhere.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Empty(t, w.Header()["Vary"])
+
+	w = serveCORS(r, "GET", "https://anywhere.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSCredentials(t *testing.T) {
+	r := newTestCORSRouter(t, apm.DefaultTracer, "*", "https://shop.example.com")
+
+	// Only exact origins are allowed credentials.
+	w := serveCORS(r, "GET", "https://shop.example.com")
+	assert.Equal(t, "https://shop.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = serveCORS(r, "GET", "https://anywhere.example.com")
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, []string{"Origin"}, w.Header()["Vary"])
+}
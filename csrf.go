@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const (
+	// csrfCookieName is the name of the cookie holding the CSRF token
+	// issued by GET /api/cart.
+	csrfCookieName = "opbeans_csrf"
+
+	// csrfHeaderName is the request header in which the frontend echoes
+	// the CSRF token.
+	csrfHeaderName = "X-CSRF-Token"
+
+	// csrfTokenBytes is the number of random bytes in a CSRF token.
+	csrfTokenBytes = 32
+)
+
+// newCSRFToken returns a new, cryptographically random CSRF token.
+func newCSRFToken() (string, error) {
+	buf := make([]byte, csrfTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "failed to generate CSRF token")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// getCart opens a cart, setting the CSRF cookie which must be echoed in
+// the X-CSRF-Token header of checkout requests. The cart's contents are
+// held by the frontend until checkout. The token is also returned in the
+// response body; an existing token is reused.
+func (h apiHandlers) getCart(c *gin.Context) {
+	token, err := c.Cookie(csrfCookieName)
+	if err != nil || token == "" {
+		if token, err = newCSRFToken(); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/api",
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	c.Header("Cache-Control", "no-store")
+	renderJSON(c, http.StatusOK, gin.H{"csrf_token": token})
+}
+
+// csrfProtect is a middleware which rejects checkout requests from
+// browsers holding the CSRF cookie, unless they echo it in the
+// X-CSRF-Token header. Requests with neither, such as those from
+// machine clients which never opened a cart, and requests authenticated
+// with a bearer token, are not checked.
+//
+// Rejected requests are reported as errors with the "csrf" custom
+// context set to "missing" or "mismatch". csrfProtect must be installed
+// after jwtAuth.
+func csrfProtect(c *gin.Context) {
+	if authenticatedCustomer(c) != nil {
+		c.Next()
+		return
+	}
+	cookie, _ := c.Cookie(csrfCookieName)
+	header := c.GetHeader(csrfHeaderName)
+	if cookie == "" && header == "" {
+		c.Next()
+		return
+	}
+	switch {
+	case header == "" || cookie == "":
+		abortWithError(c, apperr.New(apperr.Forbidden, "missing CSRF token", "csrf", "missing"))
+	case subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1:
+		abortWithError(c, apperr.New(apperr.Forbidden, "CSRF token mismatch", "csrf", "mismatch"))
+	default:
+		c.Next()
+	}
+}
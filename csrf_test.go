@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// openTestCart requests GET /api/cart from r, returning the CSRF cookie.
+func openTestCart(t *testing.T, r http.Handler) *http.Cookie {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/cart", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	cookie := cookies[0]
+	assert.Equal(t, csrfCookieName, cookie.Name)
+	assert.Equal(t, "/api", cookie.Path)
+	assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	assert.False(t, cookie.HttpOnly)
+	assert.JSONEq(t, `{"csrf_token": "`+cookie.Value+`"}`, w.Body.String())
+	return cookie
+}
+
+// postTestOrder posts an order to r with the given CSRF cookie and
+// header, which are omitted if nil or empty.
+func postTestOrder(r http.Handler, cookie *http.Cookie, header, bearer string) *httptest.ResponseRecorder {
+	body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(body))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if header != "" {
+		req.Header.Set(csrfHeaderName, header)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCSRFToken(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestAPIRouter(tracer, newTestDB(t))
+	cookie := openTestCart(t, r)
+	other := openTestCart(t, r)
+	assert.NotEqual(t, cookie.Value, other.Value)
+	assert.Len(t, cookie.Value, 43) // 32 bytes, base64-encoded
+
+	// Opening the cart again reuses the token.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/cart", nil)
+	req.AddCookie(cookie)
+	r.ServeHTTP(w, req)
+	assert.JSONEq(t, `{"csrf_token": "`+cookie.Value+`"}`, w.Body.String())
+
+	for name, test := range map[string]struct {
+		cookie *http.Cookie
+		header string
+		code   int
+		csrf   string
+	}{
+		"valid":          {cookie: cookie, header: cookie.Value, code: http.StatusOK},
+		"missing_header": {cookie: cookie, code: http.StatusForbidden, csrf: "missing"},
+		"missing_cookie": {header: cookie.Value, code: http.StatusForbidden, csrf: "missing"},
+		"mismatch":       {cookie: cookie, header: other.Value, code: http.StatusForbidden, csrf: "mismatch"},
+		"no_cart":        {code: http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder.ResetPayloads()
+			w := postTestOrder(r, test.cookie, test.header, "")
+			assert.Equal(t, test.code, w.Code, w.Body.String())
+			tracer.Flush(nil)
+			errors := recorder.Payloads().Errors
+			if test.csrf == "" {
+				assert.Empty(t, errors)
+				return
+			}
+			require.Len(t, errors, 1)
+			assert.True(t, errors[0].Exception.Handled)
+			assert.Contains(t, errors[0].Context.Custom, model.IfaceMapItem{Key: "csrf", Value: test.csrf})
+			assert.Contains(t, errors[0].Context.Tags, model.IfaceMapItem{Key: "kind", Value: "forbidden"})
+		})
+	}
+}
+
+func TestCSRFBearerBypass(t *testing.T) {
+	r := newTestJWTRouter(apm.DefaultTracer, newTestDB(t))
+	cookie := openTestCart(t, r)
+	token := newTestToken(t, testJWTSecret, 1, "", time.Now().Add(time.Hour))
+
+	w := postTestOrder(r, cookie, "", token)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Without a valid bearer token, the CSRF token is required.
+	w = postTestOrder(r, cookie, "", "")
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
 type Customer struct {
@@ -34,6 +36,32 @@ func getCustomer(ctx context.Context, db *sqlx.DB, id int) (*Customer, error) {
 	return &customers[0], nil
 }
 
+// getCustomersByID returns the customers with the given IDs, ordered
+// by ID.
+func getCustomersByID(ctx context.Context, db *sqlx.DB, ids []int) ([]Customer, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	queryString, args, err := sqlx.In(`
+SELECT
+  customers.id, full_name, company_name, email,
+  address, postal_code, city, country
+FROM customers
+WHERE id IN (?) ORDER BY id
+`, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanCustomers(rows)
+}
+
 func queryCustomers(ctx context.Context, db *sqlx.DB, id, productId, limit *int) ([]Customer, error) {
 	var args []interface{}
 	queryString := `
@@ -57,12 +85,16 @@ FROM customers
 		queryString += fmt.Sprintf("LIMIT %d\n", *limit)
 	}
 
+	defer startQuery(ctx)()
 	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanCustomers(rows)
+}
 
+func scanCustomers(rows *sql.Rows) ([]Customer, error) {
 	var customers []Customer
 	for rows.Next() {
 		var c Customer
@@ -77,3 +109,75 @@ FROM customers
 	}
 	return customers, rows.Err()
 }
+
+// errCustomerNotFound is returned by updateCustomer if there is no
+// customer with the given ID.
+var errCustomerNotFound = errors.New("customer not found")
+
+// createCustomer creates a customer with the fields of c, other than
+// its ID, returning the new customer's ID.
+func createCustomer(ctx context.Context, db *sqlx.DB, c *Customer) (int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertNextID(ctx, db, tx, "customers",
+		[]string{"full_name", "company_name", "email", "address", "postal_code", "city", "country"},
+		c.FullName, c.CompanyName, c.Email, c.Address, c.PostalCode, c.City, c.Country,
+	)
+	if err != nil {
+		return -1, errors.Wrap(err, "inserting customer")
+	}
+	if err := recordChange(ctx, db, tx, changeEntityCustomer, id, changeOpCreate); err != nil {
+		return -1, err
+	}
+	if err := recordAudit(ctx, db, tx, changeOpCreate, changeEntityCustomer, id, nil, c); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// updateCustomer updates the customer with c's ID with the fields of c,
+// returning errCustomerNotFound if there is no such customer.
+func updateCustomer(ctx context.Context, db *sqlx.DB, c *Customer) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before Customer
+	defer startQuery(ctx)()
+	if err := tx.QueryRowContext(ctx, db.Rebind(`SELECT
+  full_name, company_name, email, address, postal_code, city, country
+FROM customers WHERE id=?`), c.ID).Scan(
+		&before.FullName, &before.CompanyName, &before.Email, &before.Address,
+		&before.PostalCode, &before.City, &before.Country,
+	); err == sql.ErrNoRows {
+		return errCustomerNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "querying customer")
+	}
+
+	defer startQuery(ctx)()
+	result, err := tx.ExecContext(ctx, db.Rebind(`UPDATE customers SET
+  full_name=?, company_name=?, email=?, address=?, postal_code=?, city=?, country=?
+WHERE id=?`), c.FullName, c.CompanyName, c.Email, c.Address, c.PostalCode, c.City, c.Country, c.ID)
+	if err != nil {
+		return errors.Wrap(err, "updating customer")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errCustomerNotFound
+	}
+	if err := recordChange(ctx, db, tx, changeEntityCustomer, c.ID, changeOpUpdate); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, db, tx, changeOpUpdate, changeEntityCustomer, c.ID, &before, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -4,6 +4,10 @@ DROP TABLE IF EXISTS "product_types" CASCADE;
 DROP TABLE IF EXISTS "customers" CASCADE;
 DROP TABLE IF EXISTS "orders" CASCADE;
 DROP TABLE IF EXISTS "order_lines" CASCADE;
+DROP TABLE IF EXISTS "jobs" CASCADE;
+DROP TABLE IF EXISTS "outbox" CASCADE;
+DROP TABLE IF EXISTS "changes" CASCADE;
+DROP TABLE IF EXISTS "audit_log" CASCADE;
 
 
 -- Create everything
@@ -50,6 +54,7 @@ CREATE TABLE "orders" (
 	"id" serial NOT NULL UNIQUE,
 	"customer_id" int NOT NULL,
 	"created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+	"shipped_at" TIMESTAMP,
 	CONSTRAINT orders_pk PRIMARY KEY ("id")
 ) WITH (
   OIDS=FALSE
@@ -65,7 +70,65 @@ CREATE TABLE "order_lines" (
 );
 
 
+CREATE TABLE "jobs" (
+	"id" serial NOT NULL,
+	"order_id" int NOT NULL,
+	"state" varchar NOT NULL DEFAULT 'pending',
+	"traceparent" varchar,
+	"attempts" int NOT NULL DEFAULT 0,
+	"last_error" varchar,
+	"run_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+	"created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+	CONSTRAINT jobs_pk PRIMARY KEY ("id")
+) WITH (
+  OIDS=FALSE
+);
+
+
+CREATE TABLE "outbox" (
+	"id" serial NOT NULL,
+	"event_type" varchar NOT NULL,
+	"idempotency_key" varchar NOT NULL UNIQUE,
+	"payload" TEXT NOT NULL,
+	"traceparent" varchar,
+	"created_at" TIMESTAMP NOT NULL,
+	"sent_at" TIMESTAMP,
+	CONSTRAINT outbox_pk PRIMARY KEY ("id")
+) WITH (
+  OIDS=FALSE
+);
+
+
+CREATE TABLE "changes" (
+	"id" serial NOT NULL,
+	"entity" varchar NOT NULL,
+	"entity_id" int NOT NULL,
+	"op" varchar NOT NULL,
+	"changed_at" TIMESTAMP NOT NULL,
+	CONSTRAINT changes_pk PRIMARY KEY ("id")
+) WITH (
+  OIDS=FALSE
+);
+
+
+CREATE TABLE "audit_log" (
+	"id" serial NOT NULL,
+	"actor" varchar NOT NULL,
+	"action" varchar NOT NULL,
+	"entity" varchar,
+	"entity_id" int,
+	"diff" TEXT,
+	"trace_id" varchar,
+	"created_at" TIMESTAMP NOT NULL,
+	CONSTRAINT audit_log_pk PRIMARY KEY ("id")
+) WITH (
+  OIDS=FALSE
+);
+CREATE INDEX "audit_log_entity" ON "audit_log" ("entity", "entity_id");
+
+
 ALTER TABLE "products" ADD CONSTRAINT "products_fk0" FOREIGN KEY ("type_id") REFERENCES "product_types"("id");
 ALTER TABLE "orders" ADD CONSTRAINT "orders_fk0" FOREIGN KEY ("customer_id") REFERENCES "customers"("id");
 ALTER TABLE "order_lines" ADD CONSTRAINT "order_lines_fk0" FOREIGN KEY ("order_id") REFERENCES "orders"("id");
 ALTER TABLE "order_lines" ADD CONSTRAINT "order_lines_fk1" FOREIGN KEY ("product_id") REFERENCES "products"("id");
+ALTER TABLE "jobs" ADD CONSTRAINT "jobs_fk0" FOREIGN KEY ("order_id") REFERENCES "orders"("id");
@@ -4,6 +4,10 @@ DROP TABLE IF EXISTS "product_types";
 DROP TABLE IF EXISTS "customers";
 DROP TABLE IF EXISTS "orders";
 DROP TABLE IF EXISTS "order_lines";
+DROP TABLE IF EXISTS "jobs";
+DROP TABLE IF EXISTS "outbox";
+DROP TABLE IF EXISTS "changes";
+DROP TABLE IF EXISTS "audit_log";
 
 
 -- Create everything
@@ -45,6 +49,7 @@ CREATE TABLE "orders" (
 	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
 	"customer_id" int NOT NULL,
 	"created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	"shipped_at" TIMESTAMP,
 	FOREIGN KEY ("customer_id") REFERENCES customers("id")
 );
 
@@ -56,3 +61,49 @@ CREATE TABLE "order_lines" (
 	FOREIGN KEY ("order_id") REFERENCES orders("id"),
 	FOREIGN KEY ("product_id") REFERENCES products("id")
 );
+
+
+CREATE TABLE "jobs" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"order_id" int NOT NULL,
+	"state" varchar NOT NULL DEFAULT 'pending',
+	"traceparent" varchar,
+	"attempts" int NOT NULL DEFAULT 0,
+	"last_error" varchar,
+	"run_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	"created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY ("order_id") REFERENCES orders("id")
+);
+
+
+CREATE TABLE "outbox" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"event_type" varchar NOT NULL,
+	"idempotency_key" varchar NOT NULL UNIQUE,
+	"payload" TEXT NOT NULL,
+	"traceparent" varchar,
+	"created_at" TIMESTAMP NOT NULL,
+	"sent_at" TIMESTAMP
+);
+
+
+CREATE TABLE "changes" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"entity" varchar NOT NULL,
+	"entity_id" int NOT NULL,
+	"op" varchar NOT NULL,
+	"changed_at" TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE "audit_log" (
+	"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+	"actor" varchar NOT NULL,
+	"action" varchar NOT NULL,
+	"entity" varchar,
+	"entity_id" int,
+	"diff" TEXT,
+	"trace_id" varchar,
+	"created_at" TIMESTAMP NOT NULL
+);
+CREATE INDEX "audit_log_entity" ON "audit_log" ("entity", "entity_id");
@@ -19,7 +19,7 @@ var SQL = func() http.FileSystem {
 	fs := vfsgen۰FS{
 		"/": &vfsgen۰DirInfo{
 			name:    "/",
-			modTime: time.Date(2018, 6, 26, 7, 6, 36, 879400687, time.UTC),
+			modTime: time.Date(2026, 10, 14, 8, 2, 51, 357623634, time.UTC),
 		},
 		"/customers.sql": &vfsgen۰CompressedFileInfo{
 			name:             "customers.sql",
@@ -37,17 +37,17 @@ var SQL = func() http.FileSystem {
 		},
 		"/schema_postgres.sql": &vfsgen۰CompressedFileInfo{
 			name:             "schema_postgres.sql",
-			modTime:          time.Date(2018, 6, 26, 5, 47, 23, 119823188, time.UTC),
-			uncompressedSize: 1830,
+			modTime:          time.Date(2026, 10, 14, 8, 2, 51, 357623634, time.UTC),
+			uncompressedSize: 3348,
 
-			compressedContent: []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xac\x94\xc1\x6f\x9b\x30\x14\xc6\xcf\xe5\xaf\x78\xe2\x14\xa4\x45\xda\xce\xd5\x0e\x1e\x98\x0d\x8d\x40\x06\x8e\xda\x9e\x90\x65\xdc\xd6\x0a\x60\x64\x4c\xa5\xfc\xf7\x13\x23\x24\x50\x0c\x9d\x94\x5e\xfd\x3d\xf9\xf7\xbe\xef\xf9\x79\xbb\x05\x4f\xc9\x1a\xf8\x1b\x57\x27\xfd\x2a\xaa\x17\xcb\x4b\xe2\x3d\x10\xf4\x23\xc4\x10\xf8\x80\x1f\x83\x94\xa4\x60\xd7\x4a\xe6\x2d\xd3\x8d\x0d\x2e\x4a\x5d\xe4\xe1\xfb\xf5\xc2\x4c\x9f\x6a\xfe\x71\x35\x6b\x1b\x2d\x4b\xae\x3e\xae\x94\x2a\xff\xef\xb2\xac\x10\xd5\x04\x6e\x59\xdb\x2d\xb8\x8a\x53\xcd\xc7\x56\xdd\x04\x23\x82\xcf\x97\x8c\x2c\x6e\xac\x3b\x5b\xe4\x36\x34\x5c\x09\x5a\x40\x14\x13\x88\x0e\x61\xf8\xc5\xba\xb3\x9b\x63\x6b\xc3\x1b\x55\xec\x95\xaa\x8b\x00\x87\x28\xf8\x73\xc0\x9d\x5e\xd1\x92\xcf\x0b\x3a\x25\xe7\x0d\x53\xa2\xd6\x42\x56\x36\x10\xfc\x48\x26\x6a\x17\x57\xd6\x31\x45\xa5\xa7\x40\x2d\xd9\x71\x7e\xcc\x64\xa3\x0d\xc5\xbc\x28\x44\xf5\x92\xd5\x4a\x30\x3e\x93\xdd\x38\x4a\x49\x82\x82\x88\xc0\xe0\x35\xab\x8f\xb0\x4f\x82\x1d\x4a\x9e\xe0\x37\x7e\x82\x4d\xe7\xdb\xb1\x1c\x78\x08\xc8\x2f\xd8\x58\x00\x71\xe0\xa5\xdf\x7d\x14\xa6\xd8\x72\xba\x20\x8d\x99\x0d\xd3\x5e\x09\xce\x1c\xcc\x35\xb9\x79\x73\xfd\xa5\xb7\x76\x38\x7a\x61\x2b\xdd\x3d\xb7\x45\x91\x2d\xcf\x8e\xc9\xb2\xa6\xd5\x69\xa5\x82\x97\x54\x14\x66\x89\xe6\xb9\xe2\x4d\x63\x16\x6b\xd9\x68\x5a\x64\x4c\xe6\x4b\x68\xa1\x4f\x4b\x4d\xb5\x95\x56\x66\x71\x94\xe6\x25\x80\x5b\x93\x1c\x36\x70\x21\xc6\xd1\x12\x0c\x48\xe3\x83\x66\xff\xd6\x30\xcf\xa8\xb6\x81\x04\x3b\x9c\x12\xb4\xdb\x5f\x6f\xf1\xb0\x8f\x0e\x61\xb7\x1c\x0f\x1b\x67\xea\xa4\x6f\xe0\x53\x6c\x0c\x3f\x44\xe7\xa5\x3f\x30\xb5\x3a\x3c\x44\x93\x46\xcb\x2e\xfe\xe9\xf9\x5a\x13\x28\x24\x38\x99\x7f\x35\xc8\xf3\x60\x64\xf1\xa2\x64\xcf\xc7\xaf\x36\xf8\x71\x82\x83\x9f\xd1\xd9\xe7\xf0\x47\x38\x90\x60\x1f\x27\x38\x72\xf1\xec\xc3\xed\xd3\xb8\x9f\xe2\x86\xc9\xbd\x87\x9d\x03\x35\xa0\xc6\x13\x9c\xe2\xae\xfb\xb4\x8c\x1a\xd2\x35\xf2\x7a\xd1\x04\xbd\x0c\x62\x4a\x3c\x77\x7f\x2b\xee\xdb\x7b\xdc\x68\xba\xc6\x44\xaf\xc8\xbf\x01\x00\x00\xff\xff\xa4\xf2\xf8\x4a\x26\x07\x00\x00"),
+			compressedContent: []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\xac\x56\x41\x6f\x9b\x30\x14\x3e\x97\x5f\x61\x71\x69\x22\x35\x52\x77\xae\x76\x60\xc1\xd9\xd0\x52\xd2\x01\x51\xdb\x13\x72\xc1\x49\xbc\x80\x6d\x19\x53\x8d\x7f\x3f\x19\x02\x35\x89\xa1\xc9\xb2\xab\xbf\x87\xbf\xf7\x7d\xef\xf9\x3d\x66\x33\xe0\x0a\xc6\x01\x7e\xc7\xa2\x92\x3b\x42\xb7\x96\x1b\xac\x9e\x40\xe4\x7c\x5b\x42\xe0\x2d\x00\x7c\xf1\xc2\x28\x04\x36\x17\x2c\x2d\x13\x59\xd8\x60\xee\x84\x73\xc7\x85\x0f\xe3\x81\xb1\xac\x38\xfe\x3c\x3a\x29\x0b\xc9\x72\x2c\x3e\x8f\x64\x22\x3d\x3b\x2c\xce\x08\x3d\x83\xfc\x37\x7b\x3b\xe3\xc2\x52\xbe\xb1\x3f\x9f\x0b\xd9\x21\xba\x3d\x83\x13\x95\x29\x91\x71\xc6\xb6\x5a\xa4\x65\xcd\x66\x60\x2e\x30\x92\x58\x2f\xc4\x3c\x80\x4e\x04\x0f\x57\x68\x05\x98\x58\x37\x36\x49\x6d\x50\x60\x41\x50\x06\xfc\x55\x04\xfc\xf5\x72\x79\x67\xdd\xd8\xc5\xbe\xb4\xc1\x3b\x12\xc9\x0e\x89\x0e\x00\x6b\xdf\xfb\xb5\x86\x0a\xa7\x28\xc7\xa7\x01\x0a\x49\x71\x91\x08\xc2\x25\x61\xd4\x06\x11\x7c\x89\x7a\xa8\x2a\x66\xac\x38\x09\x95\x7d\x42\xc9\x92\xfd\xe9\x71\xc2\x0a\x69\x08\xc6\x59\x46\xe8\x36\xe6\x82\x24\xf8\x04\x9e\xaf\xfc\x30\x0a\x1c\xcf\x8f\x40\xab\x35\xe6\x7b\xf0\x14\x78\x8f\x4e\xf0\x0a\x7e\xc2\x57\x30\x51\xba\xa7\xd6\x14\x3c\x7b\xd1\x0f\x30\xb1\x00\x58\x79\x6e\xf8\x75\xe1\x2c\x43\x68\x4d\x95\x91\x46\xcf\xda\x5e\x1c\x31\xce\x6c\xcc\x87\x73\xa7\xc9\x35\x97\x5e\x9b\xa1\xd6\xff\x23\xd9\x6d\xca\x2c\x8b\x87\x6b\x97\xb0\x9c\x23\x5a\x8d\x44\xe0\x1c\x91\xcc\x0c\xa1\x34\x15\xb8\x28\xcc\x20\x67\x85\x44\x59\x9c\xb0\x74\x88\x9a\xc8\x6a\x28\xa9\x92\x4a\x61\x06\x35\x37\x3b\x03\xae\x75\xb2\x9d\x0f\x03\x36\x6a\x8f\xa0\xa5\x34\x36\x74\x52\x3f\xc3\x34\x46\xd2\x06\x91\xf7\x08\xc3\xc8\x79\x7c\xfa\xb8\xc5\x85\x0b\x67\xbd\x54\x8f\xe3\x79\x32\xad\x7b\x7a\x47\x38\x3f\x8e\xef\x4b\x6c\x32\xfb\x2f\xfa\xda\xc1\xa6\x44\x36\x07\x26\x0d\x6d\x87\x9a\x30\x94\xab\xba\xf4\xcf\xcf\x4f\xa2\x99\x98\x23\x9d\x3a\x9c\x54\x21\x91\x34\x3d\xb1\xd6\xd1\x5b\x8e\x69\x4a\xe8\xf6\x56\x05\x4b\x81\x12\xcc\x91\xc0\x54\x76\x9f\xd4\xd9\x4b\x89\x73\x2e\x8b\xfe\xf5\xdd\x1d\xf7\x2a\x26\x43\x85\x8c\xb1\x10\x4c\xf4\x3e\x15\x25\x3d\xbb\xa8\x17\x36\x81\x56\x6b\x65\xd0\xd5\x95\x3e\x6c\x9c\x11\x9b\xf1\x3b\xa6\xcd\x04\x32\x3f\x3e\x92\xe2\x9c\x33\x89\x69\x52\xc5\x7b\x5c\x8d\xee\x04\x8e\xaa\x8c\xa1\xd4\x34\xf5\x07\xaa\x30\x6e\x4f\x33\xe9\xa9\x1c\x7d\x12\xb5\xc4\xab\x87\x67\xbb\x73\xc7\x9c\xa2\x72\x70\x44\x35\x98\xb1\x5b\x19\x1f\x98\x6a\x35\xe5\x88\x74\x7d\xb4\x35\xe9\x5d\xab\x52\xfb\x63\x18\xd1\x89\x12\xa9\x35\xfc\x31\x54\x6f\xf5\x61\x0b\x7a\xd5\xed\xbb\xa2\x4e\x52\xb2\xd9\x34\xed\xd1\x75\x45\x0d\x5f\xd2\x12\x9a\x2f\x9d\xa0\x4b\x9d\x39\xf8\xe2\xf9\x2e\x7c\xd1\x7c\x89\x5b\x11\x2b\xbf\xef\x56\xab\xee\x0e\x68\xa2\x6a\x87\x9d\x65\x04\x83\xd3\x3f\x2b\xc7\x75\x81\x96\x68\x87\xc4\x9b\xfd\xbd\x0d\x16\xab\x00\x7a\xdf\xfd\x43\xaa\xed\x2f\xd1\x14\x04\x70\x01\x03\xe8\xcf\xe1\xc9\xdf\x6f\x23\xe8\xa1\x4f\xd7\x2e\xaa\x63\xb2\xe6\xdc\x44\xa5\x2f\xac\x3e\xdd\xc7\xef\xc3\x30\x55\xbb\x33\x8c\x7c\x0d\x68\x22\xed\x26\x79\x9f\xf1\x90\xfd\xb5\x74\x5f\x8e\xe9\xb4\x9d\x65\x74\x74\x80\xb2\x59\x48\xc7\x5c\xea\xf4\xdf\x35\xfd\x1d\x00\xfa\x8c\x41\xb5\x14\x0d\x00\x00"),
 		},
 		"/schema_sqlite3.sql": &vfsgen۰CompressedFileInfo{
 			name:             "schema_sqlite3.sql",
-			modTime:          time.Date(2018, 6, 26, 7, 6, 35, 623377168, time.UTC),
-			uncompressedSize: 1360,
+			modTime:          time.Date(2026, 10, 14, 8, 2, 51, 357623634, time.UTC),
+			uncompressedSize: 2638,
 
-			compressedContent: []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\x8c\x53\xc1\x6e\xa3\x30\x10\x3d\x87\xaf\x18\x71\x6a\xa4\xe6\x0b\xf6\xc4\x92\x49\x85\x36\x71\xb2\x8e\x91\xda\x13\xb2\x8c\xb7\xb5\x0a\x18\xd9\xa6\x52\xfe\x7e\x45\x42\x09\x08\x43\x7a\x9d\xf7\xec\xf7\xe6\xcd\xcc\x66\x03\x5b\xa3\x6b\x90\x5f\xd2\x5c\xdc\x87\xaa\xde\x83\x2d\x3d\x9e\x80\x45\xbf\xf7\x08\xc9\x0e\xf0\x35\x39\xb3\x33\x84\xb5\xd1\x79\x23\x9c\x0d\x7f\x2d\x13\x32\x77\xa9\xe5\x3c\x4b\x34\xd6\xe9\x52\x9a\x79\x86\x36\xf9\x43\x38\x2b\x54\x75\x15\x09\x82\xcd\x06\x62\x23\xb9\x93\xc3\x16\x62\x8a\x11\xc3\xee\xf1\xdd\x3a\x3c\x05\xab\x50\xe5\x21\x58\x69\x14\x2f\x80\x1c\x19\x90\x74\xbf\x7f\x0e\x56\xa1\xfd\x6c\x42\xf8\xe2\x46\x7c\x70\xd3\x03\x90\x92\xe4\x6f\x8a\x2d\x5e\xf1\x52\x4e\x09\x2d\x92\x4b\x2b\x8c\xaa\x9d\xd2\x55\x08\x0c\x5f\xd9\x08\x6d\xe3\xc8\x5a\x4d\x55\xb9\xb1\xa0\xd3\xe2\x73\x5a\x16\xda\x3a\x0f\x59\x16\x85\xaa\xde\xb3\xda\x28\x21\x27\xf0\x89\x26\x87\x88\xbe\xc1\x1f\x7c\x83\xa7\xb6\xc1\xf5\x73\xb0\xda\x1d\x29\x26\x2f\xa4\x2b\x7e\xdb\x58\x03\xc5\x1d\x52\x24\x31\x9e\x61\x34\xb2\xdb\xc3\x60\xdd\x86\xea\xcd\xaf\x9b\xec\x52\x88\xfe\x90\xee\x29\x4e\x8d\xfa\xf4\xee\x3b\xb2\xa4\xf5\xaf\x29\x8a\x6c\x7e\x2a\x42\x97\x35\xaf\x2e\x0b\x0c\x59\x72\x55\xf8\x21\x9e\xe7\x46\x5a\xeb\x07\x6b\x6d\x1d\x2f\x32\xa1\xf3\x39\x69\xe5\x2e\x73\xa6\x9a\xca\x19\x3f\xf8\xb3\x6c\xba\xeb\xe8\x83\x49\x08\xc3\x17\xa4\x30\x7c\x1d\xa5\xec\x98\x90\x98\xe2\x01\x09\xbb\xca\x76\x81\x7a\xf7\x50\x5c\xaf\x27\xcf\xb8\x0b\x81\x25\x07\x3c\xb3\xe8\x70\xba\xcf\x6e\x8b\xbb\x28\xdd\x33\x88\x53\x4a\x91\xb0\xac\xa7\x4c\x56\x6c\xa8\x32\x5a\xb3\x7e\x9e\x0f\xda\xea\xae\xfa\xda\xdb\xad\xe0\xf3\xfb\xbd\x8d\x3e\x8c\x97\x6d\xc0\x93\xfa\xd8\x67\xff\xf5\xc8\xe4\x2d\xd8\x99\xeb\x19\x68\xfa\x0e\x68\xd0\xd8\xff\x00\x00\x00\xff\xff\xb6\xb9\xac\xee\x50\x05\x00\x00"),
+			compressedContent: []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\xa4\x55\x4d\x6f\xe2\x30\x10\x3d\x37\xbf\xc2\xca\xa5\x45\x2a\xd2\xde\x7b\x62\xc1\x54\xd1\x42\xe8\x86\x20\xb5\xa7\xc8\xb5\x5d\xf0\x36\xd8\x96\x33\xa9\x36\xff\x7e\x95\x0f\x42\xbc\xd8\x69\xd9\xbd\xfa\x8d\x3d\xf3\xde\x3c\xcf\x4c\xa7\x68\x61\x94\x46\xfc\x83\x9b\x0a\x0e\x42\xee\x83\x45\xb2\x79\x42\xe9\xec\xfb\x0a\xa3\x68\x89\xf0\x73\xb4\x4d\xb7\x28\xd4\x46\xb1\x92\x42\x11\x3e\x8c\x07\x64\x50\x69\xee\x8f\xa2\x65\x01\xea\xc8\x8d\x3f\x42\x19\xf6\x29\x9c\xe5\x42\x8e\x24\xf9\xa5\x5e\x47\x1e\x28\xe1\x55\xfd\xf6\x17\x78\x20\x72\x3f\xf2\x36\x29\x99\x80\x2c\x57\xfb\xf0\x21\x08\x82\xe9\x14\xcd\x0d\x27\xc0\x87\x02\xce\x13\x3c\x4b\x71\x77\xf5\x2c\x1c\xba\x0b\x6e\x42\xc1\x42\x54\x70\x23\x48\x8e\xe2\x4d\x8a\xe2\xdd\x6a\x75\x1f\xdc\x84\xc5\x7b\x19\xa2\x0f\x62\xe8\x81\x98\x1e\x40\xbb\x38\xfa\xb9\xc3\x35\x2e\xc9\x91\x5f\x06\xd4\x08\xe3\x05\x35\x42\x83\x50\x32\x44\x29\x7e\x4e\x2d\xb4\x6e\x46\x56\xe7\x14\x12\xec\x84\xa0\xe8\xfb\xe5\x31\x55\x05\x38\x82\x79\x9e\x0b\xb9\xcf\xb4\x11\x94\x5f\xc0\x4f\x49\xb4\x9e\x25\x2f\xe8\x07\x7e\x41\x77\x35\xc1\xc9\x7d\x70\xb3\xdc\x24\x38\x7a\x8c\xbb\xc3\x53\x19\x13\x94\xe0\x25\x4e\x70\x3c\xc7\x5b\x64\x19\xa6\xbd\x18\x4c\x6a\x51\x9d\xfa\xb5\x61\xa3\x22\xba\x45\x3a\xab\x78\x59\xa8\x2b\xdf\xd9\xa1\x63\xb9\xde\xca\x3c\xcf\xfc\x5d\xa1\xea\xa8\x89\xac\x46\x22\xf8\x91\x88\xdc\x0d\x11\xc6\x0c\x2f\x0a\x37\xa8\x55\x01\x24\xcf\xa8\x62\xbe\xd4\x02\x2a\x5f\x51\xa5\x04\xe3\x06\xbf\xa6\x4d\xf7\x37\x7b\x61\xa2\x38\xc5\x8f\x38\x41\xc3\xdb\xb3\x5d\xba\x89\xe2\x79\x82\xd7\x38\x4e\x9b\xb4\x9d\xa0\x4e\x1f\xd2\xe6\xf7\xb0\x8c\x40\x88\xd2\x68\x8d\xb7\xe9\x6c\xfd\xd4\x47\xa0\x05\x5e\xce\x76\xab\x14\xcd\x77\x49\x82\xe3\x34\xeb\x43\x1a\x5b\x1e\x84\xd6\x7f\xdf\xbd\xf0\xde\x30\xbd\xe5\xbf\xbe\xd1\x9f\xf0\xed\x86\x4d\x43\xba\x3d\x70\x11\x39\xd9\xd4\x85\x91\x63\xad\xfc\xc5\xb9\x5d\x67\xff\xb4\x55\x64\xab\xb8\xe7\x5b\x0d\x72\xba\x7e\xd6\x08\xb1\x66\x42\x5e\xd7\x46\x3f\xf5\x02\x08\xb8\x3e\xde\xa9\x79\xb7\x9a\x4b\x26\xe4\xfe\xb6\x0e\x06\x43\x28\xd7\xc4\x70\x09\xfd\x95\x46\x23\x00\x7e\xd4\x50\xd8\xcf\xf7\x6f\x7c\xab\x63\x72\x52\x40\xc6\x8d\x51\xc6\xba\x6a\x4a\xf9\x4f\xfe\xf9\x0f\xef\x5d\xdb\x3a\xa7\xb9\xda\x45\x74\x5d\x17\xf8\x07\x97\xed\x2c\x74\xff\x71\xc1\xf8\x51\x2b\xe0\x92\x56\xd9\x3b\xaf\x46\x97\x8a\x26\x55\xae\x08\x73\xad\x0d\x4f\x93\xc6\x15\x6b\x57\x85\x04\x1b\x76\xce\xd8\x6e\xc9\x5e\xc9\x5d\x82\x77\xb6\xb5\x98\xd3\x9e\x4a\x7b\xc6\x61\x53\x84\x8f\x8c\xab\xec\xf3\xee\xbf\xae\x70\x42\x61\x60\x59\x7b\x34\xd0\x76\x73\xfb\x39\x59\x0d\xb0\x69\xd6\x27\x4c\xbc\xbd\xb5\x1d\xec\x1b\xd7\xc0\x5f\xee\x5a\x4d\xb4\xa3\x19\xc5\x0b\xfc\x3c\xa0\x99\x9d\x2a\xd8\xc4\x36\xf9\x53\x69\xf7\x68\x50\xd1\xe4\x21\xf8\x33\x00\xf4\xcd\xf0\xce\x4e\x0a\x00\x00"),
 		},
 	}
 	fs["/"].(*vfsgen۰DirInfo).entries = []os.FileInfo{
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Limits of the load generated on demand, so that demos cannot take
+// down the server.
+const (
+	maxCPUBurnMillis     = 10000
+	maxCPUBurnGoroutines = 64
+	maxAllocMB           = 1024
+)
+
+// addDemoHandlers adds the handlers toggling the demo modes of settings
+// and the goroutine leak, generating load, simulating database
+// contention, activating chaos scenarios and scheduling error bursts on
+// demand, to r, which must be protected by adminAuth.
+func addDemoHandlers(r tracedGroup, settings *runtimeSettings, leak *goroutineLeak, contention *contentionSimulator, scenarios *scenarioController, bursts *errorBurstScheduler, db *sqlx.DB) {
+	r.GET("/demo/n-plus-one", handleGetNPlusOne(settings)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/n-plus-one", handleSetNPlusOne(settings, db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/demo/leak", handleGetGoroutineLeak(leak)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/leak", handleSetGoroutineLeak(leak, db)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/leak/stop", handleStopGoroutineLeak(leak, db)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/cpu", handleCPUBurn).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/alloc", handleAlloc).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/demo/contention", handleGetContention(contention)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/contention", handleStartContention(contention, db)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/contention/stop", handleStopContention(contention, db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/demo/scenario", handleGetScenario(scenarios)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/scenario/:name", handleActivateScenario(scenarios, db)).CaptureBody(apm.CaptureBodyOff)
+	r.GET("/demo/error-burst", handleGetErrorBursts(bursts)).CaptureBody(apm.CaptureBodyOff)
+	r.POST("/demo/error-burst", handleScheduleErrorBurst(bursts, db)).CaptureBody(apm.CaptureBodyOff)
+}
+
+// demoToggleRequest is the body of requests toggling a demo mode.
+type demoToggleRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// demoToggleStatus is the body of demo mode responses.
+type demoToggleStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleGetNPlusOne reports whether the N+1 demo mode is enabled.
+func handleGetNPlusOne(settings *runtimeSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, demoToggleStatus{Enabled: settings.nPlusOne()})
+	}
+}
+
+// handleSetNPlusOne enables or disables the N+1 demo mode, as given by
+// the request body, so that the inefficient queries can be shown in
+// traces without restarting. The change is recorded in the audit log.
+func handleSetNPlusOne(settings *runtimeSettings, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req demoToggleRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		settings.setNPlusOne(*req.Enabled)
+		action := auditActionDisableNPlusOne
+		if *req.Enabled {
+			action = auditActionEnableNPlusOne
+		}
+		auditAdminAction(c, db, action)
+		renderJSON(c, http.StatusOK, demoToggleStatus{Enabled: settings.nPlusOne()})
+	}
+}
+
+// demoLoadStatus is the body of load generation responses.
+type demoLoadStatus struct {
+	Millis     int     `json:"ms,omitempty"`
+	Goroutines int     `json:"goroutines,omitempty"`
+	MB         int     `json:"mb,omitempty"`
+	ElapsedMS  float64 `json:"elapsed_ms"`
+}
+
+// queryInt returns the integer query parameter name, or defaultValue if
+// it is absent, aborting with a validation error and reporting false if
+// it is not in the range [1,max].
+func queryInt(c *gin.Context, name string, defaultValue, max int) (int, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > max {
+		abortWithError(c, apperr.New(apperr.Validation, name+" must be between 1 and "+strconv.Itoa(max), name, value))
+		return 0, false
+	}
+	return n, true
+}
+
+// queryDuration returns the duration query parameter name, or
+// defaultValue if it is absent, aborting with a validation error and
+// reporting false if it is not positive and at most max.
+func queryDuration(c *gin.Context, name string, defaultValue, max time.Duration) (time.Duration, bool) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 || d > max {
+		abortWithError(c, apperr.New(apperr.Validation, name+" must be a positive duration of at most "+max.String(), name, value))
+		return 0, false
+	}
+	return d, true
+}
+
+// handleCPUBurn spins for "ms" milliseconds, 500 by default, on each of
+// "goroutines" goroutines, 1 by default, for demos of CPU profiles. The
+// transaction is labeled with the requested load. Requests cancelled by
+// the client stop spinning and are aborted.
+func handleCPUBurn(c *gin.Context) {
+	ms, ok := queryInt(c, "ms", 500, maxCPUBurnMillis)
+	if !ok {
+		return
+	}
+	goroutines, ok := queryInt(c, "goroutines", 1, maxCPUBurnGoroutines)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	tx := apm.TransactionFromContext(ctx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("demo.cpu_ms", ms)
+		tx.Context.SetLabel("demo.cpu_goroutines", goroutines)
+	})
+
+	start := time.Now()
+	deadline := start.Add(time.Duration(ms) * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			burnCPU(ctx, deadline)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		abortWithStatus(c, http.StatusServiceUnavailable)
+		return
+	}
+	renderJSON(c, http.StatusOK, demoLoadStatus{
+		Millis:     ms,
+		Goroutines: goroutines,
+		ElapsedMS:  elapsedMillis(start),
+	})
+}
+
+// burnCPU spins until deadline, or until ctx is cancelled.
+func burnCPU(ctx context.Context, deadline time.Time) {
+	// The loop's state is returned so that the work is not optimized
+	// away; the clock and ctx are checked periodically.
+	var x uint64 = 1
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		for i := 0; i < 10000; i++ {
+			x = x*6364136223846793005 + 1442695040888963407
+		}
+	}
+	atomic.StoreUint64(&cpuBurnSink, x)
+}
+
+var cpuBurnSink uint64
+
+// handleAlloc allocates "mb" mebibytes, 100 by default, writing to each
+// page so that it is backed by memory, then releases it to the garbage
+// collector, for demos of heap profiles and memory metrics. The
+// transaction is labeled with the requested size. Requests cancelled by
+// the client stop allocating and are aborted.
+func handleAlloc(c *gin.Context) {
+	mb, ok := queryInt(c, "mb", 100, maxAllocMB)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	tx := apm.TransactionFromContext(ctx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("demo.alloc_mb", mb)
+	})
+
+	const pageSize = 4096
+	start := time.Now()
+	chunks := make([][]byte, 0, mb)
+	for i := 0; i < mb && ctx.Err() == nil; i++ {
+		chunk := make([]byte, 1<<20)
+		for j := 0; j < len(chunk); j += pageSize {
+			chunk[j] = 1
+		}
+		chunks = append(chunks, chunk)
+	}
+	// The memory is released to the garbage collector on return.
+	if ctx.Err() != nil {
+		abortWithStatus(c, http.StatusServiceUnavailable)
+		return
+	}
+	renderJSON(c, http.StatusOK, demoLoadStatus{MB: mb, ElapsedMS: elapsedMillis(start)})
+}
+
+// elapsedMillis returns the time since start in milliseconds.
+func elapsedMillis(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestNPlusOneToggle(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	// All of the N+1 queries are recorded.
+	tracer.SetMaxSpans(10000)
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	demo := func() map[string]bool {
+		var body struct {
+			Demo map[string]bool `json:"demo"`
+		}
+		w := serveGet(r, "/api/about")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body.Demo
+	}
+	query, err := json.Marshal(map[string]string{"query": graphqlOrdersQuery, "operationName": "OrderDetails"})
+	require.NoError(t, err)
+
+	// queryOrders queries the orders with their lines and customers,
+	// returning the number of orders, the number of database queries and
+	// the transaction's labels.
+	queryOrders := func() (int, int, map[string]interface{}) {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		w := serveJSON(r, "POST", "/api/graphql", string(query))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var body struct {
+			Data struct {
+				Orders []struct{} `json:"orders"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		tracer.Flush(nil)
+		// Background workers may record transactions of their own.
+		payloads := recorder.Payloads()
+		var tx model.Transaction
+		for _, recorded := range payloads.Transactions {
+			if recorded.Name == "OrderDetails" {
+				tx = recorded
+			}
+		}
+		require.NotZero(t, tx.ID)
+		// New connections may be opened for concurrent queries.
+		var queries int
+		for _, span := range payloads.Spans {
+			if span.TransactionID == tx.ID && span.Type == "db" && span.Action == "query" {
+				queries++
+			}
+		}
+		return len(body.Data.Orders), queries, transactionLabels(tx)
+	}
+
+	// The mode is enabled by default, as the dataloader is disabled.
+	assert.Equal(t, map[string]bool{"n_plus_one": true}, demo())
+	orders, queries, labels := queryOrders()
+	require.NotZero(t, orders)
+	assert.Equal(t, 1+2*orders, queries)
+	assert.Equal(t, true, labels["demo_n_plus_one"])
+
+	w := serveAdmin(r, "POST", "/api/admin/demo/n-plus-one", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"enabled": false}`, w.Body.String())
+	assert.JSONEq(t, `{"enabled": false}`, serveAdmin(r, "GET", "/api/admin/demo/n-plus-one", "").Body.String())
+	assert.Equal(t, map[string]bool{"n_plus_one": false}, demo())
+
+	// Batched, the lines and customers of all orders take one query
+	// each, rather than one per order.
+	_, queries, labels = queryOrders()
+	assert.Equal(t, 3, queries)
+	assert.Equal(t, false, labels["demo_n_plus_one"])
+
+	require.Equal(t, http.StatusOK, serveAdmin(r, "POST", "/api/admin/demo/n-plus-one", `{"enabled": true}`).Code)
+	_, queries, labels = queryOrders()
+	assert.Equal(t, 1+2*orders, queries)
+	assert.Equal(t, true, labels["demo_n_plus_one"])
+
+	// The changes are audited, and the body is required.
+	var audit auditLogResponse
+	require.NoError(t, json.Unmarshal(serveAdmin(r, "GET", "/api/admin/audit", "").Body.Bytes(), &audit))
+	var actions []string
+	for _, entry := range audit.Entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(t, actions, auditActionEnableNPlusOne)
+	assert.Contains(t, actions, auditActionDisableNPlusOne)
+	assert.Equal(t, http.StatusBadRequest, serveAdmin(r, "POST", "/api/admin/demo/n-plus-one", `{}`).Code)
+}
+
+func newTestDemoRouter(tracer *apm.Tracer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	addDemoHandlers(make(routeOptionsMap).group(r.Group("/api/admin")), nil, nil, nil, nil, nil, nil)
+	return r
+}
+
+func TestDemoLoad(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestDemoRouter(tracer)
+
+	// The CPU is burned for the requested duration, within the
+	// tolerance of scheduling.
+	w := serveJSON(r, "POST", "/api/admin/demo/cpu?ms=200&goroutines=2", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status demoLoadStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, 200, status.Millis)
+	assert.Equal(t, 2, status.Goroutines)
+	assert.InDelta(t, 200, status.ElapsedMS, 100)
+	assert.True(t, status.ElapsedMS >= 200, status.ElapsedMS)
+
+	w = serveJSON(r, "POST", "/api/admin/demo/alloc?mb=8", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	status = demoLoadStatus{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, 8, status.MB)
+
+	// The transactions are labeled with the requested intensity.
+	tracer.Flush(nil)
+	labels := make(map[string]map[string]interface{})
+	for _, tx := range recorder.Payloads().Transactions {
+		labels[tx.Name] = transactionLabels(tx)
+	}
+	assert.Equal(t, 200.0, labels["POST /api/admin/demo/cpu"]["demo_cpu_ms"])
+	assert.Equal(t, 2.0, labels["POST /api/admin/demo/cpu"]["demo_cpu_goroutines"])
+	assert.Equal(t, 8.0, labels["POST /api/admin/demo/alloc"]["demo_alloc_mb"])
+}
+
+func TestDemoLoadLimits(t *testing.T) {
+	r := newTestDemoRouter(apm.DefaultTracer)
+	for _, path := range []string{
+		"/api/admin/demo/cpu?ms=0",
+		"/api/admin/demo/cpu?ms=10001",
+		"/api/admin/demo/cpu?ms=soon",
+		"/api/admin/demo/cpu?ms=1&goroutines=0",
+		"/api/admin/demo/cpu?ms=1&goroutines=65",
+		"/api/admin/demo/alloc?mb=0",
+		"/api/admin/demo/alloc?mb=1025",
+	} {
+		w := serveJSON(r, "POST", path, "")
+		require.Equal(t, http.StatusBadRequest, w.Code, path)
+		assert.Equal(t, apperr.Validation, decodeErrorEnvelope(t, w.Body.Bytes()).Code, path)
+	}
+}
+
+func TestDemoLoadCancelled(t *testing.T) {
+	r := newTestDemoRouter(apm.DefaultTracer)
+	for _, path := range []string{"/api/admin/demo/cpu?ms=10000&goroutines=4", "/api/admin/demo/alloc?mb=1024"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("POST", path, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		r.ServeHTTP(w, req)
+		assert.True(t, time.Since(start) < time.Second, path)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+	}
+
+	// Requests cancelled while spinning stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest("POST", "/api/admin/demo/cpu?ms=10000", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, req)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
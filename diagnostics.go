@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/pprof"
+	"github.com/gin-gonic/gin"
+)
+
+// pprofPathPrefix is the path prefix of the pprof handlers.
+const pprofPathPrefix = "/debug/pprof"
+
+// recentGCPauses is the number of recent GC pauses reported by the
+// runtime status.
+const recentGCPauses = 10
+
+// processStartTime approximates the time at which the process started,
+// for reporting its uptime.
+var processStartTime = time.Now()
+
+// addPprofHandlers adds the net/http/pprof handlers to r, under
+// pprofPathPrefix. r must be protected by adminAuth, as profiles expose
+// the server's internals.
+func addPprofHandlers(r gin.IRouter) {
+	pprof.Register(r, pprofPathPrefix)
+}
+
+// isPprofRequest reports whether req is for a pprof handler. Profiling
+// requests are not traced: they run for as long as the profile is
+// collected, and would distort the service's latency.
+func isPprofRequest(req *http.Request) bool {
+	return req.URL.Path == pprofPathPrefix || strings.HasPrefix(req.URL.Path, pprofPathPrefix+"/")
+}
+
+// runtimeStatus describes the state of the Go runtime.
+type runtimeStatus struct {
+	Goroutines    int           `json:"goroutines"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Heap          runtimeHeap   `json:"heap"`
+	GC            runtimeGCInfo `json:"gc"`
+}
+
+type runtimeHeap struct {
+	AllocBytes    uint64 `json:"alloc_bytes"`
+	SysBytes      uint64 `json:"sys_bytes"`
+	IdleBytes     uint64 `json:"idle_bytes"`
+	InuseBytes    uint64 `json:"inuse_bytes"`
+	ReleasedBytes uint64 `json:"released_bytes"`
+	Objects       uint64 `json:"objects"`
+}
+
+type runtimeGCInfo struct {
+	Count             uint32     `json:"count"`
+	NextHeapBytes     uint64     `json:"next_heap_bytes"`
+	PauseTotalSeconds float64    `json:"pause_total_seconds"`
+	LastAt            *time.Time `json:"last_at,omitempty"`
+
+	// RecentPausesSeconds holds the most recent pauses, most recent
+	// first.
+	RecentPausesSeconds []float64 `json:"recent_pauses_seconds"`
+}
+
+// handleRuntimeStatus reports the goroutine count, heap and GC
+// statistics, and uptime of the process.
+func handleRuntimeStatus(c *gin.Context) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	status := runtimeStatus{
+		Goroutines:    runtime.NumGoroutine(),
+		UptimeSeconds: time.Since(processStartTime).Seconds(),
+		Heap: runtimeHeap{
+			AllocBytes:    stats.HeapAlloc,
+			SysBytes:      stats.HeapSys,
+			IdleBytes:     stats.HeapIdle,
+			InuseBytes:    stats.HeapInuse,
+			ReleasedBytes: stats.HeapReleased,
+			Objects:       stats.HeapObjects,
+		},
+		GC: runtimeGCInfo{
+			Count:               stats.NumGC,
+			NextHeapBytes:       stats.NextGC,
+			PauseTotalSeconds:   time.Duration(stats.PauseTotalNs).Seconds(),
+			RecentPausesSeconds: recentPauses(&stats, recentGCPauses),
+		},
+	}
+	if stats.LastGC != 0 {
+		lastAt := time.Unix(0, int64(stats.LastGC)).UTC()
+		status.GC.LastAt = &lastAt
+	}
+	renderJSON(c, http.StatusOK, status)
+}
+
+// recentPauses returns up to n of the most recent GC pauses recorded in
+// stats, most recent first.
+func recentPauses(stats *runtime.MemStats, n int) []float64 {
+	if uint32(n) > stats.NumGC {
+		n = int(stats.NumGC)
+	}
+	if n > len(stats.PauseNs) {
+		n = len(stats.PauseNs)
+	}
+	pauses := make([]float64, n)
+	for i := range pauses {
+		// PauseNs is a circular buffer, holding the most recent
+		// pause at (NumGC+255)%256.
+		j := (int(stats.NumGC) - 1 - i + len(stats.PauseNs)) % len(stats.PauseNs)
+		pauses[i] = time.Duration(stats.PauseNs[j]).Seconds()
+	}
+	return pauses
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestPprofDisabled(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ENABLE_PPROF", "true")
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, path)
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth("admin", "secret")
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	// Profiling requests are not traced.
+	tracer.Flush(nil)
+	for _, tx := range recorder.Payloads().Transactions {
+		assert.NotContains(t, tx.Name, "pprof")
+	}
+}
+
+func TestRuntimeStatus(t *testing.T) {
+	r := newTestAuditRouter(apm.DefaultTracer, newTestDB(t))
+	runtime.GC()
+
+	w := serveAdmin(r, "GET", "/api/admin/runtime", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status runtimeStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.NotZero(t, status.Goroutines)
+	assert.NotZero(t, status.UptimeSeconds)
+	assert.NotZero(t, status.Heap.AllocBytes)
+	assert.NotZero(t, status.Heap.Objects)
+	assert.NotZero(t, status.GC.Count)
+	assert.NotEmpty(t, status.GC.RecentPausesSeconds)
+	require.NotNil(t, status.GC.LastAt)
+	assert.WithinDuration(t, time.Now(), *status.GC.LastAt, time.Minute)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/admin/runtime", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRecentPauses(t *testing.T) {
+	var stats runtime.MemStats
+	assert.Empty(t, recentPauses(&stats, 10))
+
+	stats.NumGC = 3
+	stats.PauseNs[0], stats.PauseNs[1], stats.PauseNs[2] = 1000, 2000, 3000
+	assert.Equal(t, []float64{3e-6, 2e-6, 1e-6}, recentPauses(&stats, 10))
+	assert.Equal(t, []float64{3e-6}, recentPauses(&stats, 1))
+
+	// The pauses wrap around the buffer.
+	stats.NumGC = uint32(len(stats.PauseNs)) + 1
+	stats.PauseNs[len(stats.PauseNs)-1] = 4000
+	stats.PauseNs[0] = 5000
+	assert.Equal(t, []float64{5e-6, 4e-6}, recentPauses(&stats, 2))
+}
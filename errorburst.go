@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Limits of the error bursts scheduled on demand.
+const (
+	maxErrorBurstStartIn  = 24 * time.Hour
+	maxErrorBurstDuration = time.Hour
+	maxErrorBursts        = 100
+
+	// errorBurstInterval is the interval at which the error rate is
+	// updated for the bursts starting and ending.
+	errorBurstInterval = time.Second
+)
+
+// errorBurst is a window in which requests are failed at a raised rate.
+type errorBurst struct {
+	start, end time.Time
+	rate       float64
+}
+
+// errorBurstScheduler raises the error rate of settings during the
+// windows of scheduled bursts, for timing demos of alert rules. Bursts
+// are held in memory until they end. While bursts overlap, the highest
+// of their rates applies; once none is active, the rate otherwise in
+// effect is restored.
+type errorBurstScheduler struct {
+	settings *runtimeSettings
+	now      func() time.Time
+
+	mu     sync.Mutex
+	bursts []errorBurst
+}
+
+func newErrorBurstScheduler(settings *runtimeSettings) *errorBurstScheduler {
+	return &errorBurstScheduler{settings: settings, now: time.Now}
+}
+
+// schedule schedules a burst failing requests at rate for d, starting in
+// startIn, and updates the error rate.
+func (s *errorBurstScheduler) schedule(startIn, d time.Duration, rate float64) (errorBurstStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.bursts) >= maxErrorBursts {
+		return errorBurstStatus{}, apperr.New(apperr.Conflict, "too many error bursts are scheduled")
+	}
+	start := s.now().Add(startIn)
+	b := errorBurst{start: start, end: start.Add(d), rate: rate}
+	s.bursts = append(s.bursts, b)
+	sort.Slice(s.bursts, func(i, j int) bool { return s.bursts[i].start.Before(s.bursts[j].start) })
+	s.updateLocked()
+	logrus.WithFields(logrus.Fields{
+		"start": b.start,
+		"end":   b.end,
+		"rate":  rate,
+	}).Info("scheduled error burst")
+	return b.status(), nil
+}
+
+// update sets the error rate for the bursts active now, forgetting those
+// which have ended.
+func (s *errorBurstScheduler) update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateLocked()
+}
+
+func (s *errorBurstScheduler) updateLocked() {
+	now := s.now()
+	var rate float64
+	pending := s.bursts[:0]
+	for _, b := range s.bursts {
+		if !now.Before(b.end) {
+			continue
+		}
+		pending = append(pending, b)
+		if !now.Before(b.start) {
+			rate = math.Max(rate, b.rate)
+		}
+	}
+	s.bursts = pending
+	if rate != s.settings.errorBurstRate() {
+		logrus.WithField("rate", rate).Info("error burst rate changed")
+		s.settings.setErrorBurstRate(rate)
+	}
+}
+
+// run updates the error rate every interval until ctx is cancelled.
+func (s *errorBurstScheduler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.update()
+		}
+	}
+}
+
+// errorBurstStatus describes a scheduled error burst.
+type errorBurstStatus struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Rate  float64   `json:"rate"`
+}
+
+func (b errorBurst) status() errorBurstStatus {
+	return errorBurstStatus{Start: b.start.UTC(), End: b.end.UTC(), Rate: b.rate}
+}
+
+// errorBurstsStatus is the body of error burst responses.
+type errorBurstsStatus struct {
+	// Rate is the rate raised by the active bursts, if any.
+	Rate   float64            `json:"rate"`
+	Bursts []errorBurstStatus `json:"bursts"`
+}
+
+func (s *errorBurstScheduler) status() errorBurstsStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := errorBurstsStatus{Rate: s.settings.errorBurstRate(), Bursts: make([]errorBurstStatus, len(s.bursts))}
+	for i, b := range s.bursts {
+		status.Bursts[i] = b.status()
+	}
+	return status
+}
+
+// errorBurstRequest is the body of requests scheduling an error burst.
+type errorBurstRequest struct {
+	StartIn  string   `json:"start_in"`
+	Duration string   `json:"duration" binding:"required"`
+	Rate     *float64 `json:"rate" binding:"required"`
+}
+
+// handleGetErrorBursts reports the pending error bursts, and the rate
+// raised by those active.
+func handleGetErrorBursts(s *errorBurstScheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, s.status())
+	}
+}
+
+// handleScheduleErrorBurst schedules an error burst failing requests at
+// "rate" for "duration", starting in "start_in", immediately if absent,
+// recording it in the audit log.
+func handleScheduleErrorBurst(s *errorBurstScheduler, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req errorBurstRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		var startIn time.Duration
+		if req.StartIn != "" {
+			var err error
+			if startIn, err = time.ParseDuration(req.StartIn); err != nil || startIn < 0 || startIn > maxErrorBurstStartIn {
+				abortWithError(c, apperr.New(apperr.Validation, "start_in must be a non-negative duration of at most "+maxErrorBurstStartIn.String(), "start_in", req.StartIn))
+				return
+			}
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxErrorBurstDuration {
+			abortWithError(c, apperr.New(apperr.Validation, "duration must be a positive duration of at most "+maxErrorBurstDuration.String(), "duration", req.Duration))
+			return
+		}
+		if rate := *req.Rate; !(rate > 0 && rate <= 1) {
+			value := strconv.FormatFloat(rate, 'g', -1, 64)
+			abortWithError(c, apperr.New(apperr.Validation, "rate must be in the range (0,1]", "rate", value))
+			return
+		}
+		burst, err := s.schedule(startIn, d, *req.Rate)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAdminAction(c, db, auditActionScheduleErrorBurst)
+		renderJSON(c, http.StatusOK, burst)
+	}
+}
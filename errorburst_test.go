@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestErrorBurstScheduler(t *testing.T) {
+	cfg := &config.Config{ErrorInjection: config.ErrorInjection{Rate: 0.05}}
+	settings := newRuntimeSettings(cfg)
+	s := newErrorBurstScheduler(settings)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	start := now
+	s.now = func() time.Time { return now }
+	at := func(offset time.Duration) float64 {
+		now = start.Add(offset)
+		s.update()
+		return settings.errorRate()
+	}
+
+	// A burst from 2m to 2m30s, and overlapping bursts from 3m to 4m
+	// and 3m30s to 5m, at a lower rate and then a higher one.
+	burst, err := s.schedule(2*time.Minute, 30*time.Second, 0.8)
+	require.NoError(t, err)
+	assert.Equal(t, errorBurstStatus{Start: start.Add(2 * time.Minute), End: start.Add(150 * time.Second), Rate: 0.8}, burst)
+	_, err = s.schedule(3*time.Minute+30*time.Second, 90*time.Second, 0.9)
+	require.NoError(t, err)
+	_, err = s.schedule(3*time.Minute, time.Minute, 0.4)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0.05, at(0))
+	assert.Equal(t, 0.05, at(2*time.Minute-time.Nanosecond))
+	assert.Equal(t, 0.8, at(2*time.Minute))
+	assert.Equal(t, 0.8, at(150*time.Second-time.Nanosecond))
+	assert.Equal(t, 0.05, at(150*time.Second))
+	assert.Equal(t, 0.4, at(3*time.Minute))
+	assert.Equal(t, 0.9, at(3*time.Minute+30*time.Second))
+	assert.Equal(t, 0.9, at(4*time.Minute))
+	assert.Len(t, s.status().Bursts, 1)
+
+	// The rate in effect when the bursts end is restored, though it was
+	// reloaded meanwhile.
+	cfg.ErrorInjection.Rate = 0.1
+	settings.set(cfg)
+	assert.Equal(t, 0.9, at(5*time.Minute-time.Nanosecond))
+	assert.Equal(t, 0.1, at(5*time.Minute))
+	assert.Equal(t, errorBurstsStatus{Bursts: []errorBurstStatus{}}, s.status())
+
+	// Bursts starting now are effective immediately.
+	_, err = s.schedule(0, time.Second, 0.5)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, settings.errorRate())
+}
+
+func TestErrorBurstHandlers(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	r, _, cleanup, err := startup(apm.DefaultTracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := serveAdmin(r, "POST", "/api/admin/demo/error-burst", `{"start_in": "2m", "duration": "30s", "rate": 0.8}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var burst errorBurstStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &burst))
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), burst.Start, 10*time.Second)
+	assert.Equal(t, 30*time.Second, burst.End.Sub(burst.Start))
+	assert.Equal(t, 0.8, burst.Rate)
+
+	w = serveAdmin(r, "GET", "/api/admin/demo/error-burst", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status errorBurstsStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Zero(t, status.Rate)
+	assert.Equal(t, []errorBurstStatus{burst}, status.Bursts)
+
+	for _, body := range []string{
+		`{"duration": "30s"}`,
+		`{"rate": 0.5}`,
+		`{"start_in": "-1m", "duration": "30s", "rate": 0.5}`,
+		`{"start_in": "25h", "duration": "30s", "rate": 0.5}`,
+		`{"start_in": "soon", "duration": "30s", "rate": 0.5}`,
+		`{"duration": "0s", "rate": 0.5}`,
+		`{"duration": "2h", "rate": 0.5}`,
+		`{"duration": "30s", "rate": 0}`,
+		`{"duration": "30s", "rate": 1.5}`,
+	} {
+		w := serveAdmin(r, "POST", "/api/admin/demo/error-burst", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/validate"
+)
+
+// abortWithError records err in c and aborts the request. The response
+// status is determined by errorMiddleware, from the kind of err.
+func abortWithError(c *gin.Context, err error) {
+	c.Error(err)
+	c.Abort()
+}
+
+// abortWithStatus aborts the request, responding with status and the
+// JSON error envelope.
+func abortWithStatus(c *gin.Context, status int) {
+	c.AbortWithStatusJSON(status, errorEnvelope(c, status))
+}
+
+// errorResponse is the JSON error envelope, the body of every error
+// response.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// errorBody describes the error of an error response.
+type errorBody struct {
+	// Code is the kind of the error.
+	Code apperr.Kind `json:"code"`
+
+	// Message describes the error. Errors are described by their status
+	// text, other than client errors given a message by apperr.New or
+	// apperr.WrapMessage, so that internal details are not exposed.
+	Message string `json:"message"`
+
+	// TraceID is the trace ID of the request, if it is traced.
+	TraceID string `json:"trace_id,omitempty"`
+
+	// Reason refines Code for errors which clients may handle
+	// specifically, such as expired tokens.
+	Reason string `json:"reason,omitempty"`
+
+	// Errors holds the field errors of invalid requests.
+	Errors validate.Errors `json:"errors,omitempty"`
+}
+
+// errorEnvelope returns the JSON error envelope for responses with the
+// given status, holding the kind corresponding to the status, the status
+// text and, if the request is being traced, the trace ID.
+func errorEnvelope(c *gin.Context, status int) *errorResponse {
+	body := &errorResponse{Error: errorBody{
+		Code:    apperr.KindForStatus(status),
+		Message: http.StatusText(status),
+	}}
+	tx := apm.TransactionFromContext(c.Request.Context())
+	if traceContext := tx.TraceContext(); traceContext.Trace.Validate() == nil {
+		body.Error.TraceID = traceContext.Trace.String()
+	}
+	return body
+}
+
+// errorMiddleware returns a middleware which reports errors recorded in
+// the gin context to tracer, logs them, and responds with the JSON error
+// envelope and a status code determined by the kind of the first error.
+// The envelope's code is that kind and, for client errors given a
+// message by apperr.New or apperr.WrapMessage, its message is that
+// message; otherwise it is the status text, so that the messages of
+// wrapped errors are only reported and logged.
+//
+// For apperr errors, the reported error's culprit is set to the function
+// which created the error, its kind is recorded as the "kind" tag, and its
+// fields are recorded as custom context, keeping their types. Other errors
+// map to 500 (Internal Server Error).
+//
+// Errors caused by errors with a Reason method, such as
+// payment.DeclinedError, set the envelope's reason, if first. Errors
+// caused by errors with a Synthetic method reporting true, such as
+// injected stock shortages, are labeled synthetic=true.
+//
+// Errors caused by validate.Errors are recorded with the field errors
+// in the "validation_errors" custom context, and respond with 422
+// (Unprocessable Entity), unless wrapped by an apperr error of another
+// kind. If the first error is such an error, the field errors are
+// included in the envelope as "errors".
+//
+// The middleware must be installed after tracingMiddleware, so that errors
+// are linked to the request's transaction. Errors are removed from the
+// context once reported.
+func errorMiddleware(tracer *apm.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if len(c.Errors) == 0 {
+			return
+		}
+
+		kind := apperr.Internal
+		var message, reason string
+		var fieldErrs validate.Errors
+		tx := apm.TransactionFromContext(c.Request.Context())
+		for i, ginErr := range c.Errors {
+			e := tracer.NewError(ginErr.Err)
+			e.Handled = true
+			if tx != nil {
+				e.SetTransaction(tx)
+			}
+			e.Context.SetHTTPRequest(contextRequest(c))
+			setContextUser(&e.Context, c)
+			appErr, ok := apperr.As(ginErr.Err)
+			if ok {
+				e.Culprit = appErr.Culprit
+				e.Context.SetTag("kind", string(appErr.Kind))
+				for _, field := range appErr.Fields {
+					e.Context.SetCustom(field.Key, field.Value)
+				}
+			}
+			if s, ok := errors.Cause(ginErr.Err).(interface{ Synthetic() bool }); ok && s.Synthetic() {
+				e.Context.SetLabel("synthetic", true)
+			}
+			errs, isFieldErrs := errors.Cause(ginErr.Err).(validate.Errors)
+			if isFieldErrs {
+				e.Context.SetCustom("validation_errors", errs)
+			}
+			if i == 0 {
+				switch {
+				case ok:
+					kind = appErr.Kind
+					message = appErr.Message
+				case isFieldErrs:
+					kind = apperr.Invalid
+				}
+				fieldErrs = errs
+				if r, ok := errors.Cause(ginErr.Err).(interface{ Reason() string }); ok {
+					reason = r.Reason()
+				}
+			}
+			e.Send()
+			contextLogger(c).WithError(ginErr.Err).Warn("request failed")
+		}
+		c.Errors = c.Errors[:0]
+
+		if c.Writer.Written() {
+			return
+		}
+		status := kind.HTTPStatus()
+		body := errorEnvelope(c, status)
+		body.Error.Code = kind
+		if message != "" && status < http.StatusInternalServerError {
+			body.Error.Message = message
+		}
+		body.Error.Reason = reason
+		body.Error.Errors = fieldErrs
+		c.AbortWithStatusJSON(status, body)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/validate"
+)
+
+func TestErrorMiddleware(t *testing.T) {
+	for _, kind := range []apperr.Kind{
+		apperr.Validation,
+		apperr.NotFound,
+		apperr.Conflict,
+		apperr.DB,
+		apperr.Upstream,
+	} {
+		t.Run(string(kind), func(t *testing.T) {
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(tracingMiddleware(tracer, tracingOptions{}))
+			r.Use(errorMiddleware(tracer))
+			r.GET("/", func(c *gin.Context) {
+				abortWithError(c, apperr.New(kind, "boom", "product_id", 1))
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			tracer.Flush(nil)
+			assert.Equal(t, kind.HTTPStatus(), w.Code)
+
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Errors, 1)
+			e := payloads.Errors[0]
+			assert.Equal(t, "TestErrorMiddleware.func1.1", e.Culprit)
+			assert.Equal(t, model.IfaceMap{{Key: "kind", Value: string(kind)}}, e.Context.Tags)
+			assert.Equal(t, model.IfaceMap{{Key: "product_id", Value: float64(1)}}, e.Context.Custom)
+		})
+	}
+}
+
+func TestErrorMiddlewarePlainError(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	r.GET("/", func(c *gin.Context) {
+		abortWithError(c, assert.AnError)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Len(t, recorder.Payloads().Errors, 1)
+}
+
+func TestErrorMiddlewareFieldErrors(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	fieldErrs := validate.Errors{
+		{Field: "email", Code: "format", Message: "email must be a valid email address"},
+		{Field: "city", Code: "required", Message: "city is required"},
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	r.GET("/", func(c *gin.Context) {
+		abortWithError(c, apperr.Wrap(fieldErrs, apperr.Invalid))
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.Invalid, body.Code)
+	assert.Equal(t, "Unprocessable Entity", body.Message)
+	assert.Equal(t, fieldErrs, body.Errors)
+
+	// The failure is reported as one handled error, with the field
+	// errors in custom context.
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Errors, 1)
+	e := payloads.Errors[0]
+	assert.True(t, e.Exception.Handled)
+	assert.Equal(t, model.IfaceMap{{Key: "kind", Value: "invalid"}}, e.Context.Tags)
+	assert.Equal(t, model.IfaceMap{{
+		Key: "validation_errors",
+		Value: []interface{}{
+			map[string]interface{}{"field": "email", "code": "format", "message": "email must be a valid email address"},
+			map[string]interface{}{"field": "city", "code": "required", "message": "city is required"},
+		},
+	}}, e.Context.Custom)
+}
+
+// decodeErrorEnvelope decodes the error of a JSON error envelope.
+func decodeErrorEnvelope(t *testing.T, body []byte) errorBody {
+	var envelope errorResponse
+	require.NoError(t, json.Unmarshal(body, &envelope), string(body))
+	return envelope.Error
+}
+
+// TestErrorEnvelopeGolden pins the shape of the error envelope for each
+// class of error response served by the router. Trace IDs vary, so they
+// are checked and then replaced.
+func TestErrorEnvelopeGolden(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer func() { cleanup() }()
+
+	plain := gin.New()
+	plain.Use(tracingMiddleware(tracer, tracingOptions{}))
+	plain.Use(errorMiddleware(tracer))
+	plain.GET("/", func(c *gin.Context) {
+		abortWithError(c, errors.New("connection refused by 10.0.0.1"))
+	})
+
+	for _, test := range []struct {
+		name   string
+		serve  func() *httptest.ResponseRecorder
+		status int
+		golden string
+	}{{
+		name:   "bad_request",
+		serve:  func() *httptest.ResponseRecorder { return serveJSON(r, "POST", "/api/orders", "{") },
+		status: http.StatusBadRequest,
+		golden: `{"error": {"code": "validation", "message": "Bad Request", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name:   "unauthenticated",
+		serve:  func() *httptest.ResponseRecorder { return serveGet(r, "/api/admin/maintenance") },
+		status: http.StatusUnauthorized,
+		golden: `{"error": {"code": "unauthenticated", "message": "Unauthorized", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name:   "unknown_route",
+		serve:  func() *httptest.ResponseRecorder { return serveGet(r, "/api/nonexistent") },
+		status: http.StatusNotFound,
+		golden: `{"error": {"code": "not_found", "message": "Not Found", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name:   "unknown_entity",
+		serve:  func() *httptest.ResponseRecorder { return serveGet(r, "/api/orders/999999") },
+		status: http.StatusNotFound,
+		golden: `{"error": {"code": "not_found", "message": "Not Found", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name:   "method_not_allowed",
+		serve:  func() *httptest.ResponseRecorder { return serveJSON(r, "DELETE", "/api/products", "") },
+		status: http.StatusMethodNotAllowed,
+		golden: `{"error": {"code": "method_not_allowed", "message": "Method Not Allowed", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name:   "invalid",
+		serve:  func() *httptest.ResponseRecorder { return serveJSON(r, "POST", "/api/orders", `{"lines": []}`) },
+		status: http.StatusUnprocessableEntity,
+		golden: `{"error": {
+			"code": "invalid",
+			"message": "Unprocessable Entity",
+			"trace_id": "TRACE_ID",
+			"errors": [
+				{"field": "customer_id", "code": "required", "message": "customer_id is required"},
+				{"field": "lines", "code": "required", "message": "lines is required"}
+			]
+		}}`,
+	}, {
+		name:   "internal",
+		serve:  func() *httptest.ResponseRecorder { return serveGet(plain, "/") },
+		status: http.StatusInternalServerError,
+		golden: `{"error": {"code": "internal", "message": "Internal Server Error", "trace_id": "TRACE_ID"}}`,
+	}, {
+		name: "unavailable",
+		serve: func() *httptest.ResponseRecorder {
+			w := serveAdmin(r, "POST", "/api/admin/maintenance", `{"enabled": true}`)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			return serveGet(r, "/api/products")
+		},
+		status: http.StatusServiceUnavailable,
+		golden: `{"error": {"code": "unavailable", "message": "Service Unavailable", "reason": "maintenance", "trace_id": "TRACE_ID"}}`,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			w := test.serve()
+			assert.Equal(t, test.status, w.Code)
+			assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+			var body map[string]map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), w.Body.String())
+			if assert.Regexp(t, "^[0-9a-f]{32}$", body["error"]["trace_id"]) {
+				body["error"]["trace_id"] = "TRACE_ID"
+			}
+			data, err := json.Marshal(body)
+			require.NoError(t, err)
+			assert.JSONEq(t, test.golden, string(data))
+		})
+	}
+}
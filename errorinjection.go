@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// errorInjectionHeader overrides the injection of failures for a
+// request: "none" disables it, "random" injects a failure chosen as
+// for sampled requests, and the name of a failure injects it.
+const errorInjectionHeader = "X-Opbeans-Error"
+
+// injectedRetryAfter is the Retry-After of injected 503 responses.
+const injectedRetryAfter = 5 * time.Second
+
+// Injected failures.
+const (
+	// failurePanic panics, responding with 500.
+	failurePanic = "panic"
+
+	// failureError returns an internal error, responding with 500.
+	failureError = "error"
+
+	// failureBadGateway returns an upstream error, responding with 502.
+	failureBadGateway = "bad_gateway"
+
+	// failureUnavailable returns an unavailable error, responding with
+	// 503 and Retry-After.
+	failureUnavailable = "unavailable"
+)
+
+// injectedFailures holds the failures chosen for sampled requests, with
+// their relative weights.
+var injectedFailures = []struct {
+	name   string
+	weight int
+}{
+	{failurePanic, 1},
+	{failureError, 2},
+	{failureBadGateway, 1},
+	{failureUnavailable, 1},
+}
+
+// errorInjector fails a proportion of requests on purpose, for demos
+// of error rates.
+type errorInjector struct {
+	settings *runtimeSettings
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// newErrorInjector returns an errorInjector failing requests at the rate
+// held by settings, choosing them with a source seeded by seed, or by
+// the time if seed is zero.
+func newErrorInjector(settings *runtimeSettings, seed int64) *errorInjector {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &errorInjector{settings: settings, random: rand.New(rand.NewSource(seed))}
+}
+
+// middleware fails sampled requests, and those requesting a failure
+// with errorInjectionHeader, other than health checks and admin requests.
+// Failures are reported as errors with distinct culprits, and their
+// transactions labeled "error_injected".
+//
+// The middleware must be installed after recoveryMiddleware and
+// errorMiddleware, which report the failures.
+func (inj *errorInjector) middleware(c *gin.Context) {
+	if isHealthCheck(c.Request) || isAdminRequest(c.Request) {
+		c.Next()
+		return
+	}
+	var failure string
+	switch value := c.GetHeader(errorInjectionHeader); value {
+	case "":
+		failure = inj.sample()
+	case "none":
+	case "random":
+		failure = inj.choose()
+	case failurePanic, failureError, failureBadGateway, failureUnavailable:
+		failure = value
+	default:
+		abortWithError(c, apperr.New(apperr.Validation, "invalid "+errorInjectionHeader+" header "+strconv.Quote(value)))
+		return
+	}
+	if failure == "" {
+		c.Next()
+		return
+	}
+
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("error_injected", failure)
+	})
+	switch failure {
+	case failurePanic:
+		injectPanic()
+	case failureError:
+		abortWithError(c, injectInternalError())
+	case failureBadGateway:
+		abortWithError(c, injectBadGateway())
+	case failureUnavailable:
+		c.Header("Retry-After", strconv.Itoa(int(injectedRetryAfter/time.Second)))
+		abortWithError(c, injectUnavailable())
+	}
+}
+
+// sample returns a failure chosen by choose for the proportion of
+// requests given by the error rate, and otherwise "".
+func (inj *errorInjector) sample() string {
+	rate := inj.settings.errorRate()
+	if rate <= 0 {
+		return ""
+	}
+	inj.mu.Lock()
+	sampled := inj.random.Float64() < rate
+	inj.mu.Unlock()
+	if !sampled {
+		return ""
+	}
+	return inj.choose()
+}
+
+// choose returns one of injectedFailures, chosen by weight.
+func (inj *errorInjector) choose() string {
+	var total int
+	for _, f := range injectedFailures {
+		total += f.weight
+	}
+	inj.mu.Lock()
+	n := inj.random.Intn(total)
+	inj.mu.Unlock()
+	for _, f := range injectedFailures {
+		if n < f.weight {
+			return f.name
+		}
+		n -= f.weight
+	}
+	panic("unreachable")
+}
+
+// The failures are created by functions of their own, which are the
+// culprits of their errors. Panics are raised with an error recording
+// its stack trace, so that the culprit is not taken to be the function
+// recovering it.
+
+func injectPanic() {
+	panic(errors.New("injected panic"))
+}
+
+func injectInternalError() error {
+	return apperr.New(apperr.Internal, "injected internal error", "injected", failureError)
+}
+
+func injectBadGateway() error {
+	return apperr.New(apperr.Upstream, "injected bad gateway", "injected", failureBadGateway)
+}
+
+func injectUnavailable() error {
+	return apperr.New(apperr.Unavailable, "injected service unavailable", "injected", failureUnavailable)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+)
+
+// newTestErrorInjectionRouter returns a router traced by tracer, failing
+// requests at rate with a source seeded by seed.
+func newTestErrorInjectionRouter(tracer *apm.Tracer, rate float64, seed int64) *gin.Engine {
+	settings := newRuntimeSettings(&config.Config{ErrorInjection: config.ErrorInjection{Rate: rate}})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(recoveryMiddleware(tracer))
+	r.Use(errorMiddleware(tracer))
+	r.Use(newErrorInjector(settings, seed).middleware)
+	r.GET("/api/products", func(c *gin.Context) {
+		c.JSON(http.StatusOK, []Product{})
+	})
+	return r
+}
+
+// serveErrorInjectionRequests serves n requests with r, returning the
+// sequence of response statuses.
+func serveErrorInjectionRequests(t *testing.T, r http.Handler, n int) []int {
+	statuses := make([]int, n)
+	for i := range statuses {
+		w := serveGet(r, "/api/products")
+		statuses[i] = w.Code
+		if w.Code == http.StatusServiceUnavailable {
+			assert.Equal(t, "5", w.Header().Get("Retry-After"))
+			assert.Equal(t, apperr.Unavailable, decodeErrorEnvelope(t, w.Body.Bytes()).Code)
+		}
+	}
+	return statuses
+}
+
+func TestErrorInjection(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	const n, rate = 1000, 0.2
+	sequence := serveErrorInjectionRequests(t, newTestErrorInjectionRouter(tracer, rate, 42), n)
+
+	// About a fifth of the requests fail, with the failures chosen by
+	// weight.
+	statuses := make(map[int]int)
+	for _, status := range sequence {
+		statuses[status]++
+	}
+	injected := n - statuses[http.StatusOK]
+	assert.InDelta(t, n*rate, injected, n*rate*0.2, statuses)
+	assert.Len(t, statuses, 4, statuses)
+
+	// Each failure is reported with its culprit.
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Errors, injected)
+	culprits := make(map[string]int)
+	for _, e := range payloads.Errors {
+		culprits[e.Culprit]++
+	}
+	expected := map[string]float64{
+		"injectPanic":         0.2,
+		"injectInternalError": 0.4,
+		"injectBadGateway":    0.2,
+		"injectUnavailable":   0.2,
+	}
+	require.Len(t, culprits, len(expected), culprits)
+	for culprit, weight := range expected {
+		assert.InDelta(t, float64(injected)*weight, culprits[culprit], float64(injected)*weight*0.5, culprit)
+	}
+	assert.Equal(t, culprits["injectPanic"]+culprits["injectInternalError"], statuses[http.StatusInternalServerError])
+	assert.Equal(t, culprits["injectBadGateway"], statuses[http.StatusBadGateway])
+	assert.Equal(t, culprits["injectUnavailable"], statuses[http.StatusServiceUnavailable])
+	var labeled int
+	for _, tx := range payloads.Transactions {
+		if _, ok := transactionLabels(tx)["error_injected"]; ok {
+			labeled++
+		}
+	}
+	assert.Equal(t, injected, labeled)
+
+	// The same seed fails the same requests in the same way.
+	assert.Equal(t, sequence, serveErrorInjectionRequests(t, newTestErrorInjectionRouter(tracer, rate, 42), n))
+}
+
+func TestErrorInjectionHeader(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_ERROR_RATE", "1")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	serve := func(path, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(errorInjectionHeader, value)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for value, status := range map[string]int{
+		"panic":       http.StatusInternalServerError,
+		"error":       http.StatusInternalServerError,
+		"bad_gateway": http.StatusBadGateway,
+		"unavailable": http.StatusServiceUnavailable,
+		"none":        http.StatusOK,
+		"maybe":       http.StatusBadRequest,
+	} {
+		assert.Equal(t, status, serve("/api/products", value).Code, value)
+	}
+	assert.NotEqual(t, http.StatusOK, serve("/api/products", "random").Code)
+	assert.NotEqual(t, http.StatusOK, serveGet(r, "/api/products").Code)
+
+	// Health checks and admin requests are never failed.
+	assert.Equal(t, http.StatusOK, serve(livenessPath, "error").Code)
+	assert.Equal(t, http.StatusOK, serveAdmin(r, "GET", "/api/admin/maintenance", "").Code)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// dataVersionKey is the cache key of the data version token, from which
+// the ETags of API responses are derived.
+const dataVersionKey = "data-version"
+
+// contextCacheStore returns the cache store installed by the cache
+// middleware, or nil if the middleware is not installed.
+func contextCacheStore(c *gin.Context) persistence.CacheStore {
+	cacheValue, ok := c.Get(cache.CACHE_MIDDLEWARE_KEY)
+	if !ok {
+		return nil
+	}
+	return *cacheValue.(*persistence.CacheStore)
+}
+
+// dataVersion returns the data version token from store. The token is
+// kept in the cache so that it is shared by servers sharing the cache.
+func dataVersion(ctx context.Context, store persistence.CacheStore) (uint64, error) {
+	return cacheVersion(ctx, store, dataVersionKey)
+}
+
+// rotateDataVersion changes the data version token in store, so that
+// previously issued ETags no longer match. It must be called after each
+// mutation of the data. If store is nil, rotateDataVersion does nothing.
+func rotateDataVersion(ctx context.Context, store persistence.CacheStore) error {
+	return rotateCacheVersion(ctx, store, dataVersionKey)
+}
+
+// cacheVersion returns the version token cached under key in store. It
+// is initialized from the current time, so that versions issued before
+// the cache was emptied do not match.
+func cacheVersion(ctx context.Context, store persistence.CacheStore, key string) (uint64, error) {
+	var version uint64
+	err := cacheGet(ctx, store, key, &version)
+	if err != persistence.ErrCacheMiss {
+		return version, err
+	}
+	version = uint64(time.Now().UnixNano())
+	switch err := cacheAdd(ctx, store, key, version, persistence.FOREVER); err {
+	case nil:
+		return version, nil
+	case persistence.ErrNotStored:
+		// Initialized concurrently.
+		if err := cacheGet(ctx, store, key, &version); err != nil {
+			return 0, err
+		}
+		return version, nil
+	default:
+		return 0, err
+	}
+}
+
+// rotateCacheVersion changes the version token cached under key in
+// store. If store is nil, rotateCacheVersion does nothing.
+func rotateCacheVersion(ctx context.Context, store persistence.CacheStore, key string) error {
+	if store == nil {
+		return nil
+	}
+	_, err := cacheIncrement(ctx, store, key, 1)
+	if err == persistence.ErrCacheMiss {
+		// No versions have been issued since the cache was emptied.
+		return nil
+	}
+	return err
+}
+
+// checkNotModified sets the ETag of the response to c, derived from the
+// name of the resource, the data version and the response format. If
+// the request's If-None-Match header matches the ETag, the response
+// status is set to 304 (Not Modified), the transaction is labelled with
+// cache_not_modified, and checkNotModified returns true; the handler
+// must then not render a body.
+//
+// If the cache middleware is not installed, or the data version cannot
+// be read, no ETag is set and checkNotModified returns false.
+func checkNotModified(c *gin.Context, resource string) bool {
+	store := contextCacheStore(c)
+	if store == nil {
+		return false
+	}
+	version, err := dataVersion(c.Request.Context(), store)
+	if err != nil {
+		err := errors.Wrap(err, "failed to get data version")
+		contextLogger(c).WithError(err).Warn("not setting ETag")
+		return false
+	}
+	etag := fmt.Sprintf(`"%s-%x-%s"`, resource, version, strings.Replace(responseFormat(c), "/", "+", -1))
+	c.Header("ETag", etag)
+	c.Header("Vary", "Accept")
+	if !etagMatch(c.GetHeader("If-None-Match"), etag) {
+		return false
+	}
+	c.Status(http.StatusNotModified)
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("cache_not_modified", true)
+	})
+	return true
+}
+
+// etagMatch reports whether the If-None-Match header value ifNoneMatch
+// matches etag, using the weak comparison function.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, field := range strings.Split(ifNoneMatch, ",") {
+		field = strings.TrimSpace(field)
+		if field == "*" || strings.TrimPrefix(field, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
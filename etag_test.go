@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestConditionalGET(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestAPIRouter(tracer, newTestDB(t))
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{"/api/products", "/api/types", "/api/stats"} {
+		t.Run(path, func(t *testing.T) {
+			w := get(path, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			etag := w.Header().Get("ETag")
+			require.NotEmpty(t, etag)
+
+			// Mismatch.
+			w = get(path, `"something-else"`)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+			assert.NotEmpty(t, w.Body.String())
+
+			// Match, skipping the database queries and rendering.
+			tracer.Flush(nil)
+			recorder.ResetPayloads()
+			w = get(path, `"something-else", W/`+etag)
+			assert.Equal(t, http.StatusNotModified, w.Code)
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+			assert.Empty(t, w.Body.String())
+			tracer.Flush(nil)
+
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Transactions, 1)
+			tx := payloads.Transactions[0]
+			assert.Equal(t, "HTTP 3xx", tx.Result)
+			labels := make(map[string]interface{})
+			for _, item := range tx.Context.Tags {
+				labels[item.Key] = item.Value
+			}
+			assert.Equal(t, true, labels["cache_not_modified"])
+			for _, span := range payloads.Spans {
+				assert.NotEqual(t, "db", span.Type)
+				assert.NotEqual(t, "app.render", span.Type)
+			}
+		})
+	}
+}
+
+func TestConditionalGETFormat(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	etags := make(map[string]bool)
+	for _, accept := range []string{"application/json", jsonAPIMediaType, msgpackMediaType} {
+		req := httptest.NewRequest("GET", "/api/products", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		etags[w.Header().Get("ETag")] = true
+	}
+	assert.Len(t, etags, 3)
+}
+
+func TestConditionalGETMutation(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	etag := w.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(
+		`{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`,
+	))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "/api/stats", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.NotEmpty(t, w.Body.String())
+}
+
+func TestETagMatch(t *testing.T) {
+	assert.True(t, etagMatch(`"a"`, `"a"`))
+	assert.True(t, etagMatch(`W/"a"`, `"a"`))
+	assert.True(t, etagMatch(`"b", "a"`, `"a"`))
+	assert.True(t, etagMatch(`*`, `"a"`))
+	assert.False(t, etagMatch(``, `"a"`))
+	assert.False(t, etagMatch(`"b"`, `"a"`))
+}
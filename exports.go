@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const (
+	// exportCleanupInterval is the interval at which expired exports
+	// are removed.
+	exportCleanupInterval = time.Minute
+
+	ordersExportFilename = "orders.csv"
+)
+
+var errExportNotFound = errors.New("export not found")
+
+// writeOrdersCSV writes the orders and their lines to w as CSV, with a
+// header row and one row per order line.
+func writeOrdersCSV(ctx context.Context, db *sqlx.DB, w io.Writer) error {
+	orders, err := getOrders(ctx, db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get orders")
+	}
+	orderIDs := make([]int, len(orders))
+	for i, order := range orders {
+		orderIDs[i] = order.ID
+	}
+	lines, err := getOrderLines(ctx, db, orderIDs)
+	if err != nil {
+		return errors.Wrap(err, "failed to get order lines")
+	}
+
+	cw, release := newPooledCSVWriter(w)
+	defer release()
+	cw.Write([]string{
+		"order_id", "created_at", "customer_id", "customer_name",
+		"product_id", "sku", "product_name", "amount",
+	})
+	for _, order := range orders {
+		for _, line := range lines[order.ID] {
+			cw.Write([]string{
+				strconv.Itoa(order.ID),
+				order.CreatedAt.UTC().Format(time.RFC3339),
+				strconv.Itoa(order.CustomerID),
+				order.CustomerName,
+				strconv.Itoa(line.ID),
+				line.SKU,
+				line.Name,
+				strconv.Itoa(line.Amount),
+			})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleOrdersCSV returns a handler which streams the orders export
+// directly to the client.
+func handleOrdersCSV(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="`+ordersExportFilename+`"`)
+		if err := writeOrdersCSV(c.Request.Context(), db, c.Writer); err != nil {
+			abortWithError(c, apperr.Wrap(err, apperr.DB))
+		}
+	}
+}
+
+// export describes an export materialized to a file by an exportStore.
+type export struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	path string
+}
+
+// exportStore holds exports materialized to files in a temporary
+// directory, so that they can be downloaded with range requests and
+// resumed if interrupted. Exports are removed once they expire.
+type exportStore struct {
+	dir string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	exports map[string]*export
+}
+
+// newExportStore returns a new exportStore keeping exports for ttl, in a
+// new temporary directory. The directory is removed by close.
+func newExportStore(ttl time.Duration) (*exportStore, error) {
+	dir, err := ioutil.TempDir("", "opbeans-exports")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create exports directory")
+	}
+	return &exportStore{dir: dir, ttl: ttl, exports: make(map[string]*export)}, nil
+}
+
+// create materializes an export with the given filename to a file, with
+// the contents written by write.
+func (s *exportStore) create(filename string, write func(io.Writer) error) (*export, error) {
+	var idBytes [16]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to generate export ID")
+	}
+	id := hex.EncodeToString(idBytes[:])
+	path := filepath.Join(s.dir, id)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create export file")
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = errors.Wrap(closeErr, "failed to write export file")
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, errors.Wrap(err, "failed to stat export file")
+	}
+
+	e := &export{
+		ID:        id,
+		Filename:  filename,
+		Size:      info.Size(),
+		CreatedAt: info.ModTime(),
+		ExpiresAt: info.ModTime().Add(s.ttl),
+		path:      path,
+	}
+	s.mu.Lock()
+	s.exports[id] = e
+	s.mu.Unlock()
+	return e, nil
+}
+
+// open returns the export with the given ID and its opened file, or
+// errExportNotFound if there is no such export or it has expired. The
+// file remains readable if the export is removed while it is open.
+func (s *exportStore) open(id string) (*export, *os.File, error) {
+	s.mu.Lock()
+	e, ok := s.exports[id]
+	s.mu.Unlock()
+	if !ok || !time.Now().Before(e.ExpiresAt) {
+		return nil, nil, errExportNotFound
+	}
+	f, err := os.Open(e.path)
+	if os.IsNotExist(err) {
+		return nil, nil, errExportNotFound
+	} else if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open export file")
+	}
+	return e, f, nil
+}
+
+// removeExpired removes the exports which have expired by now.
+func (s *exportStore) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.exports {
+		if !now.Before(e.ExpiresAt) {
+			delete(s.exports, id)
+			os.Remove(e.path)
+		}
+	}
+}
+
+// runCleanup removes expired exports every interval, until ctx is
+// cancelled.
+func (s *exportStore) runCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.removeExpired(now)
+		}
+	}
+}
+
+// close removes all exports and the exports directory.
+func (s *exportStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports = make(map[string]*export)
+	os.RemoveAll(s.dir)
+}
+
+// handleCreateOrdersExport returns a handler which materializes the
+// orders export in store, responding with its description and the
+// location from which it can be downloaded.
+func handleCreateOrdersExport(store *exportStore, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, err := store.create(ordersExportFilename, func(w io.Writer) error {
+			return writeOrdersCSV(c.Request.Context(), db, w)
+		})
+		if err != nil {
+			abortWithError(c, errors.Wrap(err, "failed to create orders export"))
+			return
+		}
+		auditAdminAction(c, db, auditActionExportOrders)
+		c.Header("Location", "/api/exports/"+e.ID)
+		renderJSON(c, http.StatusCreated, e)
+	}
+}
+
+// handleGetExport returns a handler which serves the exports in store,
+// supporting range requests.
+func handleGetExport(store *exportStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		e, f, err := store.open(c.Param("id"))
+		if err == errExportNotFound {
+			abortWithStatus(c, http.StatusNotFound)
+			return
+		} else if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		defer f.Close()
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="`+e.Filename+`"`)
+		c.Header("Expires", e.ExpiresAt.UTC().Format(http.TimeFormat))
+		http.ServeContent(c.Writer, c.Request, e.Filename, e.CreatedAt, f)
+	}
+}
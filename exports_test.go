@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// newTestExportRouter returns a router serving the export and admin
+// routes, with exports materialized in a new store.
+func newTestExportRouter(t *testing.T) (*gin.Engine, *exportStore) {
+	store, err := newExportStore(time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(store.close)
+
+	db := newTestDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(apm.DefaultTracer, tracingOptions{}))
+	r.Use(errorMiddleware(apm.DefaultTracer))
+	r.GET("/api/exports/orders.csv", handleOrdersCSV(db))
+	r.GET("/api/exports/:id", handleGetExport(store))
+	adminGroup := r.Group("/api/admin", adminAuth("admin", "secret"))
+	addAdminHandlers(make(routeOptionsMap).group(adminGroup), apm.DefaultTracer, nil, db, store, nil, nil, nil, nil)
+	return r, store
+}
+
+// createTestExport materializes the orders export through the admin API,
+// returning its download location.
+func createTestExport(t *testing.T, r *gin.Engine) string {
+	req := httptest.NewRequest("POST", "/api/admin/exports/orders", nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	var e export
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+	assert.Equal(t, "/api/exports/"+e.ID, w.Header().Get("Location"))
+	assert.Equal(t, ordersExportFilename, e.Filename)
+	assert.Equal(t, time.Hour, e.ExpiresAt.Sub(e.CreatedAt))
+	return w.Header().Get("Location")
+}
+
+func getExport(r *gin.Engine, path, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestExportRangeRequests(t *testing.T) {
+	r, _ := newTestExportRouter(t)
+	streamed := getExport(r, "/api/exports/orders.csv", "")
+	require.Equal(t, http.StatusOK, streamed.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", streamed.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(streamed.Body.String(), "order_id,created_at,"))
+	full := streamed.Body.Bytes()
+	require.True(t, len(full) > 300, "export too small for test: %d bytes", len(full))
+
+	location := createTestExport(t, r)
+	w := getExport(r, location, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+	assert.Equal(t, `attachment; filename="orders.csv"`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, full, w.Body.Bytes())
+
+	// Reassemble the export from overlapping and open-ended ranges.
+	reassembled := make([]byte, len(full))
+	for _, rangeHeader := range []string{"bytes=0-99", "bytes=50-199", "bytes=150-", "bytes=-10"} {
+		w := getExport(r, location, rangeHeader)
+		require.Equal(t, http.StatusPartialContent, w.Code, rangeHeader)
+
+		var start, end, size int
+		_, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+		require.NoError(t, err)
+		assert.Equal(t, len(full), size)
+		assert.Equal(t, end-start+1, w.Body.Len())
+		assert.Equal(t, full[start:end+1], w.Body.Bytes(), rangeHeader)
+		copy(reassembled[start:], w.Body.Bytes())
+	}
+	assert.Equal(t, full, reassembled)
+
+	w = getExport(r, location, fmt.Sprintf("bytes=%d-", len(full)))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func TestExportNotFound(t *testing.T) {
+	r, _ := newTestExportRouter(t)
+	w := getExport(r, "/api/exports/0123456789abcdef", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestExportExpiry(t *testing.T) {
+	store, err := newExportStore(time.Hour)
+	require.NoError(t, err)
+	defer store.close()
+
+	content := []byte("a,b\n1,2\n")
+	e, err := store.create("test.csv", func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), e.Size)
+
+	_, f, err := store.open(e.ID)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// Removing the export does not affect open files.
+	store.removeExpired(e.ExpiresAt.Add(-time.Second))
+	_, f2, err := store.open(e.ID)
+	require.NoError(t, err)
+	f2.Close()
+	store.removeExpired(e.ExpiresAt)
+	_, _, err = store.open(e.ID)
+	assert.Equal(t, errExportNotFound, err)
+	_, err = os.Stat(e.path)
+	assert.True(t, os.IsNotExist(err))
+
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(f)
+	require.NoError(t, err)
+	assert.Equal(t, content, buf.Bytes())
+
+	store.close()
+	_, err = os.Stat(store.dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func BenchmarkOrdersCSV(b *testing.B) {
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(b, err)
+	defer tracer.Close()
+	tracer.Transport = transporttest.Discard
+
+	// The export is bounded by a handler timeout, as it is when served.
+	db := newTestDB(b)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/api/exports/orders.csv", handlerTimeout(time.Minute), handleOrdersCSV(db))
+	req := httptest.NewRequest("GET", "/api/exports/orders.csv", nil)
+	var size int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", w.Code)
+		}
+		size = w.Body.Len()
+	}
+	b.ReportMetric(float64(size), "bytes/response")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ignoreForwardedHeadersKey is the gin context key under which
+// tracingMiddleware records that forwarding headers are not trusted.
+const ignoreForwardedHeadersKey = "opbeans.ignore_forwarded_headers"
+
+// forwardingHeaders holds the proxy forwarding headers consulted by the
+// agent when recording the request URL and client address. Each value
+// is taken from the first source that is set:
+//   - URL host: the Forwarded header's "host", X-Forwarded-Host, and
+//     finally the Host header.
+//   - URL protocol: the Forwarded header's "proto", X-Forwarded-Proto,
+//     X-Forwarded-Protocol, X-Url-Scheme, then "https" if
+//     Front-End-Https or X-Forwarded-Ssl is "on" or the connection uses
+//     TLS, and finally "http".
+//   - Client address: the Forwarded header's "for", X-Real-Ip, the
+//     first hop of X-Forwarded-For, and finally the connection's remote
+//     address.
+//
+// The Forwarded header fields are taken from the element added by the
+// outermost trusted proxy, as configured by
+// $ELASTIC_APM_TRUSTED_PROXY_DEPTH, or from the first element if the
+// depth is unset.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"Front-End-Https",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Protocol",
+	"X-Forwarded-Ssl",
+	"X-Real-Ip",
+	"X-Url-Scheme",
+}
+
+// contextRequest returns the request to record in the APM context for c.
+// If tracingMiddleware was configured not to trust forwarding headers,
+// they are removed, so that the URL and client address are taken from
+// the connection.
+func contextRequest(c *gin.Context) *http.Request {
+	if !c.GetBool(ignoreForwardedHeadersKey) {
+		return c.Request
+	}
+	return withoutForwardingHeaders(c.Request)
+}
+
+// withoutForwardingHeaders returns req, or a shallow copy of req with
+// forwardingHeaders removed if it has any.
+func withoutForwardingHeaders(req *http.Request) *http.Request {
+	var header http.Header
+	for _, name := range forwardingHeaders {
+		if _, ok := req.Header[name]; !ok {
+			continue
+		}
+		if header == nil {
+			header = make(http.Header, len(req.Header))
+			for k, v := range req.Header {
+				header[k] = v
+			}
+		}
+		delete(header, name)
+	}
+	if header == nil {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	req.Header = header
+	return req
+}
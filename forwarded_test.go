@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestTracingMiddlewareForwardedHeaders(t *testing.T) {
+	for name, test := range map[string]struct {
+		headers    map[string]string
+		untrusted  bool
+		url        string
+		remoteAddr string
+	}{
+		"none": {
+			url:        "http://example.com/",
+			remoteAddr: "192.0.2.1",
+		},
+		"x_forwarded_proto": {
+			headers:    map[string]string{"X-Forwarded-Proto": "https"},
+			url:        "https://example.com/",
+			remoteAddr: "192.0.2.1",
+		},
+		"x_forwarded_host": {
+			headers:    map[string]string{"X-Forwarded-Host": "shop.example.com"},
+			url:        "http://shop.example.com/",
+			remoteAddr: "192.0.2.1",
+		},
+		"x_forwarded_for": {
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"},
+			url:        "http://example.com/",
+			remoteAddr: "203.0.113.7",
+		},
+		"x_real_ip": {
+			headers:    map[string]string{"X-Real-Ip": "203.0.113.8"},
+			url:        "http://example.com/",
+			remoteAddr: "203.0.113.8",
+		},
+		"x_forwarded_all": {
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "shop.example.com",
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Real-Ip":         "203.0.113.8",
+			},
+			url:        "https://shop.example.com/",
+			remoteAddr: "203.0.113.8",
+		},
+		"forwarded_precedence": {
+			headers: map[string]string{
+				"Forwarded":         `for="198.51.100.1:4711";host=forwarded.example.com;proto=https`,
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "shop.example.com",
+				"X-Forwarded-For":   "203.0.113.7",
+			},
+			url:        "https://forwarded.example.com/",
+			remoteAddr: "198.51.100.1",
+		},
+		"untrusted": {
+			headers: map[string]string{
+				"Forwarded":         "for=198.51.100.1;host=forwarded.example.com",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "shop.example.com",
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Real-Ip":         "203.0.113.8",
+			},
+			untrusted:  true,
+			url:        "http://example.com/",
+			remoteAddr: "192.0.2.1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(tracingMiddleware(tracer, tracingOptions{ignoreForwardedHeaders: test.untrusted}))
+			r.Use(errorMiddleware(tracer))
+			r.GET("/", func(c *gin.Context) {
+				c.Error(errors.New("boom"))
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			tracer.Flush(nil)
+
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Transactions, 1)
+			require.Len(t, payloads.Errors, 1)
+			for _, request := range []*model.Request{
+				payloads.Transactions[0].Context.Request,
+				payloads.Errors[0].Context.Request,
+			} {
+				assert.Equal(t, test.url, request.URL.Full)
+				require.NotNil(t, request.Socket)
+				assert.Equal(t, test.remoteAddr, request.Socket.RemoteAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// embeddedFrontend holds the frontend build embedded in the binary, if
+// it was built with the "embedfrontend" tag, and is otherwise nil.
+var embeddedFrontend fs.FS
+
+// openFrontend returns the source of the frontend's build configured by
+// cfg: the frontend embedded in the binary, if any, and otherwise the
+// cfg.Frontend directory. If cfg.FrontendDisk is set, the directory is
+// preferred to the embedded frontend when it exists, so that a frontend
+// under development can be served by a release binary.
+func openFrontend(cfg config.Server) (fs.FS, error) {
+	if embeddedFrontend != nil {
+		if !cfg.FrontendDisk {
+			return embeddedFrontend, nil
+		}
+		if info, err := os.Stat(cfg.Frontend); err != nil || !info.IsDir() {
+			logrus.Infof("frontend directory %q not found, serving the embedded frontend", cfg.Frontend)
+			return embeddedFrontend, nil
+		}
+	}
+	info, err := os.Stat(cfg.Frontend)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open frontend")
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("frontend %q is not a directory", cfg.Frontend)
+	}
+	return os.DirFS(cfg.Frontend), nil
+}
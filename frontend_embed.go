@@ -0,0 +1,23 @@
+//go:build embedfrontend
+// +build embedfrontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// frontendBuild holds the frontend build, which must be copied to
+// frontend/build before building with the "embedfrontend" tag.
+//
+//go:embed frontend/build
+var frontendBuild embed.FS
+
+func init() {
+	build, err := fs.Sub(frontendBuild, "frontend/build")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFrontend = build
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// testFrontendFiles holds a frontend build, as embedded or on disk.
+var testFrontendFiles = map[string]string{
+	"index.html":                    "<html><head><title>opbeans</title></head><body></body></html>",
+	"favicon.ico":                   "icon",
+	"static/js/main.1a2b3c4d.js":    "main()",
+	"static/js/main.1a2b3c4d.js.gz": "gzip",
+	"static/css/opbeans.css":        "body {}",
+	"images/logo.svg":               "<svg/>",
+}
+
+// writeTestFrontend writes testFrontendFiles to a new directory, and
+// returns its path.
+func writeTestFrontend(t *testing.T) string {
+	dir := t.TempDir()
+	for name, content := range testFrontendFiles {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	}
+	return dir
+}
+
+// setEmbeddedFrontend embeds testFrontendFiles for the test.
+func setEmbeddedFrontend(t *testing.T) fs.FS {
+	files := make(fstest.MapFS)
+	for name, content := range testFrontendFiles {
+		files[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	old := embeddedFrontend
+	embeddedFrontend = files
+	t.Cleanup(func() { embeddedFrontend = old })
+	return files
+}
+
+func TestOpenFrontend(t *testing.T) {
+	dir := writeTestFrontend(t)
+	missing := filepath.Join(dir, "missing")
+
+	frontend, err := openFrontend(config.Server{Frontend: dir})
+	require.NoError(t, err)
+	assert.Equal(t, os.DirFS(dir), frontend)
+	_, err = openFrontend(config.Server{Frontend: missing})
+	assert.Error(t, err)
+	_, err = openFrontend(config.Server{Frontend: filepath.Join(dir, "index.html")})
+	assert.Error(t, err)
+
+	// The embedded frontend is served, unless the directory is
+	// preferred and exists.
+	embedded := setEmbeddedFrontend(t)
+	frontend, err = openFrontend(config.Server{Frontend: dir})
+	require.NoError(t, err)
+	assert.Equal(t, embedded, frontend)
+	frontend, err = openFrontend(config.Server{Frontend: dir, FrontendDisk: true})
+	require.NoError(t, err)
+	assert.Equal(t, os.DirFS(dir), frontend)
+	frontend, err = openFrontend(config.Server{Frontend: missing, FrontendDisk: true})
+	require.NoError(t, err)
+	assert.Equal(t, embedded, frontend)
+}
+
+// newTestFrontendRouter returns a router serving frontend as the server
+// does, without tracing.
+func newTestFrontendRouter(t *testing.T, frontend fs.FS) *gin.Engine {
+	template, err := parseIndexTemplate(frontend, rumConfig{ServiceName: "opbeans-rum"})
+	require.NoError(t, err)
+	assets, err := newStaticAssets(frontend)
+	require.NoError(t, err)
+	notFound := unknownRouteHandler("unknown route", 404)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.SetHTMLTemplate(template)
+	r.GET("/", handleIndex)
+	for _, route := range []string{"/static/*filepath", "/images/*filepath", "/favicon.ico"} {
+		r.GET(route, assets.handler(notFound))
+	}
+	r.NoRoute(spaFallback(notFound))
+	return r
+}
+
+func TestFrontendSources(t *testing.T) {
+	embedded := newTestFrontendRouter(t, setEmbeddedFrontend(t))
+	dir, err := openFrontend(config.Server{Frontend: writeTestFrontend(t), FrontendDisk: true})
+	require.NoError(t, err)
+	disk := newTestFrontendRouter(t, dir)
+
+	// Both sources are served identically, other than Last-Modified,
+	// as embedded files have no modification time.
+	for _, path := range []string{"/", "/orders/1", "/favicon.ico", "/static/js/main.1a2b3c4d.js", "/static/css/opbeans.css", "/images/logo.svg", "/static/missing.js"} {
+		for _, acceptEncoding := range []string{"", "gzip"} {
+			serve := func(r *gin.Engine) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				w.Header().Del("Last-Modified")
+				return w
+			}
+			expected, actual := serve(disk), serve(embedded)
+			assert.Equal(t, expected.Code, actual.Code, path)
+			assert.Equal(t, expected.Header(), actual.Header(), path)
+			assert.Equal(t, expected.Body.Bytes(), actual.Body.Bytes(), path)
+		}
+	}
+
+	// The RUM agent configuration is injected from both.
+	w := serveGet(embedded, "/")
+	assert.Contains(t, w.Body.String(), "window.elasticApmConfig")
+	assert.Contains(t, w.Body.String(), "<title>opbeans</title>")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serverFrontendPaths holds the paths outside the API which the server
+// serves itself, even when proxying the frontend.
+var serverFrontendPaths = map[string]bool{
+	"/oopsie":          true,
+	"/rum-config.js":   true,
+	"/rum-config.json": true,
+}
+
+// isFrontendProxyRequest reports whether req is for the frontend, and
+// so proxied to the frontend development server if one is configured: a
+// GET or HEAD request for a path outside the API and the operational
+// routes, which the server does not serve itself.
+func isFrontendProxyRequest(req *http.Request) bool {
+	switch {
+	case req.Method != "GET" && req.Method != "HEAD":
+		return false
+	case isAPIPath(req.URL.Path), isAdminRequest(req), isHealthCheck(req):
+		return false
+	}
+	return !serverFrontendPaths[req.URL.Path]
+}
+
+// frontendProxy returns a middleware which proxies frontend requests, as
+// reported by isFrontendProxyRequest, to the frontend development server
+// at target, for developing the frontend against the server without
+// cross-origin requests. WebSocket upgrades, used by the development
+// server's hot reloading, are passed through.
+//
+// The requests are not traced; see the ignore option of
+// tracingMiddleware.
+func frontendProxy(target *url.URL) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isFrontendProxyRequest(c.Request) {
+			c.Next()
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			// Development servers may reject requests for hosts other
+			// than their own.
+			req.Host = target.Host
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			// The error is logged rather than reported, as the
+			// development server is expected to restart.
+			contextLogger(c).WithError(err).Warn("failed to proxy frontend request")
+			abortWithStatus(c, http.StatusBadGateway)
+		}
+		proxy.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// newTestFrontendDevServer returns a server standing in for the
+// frontend's development server, which describes the requests it
+// receives and echoes messages on its hot reloading WebSocket.
+func newTestFrontendDevServer(t *testing.T) *httptest.Server {
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/sockjs-node" {
+			conn, err := upgrader.Upgrade(w, req, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				messageType, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(messageType, data)
+			}
+		}
+		fmt.Fprintf(w, "dev server: %s %s %s", req.Method, req.Host, req.URL.RequestURI())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFrontendProxy(t *testing.T) {
+	devServer := newTestFrontendDevServer(t)
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_FRONTEND_PROXY_URL", devServer.URL)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+	devHost := strings.TrimPrefix(devServer.URL, "http://")
+
+	// The frontend is served by the development server, addressed by
+	// its own host. The proxy requires a real connection.
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	for _, path := range []string{"/", "/static/js/main.js", "/products/42?tab=orders", "/favicon.ico"} {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, "dev server: GET "+devHost+" "+path, string(body))
+	}
+
+	// The API, the server's own frontend routes and requests other than
+	// GET are not proxied.
+	w := serveGet(r, "/api/products")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.NotContains(t, serveGet(r, "/rum-config.json").Body.String(), "dev server")
+	assert.NotContains(t, serveGet(r, livenessPath).Body.String(), "dev server")
+	w = serveJSON(r, "POST", "/products/42", "{}")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Proxied requests are not traced.
+	tracer.Flush(nil)
+	var names []string
+	for _, tx := range recorder.Payloads().Transactions {
+		names = append(names, tx.Name)
+	}
+	assert.ElementsMatch(t, []string{"GET /api/products", "GET /rum-config.json", "POST unknown route"}, names)
+}
+
+func TestFrontendProxyWebSocket(t *testing.T) {
+	devServer := newTestFrontendDevServer(t)
+	devURL, err := url.Parse(devServer.URL)
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(frontendProxy(devURL))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// Hot reloading connections are upgraded by the development server.
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/sockjs-node", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("reload")))
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, messageType)
+	assert.Equal(t, "reload", string(data))
+}
+
+func TestFrontendProxyUnavailable(t *testing.T) {
+	// The development server is not listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	devURL := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(frontendProxy(devURL))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, apperr.Upstream, decodeErrorEnvelope(t, body).Code)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const (
+	// fulfillmentPollInterval is the interval at which each
+	// fulfillment worker polls for new jobs.
+	fulfillmentPollInterval = time.Second
+
+	// fulfillmentMaxAttempts is the number of times a job is attempted
+	// before it is moved to the dead state.
+	fulfillmentMaxAttempts = 5
+
+	// fulfillmentInitialBackoff is the delay before a failed job is
+	// retried. The delay doubles with each further failure, up to
+	// fulfillmentMaxBackoff.
+	fulfillmentInitialBackoff = 5 * time.Second
+	fulfillmentMaxBackoff     = 5 * time.Minute
+)
+
+// Fulfillment job states.
+//
+// Jobs are pending until they succeed, or fail too many times and are
+// dead. On SQLite, which has no row locks, jobs are running while claimed
+// by a worker.
+const (
+	jobStatePending = "pending"
+	jobStateRunning = "running"
+	jobStateDone    = "done"
+	jobStateDead    = "dead"
+)
+
+var jobStates = map[string]bool{
+	jobStatePending: true,
+	jobStateRunning: true,
+	jobStateDone:    true,
+	jobStateDead:    true,
+}
+
+// fulfillmentJob is a job to fulfill an order, enqueued at checkout.
+type fulfillmentJob struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	RunAt     time.Time `json:"run_at"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Traceparent holds the trace context of the checkout request,
+	// in traceparent header format, so that the job is traced as part
+	// of the same trace. It is empty if the checkout was not traced.
+	Traceparent string `json:"-"`
+}
+
+// enqueueFulfillment enqueues a job to fulfill the order with the given
+// ID as part of the database transaction tx, recording the trace context
+// of the transaction in ctx, if any.
+func enqueueFulfillment(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, orderID int) error {
+	var traceparent sql.NullString
+	if apmTx := apm.TransactionFromContext(ctx); apmTx != nil {
+		traceparent.String = apmhttp.FormatTraceparentHeader(apmTx.TraceContext())
+		traceparent.Valid = true
+	}
+	defer startQuery(ctx)()
+	if _, err := tx.ExecContext(ctx, db.Rebind(
+		"INSERT INTO jobs (order_id, traceparent, run_at) VALUES (?, ?, ?)",
+	), orderID, traceparent, time.Now().UTC()); err != nil {
+		return errors.Wrap(err, "enqueueing fulfillment job")
+	}
+	return nil
+}
+
+// fulfillmentWorker processes fulfillment jobs.
+type fulfillmentWorker struct {
+	tracer *apm.Tracer
+	db     *sqlx.DB
+
+	// events receives an event for each fulfilled order. It may be nil.
+	events *orderEventHub
+
+	// maintenance pauses processing while enabled. It may be nil.
+	maintenance *maintenanceMode
+
+	// maxAttempts is the number of times a job is attempted before
+	// it is moved to the dead state.
+	maxAttempts int
+
+	// initialBackoff is the delay before a failed job is retried.
+	// The delay doubles with each further failure, up to maxBackoff.
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newFulfillmentWorker(tracer *apm.Tracer, db *sqlx.DB, events *orderEventHub) *fulfillmentWorker {
+	return &fulfillmentWorker{
+		tracer:         tracer,
+		db:             db,
+		events:         events,
+		maxAttempts:    fulfillmentMaxAttempts,
+		initialBackoff: fulfillmentInitialBackoff,
+		maxBackoff:     fulfillmentMaxBackoff,
+	}
+}
+
+// run runs n concurrent workers processing jobs until ctx is cancelled,
+// each polling for new jobs every interval, and returns once they have
+// all stopped.
+//
+// On SQLite, jobs left running by a previous process are first made
+// pending again. The database file cannot be shared between processes,
+// so no other worker can have claimed them.
+func (w *fulfillmentWorker) run(ctx context.Context, n int, interval time.Duration) {
+	if w.db.DriverName() != "postgres" {
+		if _, err := w.db.ExecContext(ctx, w.db.Rebind(
+			"UPDATE jobs SET state=? WHERE state=?",
+		), jobStatePending, jobStateRunning); err != nil {
+			logrus.WithError(err).Error("failed to release claimed fulfillment jobs")
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.poll(ctx, interval)
+		}()
+	}
+	wg.Wait()
+}
+
+// poll processes jobs until ctx is cancelled, polling for new jobs every
+// interval, and pausing before each job in maintenance mode.
+func (w *fulfillmentWorker) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			if !w.maintenance.wait(ctx) {
+				return
+			}
+			processed, err := w.processJob(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithError(err).Error("failed to process fulfillment job")
+				}
+				break
+			}
+			if !processed {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processJob claims and processes the oldest pending fulfillment job
+// which is due, reporting whether there was one. Jobs which fail are
+// retried with exponential backoff, until they have been attempted
+// maxAttempts times, and are then dead.
+//
+// The job is traced as a "task" transaction, continuing the trace of the
+// checkout request which enqueued it. If the job has no valid trace
+// context, a new trace is started.
+func (w *fulfillmentWorker) processJob(ctx context.Context) (bool, error) {
+	claim, err := claimFulfillmentJob(ctx, w.db)
+	if err != nil || claim == nil {
+		return false, err
+	}
+	defer claim.release()
+	job := claim.job
+
+	traceContext, _ := parseTraceparent(job.Traceparent)
+	tx := w.tracer.StartTransactionOptions("fulfill order", "task", apm.TransactionOptions{
+		TraceContext: traceContext,
+	})
+	defer tx.End()
+	ifSampled(tx, func() {
+		tx.Context.SetTag("order_id", strconv.Itoa(job.OrderID))
+		tx.Context.SetLabel("attempt", job.Attempts+1)
+	})
+	ctx = apm.ContextWithTransaction(ctx, tx)
+
+	if err := fulfillOrder(ctx, w.db, claim); err != nil {
+		tx.Result = "failure"
+		if e := apm.CaptureError(ctx, err); e != nil {
+			e.Send()
+		}
+		state, updateErr := w.recordFailure(ctx, claim, err)
+		if updateErr != nil {
+			return false, updateErr
+		}
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("job_state", state)
+		})
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"job_id":   job.ID,
+			"attempts": job.Attempts + 1,
+			"state":    state,
+		}).Warn("fulfillment job failed")
+		return true, nil
+	}
+	tx.Result = "success"
+	w.events.publish(orderEvent{Type: orderEventStatusChanged, OrderID: job.OrderID, Status: jobStateDone})
+	return true, nil
+}
+
+// recordFailure records a failed attempt of the claimed job, scheduling
+// it to be retried after a backoff, or moving it to the dead state if it
+// has been attempted maxAttempts times. The job's new state is returned.
+func (w *fulfillmentWorker) recordFailure(ctx context.Context, claim *jobClaim, jobErr error) (string, error) {
+	attempts := claim.job.Attempts + 1
+	state := jobStatePending
+	if attempts >= w.maxAttempts {
+		state = jobStateDead
+	}
+	backoff := w.initialBackoff
+	for i := 1; i < attempts && backoff < w.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > w.maxBackoff {
+		backoff = w.maxBackoff
+	}
+	err := claim.update(ctx, func(tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, tx.Rebind(
+			"UPDATE jobs SET state=?, attempts=?, last_error=?, run_at=? WHERE id=?",
+		), state, attempts, jobErr.Error(), time.Now().Add(backoff).UTC(), claim.job.ID)
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "recording fulfillment job failure")
+	}
+	return state, nil
+}
+
+// jobClaim is a worker's claim on a fulfillment job.
+//
+// On Postgres, the claim is a row lock held by tx, taken with SKIP LOCKED
+// so that concurrent workers claim different jobs, and released when tx
+// ends. On SQLite, the claim is the job's running state, set with a
+// conditional update, so that only one worker claims it.
+type jobClaim struct {
+	db  *sqlx.DB
+	tx  *sqlx.Tx
+	job *fulfillmentJob
+}
+
+// claimFulfillmentJob claims the oldest pending fulfillment job which is
+// due, returning nil if there is none.
+func claimFulfillmentJob(ctx context.Context, db *sqlx.DB) (*jobClaim, error) {
+	const query = `SELECT id, order_id, attempts, traceparent
+FROM jobs WHERE state=? AND run_at<=? ORDER BY id LIMIT 1`
+	if db.DriverName() == "postgres" {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "claiming fulfillment job")
+		}
+		job, err := scanFulfillmentJob(tx.QueryRowContext(ctx, tx.Rebind(query+" FOR UPDATE SKIP LOCKED"),
+			jobStatePending, time.Now().UTC(),
+		))
+		if err != nil || job == nil {
+			tx.Rollback()
+			return nil, err
+		}
+		return &jobClaim{db: db, tx: tx, job: job}, nil
+	}
+	for {
+		job, err := scanFulfillmentJob(db.QueryRowContext(ctx, db.Rebind(query), jobStatePending, time.Now().UTC()))
+		if err != nil || job == nil {
+			return nil, err
+		}
+		result, err := db.ExecContext(ctx, db.Rebind(
+			"UPDATE jobs SET state=? WHERE id=? AND state=?",
+		), jobStateRunning, job.ID, jobStatePending)
+		if err != nil {
+			return nil, errors.Wrap(err, "claiming fulfillment job")
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, errors.Wrap(err, "claiming fulfillment job")
+		} else if n == 1 {
+			return &jobClaim{db: db, job: job}, nil
+		}
+		// Another worker claimed the job first.
+	}
+}
+
+func scanFulfillmentJob(row *sql.Row) (*fulfillmentJob, error) {
+	var job fulfillmentJob
+	var traceparent sql.NullString
+	if err := row.Scan(&job.ID, &job.OrderID, &job.Attempts, &traceparent); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "querying fulfillment jobs")
+	}
+	job.Traceparent = traceparent.String
+	return &job, nil
+}
+
+// update calls f to record the outcome of the job, in the transaction
+// holding the claim on Postgres, or in a new transaction on SQLite, and
+// commits the transaction if f succeeds. The claim is then released.
+func (c *jobClaim) update(ctx context.Context, f func(tx *sqlx.Tx) error) error {
+	tx := c.tx
+	c.tx = nil
+	if tx == nil {
+		var err error
+		if tx, err = c.db.BeginTxx(ctx, nil); err != nil {
+			return err
+		}
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.job = nil
+	return nil
+}
+
+// release releases the claim if the job's outcome was not recorded,
+// leaving the job pending.
+func (c *jobClaim) release() {
+	if c.tx != nil {
+		c.tx.Rollback()
+		return
+	}
+	if c.job != nil && c.db.DriverName() != "postgres" {
+		if _, err := c.db.Exec(c.db.Rebind(
+			"UPDATE jobs SET state=? WHERE id=? AND state=?",
+		), jobStatePending, c.job.ID, jobStateRunning); err != nil {
+			logrus.WithError(err).Error("failed to release fulfillment job")
+		}
+	}
+}
+
+// fulfillOrder fulfills the order of the claimed job, marking the order
+// shipped, and the job done.
+func fulfillOrder(ctx context.Context, db *sqlx.DB, claim *jobClaim) error {
+	job := claim.job
+	order, err := getOrder(ctx, db, job.OrderID)
+	if err != nil {
+		return errors.Wrapf(err, "fulfilling order %d", job.OrderID)
+	}
+	shipped := *order
+	shippedAt := time.Now().UTC()
+	shipped.ShippedAt = &shippedAt
+	if err := claim.update(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, tx.Rebind(
+			"UPDATE orders SET shipped_at=? WHERE id=?",
+		), shippedAt, order.ID); err != nil {
+			return errors.Wrap(err, "marking order shipped")
+		}
+		if err := recordChange(ctx, db, tx, changeEntityOrder, order.ID, changeOpUpdate); err != nil {
+			return err
+		}
+		if err := recordAudit(ctx, db, tx, changeOpUpdate, changeEntityOrder, order.ID, order, &shipped); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(
+			"UPDATE jobs SET state=?, attempts=attempts+1 WHERE id=?",
+		), jobStateDone, job.ID); err != nil {
+			return errors.Wrap(err, "updating fulfillment job")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	loggerFromContext(ctx).Debugf("fulfilled order %d (%d lines)", order.ID, len(order.Lines))
+	return nil
+}
+
+// getFulfillmentJobs returns the fulfillment jobs, optionally filtered
+// by state, most recently created first. At most 1000 jobs are returned.
+func getFulfillmentJobs(ctx context.Context, db *sqlx.DB, state string) ([]fulfillmentJob, error) {
+	query := `SELECT id, order_id, state, attempts, last_error, run_at, created_at FROM jobs`
+	var args []interface{}
+	if state != "" {
+		query += " WHERE state=?"
+		args = append(args, state)
+	}
+	query += " ORDER BY id DESC LIMIT 1000"
+
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(query), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying fulfillment jobs")
+	}
+	defer rows.Close()
+
+	jobs := []fulfillmentJob{}
+	for rows.Next() {
+		var job fulfillmentJob
+		var lastError sql.NullString
+		if err := rows.Scan(
+			&job.ID, &job.OrderID, &job.State, &job.Attempts,
+			&lastError, &job.RunAt, &job.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		job.LastError = lastError.String
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// handleGetJobs returns a handler which lists the fulfillment jobs,
+// filtered by the "state" query parameter if it is specified.
+func handleGetJobs(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state := c.Query("state")
+		if state != "" && !jobStates[state] {
+			abortWithError(c, apperr.New(apperr.Validation, "invalid job state", "state", state))
+			return
+		}
+		jobs, err := getFulfillmentJobs(c.Request.Context(), db, state)
+		if err != nil {
+			abortWithError(c, apperr.Wrap(err, apperr.DB))
+			return
+		}
+		renderJSON(c, http.StatusOK, jobs)
+	}
+}
+
+var fulfillmentQueueDesc = prometheus.NewDesc(
+	"fulfillment_jobs", "Number of fulfillment jobs which are not done, by state.", []string{"state"}, nil,
+)
+
+// fulfillmentQueueCollector is a prometheus.Collector reporting the
+// depth of the fulfillment job queue.
+type fulfillmentQueueCollector struct {
+	db *sqlx.DB
+}
+
+// Describe sends the descriptor of the queue depth metric to ch.
+func (fulfillmentQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fulfillmentQueueDesc
+}
+
+// Collect reports the number of pending, running and dead jobs. Nothing
+// is reported if the jobs cannot be queried.
+func (q fulfillmentQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	counts, err := q.count(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("failed to collect fulfillment queue metrics")
+		return
+	}
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(fulfillmentQueueDesc, prometheus.GaugeValue, float64(n), state)
+	}
+}
+
+// count returns the number of jobs in each state other than done.
+func (q fulfillmentQueueCollector) count(ctx context.Context) (map[string]int, error) {
+	rows, err := q.db.QueryContext(ctx, q.db.Rebind(
+		"SELECT state, COUNT(*) FROM jobs WHERE state<>? GROUP BY state",
+	), jobStateDone)
+	if err != nil {
+		return nil, errors.Wrap(err, "counting fulfillment jobs")
+	}
+	defer rows.Close()
+	counts := map[string]int{jobStatePending: 0, jobStateRunning: 0, jobStateDead: 0}
+	for rows.Next() {
+		var state string
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestFulfillmentTraceContext(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	db := newTestDB(t)
+	r := newTestAPIRouter(tracer, db)
+	w := httptest.NewRecorder()
+	body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 2}]}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders", strings.NewReader(body)))
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	worker := newFulfillmentWorker(tracer, db, nil)
+	processed, err := worker.processJob(context.Background())
+	require.NoError(t, err)
+	assert.True(t, processed)
+	processed, err = worker.processJob(context.Background())
+	require.NoError(t, err)
+	assert.False(t, processed)
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	checkout, task := payloads.Transactions[0], payloads.Transactions[1]
+	assert.Equal(t, "POST /api/orders", checkout.Name)
+	assert.Equal(t, "fulfill order", task.Name)
+	assert.Equal(t, "task", task.Type)
+	assert.Equal(t, "success", task.Result)
+	assert.Equal(t, checkout.TraceID, task.TraceID)
+	assert.Equal(t, checkout.ID, task.ParentID)
+
+	// Shipping the order is audited as a system action.
+	entries, err := getAuditLog(context.Background(), db, changeEntityOrder, 0, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	shipped, created := entries[0], entries[1]
+	assert.Equal(t, auditActorSystem, shipped.Actor)
+	assert.Equal(t, changeOpUpdate, shipped.Action)
+	assert.Equal(t, []string{"shipped_at"}, auditDiffFields(shipped.Diff))
+	assert.Nil(t, shipped.Diff["shipped_at"].Before)
+	assert.NotNil(t, shipped.Diff["shipped_at"].After)
+	assert.Equal(t, auditActorAnonymous, created.Actor)
+	assert.Equal(t, auditDiff{
+		"customer_id": {After: 1.0},
+		"lines":       {After: []interface{}{map[string]interface{}{"id": 1.0, "amount": 2.0}}},
+	}, created.Diff)
+}
+
+// auditDiffFields returns the names of the changed fields in diff, in
+// no particular order.
+func auditDiffFields(diff auditDiff) []string {
+	var fields []string
+	for field := range diff {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func TestFulfillmentInvalidTraceContext(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	db := newTestDB(t)
+	_, err := db.Exec("INSERT INTO jobs (order_id, traceparent) VALUES (1, NULL), (2, 'garbage')")
+	require.NoError(t, err)
+	worker := newFulfillmentWorker(tracer, db, nil)
+	for i := 0; i < 2; i++ {
+		processed, err := worker.processJob(context.Background())
+		require.NoError(t, err)
+		assert.True(t, processed)
+	}
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	for _, tx := range payloads.Transactions {
+		assert.Equal(t, "success", tx.Result)
+		assert.NotZero(t, tx.TraceID)
+		assert.Zero(t, tx.ParentID)
+	}
+	assert.NotEqual(t, payloads.Transactions[0].TraceID, payloads.Transactions[1].TraceID)
+}
+
+func TestFulfillmentConcurrentWorkers(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	const numJobs = 50
+	db := newTestDB(t)
+	for i := 1; i <= numJobs; i++ {
+		_, err := db.Exec("INSERT INTO jobs (order_id) VALUES (?)", i)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newFulfillmentWorker(tracer, db, nil).run(ctx, 4, 10*time.Millisecond)
+	}()
+	require.Eventually(t, func() bool {
+		jobs, err := getFulfillmentJobs(context.Background(), db, jobStateDone)
+		require.NoError(t, err)
+		return len(jobs) == numJobs
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	// Each job was processed exactly once.
+	jobs, err := getFulfillmentJobs(context.Background(), db, "")
+	require.NoError(t, err)
+	require.Len(t, jobs, numJobs)
+	for _, job := range jobs {
+		assert.Equal(t, 1, job.Attempts, "job %d", job.ID)
+	}
+	tracer.Flush(nil)
+	orderIDs := make(map[interface{}]bool)
+	for _, tx := range recorder.Payloads().Transactions {
+		assert.Equal(t, "success", tx.Result)
+		orderIDs[transactionLabels(tx)["order_id"]] = true
+	}
+	assert.Len(t, recorder.Payloads().Transactions, numJobs)
+	assert.Len(t, orderIDs, numJobs)
+
+	order, err := getOrder(context.Background(), db, 1)
+	require.NoError(t, err)
+	require.NotNil(t, order.ShippedAt)
+	assert.WithinDuration(t, time.Now(), *order.ShippedAt, time.Minute)
+}
+
+func TestFulfillmentBackoff(t *testing.T) {
+	db := newTestDB(t)
+	_, err := db.Exec("INSERT INTO jobs (order_id) VALUES (999999)")
+	require.NoError(t, err)
+
+	worker := newFulfillmentWorker(apm.DefaultTracer, db, nil)
+	processed, err := worker.processJob(context.Background())
+	require.NoError(t, err)
+	assert.True(t, processed)
+
+	// The failed job is not retried until the backoff has elapsed.
+	processed, err = worker.processJob(context.Background())
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	jobs, err := getFulfillmentJobs(context.Background(), db, jobStatePending)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 1, jobs[0].Attempts)
+	assert.WithinDuration(t, time.Now().Add(fulfillmentInitialBackoff), jobs[0].RunAt, time.Second)
+}
+
+func TestFulfillmentDeadLetter(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	db := newTestDB(t)
+	_, err := db.Exec("INSERT INTO jobs (order_id) VALUES (1), (999999)")
+	require.NoError(t, err)
+
+	worker := newFulfillmentWorker(tracer, db, nil)
+	worker.maxAttempts = 3
+	worker.initialBackoff = 0
+	for i := 0; i < 4; i++ {
+		processed, err := worker.processJob(context.Background())
+		require.NoError(t, err)
+		assert.True(t, processed)
+	}
+	processed, err := worker.processJob(context.Background())
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 4)
+	assert.Len(t, payloads.Errors, 3)
+	last := transactionLabels(payloads.Transactions[3])
+	assert.Equal(t, float64(3), last["attempt"])
+	assert.Equal(t, jobStateDead, last["job_state"])
+
+	r := newTestJobsRouter(db)
+	var dead []fulfillmentJob
+	getJobs(t, r, "/api/admin/jobs?state=dead", http.StatusOK, &dead)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 999999, dead[0].OrderID)
+	assert.Equal(t, jobStateDead, dead[0].State)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Contains(t, dead[0].LastError, "fulfilling order 999999")
+
+	var all []fulfillmentJob
+	getJobs(t, r, "/api/admin/jobs", http.StatusOK, &all)
+	assert.Len(t, all, 2)
+	var pending []fulfillmentJob
+	getJobs(t, r, "/api/admin/jobs?state=pending", http.StatusOK, &pending)
+	assert.Empty(t, pending)
+	getJobs(t, r, "/api/admin/jobs?state=bogus", http.StatusBadRequest, nil)
+}
+
+func newTestJobsRouter(db *sqlx.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(errorMiddleware(apm.DefaultTracer))
+	adminGroup := r.Group("/api/admin", adminAuth("admin", "secret"))
+	addAdminHandlers(make(routeOptionsMap).group(adminGroup), apm.DefaultTracer, nil, db, nil, nil, nil, nil, nil)
+	return r
+}
+
+func getJobs(t *testing.T, r *gin.Engine, path string, expectedStatus int, out interface{}) {
+	req := httptest.NewRequest("GET", path, nil)
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, expectedStatus, w.Code, w.Body.String())
+	if out != nil {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), out))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+)
+
+// goroutineSampleInterval is the interval at which the number of
+// goroutines is sampled.
+const goroutineSampleInterval = 10 * time.Second
+
+// goroutineDetector samples the number of goroutines, reporting a
+// suspected leak when it grows by more than a threshold within a
+// window. goroutineDetector implements apm.MetricsGatherer.
+type goroutineDetector struct {
+	tracer       *apm.Tracer
+	threshold    int
+	window       time.Duration
+	numGoroutine func() int
+
+	mu       sync.Mutex
+	samples  []goroutineSample
+	reported time.Time
+}
+
+type goroutineSample struct {
+	time  time.Time
+	count int
+}
+
+func newGoroutineDetector(tracer *apm.Tracer, threshold int, window time.Duration) *goroutineDetector {
+	return &goroutineDetector{
+		tracer:       tracer,
+		threshold:    threshold,
+		window:       window,
+		numGoroutine: runtime.NumGoroutine,
+	}
+}
+
+// run samples the number of goroutines every interval until ctx is
+// cancelled.
+func (d *goroutineDetector) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	d.sample(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.sample(now)
+		}
+	}
+}
+
+// sample records the number of goroutines at now. If it exceeds the
+// least number sampled within the window by more than the threshold,
+// a warning is logged and an error reported, at most once per window.
+func (d *goroutineDetector) sample(now time.Time) {
+	count := d.numGoroutine()
+	d.mu.Lock()
+	d.samples = append(d.samples, goroutineSample{time: now, count: count})
+	for len(d.samples) > 1 && now.Sub(d.samples[0].time) > d.window {
+		d.samples = d.samples[1:]
+	}
+	growth := d.growthLocked()
+	report := growth > d.threshold && (d.reported.IsZero() || now.Sub(d.reported) >= d.window)
+	if report {
+		d.reported = now
+	}
+	d.mu.Unlock()
+	if !report {
+		return
+	}
+
+	err := errors.Errorf("goroutines grew by %d to %d within %s", growth, count, d.window)
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"goroutines": count,
+		"growth":     growth,
+		"threshold":  d.threshold,
+	}).Warn("suspected goroutine leak")
+	if apmErr := d.tracer.NewError(err); apmErr != nil {
+		apmErr.Context.SetLabel("goroutines", count)
+		apmErr.Context.SetLabel("goroutine_growth", growth)
+		apmErr.Send()
+	}
+}
+
+// growthLocked returns the growth of the latest sample over the least
+// within the window. d.mu must be held.
+func (d *goroutineDetector) growthLocked() int {
+	if len(d.samples) == 0 {
+		return 0
+	}
+	least := d.samples[0].count
+	for _, s := range d.samples {
+		if s.count < least {
+			least = s.count
+		}
+	}
+	return d.samples[len(d.samples)-1].count - least
+}
+
+// GatherMetrics gathers the latest number of goroutines sampled, and
+// its growth within the window, adding them to m.
+func (d *goroutineDetector) GatherMetrics(ctx context.Context, m *apm.Metrics) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.samples) == 0 {
+		return nil
+	}
+	m.Add("goroutines", nil, float64(d.samples[len(d.samples)-1].count))
+	m.Add("goroutines_growth", nil, float64(d.growthLocked()))
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestGoroutineDetector(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	logs := captureLogs(t)
+	d := newGoroutineDetector(tracer, 100, time.Minute)
+	var count int
+	d.numGoroutine = func() int { return count }
+
+	// Growth is measured from the least number sampled within the
+	// window.
+	start := time.Now()
+	for i, n := range []int{50, 40, 120, 140} {
+		count = n
+		d.sample(start.Add(time.Duration(i) * 10 * time.Second))
+	}
+	assert.Empty(t, logs.String())
+	count = 141
+	d.sample(start.Add(40 * time.Second))
+	assert.Contains(t, logs.String(), "suspected goroutine leak")
+	assert.Contains(t, logs.String(), "goroutines grew by 101 to 141 within 1m0s")
+
+	// Leaks are reported at most once per window.
+	count = 200
+	d.sample(start.Add(50 * time.Second))
+	assert.Equal(t, 1, strings.Count(logs.String(), "suspected goroutine leak"))
+
+	// Samples older than the window are forgotten.
+	count = 210
+	d.sample(start.Add(110 * time.Second))
+	assert.Equal(t, 1, strings.Count(logs.String(), "suspected goroutine leak"))
+	count = 240
+	d.sample(start.Add(130 * time.Second))
+	assert.Equal(t, 1, strings.Count(logs.String(), "suspected goroutine leak"))
+	count = 400
+	d.sample(start.Add(140 * time.Second))
+	assert.Equal(t, 2, strings.Count(logs.String(), "suspected goroutine leak"))
+
+	tracer.Flush(nil)
+	errors := recorder.Payloads().Errors
+	require.Len(t, errors, 2)
+	assert.Equal(t, "goroutines grew by 101 to 141 within 1m0s", errors[0].Exception.Message)
+
+	// The latest number and its growth are gathered as metrics.
+	tracer.RegisterMetricsGatherer(d)
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+	var gathered map[string]model.Metric
+	for _, m := range recorder.Payloads().Metrics {
+		if _, ok := m.Samples["goroutines"]; ok {
+			gathered = m.Samples
+		}
+	}
+	assert.Equal(t, 400.0, gathered["goroutines"].Value)
+	assert.Equal(t, 190.0, gathered["goroutines_growth"].Value)
+}
+
+func TestGoroutineDetectorRun(t *testing.T) {
+	d := newGoroutineDetector(apm.DefaultTracer, 100, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx, time.Millisecond)
+	}()
+	assert.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.samples) > 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
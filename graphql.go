@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/introspection"
+	"github.com/graph-gophers/graphql-go/trace/tracer"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	products: [Product!]!
+	product(id: Int!): Product
+	productTypes: [ProductType!]!
+	productType(id: Int!): ProductType
+	customers: [Customer!]!
+	customer(id: Int!): Customer
+	orders: [Order!]!
+	order(id: Int!): Order
+}
+
+type Product {
+	id: Int!
+	sku: String!
+	name: String!
+	description: String!
+	stock: Int!
+	cost: Int!
+	sellingPrice: Int!
+	type: ProductType!
+}
+
+type ProductType {
+	id: Int!
+	name: String!
+}
+
+type Customer {
+	id: Int!
+	fullName: String!
+	companyName: String!
+	email: String!
+	address: String!
+	postalCode: String!
+	city: String!
+	country: String!
+}
+
+type Order {
+	id: Int!
+	createdAt: String!
+	customer: Customer
+	lines: [OrderLine!]!
+}
+
+type OrderLine {
+	product: Product!
+	amount: Int!
+}
+`
+
+// newGraphQLSchema returns the GraphQL schema resolved from db, batching
+// the loading of orders' lines and customers unless the N+1 demo mode
+// of settings is enabled. Each non-trivial field resolution is traced
+// as a span.
+func newGraphQLSchema(db *sqlx.DB, settings *runtimeSettings) *graphql.Schema {
+	return graphql.MustParseSchema(
+		graphqlSchema,
+		&graphqlResolver{db: db, settings: settings},
+		graphql.Tracer(graphqlTracer{}),
+	)
+}
+
+// handleGraphQL returns a handler which executes GraphQL queries posted
+// as JSON against schema. Transactions are labeled "demo.n_plus_one"
+// with the state of the N+1 demo mode of settings.
+func handleGraphQL(schema *graphql.Schema, settings *runtimeSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var params struct {
+			Query         string                 `json:"query" binding:"required"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+		if !bindJSON(c, &params) {
+			return
+		}
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("demo.n_plus_one", settings.nPlusOne())
+		})
+		response := schema.Exec(c.Request.Context(), params.Query, params.OperationName, params.Variables)
+		renderJSON(c, http.StatusOK, response)
+	}
+}
+
+// graphqlTracer implements tracer.Tracer, naming the transaction after
+// the query's operation name, if any, and tracing the resolution of
+// non-trivial fields as spans.
+type graphqlTracer struct{}
+
+func (graphqlTracer) TraceQuery(
+	ctx context.Context,
+	queryString, operationName string,
+	variables map[string]interface{},
+	varTypes map[string]*introspection.Type,
+) (context.Context, tracer.QueryFinishFunc) {
+	if tx := apm.TransactionFromContext(ctx); tx != nil && operationName != "" {
+		tx.Name = operationName
+	}
+	return ctx, func([]*gqlerrors.QueryError) {}
+}
+
+func (graphqlTracer) TraceField(
+	ctx context.Context,
+	label, typeName, fieldName string,
+	trivial bool,
+	args map[string]interface{},
+) (context.Context, tracer.FieldFinishFunc) {
+	if trivial {
+		return ctx, func(*gqlerrors.QueryError) {}
+	}
+	span, ctx := apm.StartSpan(ctx, typeName+"."+fieldName, "app.graphql")
+	return ctx, func(*gqlerrors.QueryError) { span.End() }
+}
+
+// graphqlResolver resolves the GraphQL Query type.
+type graphqlResolver struct {
+	db       *sqlx.DB
+	settings *runtimeSettings
+}
+
+func (r *graphqlResolver) Products(ctx context.Context) ([]productResolver, error) {
+	products, err := getProducts(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	return productResolvers(products), nil
+}
+
+func (r *graphqlResolver) Product(ctx context.Context, args struct{ ID int32 }) (*productResolver, error) {
+	product, err := getProduct(ctx, r.db, int(args.ID))
+	if err == errProductNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &productResolver{*product}, nil
+}
+
+func (r *graphqlResolver) ProductTypes(ctx context.Context) ([]productTypeResolver, error) {
+	productTypes, err := getProductTypes(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]productTypeResolver, len(productTypes))
+	for i, pt := range productTypes {
+		resolvers[i] = productTypeResolver{pt}
+	}
+	return resolvers, nil
+}
+
+func (r *graphqlResolver) ProductType(ctx context.Context, args struct{ ID int32 }) (*productTypeResolver, error) {
+	productType, err := getProductType(ctx, r.db, int(args.ID))
+	if err != nil || productType == nil {
+		return nil, err
+	}
+	return &productTypeResolver{*productType}, nil
+}
+
+func (r *graphqlResolver) Customers(ctx context.Context) ([]customerResolver, error) {
+	customers, err := getCustomers(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]customerResolver, len(customers))
+	for i, c := range customers {
+		resolvers[i] = customerResolver{c}
+	}
+	return resolvers, nil
+}
+
+func (r *graphqlResolver) Customer(ctx context.Context, args struct{ ID int32 }) (*customerResolver, error) {
+	customer, err := getCustomer(ctx, r.db, int(args.ID))
+	if err != nil || customer == nil {
+		return nil, err
+	}
+	return &customerResolver{*customer}, nil
+}
+
+func (r *graphqlResolver) Orders(ctx context.Context) ([]orderResolver, error) {
+	orders, err := getOrders(ctx, r.db)
+	if err != nil {
+		return nil, err
+	}
+	// In the N+1 demo mode, each order's resolver loads its own lines
+	// and customer, making N+1 queries.
+	var shared *orderLoader
+	if !r.settings.nPlusOne() {
+		shared = newOrderLoader(r.db, orders)
+	}
+	resolvers := make([]orderResolver, len(orders))
+	for i, order := range orders {
+		loader := shared
+		if loader == nil {
+			loader = newOrderLoader(r.db, orders[i:i+1])
+		}
+		resolvers[i] = orderResolver{order: order, loader: loader}
+	}
+	return resolvers, nil
+}
+
+func (r *graphqlResolver) Order(ctx context.Context, args struct{ ID int32 }) (*orderResolver, error) {
+	order, err := getOrder(ctx, r.db, int(args.ID))
+	if errors.Cause(err) == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// getOrder loads the order's lines.
+	loader := newOrderLoader(r.db, []Order{*order})
+	loader.linesOnce.Do(func() {
+		loader.lines = map[int][]ProductOrderLine{order.ID: order.Lines}
+	})
+	return &orderResolver{order: *order, loader: loader}, nil
+}
+
+type productResolver struct {
+	p Product
+}
+
+func productResolvers(products []Product) []productResolver {
+	resolvers := make([]productResolver, len(products))
+	for i, p := range products {
+		resolvers[i] = productResolver{p}
+	}
+	return resolvers
+}
+
+func (r productResolver) ID() int32           { return int32(r.p.ID) }
+func (r productResolver) SKU() string         { return r.p.SKU }
+func (r productResolver) Name() string        { return r.p.Name }
+func (r productResolver) Description() string { return r.p.Description }
+func (r productResolver) Stock() int32        { return int32(r.p.Stock) }
+func (r productResolver) Cost() int32         { return int32(r.p.Cost) }
+func (r productResolver) SellingPrice() int32 { return int32(r.p.SellingPrice) }
+
+func (r productResolver) Type() productTypeResolver {
+	return productTypeResolver{ProductType{ID: r.p.TypeID, Name: r.p.TypeName}}
+}
+
+type productTypeResolver struct {
+	pt ProductType
+}
+
+func (r productTypeResolver) ID() int32    { return int32(r.pt.ID) }
+func (r productTypeResolver) Name() string { return r.pt.Name }
+
+type customerResolver struct {
+	c Customer
+}
+
+func (r customerResolver) ID() int32           { return int32(r.c.ID) }
+func (r customerResolver) FullName() string    { return r.c.FullName }
+func (r customerResolver) CompanyName() string { return r.c.CompanyName }
+func (r customerResolver) Email() string       { return r.c.Email }
+func (r customerResolver) Address() string     { return r.c.Address }
+func (r customerResolver) PostalCode() string  { return r.c.PostalCode }
+func (r customerResolver) City() string        { return r.c.City }
+func (r customerResolver) Country() string     { return r.c.Country }
+
+type orderResolver struct {
+	order  Order
+	loader *orderLoader
+}
+
+func (r orderResolver) ID() int32 { return int32(r.order.ID) }
+
+func (r orderResolver) CreatedAt() string {
+	return r.order.CreatedAt.UTC().Format(time.RFC3339)
+}
+
+func (r orderResolver) Customer(ctx context.Context) (*customerResolver, error) {
+	customers, err := r.loader.loadCustomers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	customer, ok := customers[r.order.CustomerID]
+	if !ok {
+		return nil, nil
+	}
+	return &customerResolver{customer}, nil
+}
+
+func (r orderResolver) Lines(ctx context.Context) ([]orderLineResolver, error) {
+	lines, err := r.loader.loadLines(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resolvers := make([]orderLineResolver, len(lines[r.order.ID]))
+	for i, line := range lines[r.order.ID] {
+		resolvers[i] = orderLineResolver{line}
+	}
+	return resolvers, nil
+}
+
+type orderLineResolver struct {
+	line ProductOrderLine
+}
+
+func (r orderLineResolver) Product() productResolver { return productResolver{r.line.Product} }
+func (r orderLineResolver) Amount() int32            { return int32(r.line.Amount) }
+
+// orderLoader loads the lines and customers of a list of orders, with a
+// single query for each, the first time they are requested by any of the
+// orders' resolvers.
+type orderLoader struct {
+	db     *sqlx.DB
+	orders []Order
+
+	linesOnce sync.Once
+	lines     map[int][]ProductOrderLine
+	linesErr  error
+
+	customersOnce sync.Once
+	customers     map[int]Customer
+	customersErr  error
+}
+
+func newOrderLoader(db *sqlx.DB, orders []Order) *orderLoader {
+	return &orderLoader{db: db, orders: orders}
+}
+
+// loadLines returns the order lines, keyed by order ID.
+func (l *orderLoader) loadLines(ctx context.Context) (map[int][]ProductOrderLine, error) {
+	l.linesOnce.Do(func() {
+		orderIDs := make([]int, len(l.orders))
+		for i, order := range l.orders {
+			orderIDs[i] = order.ID
+		}
+		l.lines, l.linesErr = getOrderLines(ctx, l.db, orderIDs)
+	})
+	return l.lines, l.linesErr
+}
+
+// loadCustomers returns the orders' customers, keyed by customer ID.
+func (l *orderLoader) loadCustomers(ctx context.Context) (map[int]Customer, error) {
+	l.customersOnce.Do(func() {
+		var customerIDs []int
+		seen := make(map[int]bool)
+		for _, order := range l.orders {
+			if !seen[order.CustomerID] {
+				seen[order.CustomerID] = true
+				customerIDs = append(customerIDs, order.CustomerID)
+			}
+		}
+		customers, err := getCustomersByID(ctx, l.db, customerIDs)
+		if err != nil {
+			l.customersErr = err
+			return
+		}
+		l.customers = make(map[int]Customer, len(customers))
+		for _, c := range customers {
+			l.customers[c.ID] = c
+		}
+	})
+	return l.customers, l.customersErr
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+const graphqlOrdersQuery = `query OrderDetails {
+	orders {
+		id
+		createdAt
+		customer { fullName }
+		lines {
+			amount
+			product { name type { name } }
+		}
+	}
+}`
+
+const graphqlOrdersResult = `{"data": {"orders": [{
+	"id": 1,
+	"createdAt": "2019-01-02T03:04:05Z",
+	"customer": {"fullName": "Barbara Rogers"},
+	"lines": [
+		{"amount": 2, "product": {"name": "Brazil Verde, Italian Roast", "type": {"name": "Dark Roast Coffee"}}},
+		{"amount": 1, "product": {"name": "Colombian Supremo, Cinnamon Roast", "type": {"name": "Light Roast Coffee"}}}
+	]
+}, {
+	"id": 2,
+	"createdAt": "2019-01-02T03:04:05Z",
+	"customer": {"fullName": "Paula Hill"},
+	"lines": [
+		{"amount": 5, "product": {"name": "Jamaica Blue Mountain, Vienna Roast", "type": {"name": "Medium Roast Coffee"}}}
+	]
+}]}}`
+
+// newTestGraphQLDB returns a test database holding only two orders.
+func newTestGraphQLDB(t *testing.T) *sqlx.DB {
+	db := newTestDB(t)
+	for _, stmt := range []string{
+		"DELETE FROM jobs",
+		"DELETE FROM order_lines",
+		"DELETE FROM orders",
+		"INSERT INTO orders (id, customer_id, created_at) VALUES (1, 1, '2019-01-02 03:04:05'), (2, 2, '2019-01-02 03:04:05')",
+		"INSERT INTO order_lines (order_id, product_id, amount) VALUES (1, 1, 2), (1, 3, 1), (2, 2, 5)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+	return db
+}
+
+func postGraphQL(t *testing.T, tracer *apm.Tracer, db *sqlx.DB, dataloader bool, query, operationName string) string {
+	settings := newRuntimeSettings(&config.Config{GraphQL: config.GraphQL{Dataloader: dataloader}})
+	body, err := json.Marshal(map[string]string{"query": query, "operationName": operationName})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.POST("/api/graphql", handleGraphQL(newGraphQLSchema(db, settings), settings))
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/graphql", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+func TestGraphQLNestedQuery(t *testing.T) {
+	type expectation struct {
+		linesQueries     int
+		customersQueries int
+	}
+	for name, expect := range map[string]expectation{
+		"n+1":        {linesQueries: 2, customersQueries: 2},
+		"dataloader": {linesQueries: 1, customersQueries: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			body := postGraphQL(t, tracer, newTestGraphQLDB(t), name == "dataloader", graphqlOrdersQuery, "OrderDetails")
+			assert.JSONEq(t, graphqlOrdersResult, body)
+
+			tracer.Flush(nil)
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Transactions, 1)
+			assert.Equal(t, "OrderDetails", payloads.Transactions[0].Name)
+
+			resolverSpans := make(map[string][]model.Span)
+			for _, span := range payloads.Spans {
+				if span.Type == "app" && span.Subtype == "graphql" {
+					resolverSpans[span.Name] = append(resolverSpans[span.Name], span)
+				}
+			}
+			assert.Len(t, resolverSpans["Query.orders"], 1)
+			assert.Len(t, resolverSpans["Order.customer"], 2)
+			assert.Len(t, resolverSpans["Order.lines"], 2)
+
+			var linesQueries, customersQueries int
+			for _, span := range payloads.Spans {
+				if span.Type != "db" {
+					continue
+				}
+				statement := span.Context.Database.Statement
+				switch {
+				case strings.Contains(statement, "order_lines.order_id IN"):
+					linesQueries++
+					assert.Contains(t, spanIDs(resolverSpans["Order.lines"]), span.ParentID)
+				case strings.Contains(statement, "FROM customers"):
+					customersQueries++
+					assert.Contains(t, spanIDs(resolverSpans["Order.customer"]), span.ParentID)
+				}
+			}
+			assert.Equal(t, expect.linesQueries, linesQueries)
+			assert.Equal(t, expect.customersQueries, customersQueries)
+		})
+	}
+}
+
+func TestGraphQLUnnamedOperation(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	body := postGraphQL(t, tracer, newTestDB(t), false, "{ product(id: 2) { sku type { id } } missing: product(id: 999) { sku } }", "")
+	assert.JSONEq(t, `{"data": {"product": {"sku": "OP-MRC-C2", "type": {"id": 2}}, "missing": null}}`, body)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "POST /api/graphql", payloads.Transactions[0].Name)
+}
+
+func spanIDs(spans []model.Span) []model.SpanID {
+	ids := make([]model.SpanID, len(spans))
+	for i, span := range spans {
+		ids[i] = span.ID
+	}
+	return ids
+}
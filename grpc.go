@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmgrpc"
+
+	"github.com/elastic/opbeans-go/catalogpb"
+)
+
+// newGRPCServer returns a gRPC server serving the product catalog from
+// db. Each RPC is traced by tracer as a transaction, with the gRPC status
+// code as its result.
+func newGRPCServer(tracer *apm.Tracer, db *sqlx.DB) *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(apmgrpc.NewUnaryServerInterceptor(
+		apmgrpc.WithTracer(tracer),
+		apmgrpc.WithRecovery(),
+	)))
+	catalogpb.RegisterCatalogServer(s, catalogServer{db: db})
+	return s
+}
+
+// serveGRPC listens on addr and serves s in the background, returning
+// the listener's address.
+func serveGRPC(s *grpc.Server, addr string) (net.Addr, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for gRPC requests")
+	}
+	go s.Serve(lis)
+	return lis.Addr(), nil
+}
+
+// catalogServer implements catalogpb.CatalogServer, sharing the product
+// repository with the HTTP API.
+type catalogServer struct {
+	db *sqlx.DB
+}
+
+func (s catalogServer) GetProduct(ctx context.Context, req *catalogpb.GetProductRequest) (*catalogpb.Product, error) {
+	product, err := getProduct(ctx, s.db, int(req.Id))
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "failed to get product"))
+	}
+	return productMessage(*product), nil
+}
+
+func (s catalogServer) ListProducts(ctx context.Context, req *catalogpb.ListProductsRequest) (*catalogpb.ListProductsResponse, error) {
+	products, err := getProducts(ctx, s.db)
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "failed to get products"))
+	}
+	return &catalogpb.ListProductsResponse{Products: productMessages(products)}, nil
+}
+
+func (s catalogServer) SearchProducts(ctx context.Context, req *catalogpb.SearchProductsRequest) (*catalogpb.SearchProductsResponse, error) {
+	products, err := searchProducts(ctx, s.db, req.Query, int(req.Limit))
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "failed to search products"))
+	}
+	return &catalogpb.SearchProductsResponse{Products: productMessages(products)}, nil
+}
+
+// grpcError returns a gRPC status error for err, with a code determined
+// by the repository error at its cause. Other errors map to Internal.
+func grpcError(err error) error {
+	code := codes.Internal
+	switch errors.Cause(err) {
+	case errProductNotFound:
+		code = codes.NotFound
+	case errInvalidProductSearch:
+		code = codes.InvalidArgument
+	}
+	return status.Error(code, err.Error())
+}
+
+func productMessages(products []Product) []*catalogpb.Product {
+	out := make([]*catalogpb.Product, len(products))
+	for i, p := range products {
+		out[i] = productMessage(p)
+	}
+	return out
+}
+
+func productMessage(p Product) *catalogpb.Product {
+	return &catalogpb.Product{
+		Id:           int64(p.ID),
+		Sku:          p.SKU,
+		Name:         p.Name,
+		Description:  p.Description,
+		Stock:        int64(p.Stock),
+		Cost:         int64(p.Cost),
+		SellingPrice: int64(p.SellingPrice),
+		TypeId:       int64(p.TypeID),
+		TypeName:     p.TypeName,
+	}
+}
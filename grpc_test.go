@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/catalogpb"
+)
+
+// newTestCatalogClient returns a client for the gRPC catalog service
+// serving db, traced by tracer, over an in-memory connection.
+func newTestCatalogClient(t *testing.T, tracer *apm.Tracer, db *sqlx.DB) catalogpb.CatalogClient {
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer(tracer, db)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithDialer(
+		func(string, time.Duration) (net.Conn, error) { return lis.Dial() },
+	))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return catalogpb.NewCatalogClient(conn)
+}
+
+func TestGRPCGetProduct(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	client := newTestCatalogClient(t, tracer, newTestDB(t))
+
+	product, err := client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, &catalogpb.Product{
+		Id:           1,
+		Sku:          "OP-DRC-C1",
+		Name:         "Brazil Verde, Italian Roast",
+		Description:  "Soft, nutty, low acid, with nice bitter-sweet chocolate tastes.",
+		Stock:        80,
+		Cost:         1500,
+		SellingPrice: 3200,
+		TypeId:       3,
+		TypeName:     "Dark Roast Coffee",
+	}, product)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "/opbeans.catalog.Catalog/GetProduct", tx.Name)
+	assert.Equal(t, "request", tx.Type)
+	assert.Equal(t, "OK", tx.Result)
+	require.NotNil(t, tx.Context.Request)
+	assert.Equal(t, &model.RequestSocket{RemoteAddress: "bufconn"}, tx.Context.Request.Socket)
+
+	// The repository's database spans are recorded in the transaction.
+	require.NotEmpty(t, payloads.Spans)
+	for _, span := range payloads.Spans {
+		assert.Equal(t, tx.ID, span.TransactionID)
+	}
+}
+
+func TestGRPCListProducts(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	client := newTestCatalogClient(t, tracer, db)
+
+	var count int
+	require.NoError(t, db.Get(&count, "SELECT COUNT(*) FROM products"))
+	resp, err := client.ListProducts(context.Background(), &catalogpb.ListProductsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Products, count)
+	for i, product := range resp.Products {
+		assert.Equal(t, int64(i+1), product.Id)
+	}
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "/opbeans.catalog.Catalog/ListProducts", payloads.Transactions[0].Name)
+	assert.Equal(t, "OK", payloads.Transactions[0].Result)
+}
+
+func TestGRPCSearchProducts(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	client := newTestCatalogClient(t, tracer, newTestDB(t))
+
+	resp, err := client.SearchProducts(context.Background(), &catalogpb.SearchProductsRequest{Query: "CHOCOLATE"})
+	require.NoError(t, err)
+	var ids []int64
+	for _, product := range resp.Products {
+		ids = append(ids, product.Id)
+	}
+	assert.Equal(t, []int64{1, 4}, ids)
+
+	resp, err = client.SearchProducts(context.Background(), &catalogpb.SearchProductsRequest{Query: "french roast", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, resp.Products, 1)
+	assert.Equal(t, "European Royale, French Roast", resp.Products[0].Name)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	for _, tx := range payloads.Transactions {
+		assert.Equal(t, "/opbeans.catalog.Catalog/SearchProducts", tx.Name)
+		assert.Equal(t, "OK", tx.Result)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	client := newTestCatalogClient(t, tracer, newTestDB(t))
+
+	_, err := client.GetProduct(context.Background(), &catalogpb.GetProductRequest{Id: 999})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.EqualError(t, err, "rpc error: code = NotFound desc = failed to get product: product not found")
+
+	_, err = client.SearchProducts(context.Background(), &catalogpb.SearchProductsRequest{Query: " "})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.SearchProducts(context.Background(), &catalogpb.SearchProductsRequest{Query: "roast", Limit: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 3)
+	assert.Equal(t, "NotFound", payloads.Transactions[0].Result)
+	assert.Equal(t, "InvalidArgument", payloads.Transactions[1].Result)
+	assert.Equal(t, "InvalidArgument", payloads.Transactions[2].Result)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hashRingReplicas is the number of points of each backend on a
+// hashRing, per unit of weight. More points spread the keys more evenly.
+const hashRingReplicas = 128
+
+// hashRingPoint is a point of a backend on a hashRing.
+type hashRingPoint struct {
+	hash    uint64
+	backend *backend
+}
+
+// hashRing maps keys onto backends by consistent hashing: each key is
+// mapped to the backend of the first point following its hash on the
+// ring, skipping the backends which are unavailable. A backend becoming
+// unavailable only remaps the keys which were mapped to it.
+type hashRing struct {
+	points []hashRingPoint // sorted by hash
+}
+
+// newHashRing returns a hashRing of backends, with points in proportion
+// to their weights, placed by their hosts.
+func newHashRing(backends []*backend) hashRing {
+	var r hashRing
+	for _, b := range backends {
+		for i := 0; i < hashRingReplicas*b.weight; i++ {
+			r.points = append(r.points, hashRingPoint{hash: ringHash(b.url.Host + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// locate returns the backend of candidates to which key is mapped, or
+// nil if none of the candidates is on the ring.
+func (r hashRing) locate(key string, candidates []*backend) *backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	for i := range r.points {
+		b := r.points[(start+i)%len(r.points)].backend
+		for _, c := range candidates {
+			if c == b {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+// ringHash returns the position of s on a hashRing: its FNV-1a hash,
+// mixed with the finalizer of MurmurHash3 so that similar keys, such as
+// consecutive customer IDs, are spread over the ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// stickyRoutingKey returns the key by which the request of c is routed
+// to a backend with the sticky strategy: the ID of the authenticated
+// customer, or else of the customer named by the path, or "" if there
+// is neither.
+func stickyRoutingKey(c *gin.Context) string {
+	if claims := authenticatedCustomer(c); claims != nil {
+		return strconv.Itoa(claims.CustomerID)
+	}
+	if routeClass(c.FullPath()) == "customers" {
+		return c.Param("id")
+	}
+	return ""
+}
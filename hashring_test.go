@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestHashRingDistribution(t *testing.T) {
+	p := newTestBackendPool(config.ProxySticky, nil, "a", "b", "c")
+	const keys = 9000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[p.ring.locate(strconv.Itoa(i), p.backends).url.Host]++
+	}
+	for _, host := range []string{"a", "b", "c"} {
+		assert.InDelta(t, 1.0/3, float64(counts[host])/keys, 0.08, host)
+	}
+
+	// Weights scale the shares.
+	p = newTestBackendPool(config.ProxySticky, []int{3, 1}, "a", "b")
+	counts = make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[p.ring.locate(strconv.Itoa(i), p.backends).url.Host]++
+	}
+	assert.InDelta(t, 0.75, float64(counts["a"])/keys, 0.08)
+}
+
+func TestHashRingRemapping(t *testing.T) {
+	p := newTestBackendPool(config.ProxySticky, nil, "a", "b", "c", "d")
+	const keys = 10000
+	before := make([]*backend, keys)
+	for i := range before {
+		before[i] = p.ring.locate(strconv.Itoa(i), p.backends)
+	}
+
+	// Removing a backend only remaps the keys it held, spreading them
+	// over the others.
+	removed := p.backends[1]
+	remaining := []*backend{p.backends[0], p.backends[2], p.backends[3]}
+	var moved int
+	spread := make(map[*backend]int)
+	for i, b := range before {
+		after := p.ring.locate(strconv.Itoa(i), remaining)
+		if b != removed {
+			assert.Equal(t, b, after, "key %d", i)
+			continue
+		}
+		moved++
+		spread[after]++
+	}
+	assert.InDelta(t, 0.25, float64(moved)/keys, 0.08)
+	assert.Len(t, spread, 3)
+
+	// The keys return once it is restored.
+	for i, b := range before {
+		assert.Equal(t, b, p.ring.locate(strconv.Itoa(i), p.backends), "key %d", i)
+	}
+}
+
+func TestBackendPoolSticky(t *testing.T) {
+	p := newTestBackendPool(config.ProxySticky, nil, "a", "b")
+	host := p.pick("42").backend.url.Host
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, host, p.pick("42").backend.url.Host)
+	}
+
+	// Requests without a key are routed at random.
+	counts := make(map[string]int)
+	for _, host := range pickHosts(p, 100) {
+		counts[host]++
+	}
+	assert.Len(t, counts, 2)
+
+	// Keys move off backends whose circuit opens, and back once it
+	// closes.
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	recordAttempt(p, p.pick("42").backend, true)
+	assert.NotEqual(t, host, p.pick("42").backend.url.Host)
+	now = now.Add(time.Minute)
+	trial := p.pick("42")
+	assert.Equal(t, host+":"+circuitHalfOpen, trial.backend.url.Host+":"+trial.circuit)
+	trial.record(false)
+	p.done(trial)
+	assert.Equal(t, host, p.pick("42").backend.url.Host)
+}
+
+func TestProxySticky(t *testing.T) {
+	var mu sync.Mutex
+	served := make(map[string]map[string]int) // by URI, by backend
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			uri := req.URL.RequestURI()
+			if served[uri] == nil {
+				served[uri] = make(map[string]int)
+			}
+			served[uri][name]++
+			mu.Unlock()
+			w.Write([]byte("{}"))
+		}))
+	}
+	// servedBy returns the number of requests for uri served by each
+	// backend.
+	servedBy := func(uri string) map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		counts := make(map[string]int)
+		for name, n := range served[uri] {
+			counts[name] = n
+		}
+		return counts
+	}
+	backend1, backend2 := newBackend("backend1"), newBackend("backend2")
+	defer backend1.Close()
+	defer backend2.Close()
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_SERVICES", backend1.URL+","+backend2.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	t.Setenv("OPBEANS_DT_STRATEGY", "sticky")
+	t.Setenv("OPBEANS_JWT_SECRET", string(testJWTSecret))
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	srv := newTestProxyServer(t, r)
+
+	serve := func(path, token string) {
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// The requests of each customer, named by the path or the token,
+	// are all proxied to the same backend, and the customers are spread
+	// over both.
+	backends := make(map[string]int)
+	for id := 1; id <= 10; id++ {
+		path := "/api/customers/" + strconv.Itoa(id)
+		orders := "/api/orders?customer=" + strconv.Itoa(id)
+		token := newTestToken(t, testJWTSecret, id, "", time.Now().Add(time.Hour))
+		for i := 0; i < 5; i++ {
+			serve(path, "")
+			serve(orders, token)
+		}
+		require.Len(t, servedBy(path), 1, path)
+		assert.Equal(t, servedBy(path), servedBy(orders), orders)
+		for name := range servedBy(path) {
+			backends[name]++
+		}
+	}
+	assert.Len(t, backends, 2)
+
+	// Anonymous requests are spread at random.
+	for i := 0; i < 20; i++ {
+		serve("/api/products", "")
+	}
+	assert.Len(t, servedBy("/api/products"), 2)
+}
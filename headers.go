@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"go.elastic.co/apm"
+)
+
+const (
+	// maxCapturedHeaderLength is the maximum length, in runes, of a
+	// captured header value. Longer values are truncated.
+	maxCapturedHeaderLength = 1024
+
+	redacted = "[REDACTED]"
+)
+
+// headerCapture captures all request and response headers as the custom
+// context "http.request.headers" and "http.response.headers". The agent
+// itself records only a few request headers.
+type headerCapture struct {
+	// denylist holds the canonical names of headers whose values are
+	// replaced with "[REDACTED]".
+	denylist map[string]bool
+}
+
+// newHeaderCapture returns a headerCapture which redacts the headers
+// named in denylist.
+func newHeaderCapture(denylist ...string) *headerCapture {
+	hc := &headerCapture{denylist: make(map[string]bool)}
+	for _, name := range denylist {
+		if name = strings.TrimSpace(name); name != "" {
+			hc.denylist[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return hc
+}
+
+// setCustomContext records the request and response headers in ctx.
+func (hc *headerCapture) setCustomContext(ctx *apm.Context, request, response http.Header) {
+	ctx.SetCustom("http", map[string]interface{}{
+		"request":  map[string]interface{}{"headers": hc.capture(request)},
+		"response": map[string]interface{}{"headers": hc.capture(response)},
+	})
+}
+
+func (hc *headerCapture) capture(h http.Header) map[string]string {
+	captured := make(map[string]string, len(h))
+	for name, values := range h {
+		if hc.denylist[http.CanonicalHeaderKey(name)] {
+			captured[name] = redacted
+			continue
+		}
+		captured[name] = truncateRunes(strings.Join(values, ", "), maxCapturedHeaderLength)
+	}
+	return captured
+}
+
+// truncateRunes truncates s to at most n runes.
+func truncateRunes(s string, n int) string {
+	var i int
+	for pos := range s {
+		if i == n {
+			return s[:pos]
+		}
+		i++
+	}
+	return s
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestHeaderCapture(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{
+		headers: newHeaderCapture("authorization", "Cookie", "Set-Cookie"),
+	}))
+	r.GET("/", func(c *gin.Context) {
+		c.SetCookie("session", "secret", 0, "/", "", false, true)
+		c.Header("X-Response", "response")
+		c.String(200, "hello")
+	})
+
+	longValue := strings.Repeat("é", maxCapturedHeaderLength+1)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Add("X-Multi", "a")
+	req.Header.Add("X-Multi", "b")
+	req.Header.Set("X-Long", longValue)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	custom := payloads.Transactions[0].Context.Custom
+	require.Len(t, custom, 1)
+	assert.Equal(t, model.IfaceMapItem{Key: "http", Value: map[string]interface{}{
+		"request": map[string]interface{}{"headers": map[string]interface{}{
+			"Authorization": "[REDACTED]",
+			"Cookie":        "[REDACTED]",
+			"X-Multi":       "a, b",
+			"X-Long":        longValue[:len(longValue)-len("é")],
+		}},
+		"response": map[string]interface{}{"headers": map[string]interface{}{
+			"Content-Type": "text/plain; charset=utf-8",
+			"Set-Cookie":   "[REDACTED]",
+			"X-Response":   "response",
+		}},
+	}}, custom[0])
+}
+
+func TestHeaderCaptureDisabled(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Custom", "value")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Empty(t, payloads.Transactions[0].Context.Custom)
+}
+
+func TestNewHeaderCaptureDenylist(t *testing.T) {
+	hc := newHeaderCapture(strings.Split(config.DefaultCaptureHeadersDenylist, ",")...)
+	assert.Equal(t, map[string]bool{"Authorization": true, "Cookie": true, "Set-Cookie": true}, hc.denylist)
+
+	hc = newHeaderCapture("x-api-key", " ")
+	assert.Equal(t, map[string]bool{"X-Api-Key": true}, hc.denylist)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// Health check paths.
+const (
+	livenessPath  = "/healthz/live"
+	readinessPath = "/healthz/ready"
+)
+
+// healthCheckTimeout bounds the dependency checks of a readiness check.
+const healthCheckTimeout = 2 * time.Second
+
+// Server states reported by the health checks.
+const (
+	healthStarting int32 = iota
+	healthWarmingUp
+	healthServing
+	healthDraining
+)
+
+// Statuses reported by the health checks, for the server and for each
+// dependency.
+const (
+	healthStatusOK          = "ok"
+	healthStatusStarting    = "starting"
+	healthStatusWarmingUp   = "warming_up"
+	healthStatusDraining    = "draining"
+	healthStatusMaintenance = "maintenance"
+	healthStatusPending     = "pending"
+	healthStatusUnavailable = "unavailable"
+)
+
+// healthChecker serves the liveness and readiness checks. The server is
+// starting until serving is called, warming up while warmUp runs, and
+// draining once drain is called; its dependencies are checked as they
+// are set up. The zero value is starting, with no dependencies. The server is not ready while in
+// maintenance mode.
+type healthChecker struct {
+	state int32
+
+	mu          sync.Mutex
+	db          *sqlx.DB
+	migrated    bool
+	cache       *redisCacheStore
+	maintenance *maintenanceMode
+	warmer      *warmer
+}
+
+// healthStatus is the body of health check responses.
+type healthStatus struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyStatus `json:"checks,omitempty"`
+}
+
+// dependencyStatus is the status of a dependency checked by the
+// readiness check.
+type dependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// setDatabase records db, which is pinged by readiness checks.
+func (h *healthChecker) setDatabase(db *sqlx.DB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.db = db
+}
+
+// setMigrated records that the database schema has been applied.
+func (h *healthChecker) setMigrated() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.migrated = true
+}
+
+// setCache records store, which is pinged by readiness checks if it is
+// backed by Redis. The in-memory cache is always available.
+func (h *healthChecker) setCache(store persistence.CacheStore) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cache, _ = store.(*redisCacheStore)
+}
+
+// setMaintenance records m, which fails readiness checks while enabled.
+func (h *healthChecker) setMaintenance(m *maintenanceMode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.maintenance = m
+}
+
+// setWarmer records w, which warms the server up in warmUp.
+func (h *healthChecker) setWarmer(w *warmer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.warmer = w
+}
+
+// serving marks the server as started, and ready for traffic if its
+// dependencies are available.
+func (h *healthChecker) serving() {
+	if !atomic.CompareAndSwapInt32(&h.state, healthStarting, healthServing) {
+		atomic.CompareAndSwapInt32(&h.state, healthWarmingUp, healthServing)
+	}
+}
+
+// drain marks the server as draining, no longer ready for traffic.
+func (h *healthChecker) drain() {
+	atomic.StoreInt32(&h.state, healthDraining)
+}
+
+// handleLive serves the liveness check, which reports that the process
+// is up, responding with 503 only once the server begins draining.
+func (h *healthChecker) handleLive(c *gin.Context) {
+	if atomic.LoadInt32(&h.state) == healthDraining {
+		c.JSON(http.StatusServiceUnavailable, healthStatus{Status: healthStatusDraining})
+		return
+	}
+	c.JSON(http.StatusOK, healthStatus{Status: healthStatusOK})
+}
+
+// handleReady serves the readiness check, responding with 200 if the
+// server is serving and its dependencies are available, and 503 with the
+// status of each dependency otherwise.
+func (h *healthChecker) handleReady(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), healthCheckTimeout)
+	defer cancel()
+	status := h.check(ctx)
+	code := http.StatusOK
+	if status.Status != healthStatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, status)
+}
+
+// check returns the readiness of the server and its dependencies.
+func (h *healthChecker) check(ctx context.Context) healthStatus {
+	h.mu.Lock()
+	db, migrated, cache, maintenance := h.db, h.migrated, h.cache, h.maintenance
+	h.mu.Unlock()
+
+	status := healthStatus{Status: healthStatusOK, Checks: make(map[string]dependencyStatus)}
+	status.Checks["database"] = checkDependency(db != nil, func() error {
+		return db.PingContext(ctx)
+	})
+	status.Checks["migrations"] = checkDependency(migrated, nil)
+	if cache != nil {
+		status.Checks["cache"] = checkDependency(true, func() error {
+			return cache.ping(ctx)
+		})
+	}
+	for _, check := range status.Checks {
+		if check.Status != healthStatusOK {
+			status.Status = healthStatusUnavailable
+		}
+	}
+	if status.Status == healthStatusOK && maintenance.enabled() {
+		status.Status = healthStatusMaintenance
+	}
+	switch atomic.LoadInt32(&h.state) {
+	case healthStarting:
+		status.Status = healthStatusStarting
+	case healthWarmingUp:
+		status.Status = healthStatusWarmingUp
+	case healthDraining:
+		status.Status = healthStatusDraining
+	}
+	return status
+}
+
+// checkDependency returns the status of a dependency: pending if it is
+// not yet set up, or the result of ping, which may be nil.
+func checkDependency(setUp bool, ping func() error) dependencyStatus {
+	if !setUp {
+		return dependencyStatus{Status: healthStatusPending}
+	}
+	if ping != nil {
+		if err := ping(); err != nil {
+			return dependencyStatus{Status: healthStatusUnavailable, Error: err.Error()}
+		}
+	}
+	return dependencyStatus{Status: healthStatusOK}
+}
+
+// addHealthHandlers adds the health check handlers to r.
+func addHealthHandlers(r gin.IRoutes, h *healthChecker) {
+	r.GET(livenessPath, h.handleLive)
+	r.GET(readinessPath, h.handleReady)
+}
+
+// isHealthCheck reports whether req is a health check, which is not
+// traced: probes are frequent, and of no interest.
+func isHealthCheck(req *http.Request) bool {
+	return strings.HasPrefix(req.URL.Path, "/healthz/")
+}
+
+// newStartupRouter returns a router serving the health checks while the
+// server starts up, responding to other requests with 503.
+func newStartupRouter(h *healthChecker) *gin.Engine {
+	r := gin.New()
+	addHealthHandlers(r, h)
+	r.NoRoute(func(c *gin.Context) {
+		c.Header("Retry-After", "1")
+		abortWithStatus(c, http.StatusServiceUnavailable)
+	})
+	return r
+}
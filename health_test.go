@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func serveHealthCheck(t *testing.T, r http.Handler, path string) (int, healthStatus) {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var status healthStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status), w.Body.String())
+	return w.Code, status
+}
+
+func TestHealthChecks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	health := &healthChecker{}
+	r := newStartupRouter(health)
+
+	// While starting, the server is live but not ready, and its
+	// dependencies are pending until they are set up.
+	code, status := serveHealthCheck(t, r, livenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthStatus{Status: healthStatusOK}, status)
+	code, status = serveHealthCheck(t, r, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthStatus{
+		Status: healthStatusStarting,
+		Checks: map[string]dependencyStatus{
+			"database":   {Status: healthStatusPending},
+			"migrations": {Status: healthStatusPending},
+		},
+	}, status)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	db := newTestDB(t)
+	health.setDatabase(db)
+	health.setMigrated()
+	health.serving()
+	code, status = serveHealthCheck(t, r, readinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthStatus{
+		Status: healthStatusOK,
+		Checks: map[string]dependencyStatus{
+			"database":   {Status: healthStatusOK},
+			"migrations": {Status: healthStatusOK},
+		},
+	}, status)
+
+	// A failed database ping makes the server unready, but not unlive.
+	require.NoError(t, db.Close())
+	code, _ = serveHealthCheck(t, r, livenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	code, status = serveHealthCheck(t, r, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthStatusUnavailable, status.Status)
+	assert.Equal(t, dependencyStatus{
+		Status: healthStatusUnavailable,
+		Error:  "sql: database is closed",
+	}, status.Checks["database"])
+	assert.Equal(t, dependencyStatus{Status: healthStatusOK}, status.Checks["migrations"])
+
+	health.drain()
+	code, status = serveHealthCheck(t, r, livenessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthStatusDraining, status.Status)
+	code, status = serveHealthCheck(t, r, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthStatusDraining, status.Status)
+}
+
+func TestHealthChecksNotTraced(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	health := &healthChecker{}
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), health)
+	require.NoError(t, err)
+	defer cleanup()
+	health.serving()
+	recorder.ResetPayloads()
+
+	code, _ := serveHealthCheck(t, r, livenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = serveHealthCheck(t, r, readinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Transactions)
+}
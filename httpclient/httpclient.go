@@ -0,0 +1,79 @@
+// Package httpclient provides the transports and clients of the
+// server's outbound HTTP requests: those proxied to other opbeans
+// services, webhook deliveries, payment authorizations and the requests
+// the server sends to itself. The transports are shared by all clients,
+// and tuned to keep connections alive and reuse them, along with TLS
+// sessions, rather than dialing a new connection per request.
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+const (
+	// MaxIdleConnsPerHost is the number of idle connections kept alive
+	// to each host, so that concurrent requests to a host reuse them.
+	MaxIdleConnsPerHost = 32
+
+	// MaxIdleConns is the number of idle connections kept alive to all
+	// hosts.
+	MaxIdleConns = 256
+
+	// IdleConnTimeout is the time for which idle connections are kept
+	// alive.
+	IdleConnTimeout = 90 * time.Second
+
+	dialTimeout         = 10 * time.Second
+	keepAlive           = 30 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	external = newTransport(http.ProxyFromEnvironment, &tls.Config{})
+
+	// The local listener's certificate, if any, need not be valid for
+	// its address.
+	local = newTransport(nil, &tls.Config{InsecureSkipVerify: true})
+)
+
+func newTransport(proxy func(*http.Request) (*url.URL, error), tlsConfig *tls.Config) *http.Transport {
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: dialTimeout, KeepAlive: keepAlive}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          MaxIdleConns,
+		MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
+		IdleConnTimeout:       IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Transport returns the shared transport for requests to other
+// services. It is not traced, so that it may be wrapped by round
+// trippers which are in turn wrapped by apmhttp.WrapRoundTripper.
+func Transport() http.RoundTripper {
+	return external
+}
+
+// Client returns a client for requests to other services, sent through
+// the shared transport, traced by apmhttp, and bounded by timeout
+// unless zero.
+func Client(timeout time.Duration) *http.Client {
+	return apmhttp.WrapClient(&http.Client{Transport: external, Timeout: timeout})
+}
+
+// LocalClient returns a client for requests to the server's own
+// listener, sent through a transport shared by such clients, and
+// traced by apmhttp. The listener's certificate is not verified.
+func LocalClient() *http.Client {
+	return apmhttp.WrapClient(&http.Client{Transport: local})
+}
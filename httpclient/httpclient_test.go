@@ -0,0 +1,154 @@
+package httpclient_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/httpclient"
+)
+
+// newCountingServer starts a server, over TLS if useTLS is true, and
+// returns it along with a function returning the number of connections
+// it accepted.
+func newCountingServer(t *testing.T, useTLS bool, handler http.HandlerFunc) (*httptest.Server, func() int64) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv, func() int64 { return atomic.LoadInt64(&conns) }
+}
+
+func writeOK(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// get sends a GET request for url with client, and reads the response.
+func get(t *testing.T, ctx context.Context, client *http.Client, url string) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestConnectionReuse(t *testing.T) {
+	for name, test := range map[string]struct {
+		client *http.Client
+		tls    bool
+	}{
+		"client":    {client: httpclient.Client(time.Second)},
+		"transport": {client: &http.Client{Transport: apmhttp.WrapRoundTripper(httpclient.Transport())}},
+		"local":     {client: httpclient.LocalClient()},
+		"local_tls": {client: httpclient.LocalClient(), tls: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv, conns := newCountingServer(t, test.tls, writeOK)
+			for i := 0; i < 10; i++ {
+				get(t, context.Background(), test.client, srv.URL)
+			}
+			assert.Equal(t, int64(1), conns())
+		})
+	}
+}
+
+func TestClientsShareConnections(t *testing.T) {
+	// Each client sends its requests through the shared transport.
+	srv, conns := newCountingServer(t, false, writeOK)
+	for i := 0; i < 5; i++ {
+		get(t, context.Background(), httpclient.LocalClient(), srv.URL)
+	}
+	assert.Equal(t, int64(1), conns())
+}
+
+func TestConcurrentConnectionsKeptAlive(t *testing.T) {
+	// Each request is held until all are in flight, so that each has
+	// its own connection; they are then all reused.
+	const concurrency = 8
+	var inFlight sync.WaitGroup
+	inFlight.Add(concurrency)
+	srv, conns := newCountingServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("hold") != "" {
+			inFlight.Done()
+			inFlight.Wait()
+		}
+		writeOK(w, r)
+	})
+	client := httpclient.Client(10 * time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(t, context.Background(), client, srv.URL+"?hold=1")
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(concurrency), conns())
+	for i := 0; i < concurrency; i++ {
+		get(t, context.Background(), client, srv.URL)
+	}
+	assert.Equal(t, int64(concurrency), conns())
+}
+
+func TestLocalClientResumesTLSSessions(t *testing.T) {
+	var mu sync.Mutex
+	var resumed []bool
+	srv, conns := newCountingServer(t, true, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resumed = append(resumed, r.TLS.DidResume)
+		mu.Unlock()
+		writeOK(w, r)
+	})
+	srv.Config.SetKeepAlivesEnabled(false)
+
+	// Connections which are not kept alive resume the TLS session of
+	// the first one.
+	client := httpclient.LocalClient()
+	for i := 0; i < 3; i++ {
+		get(t, context.Background(), client, srv.URL)
+	}
+	assert.Equal(t, int64(3), conns())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []bool{false, true, true}, resumed)
+}
+
+func TestClientTraced(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	srv, _ := newCountingServer(t, false, writeOK)
+
+	tx := tracer.StartTransaction("name", "type")
+	get(t, apm.ContextWithTransaction(context.Background(), tx), httpclient.Client(time.Second), srv.URL)
+	tx.End()
+	tracer.Flush(nil)
+	spans := recorder.Payloads().Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, "external", spans[0].Type)
+}
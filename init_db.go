@@ -11,19 +11,36 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func initDatabase(db *sqlx.DB, driver string) error {
-	if orders, err := getOrders(context.Background(), db); err == nil {
+// initDatabase creates the database schema and seeds the database with
+// customers, products, and random orders, unless the database has already
+// been initialized. Each step is traced as a startup phase.
+func initDatabase(ctx context.Context, db *sqlx.DB, driver string) error {
+	if orders, err := getOrders(ctx, db); err == nil {
 		if len(orders) != 0 {
 			return nil
 		}
 	}
 
-	filenames := []string{
-		"schema_" + driver + ".sql",
-		"customers.sql",
-		"products.sql",
-	}
 	logrus.Infof("initializing %q database", driver)
+	if err := startupPhase(ctx, "migrate database", func(ctx context.Context) error {
+		return execSQLFiles(ctx, db, "schema_"+driver+".sql")
+	}); err != nil {
+		return err
+	}
+	return startupPhase(ctx, "seed database", func(ctx context.Context) error {
+		// Seeding executes thousands of statements, which are not traced
+		// individually so as not to exhaust the transaction's span limit.
+		if err := execSQLFiles(context.Background(), db, "customers.sql", "products.sql"); err != nil {
+			return err
+		}
+		const numOrders = 5000
+		logrus.Infof("generating %d random orders", numOrders)
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return opbeansdb.GenerateOrders(db, driver, numOrders, rng)
+	})
+}
+
+func execSQLFiles(ctx context.Context, db *sqlx.DB, filenames ...string) error {
 	for _, filename := range filenames {
 		logrus.Infof("executing %q", filename)
 		f, err := opbeansdb.SQL.Open(filename)
@@ -31,13 +48,9 @@ func initDatabase(db *sqlx.DB, driver string) error {
 			return err
 		}
 		defer f.Close()
-		if err := opbeansdb.ExecCommands(context.Background(), db, f); err != nil {
+		if err := opbeansdb.ExecCommands(ctx, db, f); err != nil {
 			return errors.Wrapf(err, "executing %q", filename)
 		}
 	}
-
-	const numOrders = 5000
-	logrus.Infof("generating %d random orders", numOrders)
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return opbeansdb.GenerateOrders(db, driver, numOrders, rng)
+	return nil
 }
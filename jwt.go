@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// authenticatedCustomerKey is the gin context key under which jwtAuth
+// records the claims of a valid bearer token.
+const authenticatedCustomerKey = "opbeans.authenticated_customer"
+
+// Reasons for rejecting a bearer token, returned in the "reason" field
+// of 401 error envelopes.
+const (
+	tokenErrorRequired = "token_required"
+	tokenErrorExpired  = "token_expired"
+	tokenErrorInvalid  = "token_invalid"
+)
+
+// customerClaims are the claims of a customer's bearer token.
+type customerClaims struct {
+	jwt.RegisteredClaims
+	CustomerID int    `json:"customer_id"`
+	Email      string `json:"email,omitempty"`
+}
+
+// jwtAuth returns a middleware which authenticates requests carrying a
+// bearer token, signed with HS256 using secret, and records the token's
+// claims in the gin context. Requests with an expired or invalid token
+// are rejected with 401, and are not reported as errors. Requests
+// without a bearer token, or all requests if secret is empty, are served
+// anonymously.
+func jwtAuth(secret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if len(secret) == 0 || !strings.HasPrefix(header, "Bearer ") {
+			c.Next()
+			return
+		}
+		var claims customerClaims
+		_, err := jwt.ParseWithClaims(
+			strings.TrimPrefix(header, "Bearer "), &claims,
+			func(*jwt.Token) (interface{}, error) { return secret, nil },
+			jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+		)
+		if err != nil {
+			code := tokenErrorInvalid
+			if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+				code = tokenErrorExpired
+			}
+			abortUnauthorized(c, "Bearer", code)
+			return
+		}
+		if claims.CustomerID <= 0 {
+			abortUnauthorized(c, "Bearer", tokenErrorInvalid)
+			return
+		}
+		c.Set(authenticatedCustomerKey, &claims)
+		c.Next()
+	}
+}
+
+// abortUnauthorized aborts the request with 401, challenging the client
+// to authenticate with the given scheme, and the JSON error envelope with
+// the given reason.
+func abortUnauthorized(c *gin.Context, scheme, reason string) {
+	c.Header("WWW-Authenticate", scheme+` realm="opbeans"`)
+	body := errorEnvelope(c, http.StatusUnauthorized)
+	body.Error.Reason = reason
+	c.AbortWithStatusJSON(http.StatusUnauthorized, body)
+}
+
+// authenticatedCustomer returns the claims recorded by jwtAuth, or nil if
+// the request is anonymous.
+func authenticatedCustomer(c *gin.Context) *customerClaims {
+	v, _ := c.Get(authenticatedCustomerKey)
+	claims, _ := v.(*customerClaims)
+	return claims
+}
+
+// requireCustomer is a middleware which rejects anonymous requests. It
+// must be installed after jwtAuth.
+func requireCustomer(c *gin.Context) {
+	if authenticatedCustomer(c) == nil {
+		abortUnauthorized(c, "Bearer", tokenErrorRequired)
+		return
+	}
+	c.Next()
+}
+
+// addCustomerHandlers adds the handlers for the authenticated customer
+// to r, which must be protected by jwtAuth and requireCustomer.
+func addCustomerHandlers(r *gin.RouterGroup, db *sqlx.DB) {
+	r.GET("", handleGetMe(db))
+	r.GET("/orders", handleGetMyOrders(db))
+}
+
+func handleGetMe(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerID := authenticatedCustomer(c).CustomerID
+		customer, err := getCustomer(c.Request.Context(), db, customerID)
+		if err != nil {
+			abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customerID))
+			return
+		}
+		if customer == nil {
+			abortWithError(c, apperr.New(apperr.NotFound, "customer not found", "customer_id", customerID))
+			return
+		}
+		renderJSON(c, http.StatusOK, customer)
+	}
+}
+
+func handleGetMyOrders(db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerID := authenticatedCustomer(c).CustomerID
+		orders, err := getCustomerOrders(c.Request.Context(), db, customerID)
+		if err != nil {
+			err := errors.Wrap(err, "failed to get customer orders")
+			abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customerID))
+			return
+		}
+		renderJSON(c, http.StatusOK, orders)
+	}
+}
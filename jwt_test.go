@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+var testJWTSecret = []byte("hunter2")
+
+// newTestToken returns a bearer token for the given customer, signed
+// with secret and expiring at expires.
+func newTestToken(t *testing.T, secret []byte, customerID int, email string, expires time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, customerClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expires)},
+		CustomerID:       customerID,
+		Email:            email,
+	})
+	signed, err := token.SignedString(secret)
+	require.NoError(t, err)
+	return signed
+}
+
+// newTestJWTRouter returns a router serving the API and customer
+// handlers, authenticating customers with testJWTSecret.
+func newTestJWTRouter(tracer *apm.Tracer, db *sqlx.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	addAPIHandlers(r.Group("/api", jwtAuth(testJWTSecret)), db, &businessMetrics{}, nil, nil, nil, nil)
+	addCustomerHandlers(r.Group("/api/me", jwtAuth(testJWTSecret), requireCustomer), db)
+	return r
+}
+
+func serveWithToken(r http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestJWTAuthClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var claims *customerClaims
+	r := gin.New()
+	r.GET("/", jwtAuth(testJWTSecret), func(c *gin.Context) {
+		claims = authenticatedCustomer(c)
+	})
+
+	token := newTestToken(t, testJWTSecret, 42, "bob@example.com", time.Now().Add(time.Hour))
+	w := serveWithToken(r, "GET", "/", "", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, claims)
+	assert.Equal(t, 42, claims.CustomerID)
+	assert.Equal(t, "bob@example.com", claims.Email)
+
+	// Requests without a token are anonymous.
+	w = serveWithToken(r, "GET", "/", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, claims)
+
+	// Tokens are ignored if no secret is configured.
+	r = gin.New()
+	r.GET("/", jwtAuth(nil), func(c *gin.Context) {
+		claims = authenticatedCustomer(c)
+	})
+	w = serveWithToken(r, "GET", "/", "", "garbage")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, claims)
+}
+
+func TestJWTAuthRejected(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestJWTRouter(tracer, newTestDB(t))
+	valid := time.Now().Add(time.Hour)
+
+	for name, test := range map[string]struct {
+		token string
+		code  string
+	}{
+		"expired":       {token: newTestToken(t, testJWTSecret, 1, "", time.Now().Add(-time.Minute)), code: tokenErrorExpired},
+		"bad_signature": {token: newTestToken(t, []byte("guess"), 1, "", valid), code: tokenErrorInvalid},
+		"malformed":     {token: "garbage", code: tokenErrorInvalid},
+		"no_customer":   {token: newTestToken(t, testJWTSecret, 0, "", valid), code: tokenErrorInvalid},
+		"anonymous":     {code: tokenErrorRequired},
+	} {
+		t.Run(name, func(t *testing.T) {
+			recorder.ResetPayloads()
+			w := serveWithToken(r, "GET", "/api/me", "", test.token)
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Equal(t, `Bearer realm="opbeans"`, w.Header().Get("WWW-Authenticate"))
+			body := decodeErrorEnvelope(t, w.Body.Bytes())
+			assert.Equal(t, apperr.Unauthenticated, body.Code)
+			assert.Equal(t, test.code, body.Reason)
+
+			// Rejected requests are not reported as errors.
+			tracer.Flush(nil)
+			assert.Empty(t, recorder.Payloads().Errors)
+		})
+	}
+
+	// Rejected tokens fail requests to the anonymous API too.
+	token := newTestToken(t, testJWTSecret, 1, "", time.Now().Add(-time.Minute))
+	w := serveWithToken(r, "GET", "/api/orders", "", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCustomerHandlers(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	r := newTestJWTRouter(tracer, db)
+	customer, err := getCustomer(context.Background(), db, 1)
+	require.NoError(t, err)
+	require.NotNil(t, customer)
+	token := newTestToken(t, testJWTSecret, 1, customer.Email, time.Now().Add(time.Hour))
+
+	w := serveWithToken(r, "GET", "/api/me", "", token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var me Customer
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &me))
+	assert.Equal(t, *customer, me)
+
+	// The customer is recorded in the transaction's user context.
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, &model.User{ID: "1", Email: customer.Email}, payloads.Transactions[0].Context.User)
+
+	// Orders are scoped to the authenticated customer.
+	ids := createTestOrders(t, db, 2)
+	w = serveWithToken(r, "GET", "/api/me/orders", "", token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var orders []Order
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &orders))
+	require.NotEmpty(t, orders)
+	assert.Equal(t, ids[1], orders[0].ID)
+	assert.Equal(t, ids[0], orders[1].ID)
+	for _, order := range orders {
+		assert.Equal(t, 1, order.CustomerID)
+	}
+
+	// Authenticated customers may only order for themselves.
+	body := `{"customer_id": 2, "lines": [{"id": 1, "amount": 1}]}`
+	w = serveWithToken(r, "POST", "/api/orders", body, token)
+	assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	body = `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`
+	w = serveWithToken(r, "POST", "/api/orders", body, token)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// Anonymous requests to the API are unchanged.
+	body = `{"customer_id": 2, "lines": [{"id": 1, "amount": 1}]}`
+	w = serveWithToken(r, "POST", "/api/orders", body, "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+// kafkaErrorInterval is the minimum interval between publish failures
+// reported to APM, so that an unavailable broker does not flood it with
+// errors.
+const kafkaErrorInterval = time.Minute
+
+// Kafka message headers holding the trace context of the publishing span,
+// in the Elastic and W3C formats, for consumers to continue the trace.
+const (
+	kafkaTraceparentHeader    = "elastic-apm-traceparent"
+	kafkaW3CTraceparentHeader = "traceparent"
+	kafkaEventTypeHeader      = "event_type"
+)
+
+// kafkaEventTypes holds the order event types published to Kafka.
+var kafkaEventTypes = map[string]bool{
+	orderEventCreated: true,
+}
+
+// kafkaWriter writes messages to Kafka. It is implemented by
+// *kafka.Writer, and faked in tests.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// newKafkaWriter returns a *kafka.Writer writing to topic on brokers.
+// Messages with the same key, the order ID, go to the same partition.
+func newKafkaWriter(brokers []string, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		MaxAttempts:  3,
+		RequiredAcks: kafka.RequireOne,
+		WriteTimeout: 10 * time.Second,
+
+		// Events are written one at a time, so there is no
+		// point waiting to fill a batch.
+		BatchTimeout: 10 * time.Millisecond,
+	}
+}
+
+// kafkaPublisher publishes order events to a Kafka topic.
+type kafkaPublisher struct {
+	tracer *apm.Tracer
+	writer kafkaWriter
+	topic  string
+
+	// errorInterval is the minimum interval between failures
+	// reported to APM. Failures in between are counted, and
+	// reported with the next failure reported.
+	errorInterval time.Duration
+	lastError     time.Time
+	suppressed    int
+}
+
+// newKafkaPublisher returns a kafkaPublisher publishing events to topic
+// with writer, and traced by tracer.
+func newKafkaPublisher(tracer *apm.Tracer, writer kafkaWriter, topic string) *kafkaPublisher {
+	return &kafkaPublisher{
+		tracer:        tracer,
+		writer:        writer,
+		topic:         topic,
+		errorInterval: kafkaErrorInterval,
+	}
+}
+
+// publishEvent publishes e, if it is of a type published to Kafka.
+// Failures are reported by reportError, and not returned, so that an
+// unavailable broker does not hold up the outbox; an error is returned
+// only if ctx is cancelled, in which case e is dispatched again.
+//
+// The publish is traced as a "task" transaction, continuing the trace in
+// which the event was published, with a messaging span for the write.
+// The span's trace context is injected into the message headers.
+func (p *kafkaPublisher) publishEvent(ctx context.Context, e orderEvent) error {
+	if !kafkaEventTypes[e.Type] {
+		return nil
+	}
+	tx := p.tracer.StartTransactionOptions("publish order event", "task", apm.TransactionOptions{
+		TraceContext: e.traceContext,
+	})
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("event_type", e.Type)
+		tx.Context.SetLabel("order_id", e.OrderID)
+	})
+
+	span, ctx := apm.StartSpan(ctx, "Kafka SEND to "+p.topic, "messaging.kafka.send")
+	traceContext := tx.TraceContext()
+	if !span.Dropped() {
+		traceContext = span.TraceContext()
+		span.Context.SetMessage(apm.MessageSpanContext{QueueName: p.topic})
+		span.Context.SetDestinationService(apm.DestinationServiceSpanContext{
+			Name:     "kafka",
+			Resource: "kafka/" + p.topic,
+		})
+	}
+	traceparent := apmhttp.FormatTraceparentHeader(traceContext)
+	payload, _ := json.Marshal(e) // orderEvent is always encodable
+	err := p.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(strconv.Itoa(e.OrderID)),
+		Value: payload,
+		Headers: []kafka.Header{
+			{Key: kafkaEventTypeHeader, Value: []byte(e.Type)},
+			{Key: kafkaTraceparentHeader, Value: []byte(traceparent)},
+			{Key: kafkaW3CTraceparentHeader, Value: []byte(traceparent)},
+		},
+	})
+	span.End()
+
+	if err == nil {
+		tx.Result = "success"
+		return nil
+	}
+	tx.Result = "failure"
+	p.reportError(tx, errors.Wrapf(err, "failed to publish order event to Kafka topic %s", p.topic))
+	return ctx.Err()
+}
+
+// reportError logs err, and reports it to APM, unless a failure was
+// reported less than errorInterval ago.
+func (p *kafkaPublisher) reportError(tx *apm.Transaction, err error) {
+	now := time.Now()
+	if !p.lastError.IsZero() && now.Sub(p.lastError) < p.errorInterval {
+		p.suppressed++
+		logrus.WithError(err).Debug("Kafka publish failed")
+		return
+	}
+	logrus.WithError(err).WithField("suppressed", p.suppressed).Error("Kafka publish failed")
+	if apmErr := p.tracer.NewError(err); apmErr != nil {
+		apmErr.SetTransaction(tx)
+		apmErr.Context.SetLabel("errors_suppressed", p.suppressed)
+		apmErr.Send()
+	}
+	p.lastError = now
+	p.suppressed = 0
+}
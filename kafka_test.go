@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// fakeKafkaWriter is an in-memory broker, recording the messages written
+// to it, or failing with err.
+type fakeKafkaWriter struct {
+	mu       sync.Mutex
+	err      error
+	messages []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) written() []kafka.Message {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]kafka.Message(nil), w.messages...)
+}
+
+func kafkaHeader(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestKafkaPublish(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	writer := &fakeKafkaWriter{}
+	p := newKafkaPublisher(tracer, writer, "orders")
+
+	checkout := tracer.StartTransaction("POST /api/orders", "request")
+	require.NoError(t, p.publishEvent(context.Background(), orderEvent{
+		Type:         orderEventCreated,
+		OrderID:      123,
+		Status:       jobStatePending,
+		traceContext: checkout.TraceContext(),
+	}))
+	checkout.End()
+
+	messages := writer.written()
+	require.Len(t, messages, 1)
+	msg := messages[0]
+	assert.Equal(t, "123", string(msg.Key))
+	assert.JSONEq(t, `{"type":"order_created","order_id":123,"status":"pending"}`, string(msg.Value))
+	assert.Equal(t, orderEventCreated, kafkaHeader(msg, kafkaEventTypeHeader))
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "publish order event", tx.Name)
+	assert.Equal(t, "task", tx.Type)
+	assert.Equal(t, "success", tx.Result)
+	assert.Equal(t, payloads.Transactions[1].TraceID, tx.TraceID)
+	assert.Equal(t, payloads.Transactions[1].ID, tx.ParentID)
+
+	require.Len(t, payloads.Spans, 1)
+	span := payloads.Spans[0]
+	assert.Equal(t, "Kafka SEND to orders", span.Name)
+	assert.Equal(t, "messaging", span.Type)
+	assert.Equal(t, "kafka", span.Subtype)
+	assert.Equal(t, "send", span.Action)
+	assert.Equal(t, &model.SpanContext{
+		Destination: &model.DestinationSpanContext{
+			Service: &model.DestinationServiceSpanContext{
+				Type:     "messaging",
+				Name:     "kafka",
+				Resource: "kafka/orders",
+			},
+		},
+		Message: &model.MessageSpanContext{
+			Queue: &model.MessageQueueSpanContext{Name: "orders"},
+		},
+	}, span.Context)
+
+	// The headers carry the span's trace context.
+	for _, key := range []string{kafkaTraceparentHeader, kafkaW3CTraceparentHeader} {
+		traceContext, err := apmhttp.ParseTraceparentHeader(kafkaHeader(msg, key))
+		require.NoError(t, err, key)
+		assert.Equal(t, apm.TraceID(tx.TraceID), traceContext.Trace)
+		assert.Equal(t, apm.SpanID(span.ID), traceContext.Span)
+	}
+}
+
+func TestKafkaPublishErrorsRateLimited(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	writer := &fakeKafkaWriter{err: errors.New("broker unavailable")}
+	p := newKafkaPublisher(tracer, writer, "orders")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, p.publishEvent(context.Background(), orderEvent{Type: orderEventCreated, OrderID: i}))
+	}
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 3)
+	for _, tx := range payloads.Transactions {
+		assert.Equal(t, "failure", tx.Result)
+	}
+	require.Len(t, payloads.Errors, 1)
+	assert.Equal(t,
+		"failed to publish order event to Kafka topic orders: broker unavailable",
+		payloads.Errors[0].Exception.Message,
+	)
+	assert.Equal(t, payloads.Transactions[0].ID, payloads.Errors[0].TransactionID)
+
+	// Once the interval has passed, the next failure is reported
+	// with the number suppressed.
+	p.lastError = time.Now().Add(-p.errorInterval)
+	recorder.ResetPayloads()
+	assert.NoError(t, p.publishEvent(context.Background(), orderEvent{Type: orderEventCreated, OrderID: 4}))
+	tracer.Flush(nil)
+	apmErrors := recorder.Payloads().Errors
+	require.Len(t, apmErrors, 1)
+	assert.Equal(t, model.IfaceMap{{Key: "errors_suppressed", Value: float64(2)}}, apmErrors[0].Context.Tags)
+}
+
+func TestKafkaPublishEventTypes(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	writer := &fakeKafkaWriter{}
+	p := newKafkaPublisher(tracer, writer, "orders")
+
+	// Status changes are not published.
+	require.NoError(t, p.publishEvent(context.Background(), orderEvent{Type: orderEventStatusChanged, OrderID: 1, Status: jobStateDone}))
+	assert.Empty(t, writer.written())
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Transactions)
+}
+
+func TestKafkaPublishFailureOutbox(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	writer := &fakeKafkaWriter{err: errors.New("broker unavailable")}
+	other := &fakeOutboxSink{}
+	d := newOutboxDispatcher(db, newKafkaPublisher(tracer, writer, "orders"), other)
+
+	// While the broker is unavailable, the other sinks keep receiving
+	// the events, which are not published to Kafka again once it is
+	// available.
+	createTestOrders(t, db, 2)
+	sent, err := d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Len(t, other.published(), 2)
+
+	writer.mu.Lock()
+	writer.err = nil
+	writer.mu.Unlock()
+	ids := createTestOrders(t, db, 1)
+	sent, err = d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Len(t, other.published(), 3)
+	messages := writer.written()
+	require.Len(t, messages, 1)
+	assert.Equal(t, strconv.Itoa(ids[0]), string(messages[0].Key))
+
+	// Events are dispatched again if publishing is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := newKafkaPublisher(tracer, &fakeKafkaWriter{err: context.Canceled}, "orders")
+	assert.Equal(t, context.Canceled, p.publishEvent(ctx, orderEvent{Type: orderEventCreated, OrderID: 1}))
+}
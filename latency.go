@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// latencyInjector delays requests on purpose, for demos of latency,
+// with delays drawn from a configured distribution and scaled per route.
+type latencyInjector struct {
+	latency config.Latency
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// newLatencyInjector returns a latencyInjector delaying requests as
+// configured by latency.
+func newLatencyInjector(latency config.Latency) *latencyInjector {
+	return &latencyInjector{
+		latency: latency,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// middleware delays requests other than health checks, admin requests
+// and static assets, which are not traced, by a duration drawn from the
+// distribution and scaled by the multiplier of the request's route. The
+// delay is recorded as a span named "artificial_delay", so that it is
+// attributable in traces. Requests whose context is cancelled during
+// the delay are aborted.
+func (inj *latencyInjector) middleware(c *gin.Context) {
+	req := c.Request
+	if isHealthCheck(req) || isAdminRequest(req) || isStaticAsset(req) {
+		c.Next()
+		return
+	}
+	d := inj.delay(c.FullPath())
+	if d <= 0 {
+		c.Next()
+		return
+	}
+	ctx := req.Context()
+	span, _ := apm.StartSpan(ctx, "artificial_delay", "app.delay")
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		span.End()
+	case <-ctx.Done():
+		timer.Stop()
+		span.End()
+		abortWithStatus(c, http.StatusServiceUnavailable)
+		return
+	}
+	c.Next()
+}
+
+// delay returns a delay drawn from the distribution, scaled by the
+// multiplier of route, if any.
+func (inj *latencyInjector) delay(route string) time.Duration {
+	ms := inj.sample()
+	if m, ok := inj.latency.Multipliers[route]; ok {
+		ms *= m
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// sample returns a delay in milliseconds drawn from the distribution.
+func (inj *latencyInjector) sample() float64 {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return inj.latency.Sample(inj.random)
+}
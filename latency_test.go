@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func newTestLatencyInjector(spec string) *latencyInjector {
+	latency, err := config.ParseLatency(spec)
+	if err != nil {
+		panic(err)
+	}
+	inj := newLatencyInjector(latency)
+	inj.random = rand.New(rand.NewSource(42))
+	return inj
+}
+
+func TestLatencySample(t *testing.T) {
+	const n = 10000
+	inj := newTestLatencyInjector("250")
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, 250.0, inj.sample())
+	}
+
+	inj = newTestLatencyInjector("100-300")
+	var sum float64
+	for i := 0; i < n; i++ {
+		ms := inj.sample()
+		require.True(t, ms >= 100 && ms <= 300, ms)
+		sum += ms
+	}
+	assert.InDelta(t, 200, sum/n, 5)
+
+	// The median of a lognormal distribution is e^mu, and nearly all
+	// samples lie within five standard deviations of the logarithm.
+	inj = newTestLatencyInjector("lognormal:4.6,0.5")
+	samples := make([]float64, n)
+	for i := range samples {
+		ms := inj.sample()
+		require.True(t, ms >= math.Exp(4.6-5*0.5) && ms <= math.Exp(4.6+5*0.5), ms)
+		samples[i] = ms
+	}
+	sort.Float64s(samples)
+	assert.InEpsilon(t, math.Exp(4.6), samples[n/2], 0.05)
+
+	inj = newTestLatencyInjector("lognormal:4.6,0")
+	assert.InDelta(t, math.Exp(4.6), inj.sample(), 1e-9)
+}
+
+func TestLatencyMultipliers(t *testing.T) {
+	inj := newTestLatencyInjector("10")
+	inj.latency.Multipliers = map[string]float64{"/api/stats": 3, "/api/products": 0}
+	assert.Equal(t, 30*time.Millisecond, inj.delay("/api/stats"))
+	assert.Equal(t, time.Duration(0), inj.delay("/api/products"))
+	assert.Equal(t, 10*time.Millisecond, inj.delay("/api/customers"))
+}
+
+func TestLatencySpan(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_LATENCY_MS", "20")
+	t.Setenv("OPBEANS_LATENCY_MULTIPLIERS", "/api/stats=3")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	for _, path := range []string{"/api/products", "/api/stats", livenessPath} {
+		assert.Equal(t, http.StatusOK, serveGet(r, path).Code, path)
+	}
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	delays := make(map[string]float64)
+	for _, span := range payloads.Spans {
+		if span.Name != "artificial_delay" {
+			continue
+		}
+		assert.Equal(t, "app", span.Type)
+		assert.Equal(t, "delay", span.Subtype)
+		for _, tx := range payloads.Transactions {
+			if tx.ID == span.TransactionID {
+				delays[tx.Name] = span.Duration
+			}
+		}
+	}
+
+	// Health checks are not delayed, and the stats are delayed by their
+	// multiplier.
+	require.Len(t, delays, 2)
+	assert.True(t, delays["GET /api/products"] >= 20, delays)
+	assert.True(t, delays["GET /api/stats"] >= 60, delays)
+}
+
+func TestLatencyCancelled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(newTestLatencyInjector("60000").middleware)
+	var handled bool
+	r.GET("/api/products", func(c *gin.Context) { handled = true })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	req := httptest.NewRequest("GET", "/api/products", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	r.ServeHTTP(w, req)
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.False(t, handled)
+}
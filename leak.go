@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// defaultGoroutineLeakRate is the proportion of requests which leak a
+// goroutine while leaking is enabled, unless another is requested.
+const defaultGoroutineLeakRate = 0.05
+
+// goroutineLeak leaks goroutines on purpose, for demos of leak
+// detection: while enabled, a proportion of requests each start a
+// goroutine blocked until the leak is stopped.
+type goroutineLeak struct {
+	enabledFlag uint32 // accessed atomically
+	rateBits    uint64 // math.Float64bits, accessed atomically
+	leaked      int64  // accessed atomically
+
+	mu      sync.Mutex
+	random  *rand.Rand
+	release chan struct{}
+}
+
+func newGoroutineLeak() *goroutineLeak {
+	return &goroutineLeak{
+		rateBits: math.Float64bits(defaultGoroutineLeakRate),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		release:  make(chan struct{}),
+	}
+}
+
+func (l *goroutineLeak) enabled() bool {
+	return atomic.LoadUint32(&l.enabledFlag) != 0
+}
+
+func (l *goroutineLeak) rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&l.rateBits))
+}
+
+// set enables or disables leaking, at the given rate if positive.
+// Disabling leaking does not release the goroutines already leaked.
+func (l *goroutineLeak) set(enabled bool, rate float64) {
+	if rate > 0 {
+		atomic.StoreUint64(&l.rateBits, math.Float64bits(rate))
+	}
+	var flag uint32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreUint32(&l.enabledFlag, flag)
+}
+
+// stop disables leaking and releases the leaked goroutines, by closing
+// the channel on which they are blocked.
+func (l *goroutineLeak) stop() {
+	l.set(false, 0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.release)
+	l.release = make(chan struct{})
+}
+
+// middleware leaks a goroutine for the proportion of requests given by
+// the rate while leaking is enabled, other than health checks and admin
+// requests, labeling their transactions "demo.goroutine_leaked".
+func (l *goroutineLeak) middleware(c *gin.Context) {
+	if !l.enabled() || isHealthCheck(c.Request) || isAdminRequest(c.Request) {
+		c.Next()
+		return
+	}
+	l.mu.Lock()
+	leak := l.random.Float64() < l.rate()
+	release := l.release
+	l.mu.Unlock()
+	if leak {
+		atomic.AddInt64(&l.leaked, 1)
+		go func() {
+			<-release
+			atomic.AddInt64(&l.leaked, -1)
+		}()
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("demo.goroutine_leaked", true)
+		})
+	}
+	c.Next()
+}
+
+// goroutineLeakRequest is the body of requests toggling the leak.
+type goroutineLeakRequest struct {
+	Enabled *bool    `json:"enabled" binding:"required"`
+	Rate    *float64 `json:"rate"`
+}
+
+// goroutineLeakStatus is the body of leak responses.
+type goroutineLeakStatus struct {
+	Enabled bool    `json:"enabled"`
+	Rate    float64 `json:"rate"`
+	Leaked  int64   `json:"leaked"`
+}
+
+func (l *goroutineLeak) status() goroutineLeakStatus {
+	return goroutineLeakStatus{
+		Enabled: l.enabled(),
+		Rate:    l.rate(),
+		Leaked:  atomic.LoadInt64(&l.leaked),
+	}
+}
+
+// handleGetGoroutineLeak reports whether goroutines are leaked, at what
+// rate, and how many are leaked.
+func handleGetGoroutineLeak(l *goroutineLeak) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, l.status())
+	}
+}
+
+// handleSetGoroutineLeak enables or disables leaking, at the rate given
+// by the request body if any, recording the change in the audit log.
+func handleSetGoroutineLeak(l *goroutineLeak, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req goroutineLeakRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		var rate float64
+		if req.Rate != nil {
+			rate = *req.Rate
+			if !(rate > 0 && rate <= 1) {
+				value := strconv.FormatFloat(rate, 'g', -1, 64)
+				abortWithError(c, apperr.New(apperr.Validation, "rate must be in the range (0,1]", "rate", value))
+				return
+			}
+		}
+		l.set(*req.Enabled, rate)
+		action := auditActionDisableGoroutineLeak
+		if *req.Enabled {
+			action = auditActionEnableGoroutineLeak
+		}
+		auditAdminAction(c, db, action)
+		renderJSON(c, http.StatusOK, l.status())
+	}
+}
+
+// handleStopGoroutineLeak disables leaking and releases the leaked
+// goroutines, recording the change in the audit log.
+func handleStopGoroutineLeak(l *goroutineLeak, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		l.stop()
+		auditAdminAction(c, db, auditActionStopGoroutineLeak)
+		renderJSON(c, http.StatusOK, l.status())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestGoroutineLeak(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	status := func() goroutineLeakStatus {
+		var status goroutineLeakStatus
+		w := serveAdmin(r, "GET", "/api/admin/demo/leak", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return status
+	}
+	assert.Equal(t, goroutineLeakStatus{Rate: defaultGoroutineLeakRate}, status())
+	for _, body := range []string{`{}`, `{"enabled": true, "rate": 0}`, `{"enabled": true, "rate": 1.5}`} {
+		assert.Equal(t, http.StatusBadRequest, serveAdmin(r, "POST", "/api/admin/demo/leak", body).Code, body)
+	}
+
+	// Every request leaks a goroutine at the rate 1, other than health
+	// checks and admin requests.
+	w := serveAdmin(r, "POST", "/api/admin/demo/leak", `{"enabled": true, "rate": 1}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+	const n = 50
+	before := runtime.NumGoroutine()
+	for i := 0; i < n; i++ {
+		require.Equal(t, http.StatusOK, serveGet(r, "/api/products").Code)
+	}
+	serveGet(r, livenessPath)
+	assert.Equal(t, goroutineLeakStatus{Enabled: true, Rate: 1, Leaked: n}, status())
+	assert.GreaterOrEqual(t, runtime.NumGoroutine()-before, n-10)
+
+	tracer.Flush(nil)
+	var leaked int
+	for _, tx := range recorder.Payloads().Transactions {
+		if transactionLabels(tx)["demo_goroutine_leaked"] == true {
+			leaked++
+			assert.Equal(t, "GET /api/products", tx.Name)
+		}
+	}
+	assert.Equal(t, n, leaked)
+
+	// Stopping the leak releases the goroutines, and disables leaking.
+	w = serveAdmin(r, "POST", "/api/admin/demo/leak/stop", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Eventually(t, func() bool { return status().Leaked == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return runtime.NumGoroutine()-before < 10 }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, status().Enabled)
+	serveGet(r, "/api/products")
+	assert.Zero(t, status().Leaked)
+}
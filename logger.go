@@ -1,7 +1,7 @@
 package main
 
 import (
-	"time"
+	"context"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -21,27 +21,29 @@ func (f *logLevelFlag) Set(s string) error {
 	return nil
 }
 
+// contextLogger returns a logger for the request handled by c,
+// whose entries include the request's trace context.
 func contextLogger(c *gin.Context) logrus.FieldLogger {
-	return logrus.WithFields(apmlogrus.TraceContext(c.Request.Context()))
+	return loggerFromContext(c.Request.Context())
 }
 
-func logrusMiddleware(c *gin.Context) {
-	start := time.Now()
-	method := c.Request.Method
-	path := c.Request.URL.Path
-	if rawQuery := c.Request.URL.RawQuery; rawQuery != "" {
-		path += "?" + rawQuery
+// loggerFromContext returns a logger whose entries include the trace
+// context for the transaction and span in ctx, and the request ID and
+// chaos scenario, if any. Error-level entries are reported to the tracer by the apmlogrus
+// hook, associated with the same transaction and span.
+func loggerFromContext(ctx context.Context) logrus.FieldLogger {
+	fields := apmlogrus.TraceContext(ctx)
+	if id := requestIDFromContext(ctx); id != "" {
+		if fields == nil {
+			fields = make(logrus.Fields, 1)
+		}
+		fields[requestIDField] = id
 	}
-	c.Next()
-
-	logger := contextLogger(c)
-	entry := logger.WithFields(logrus.Fields{
-		"path":      path,
-		"method":    method,
-		"duration":  time.Since(start),
-		"client-ip": c.ClientIP(),
-		"status":    c.Writer.Status(),
-	})
-	entry.Time = start
-	entry.Info()
+	if name := scenarioFromContext(ctx); name != "" {
+		if fields == nil {
+			fields = make(logrus.Fields, 1)
+		}
+		fields[scenarioField] = name
+	}
+	return logrus.WithFields(fields)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/module/apmlogrus"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestContextLoggerTraceContext(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	origOutput, origFormatter, origHooks := logger.Out, logger.Formatter, logger.Hooks
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.ReplaceHooks(make(logrus.LevelHooks))
+	logger.AddHook(&apmlogrus.Hook{Tracer: tracer})
+	defer func() {
+		logger.SetOutput(origOutput)
+		logger.SetFormatter(origFormatter)
+		logger.ReplaceHooks(origHooks)
+	}()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		contextLogger(c).Error("uh oh")
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	require.Len(t, payloads.Errors, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, tx.ID, payloads.Errors[0].TransactionID)
+	assert.Equal(t, "uh oh", payloads.Errors[0].Log.Message)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.NewDecoder(&buf).Decode(&entry))
+	assert.Equal(t, fmt.Sprintf("%x", tx.TraceID[:]), entry["trace.id"])
+	assert.Equal(t, fmt.Sprintf("%x", tx.ID[:]), entry["transaction.id"])
+}
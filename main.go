@@ -1,25 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
-	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"path/filepath"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cache"
 	"github.com/gin-contrib/cache/persistence"
-	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/gomodule/redigo/redis"
 	"github.com/jmoiron/sqlx"
@@ -27,10 +25,15 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"go.elastic.co/apm"
-	"go.elastic.co/apm/module/apmgin"
 	"go.elastic.co/apm/module/apmhttp"
 	"go.elastic.co/apm/module/apmlogrus"
+	"go.elastic.co/apm/module/apmprometheus"
 	"go.elastic.co/apm/module/apmsql"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+	"github.com/elastic/opbeans-go/httpclient"
+	"github.com/elastic/opbeans-go/payment"
 )
 
 const (
@@ -40,13 +43,21 @@ const (
 
 var (
 	listenAddr      = flag.String("listen", ":8000", "Address on which to listen for HTTP requests")
+	grpcListenAddr  = flag.String("grpc-listen", "", "Address on which to listen for gRPC requests, if any")
+	tlsCertFile     = flag.String("tls-cert", "", "TLS certificate file; if set with -tls-key, serve HTTPS and HTTP/2 ($OPBEANS_TLS_CERT)")
+	tlsKeyFile      = flag.String("tls-key", "", "TLS private key file ($OPBEANS_TLS_KEY)")
+	enableH2C       = flag.Bool("h2c", false, "Serve HTTP/2 over cleartext (h2c) on the HTTP listener")
 	backendAddrs    = flag.String("backend", "", "Comma-separated list of addresses of opbeans services to proxy API requests to ($OPBEANS_SERVICES)")
 	database        = flag.String("db", "sqlite3::memory:", "Database URL")
-	frontendDir     = flag.String("frontend", "frontend/build", "Frontend assets dir")
+	frontendDir     = flag.String("frontend", "frontend/build", "Frontend assets dir, unless embedded in the binary")
+	frontendDisk    = flag.Bool("frontend-disk", false, "Serve the -frontend dir, if it exists, rather than the frontend embedded in the binary")
 	cacheURL        = flag.String("cache", "inmem", "Cache URL ("+cacheURLFormat+")")
 	healthcheckAddr = flag.String("healthcheck", "", "Address to connect to for Docker healthchecking")
 	logLevel        = &logLevelFlag{Level: logrus.InfoLevel}
 	logJSON         = flag.Bool("log-json", false, "Format log records as JSON")
+	startupTracing  = flag.Bool("startup-tracing", true, "Trace the startup sequence")
+	envFile         = flag.String("env-file", "", "File of NAME=value options overriding the environment, re-read when reloading the configuration")
+	drainTimeout    = flag.Duration("drain-timeout", 30*time.Second, "Time to wait for in-flight requests to complete when shutting down")
 )
 
 func init() {
@@ -69,9 +80,10 @@ func main() {
 		return
 	}
 
-	// Instrument the default HTTP transport, so that outgoing
-	// (reverse-proxy) requests are reported as spans.
-	http.DefaultTransport = apmhttp.WrapRoundTripper(http.DefaultTransport)
+	// Record the result of sending data to the APM Server,
+	// for reporting by the admin API.
+	apm.DefaultTracer.Transport = &sendStatusTransport{Transport: apm.DefaultTracer.Transport}
+	setServiceVersion(apm.DefaultTracer, currentBuildInfo())
 
 	if err := Main(); err != nil {
 		logrus.Fatal(err)
@@ -79,145 +91,731 @@ func main() {
 }
 
 func Main() error {
-	frontendBuildDir := filepath.FromSlash(*frontendDir)
-	indexFilePath := filepath.Join(frontendBuildDir, "index.html")
-	faviconFilePath := filepath.Join(frontendBuildDir, "favicon.ico")
-	staticDirPath := filepath.Join(frontendBuildDir, "static")
-	imagesDirPath := filepath.Join(frontendBuildDir, "images")
-
-	var backendURLs []*url.URL
-	if *backendAddrs == "" {
-		*backendAddrs = os.Getenv("OPBEANS_SERVICES")
-	}
-	if *backendAddrs != "" {
-		for _, field := range strings.Split(*backendAddrs, ",") {
-			field = strings.TrimSpace(field)
-			if u, err := url.Parse(field); err == nil && u.Scheme != "" {
-				backendURLs = append(backendURLs, u)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(cfg.Diagnostics.LogLevel)
+	logEffectiveConfig(cfg)
+
+	// The health checks are served while the server starts up, reporting
+	// that it is not yet ready.
+	health := &healthChecker{}
+	handler := newSwitchHandler(newStartupRouter(health))
+	// The admin routes are served on a separate listener if configured.
+	servers := []*http.Server{newHTTPServer(cfg.Server.Listen, handler, cfg.Server.H2C)}
+	if cfg.Server.AdminListen != "" {
+		servers = append(servers, newAdminServer(cfg.Server.AdminListen, handler, cfg.Server.H2C))
+	}
+	if cfg.Server.TLSCert != "" {
+		tlsConfig, err := newTLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey, cfg.Server.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		for _, srv := range servers {
+			srv.TLSConfig = tlsConfig
+		}
+	}
+	closeServers := func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+	served := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			served <- listenAndServe(srv)
+		}(srv)
+	}
+
+	// HTTP requests are redirected to HTTPS if configured, on a separate
+	// listener which is closed without draining.
+	redirected := make(chan error, 1)
+	if cfg.Server.RedirectListen != "" {
+		redirectSrv := newRedirectServer(cfg.Server.RedirectListen, cfg.Server.Listen)
+		defer redirectSrv.Close()
+		go func() {
+			redirected <- redirectSrv.ListenAndServe()
+		}()
+	}
+
+	r, reloader, cleanup, err := startup(apm.DefaultTracer, cfg, health)
+	if err != nil {
+		closeServers()
+		return err
+	}
+	defer cleanup()
+	handler.set(r)
+
+	// The server is ready once warmed up. The warm-up is cancelled if
+	// the server stops first.
+	warmUpCtx, cancelWarmUp := context.WithCancel(context.Background())
+	defer cancelWarmUp()
+	go health.warmUp(warmUpCtx, time.Duration(cfg.Server.WarmUpTimeout))
+
+	// On SIGHUP, reload the configuration. On SIGTERM or SIGINT, drain
+	// the server's connections, and then stop the background workers,
+	// flush and close the tracer, and close the database with cleanup.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for draining := false; !draining; {
+		select {
+		case err := <-served:
+			closeServers()
+			return err
+		case err := <-redirected:
+			closeServers()
+			return errors.Wrap(err, "failed to serve HTTPS redirects")
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if _, err := reloader.reload(); err != nil {
+					logrus.WithError(err).Error("failed to reload configuration")
+				}
 				continue
 			}
-			// Not an absolute URL, so should be a host or host/port pair.
-			hostport := field
-			if _, _, err := net.SplitHostPort(hostport); err != nil {
-				// A bare host was specified; assume the same port
-				// that we're listening on.
-				_, port, err := net.SplitHostPort(*listenAddr)
-				if err != nil {
-					port = "3000"
-				}
-				hostport = net.JoinHostPort(hostport, port)
+			logrus.Infof("received %s, draining connections for up to %s", sig, time.Duration(cfg.Server.DrainTimeout))
+			draining = true
+		}
+	}
+	if err := drainServer(health, time.Duration(cfg.Server.DrainTimeout), servers...); err != nil {
+		logrus.WithError(err).Warn("failed to drain connections")
+	}
+	for range servers {
+		if err := <-served; err != http.ErrServerClosed {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadConfig loads the configuration from the flags and environment,
+// and the -env-file if any, returning an error listing every invalid
+// option.
+func loadConfig() (*config.Config, error) {
+	lookup := os.LookupEnv
+	if *envFile != "" {
+		env, err := config.ReadEnvFile(*envFile)
+		if err != nil {
+			return nil, err
+		}
+		lookup = func(name string) (string, bool) {
+			if value, ok := env[name]; ok {
+				return value, true
 			}
-			backendURLs = append(backendURLs, &url.URL{Scheme: "http", Host: hostport})
+			return os.LookupEnv(name)
 		}
 	}
+	cfg, err := config.Load(config.Flags{
+		Listen:         *listenAddr,
+		GRPCListen:     *grpcListenAddr,
+		TLSCert:        *tlsCertFile,
+		TLSKey:         *tlsKeyFile,
+		H2C:            *enableH2C,
+		Backend:        *backendAddrs,
+		Database:       *database,
+		Frontend:       *frontendDir,
+		FrontendDisk:   *frontendDisk,
+		Cache:          *cacheURL,
+		StartupTracing: *startupTracing,
+		DrainTimeout:   *drainTimeout,
+		LogLevel:       logLevel.Level,
+	}, lookup)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+	return cfg, nil
+}
 
-	// Read index.html, replace <head> with <head><script>...
-	// that injects the dynamic page load properties for RUM.
-	indexFileBytes, err := ioutil.ReadFile(indexFilePath)
+// logEffectiveConfig logs cfg as JSON, with its secrets redacted.
+func logEffectiveConfig(cfg *config.Config) {
+	encoded, err := json.Marshal(cfg)
 	if err != nil {
+		logrus.WithError(err).Warn("failed to encode configuration")
+		return
+	}
+	logrus.Infof("effective configuration: %s", encoded)
+}
+
+// startup prepares the server configured by cfg, returning the router to
+// serve, the reloader of its configuration, and a function which
+// releases the server's resources. The router
+// serves the health checks of health, whose dependencies are recorded as
+// they are set up.
+//
+// Unless disabled with -startup-tracing=false, the startup sequence is
+// traced as a single transaction with a span per phase, and errors from
+// failed phases are reported linked to the transaction. The transaction
+// is flushed before startup returns, and so before the server begins
+// accepting traffic.
+func startup(tracer *apm.Tracer, cfg *config.Config, health *healthChecker) (_ *gin.Engine, _ *configReloader, _ func(), resultErr error) {
+	// Resources are released on failure after the startup transaction
+	// is flushed, as they include the tracer.
+	var closers []func()
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	defer func() {
+		if resultErr != nil {
+			cleanup()
+		}
+	}()
+
+	ctx := context.Background()
+	if cfg.APM.StartupTracing {
+		tx := tracer.StartTransaction("startup", "app.startup")
+		ctx = apm.ContextWithTransaction(ctx, tx)
+		defer func() {
+			tx.Result = "success"
+			if resultErr != nil {
+				tx.Result = "failure"
+			}
+			tx.End()
+			tracer.Flush(nil)
+		}()
+	}
+
+	// The options are validated by config.Load; the phase prepares the
+	// components which they configure.
+	var (
+		headers       *headerCapture
+		reportConfig  *reportConfig
+		maintenance   *maintenanceMode
+		secure        *secureHeaders
+		indexTemplate *template.Template
+		assets        *staticAssets
+	)
+	if err := startupPhase(ctx, "parse config", func(ctx context.Context) error {
+		var err error
+		if cfg.APM.CaptureHeaders {
+			headers = newHeaderCapture(cfg.APM.CaptureHeadersDenylist...)
+		}
+		if reportConfig, err = newReportConfig(cfg.Reports); err != nil {
+			return err
+		}
+		if maintenance, err = newMaintenanceMode(cfg.Maintenance); err != nil {
+			return err
+		}
+		secure = newSecureHeaders(cfg.APM.RUMServerURL.URL, cfg.HTTP.SecureHeadersAPI, cfg.HTTP.CSPConnectSrc)
+		if cfg.Server.FrontendProxyURL.URL != nil {
+			// The frontend is served by its development server.
+			return nil
+		}
+		frontend, err := openFrontend(cfg.Server)
+		if err != nil {
+			return err
+		}
+		if indexTemplate, err = parseIndexTemplate(frontend, newRUMConfig(cfg.APM)); err != nil {
+			return err
+		}
+		assets, err = newStaticAssets(frontend)
 		return err
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+	health.setMaintenance(maintenance)
+	apiKeys := newAPIKeyring(cfg.Auth.APIKeys)
+	cors := newCORSPolicy(cfg.HTTP.CORSOrigins)
+	limits := bodyLimits{
+		maxBytes: cfg.HTTP.MaxRequestBodyBytes,
+		timeout:  time.Duration(cfg.HTTP.RequestBodyTimeout),
 	}
-	indexFileContent := strings.Replace(string(indexFileBytes), "<head>", `<head>
-<script type="text/javascript">
-  window.rumConfig = {
-    pageLoadTraceId: {{.TraceContext.Trace}},
-    pageLoadSpanId: {{.EnsureParent}},
-    pageLoadSampled: {{.Sampled}},
-  }
-</script>`, 1)
-	indexTemplate, err := template.New(indexTemplateName).Parse(indexFileContent)
+	accessLog, closeAccessLog, err := openAccessLog(cfg.Diagnostics.AccessLog)
 	if err != nil {
+		return nil, nil, nil, err
+	}
+	closers = append(closers, closeAccessLog)
+
+	var db *sqlx.DB
+	if err := startupPhase(ctx, "connect database", func(ctx context.Context) error {
+		var err error
+		db, err = newDatabase(ctx, string(cfg.Database))
 		return err
+	}); err != nil {
+		return nil, nil, nil, err
 	}
+	closers = append(closers, func() { db.Close() })
+	health.setDatabase(db)
 
-	db, err := newDatabase()
-	if err != nil {
+	// The tracer is closed after the background workers stop, and before
+	// the database is closed, so that the workers' final events are sent.
+	closers = append(closers, func() {
+		tracer.Flush(nil)
+		tracer.Close()
+	})
+	if err := initDatabase(ctx, db, db.DriverName()); err != nil {
+		return nil, nil, nil, err
+	}
+	health.setMigrated()
+
+	if cfg.Server.GRPCListen != "" {
+		if err := startupPhase(ctx, "start grpc server", func(ctx context.Context) error {
+			s := newGRPCServer(tracer, db)
+			addr, err := serveGRPC(s, cfg.Server.GRPCListen)
+			if err != nil {
+				return err
+			}
+			closers = append(closers, s.GracefulStop)
+			logrus.Infof("serving gRPC requests on %s", addr)
+			return nil
+		}); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	var cacheStore persistence.CacheStore
+	if err := startupPhase(ctx, "initialize cache", func(ctx context.Context) error {
+		var err error
+		cacheStore, err = newCache(string(cfg.Cache))
 		return err
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+	health.setCache(cacheStore)
+
+	metrics := &businessMetrics{}
+	requestMetrics := newHTTPMetrics()
+
+	// Closing the hub closes the order event WebSocket connections.
+	orderEvents := newOrderEventHub()
+	closers = append(closers, orderEvents.close)
+
+	// Order events are recorded in the outbox along with the orders,
+	// and dispatched to Kafka and webhooks from there. The outbox is
+	// dispatched even if neither is configured, so that it drains.
+	var sinks []outboxSink
+	if kafka := cfg.Events.Kafka; len(kafka.Brokers) > 0 {
+		writer := newKafkaWriter(kafka.Brokers, kafka.Topic)
+		closers = append(closers, func() { writer.Close() })
+		sinks = append(sinks, newKafkaPublisher(tracer, writer, kafka.Topic))
+	}
+	if webhooks := cfg.Events.Webhooks; len(webhooks.URLs) > 0 {
+		urls := make([]*url.URL, len(webhooks.URLs))
+		for i, u := range webhooks.URLs {
+			urls[i] = u.URL
+		}
+		sinks = append(sinks, newWebhookSender(tracer, urls, []byte(string(webhooks.Secret))))
 	}
-	defer db.Close()
+	outbox := newOutboxDispatcher(db, sinks...)
+	outbox.maintenance = maintenance
 
-	cacheStore, err := newCache()
+	// The registry's metrics are both served to Prometheus and gathered
+	// by the tracer, so that the two report the same values.
+	registry := newMetricsRegistry(
+		metrics, requestMetrics, dbStatsCollector{db},
+		outbox, fulfillmentQueueCollector{db},
+	)
+	closers = append(closers, tracer.RegisterMetricsGatherer(apmprometheus.Wrap(registry)))
+	outboxCtx, cancelOutbox := context.WithCancel(context.Background())
+	outboxDone := make(chan struct{})
+	go func() {
+		defer close(outboxDone)
+		outbox.run(outboxCtx, outboxPollInterval)
+	}()
+	closers = append(closers, func() {
+		cancelOutbox()
+		<-outboxDone
+	})
+
+	workerCtx, cancelWorker := context.WithCancel(context.Background())
+	workerDone := make(chan struct{})
+	worker := newFulfillmentWorker(tracer, db, orderEvents)
+	worker.maintenance = maintenance
+	go func() {
+		defer close(workerDone)
+		worker.run(workerCtx, cfg.Jobs.FulfillmentWorkers, fulfillmentPollInterval)
+	}()
+	closers = append(closers, func() {
+		cancelWorker()
+		<-workerDone
+	})
+
+	if amqp := cfg.Events.AMQP; amqp.URL.URL != nil {
+		consumer := newAMQPConsumer(tracer, db, amqp.URL.String(), amqp.Queue)
+		consumer.maintenance = maintenance
+		consumer.cache = cacheStore
+		consumerCtx, cancelConsumer := context.WithCancel(context.Background())
+		consumerDone := make(chan struct{})
+		go func() {
+			defer close(consumerDone)
+			consumer.run(consumerCtx)
+		}()
+		closers = append(closers, func() {
+			cancelConsumer()
+			<-consumerDone
+		})
+	}
+
+	var reports *reporter
+	if reportConfig != nil {
+		reports = newReporter(tracer, db, reportConfig)
+		reports.maintenance = maintenance
+		reportsCtx, cancelReports := context.WithCancel(context.Background())
+		reportsDone := make(chan struct{})
+		go func() {
+			defer close(reportsDone)
+			reports.run(reportsCtx)
+		}()
+		closers = append(closers, func() {
+			cancelReports()
+			<-reportsDone
+		})
+	}
+
+	exports, err := newExportStore(time.Duration(cfg.Jobs.ExportTTL))
 	if err != nil {
-		return err
+		return nil, nil, nil, err
+	}
+	closers = append(closers, exports.close)
+	cleanupCtx, cancelCleanup := context.WithCancel(context.Background())
+	cleanupDone := make(chan struct{})
+	go func() {
+		defer close(cleanupDone)
+		exports.runCleanup(cleanupCtx, exportCleanupInterval)
+	}()
+	closers = append(closers, func() {
+		cancelCleanup()
+		<-cleanupDone
+	})
+
+	// Rate limiting is installed on the API and admin routes, after
+	// authentication, so that authenticated clients are limited
+	// individually. Other routes, such as the frontend's static assets,
+	// are not limited. API keys are limited separately from other
+	// clients, by default at the same rate.
+	trustForwarded := cfg.HTTP.TrustForwardedHeaders
+	limiter := newRateLimiter(tracer,
+		newRateLimit(cfg.Limits.RateLimit),
+		newRateLimit(cfg.Limits.APIKeyRateLimit),
+		trustForwarded,
+	)
+	closers = append(closers, tracer.RegisterMetricsGatherer(limiter))
+
+	// Goroutine growth is sampled for reporting suspected leaks, such as
+	// those made on purpose by the leak demo.
+	detector := newGoroutineDetector(tracer,
+		cfg.Diagnostics.GoroutineGrowthThreshold,
+		time.Duration(cfg.Diagnostics.GoroutineGrowthWindow),
+	)
+	closers = append(closers, tracer.RegisterMetricsGatherer(detector))
+	detectorCtx, cancelDetector := context.WithCancel(context.Background())
+	detectorDone := make(chan struct{})
+	go func() {
+		defer close(detectorDone)
+		detector.run(detectorCtx, goroutineSampleInterval)
+	}()
+	closers = append(closers, func() {
+		cancelDetector()
+		<-detectorDone
+	})
+
+	// The settings read per request, and the rate limits, are replaced
+	// when the configuration is reloaded.
+	settings := newRuntimeSettings(cfg)
+	reloader := &configReloader{
+		load:     loadConfig,
+		settings: settings,
+		limiter:  limiter,
+		current:  cfg,
 	}
 
 	r := gin.New()
+	routes := make(routeOptionsMap)
 	r.Use(cache.Cache(&cacheStore))
-	r.Use(apmgin.Middleware(r))
-	r.Use(logrusMiddleware)
-
-	pprof.Register(r)
-	r.Static("/static", staticDirPath)
-	r.Static("/images", imagesDirPath)
-	r.StaticFile("/favicon.ico", faviconFilePath)
-	r.SetHTMLTemplate(indexTemplate)
-	r.GET("/", handleIndex)
-	r.GET("/oopsie", handleOopsie)
-	r.GET("/rum-config.js", handleRUMConfig)
-	r.Use(func(c *gin.Context) {
-		// Paths used by the frontend for state.
-		for _, prefix := range []string{
-			"/dashboard",
-			"/products",
-			"/customers",
-			"/orders",
-		} {
-			if strings.HasPrefix(c.Request.URL.Path, prefix) {
-				tx := apm.TransactionFromContext(c.Request.Context())
-				if tx != nil {
-					tx.Name = c.Request.Method + " " + prefix
-				}
-				handleIndex(c)
-				return
+	r.Use(requestMetrics.middleware)
+	r.Use(limits.middleware)
+	r.Use(tracingMiddleware(tracer, tracingOptions{
+		routes:                 routes,
+		headers:                headers,
+		ignoreForwardedHeaders: !trustForwarded,
+		ignore: func(req *http.Request) bool {
+			if !cfg.Diagnostics.MetricsTracing && req.URL.Path == metricsPath {
+				return true
 			}
-		}
-		c.Next()
+			if cfg.Server.FrontendProxyURL.URL != nil && isFrontendProxyRequest(req) {
+				return true
+			}
+			return isCORSPreflight(req) || isHealthCheck(req) || isPprofRequest(req) || isStaticAsset(req)
+		},
+	}))
+	r.Use(traceIDMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(baggageMiddleware)
+	r.Use(scenarioMiddleware(settings))
+	r.Use(spanAccountingMiddleware(cfg.APM.TransactionMaxSpans))
+	r.Use(serverTimingMiddleware)
+	r.Use(recoveryMiddleware(tracer))
+	r.Use(errorMiddleware(tracer))
+	r.Use(accessLog.middleware)
+	if cors != nil {
+		r.Use(cors.middleware)
+	}
+	r.Use(secure.middleware)
+	notFound := unknownRouteHandler("unknown route", http.StatusNotFound)
+	if cfg.Server.AdminListen != "" {
+		r.Use(partitionListeners(notFound))
+	}
+	r.Use(maintenance.middleware)
+	r.Use(newErrorInjector(settings, cfg.ErrorInjection.Seed).middleware)
+	if cfg.Latency.Distribution != "" {
+		r.Use(newLatencyInjector(cfg.Latency).middleware)
+	}
+	leak := newGoroutineLeak()
+	closers = append(closers, leak.stop)
+	contention := newContentionSimulator(tracer, db)
+	closers = append(closers, contention.stop)
+	r.Use(leak.middleware)
+
+	// Chaos scenarios combine the fault injection knobs, and expire so
+	// that demos heal themselves.
+	scenarios := newScenarioController(settings, leak, contention)
+	scenariosCtx, cancelScenarios := context.WithCancel(context.Background())
+	scenariosDone := make(chan struct{})
+	go func() {
+		defer close(scenariosDone)
+		scenarios.run(scenariosCtx, scenarioExpiryInterval)
+	}()
+	closers = append(closers, func() {
+		cancelScenarios()
+		<-scenariosDone
 	})
 
-	// Create API routes. We install middleware for /api which probabilistically
-	// proxies these requests to another opbeans service to demonstrate distributed
-	// tracing, and test agent compatibility.
-	proxyProbability := 0.5
-	if value := os.Getenv("OPBEANS_DT_PROBABILITY"); value != "" {
-		f, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return errors.Wrapf(err, "failed to parse OPBEANS_DT_PROBABILITY")
-		}
-		if f < 0.0 || f > 1.0 {
-			return errors.Errorf("invalid OPBEANS_DT_PROBABILITY value %s: out of range [0,1.0]", value)
+	// Error bursts raise the error rate during scheduled windows.
+	bursts := newErrorBurstScheduler(settings)
+	burstsCtx, cancelBursts := context.WithCancel(context.Background())
+	burstsDone := make(chan struct{})
+	go func() {
+		defer close(burstsDone)
+		bursts.run(burstsCtx, errorBurstInterval)
+	}()
+	closers = append(closers, func() {
+		cancelBursts()
+		<-burstsDone
+	})
+
+	// The frontend is served from its build, or by its development
+	// server if configured, in which case the frontend's routes are
+	// proxied before reaching the fallback to index.html.
+	if u := cfg.Server.FrontendProxyURL.URL; u != nil {
+		r.Use(frontendProxy(u))
+	} else {
+		serveAsset := assets.handler(notFound)
+		for _, route := range []string{"/static/*filepath", "/images/*filepath", "/favicon.ico"} {
+			r.GET(route, serveAsset)
+			r.HEAD(route, serveAsset)
 		}
-		proxyProbability = f
+		r.SetHTMLTemplate(indexTemplate)
+		r.GET("/", handleIndex)
+	}
+	r.GET("/oopsie", handleOopsie)
+	r.GET("/rum-config.js", handleRUMConfig(cfg.APM.RUMServerURL.URL))
+	r.GET("/rum-config.json", handleRUMConfigJSON(newRUMConfig(cfg.APM)))
+	addHealthHandlers(r, health)
+
+	// Create API routes. We install middleware for /api which probabilistically
+	// proxies these requests to another opbeans service to demonstrate
+	// distributed tracing, and test agent compatibility. The probability
+	// depends on the request's route class, such as "products". Services
+	// are skipped while their circuit breaker is open, and requests are
+	// served locally while all are open, or, if they do not write, when
+	// their service fails. Each attempt is bounded by a timeout, and sent
+	// again if the service cannot be dialed; the attempts are bounded by
+	// the inbound request's deadline, up to the handler timeout.
+	decider := newProxyDecider(settings, cfg.ErrorInjection.Seed)
+	backends := newBackendPool(cfg.Proxy)
+	proxyTransport := proxyAttempts{
+		timeout: time.Duration(cfg.Proxy.Timeout),
+		next: apmhttp.WrapRoundTripper(backendLabels{
+			next: newProxyFaults(settings, backendHealth{next: httpclient.Transport()}, cfg.ErrorInjection.Seed),
+		}),
 	}
-	rand.Seed(time.Now().UnixNano())
 	maybeProxy := func(c *gin.Context) {
-		if len(backendURLs) > 0 && rand.Float64() < proxyProbability {
-			u := backendURLs[rand.Intn(len(backendURLs))]
-			logrus.WithFields(apmlogrus.TraceContext(c.Request.Context())).Infof("proxying API request to %s", u)
-			httputil.NewSingleHostReverseProxy(u).ServeHTTP(c.Writer, c.Request)
+		if len(cfg.Proxy.Services) > 0 && decider.decide(c) {
+			attempt := backends.pick(stickyRoutingKey(c))
+			defer backends.done(attempt)
+			if attempt.circuit == circuitOpen {
+				contextLogger(c).Debug("all backend circuits are open, serving API request locally")
+				shortCircuit(c.Request, attempt)
+				tx := apm.TransactionFromContext(c.Request.Context())
+				ifSampled(tx, func() {
+					tx.Context.SetLabel("proxy_fallback", true)
+				})
+				c.Next()
+				return
+			}
+			u := attempt.backend.url
+			contextLogger(c).Infof("proxying API request to %s", u)
+			// The attempts are bounded by the time remaining for handling
+			// the inbound request, up to the handler timeout.
+			ctx, cancel := proxyBudget(
+				contextWithBackend(c.Request.Context(), attempt),
+				time.Duration(cfg.HTTP.HandlerTimeout),
+			)
+			defer cancel()
+			proxy := httputil.NewSingleHostReverseProxy(u)
+			director := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				director(req)
+				filterProxiedRequest(req, trustForwarded)
+				req.Host = u.Host
+			}
+			// Requests which do not write may fall back to the local
+			// handler, if enabled, when the backend fails.
+			fallback := cfg.Proxy.Fallback && isFallbackMethod(c.Request.Method)
+			var fellBack bool
+			proxy.ModifyResponse = func(resp *http.Response) error {
+				if fallback && resp.StatusCode >= http.StatusInternalServerError {
+					return backendFailed(resp)
+				}
+				filterProxiedResponse(resp)
+				resp.Body = transferCloser{ReadCloser: resp.Body, attempt: attempt}
+				return nil
+			}
+			proxy.FlushInterval = proxyFlushInterval
+			proxy.Transport = proxyTransport
+			proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+				if fallback && c.Request.Context().Err() == nil {
+					fellBack = true
+					fallBack(c, attempt, err)
+					return
+				}
+				contextLogger(c).WithError(err).Warnf("failed to proxy API request to %s", u)
+				if _, ok := apperr.As(err); ok {
+					// Timeouts are reported, naming the backend.
+					abortWithError(c, err)
+					return
+				}
+				// Other errors are logged rather than reported, as
+				// simulated failures are reported by proxyFaults.
+				status := http.StatusBadGateway
+				if err, ok := errors.Cause(err).(net.Error); ok && err.Timeout() {
+					status = http.StatusGatewayTimeout
+				}
+				abortWithStatus(c, status)
+			}
+			proxy.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+			if fellBack {
+				c.Next()
+				return
+			}
 			c.Abort()
 			return
 		}
 		c.Next()
 	}
-	apiGroup := r.Group("/api", maybeProxy)
-	addAPIHandlers(apiGroup, db)
 
-	return r.Run(*listenAddr)
-}
+	// The payments of orders are authorized, if enabled, by a simulated
+	// third-party provider served on the listener, so that checkouts
+	// are traced through an external request.
+	var payments *payment.Client
+	if cfg.Payment.Enabled {
+		r.POST(payment.AuthorizePath, gin.WrapH(payment.NewProvider(cfg.Payment)))
+		payments = payment.NewClient(
+			listenerURL(cfg.Server)+payment.AuthorizePath,
+			httpclient.LocalClient(), time.Duration(cfg.Payment.Timeout),
+		)
+	}
+
+	// Customers and machine clients are authenticated on all API routes
+	// other than the admin routes. Handlers are bounded by a timeout,
+	// longer for exports; proxied requests are bounded by the inbound
+	// request's deadline, up to the same timeout, as their budget.
+	// Anonymous product reads are cached.
+	authenticated := r.Group("/api", jwtAuth([]byte(string(cfg.Auth.JWTSecret))), apiKeyAuth(apiKeys), auditActorMiddleware)
+	apiTimeout := handlerTimeout(time.Duration(cfg.HTTP.HandlerTimeout))
+	exportTimeout := handlerTimeout(time.Duration(cfg.HTTP.ExportHandlerTimeout))
+	apiGroup := authenticated.Group("", limiter.middleware, maybeProxy, apiTimeout, responseCacheMiddleware(settings))
+	shortages := newStockShortageInjector(settings, cfg.ErrorInjection.Seed)
+	addAPIHandlers(apiGroup, db, metrics, orderEvents, settings, payments, shortages)
+
+	// Customer routes are never proxied, as the other opbeans services
+	// do not authenticate customers.
+	addCustomerHandlers(authenticated.Group("/me", requireCustomer, limiter.middleware, apiTimeout), db)
+
+	routes.handle(&r.RouterGroup, "GET", "/ws/orders", routeOptions{
+		transactionType: transactionTypeWebSocket,
+	}, limiter.middleware, handleOrderEventsWebSocket(orderEvents, orderEventsPingPeriod))
 
-func handleIndex(c *gin.Context) {
-	c.HTML(200, indexTemplateName, apm.TransactionFromContext(c.Request.Context()))
+	// GraphQL requests are never proxied, as the other opbeans
+	// services do not serve a GraphQL API.
+	authenticated.POST("/graphql", limiter.middleware, apiTimeout, handleGraphQL(newGraphQLSchema(db, settings), settings))
+
+	// The about endpoint describes this service, so is never proxied.
+	authenticated.GET("/about", limiter.middleware, handleAbout(tracer, currentBuildInfo(), reloader, db))
+
+	// Exports are never proxied: materialized exports are held by the
+	// service which created them.
+	authenticated.GET("/exports/orders.csv", limiter.middleware, exportTimeout, handleOrdersCSV(db))
+	authenticated.GET("/exports/:id", limiter.middleware, exportTimeout, handleGetExport(exports))
+
+	// Admin routes are never proxied.
+	adminUsername, adminPassword := cfg.Auth.AdminUser, string(cfg.Auth.AdminPassword)
+	adminMiddleware := []gin.HandlerFunc{adminAuth(adminUsername, adminPassword), auditActorMiddleware, limiter.middleware}
+	if cfg.Server.TLSClientCA != "" {
+		// Admins must also present a verified client certificate.
+		adminMiddleware = append([]gin.HandlerFunc{requireClientCert}, adminMiddleware...)
+	}
+	adminGroup := r.Group("/api/admin", adminMiddleware...)
+	addAdminHandlers(routes.group(adminGroup), tracer, reloader, db, exports, reports, apiKeys, maintenance, backends)
+	addCatalogHandlers(routes.group(adminGroup), db)
+	addDemoHandlers(routes.group(adminGroup), settings, leak, contention, scenarios, bursts, db)
+
+	// Metrics are scraped without credentials, unless configured to
+	// require the admin credentials.
+	metricsHandlers := []gin.HandlerFunc{handleMetrics(registry)}
+	if cfg.Diagnostics.MetricsAuth {
+		metricsHandlers = append([]gin.HandlerFunc{adminAuth(adminUsername, adminPassword)}, metricsHandlers...)
+	}
+	r.GET(metricsPath, metricsHandlers...)
+
+	// Profiles are only served if enabled, to the admin.
+	if cfg.Diagnostics.Pprof {
+		addPprofHandlers(r.Group("", adminAuth(adminUsername, adminPassword)))
+	}
+
+	// The frontend's client-side routes are served index.html. Other
+	// unknown routes and methods respond with the error envelope, and
+	// share a transaction name per method.
+	r.HandleMethodNotAllowed = true
+	r.NoRoute(spaFallback(notFound))
+	r.NoMethod(unknownRouteHandler("method not allowed", http.StatusMethodNotAllowed))
+
+	// Load is generated by the server itself if configured, through its
+	// listener, so that the requests are handled by the full middleware
+	// chain and traced end to end.
+	if cfg.SelfLoad.Enabled {
+		selfLoad := newSelfLoadGenerator(tracer, listenerURL(cfg.Server), cfg.SelfLoad.RPS)
+		selfLoad.maintenance = maintenance
+		selfLoadCtx, cancelSelfLoad := context.WithCancel(context.Background())
+		selfLoadDone := make(chan struct{})
+		go func() {
+			defer close(selfLoadDone)
+			selfLoad.run(selfLoadCtx)
+		}()
+		closers = append(closers, func() {
+			cancelSelfLoad()
+			<-selfLoadDone
+		})
+	}
+
+	health.setWarmer(newWarmer(tracer, db, cacheStore, settings, cfg.Server))
+	return r, reloader, cleanup, nil
 }
 
-func handleRUMConfig(c *gin.Context) {
-	apmServerURL := os.Getenv("ELASTIC_APM_JS_SERVER_URL")
-	if apmServerURL == "" {
-		apmServerURL = "http://localhost:8200"
-	} else {
-		apmServerURL = template.JSEscapeString(apmServerURL)
+// startupPhase calls f as a phase of the startup sequence traced in ctx,
+// reporting the error returned by f, if any.
+func startupPhase(ctx context.Context, name string, f func(ctx context.Context) error) error {
+	span, ctx := apm.StartSpan(ctx, name, "app.startup")
+	defer span.End()
+	if err := f(ctx); err != nil {
+		if e := apm.CaptureError(ctx, err); e != nil {
+			e.Send()
+		}
+		return err
 	}
-	content := fmt.Sprintf("window.elasticApmJsBaseServerUrl = '%s';\n", apmServerURL)
-	c.Data(200, "application/javascript", []byte(content))
+	return nil
 }
 
 func healthcheck() error {
@@ -231,13 +829,16 @@ func healthcheck() error {
 	return json.NewDecoder(resp.Body).Decode(&orders)
 }
 
-func newDatabase() (*sqlx.DB, error) {
-	fields := strings.SplitN(*database, ":", 2)
+// newDatabase connects to the database specified by dataSource, of the
+// form "<driver>:<connection-string>". The database is not initialized;
+// see initDatabase.
+func newDatabase(ctx context.Context, dataSource string) (*sqlx.DB, error) {
+	fields := strings.SplitN(dataSource, ":", 2)
 	if len(fields) != 2 {
 		return nil, errors.Errorf(
 			"expected database URL with format %q, got %q",
 			"<driver>:<connection-string>",
-			*database,
+			dataSource,
 		)
 	}
 	driver := fields[0]
@@ -245,31 +846,30 @@ func newDatabase() (*sqlx.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
-		db.Close()
-		return nil, err
-	}
-	dbx := sqlx.NewDb(db, driver)
-	if err := initDatabase(dbx, driver); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		db.Close()
 		return nil, err
 	}
-	return dbx, nil
+	return sqlx.NewDb(db, driver), nil
 }
 
-func newCache() (persistence.CacheStore, error) {
+// newCache returns the cache store specified by cacheURL, of the form
+// cacheURLFormat.
+func newCache(cacheURL string) (persistence.CacheStore, error) {
 	const defaultExpiration = time.Minute
-	if *cacheURL == "inmem" {
+	if cacheURL == "inmem" {
 		return persistence.NewInMemoryStore(defaultExpiration), nil
 	}
-	if !strings.HasPrefix(*cacheURL, "redis") {
+	if !strings.HasPrefix(cacheURL, "redis") {
 		return nil, errors.Errorf(
 			"invalid cache URL %q, expected %s",
-			*cacheURL, cacheURLFormat,
+			cacheURL, cacheURLFormat,
 		)
 	}
-	redisPool := newRedisPool(*cacheURL)
-	return persistence.NewRedisCacheWithPool(redisPool, defaultExpiration), nil
+	redisPool := newRedisPool(cacheURL)
+	store := newRedisCacheStore(persistence.NewRedisCacheWithPool(redisPool, defaultExpiration), cacheURL)
+	store.pool = redisPool
+	return store, nil
 }
 
 func newRedisPool(url string) *redis.Pool {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmsql"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// newTestDB returns a new, initialized, in-memory SQLite database.
+func newTestDB(tb testing.TB) *sqlx.DB {
+	db, err := apmsql.Open("sqlite3", ":memory:")
+	require.NoError(tb, err)
+	tb.Cleanup(func() { db.Close() })
+
+	// Each connection to ":memory:" opens a distinct database.
+	db.SetMaxOpenConns(1)
+	dbx := sqlx.NewDb(db, "sqlite3")
+	require.NoError(tb, initDatabase(context.Background(), dbx, "sqlite3"))
+	return dbx
+}
+
+// newTestAPIRouter returns a router serving the API handlers at /api,
+// traced by tracer.
+func newTestAPIRouter(tracer *apm.Tracer, db *sqlx.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	cacheStore := persistence.CacheStore(persistence.NewInMemoryStore(0))
+	r := gin.New()
+	r.Use(cache.Cache(&cacheStore))
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(traceIDMiddleware)
+	r.Use(recoveryMiddleware(tracer))
+	r.Use(errorMiddleware(tracer))
+	addAPIHandlers(r.Group("/api", auditActorMiddleware), db, &businessMetrics{}, nil, nil, nil, nil)
+	return r
+}
+
+// setTestStartupFlags sets the flags read by startup to serve an empty
+// frontend from a temporary database, until the test completes. The
+// database is a file, as each connection to ":memory:" opens a distinct
+// database.
+func setTestStartupFlags(t *testing.T) {
+	dir := t.TempDir()
+	indexFile := filepath.Join(dir, "index.html")
+	require.NoError(t, ioutil.WriteFile(indexFile, []byte("<html><head></head></html>"), 0644))
+	t.Cleanup(setFlag(frontendDir, dir))
+	t.Cleanup(setFlag(database, "sqlite3:"+filepath.Join(dir, "opbeans.db")))
+}
+
+// loadTestConfig loads the configuration from the flags and environment
+// set by the test.
+func loadTestConfig(t *testing.T) *config.Config {
+	cfg, err := loadConfig()
+	require.NoError(t, err)
+	return cfg
+}
+
+func TestStartupTracing(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	_, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	// startup flushes the tracer before returning.
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "startup", tx.Name)
+	assert.Equal(t, "success", tx.Result)
+
+	var spanNames []string
+	for _, span := range payloads.Spans {
+		if span.Type == "app" && span.Subtype == "startup" {
+			assert.Equal(t, tx.ID, span.ParentID)
+			spanNames = append(spanNames, span.Name)
+		}
+	}
+	assert.Equal(t, []string{
+		"parse config",
+		"connect database",
+		"migrate database",
+		"seed database",
+		"initialize cache",
+	}, spanNames)
+}
+
+func TestStartupTracingFailure(t *testing.T) {
+	defer setFlag(frontendDir, filepath.Join(t.TempDir(), "missing"))()
+
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	_, _, _, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.Error(t, err)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	require.Len(t, payloads.Errors, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "failure", tx.Result)
+	assert.Equal(t, tx.ID, payloads.Errors[0].TransactionID)
+	require.Len(t, payloads.Spans, 1)
+	assert.Equal(t, "parse config", payloads.Spans[0].Name)
+}
+
+// setFlag sets *p to value, returning a function which restores
+// its original value.
+func setFlag(p *string, value string) (restore func()) {
+	orig := *p
+	*p = value
+	return func() { *p = orig }
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// maintenanceRetryAfter is the delay after which clients are told to
+// retry requests rejected in maintenance mode.
+const maintenanceRetryAfter = time.Minute
+
+// maintenanceMode records whether the server is in maintenance mode, in
+// which requests other than the admin and operational ones are rejected
+// with 503, the background workers pause, and the readiness check fails.
+// The mode is optionally persisted to a file, so that it survives
+// restarts.
+type maintenanceMode struct {
+	// on is 1 while the mode is enabled, and read without locking mu.
+	on int32
+
+	// path is the file in which the mode is persisted, if any.
+	path string
+
+	// mu serializes changes to the mode, and guards resumed, which is
+	// closed when the mode is disabled.
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// newMaintenanceMode returns the maintenance mode configured by cfg. If
+// cfg.File exists, it records the mode, overriding cfg.Enabled.
+func newMaintenanceMode(cfg config.Maintenance) (*maintenanceMode, error) {
+	enabled := cfg.Enabled
+	if cfg.File != "" {
+		data, err := ioutil.ReadFile(cfg.File)
+		switch {
+		case err == nil:
+			if enabled, err = strconv.ParseBool(strings.TrimSpace(string(data))); err != nil {
+				return nil, errors.Wrapf(err, "invalid maintenance mode in %s", cfg.File)
+			}
+		case !os.IsNotExist(err):
+			return nil, errors.Wrap(err, "failed to read maintenance mode")
+		}
+	}
+	m := &maintenanceMode{path: cfg.File}
+	if enabled {
+		m.on = 1
+		m.resumed = make(chan struct{})
+	}
+	return m, nil
+}
+
+// enabled reports whether the mode is enabled. The nil mode is never
+// enabled.
+func (m *maintenanceMode) enabled() bool {
+	return m != nil && atomic.LoadInt32(&m.on) == 1
+}
+
+// set enables or disables the mode, persisting it first if configured
+// to. If it cannot be persisted, the mode is left unchanged.
+func (m *maintenanceMode) set(enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path != "" {
+		if err := writeFileAtomic(m.path, []byte(strconv.FormatBool(enabled)+"\n")); err != nil {
+			return errors.Wrap(err, "failed to persist maintenance mode")
+		}
+	}
+	if enabled == m.enabled() {
+		return nil
+	}
+	if enabled {
+		m.resumed = make(chan struct{})
+		atomic.StoreInt32(&m.on, 1)
+	} else {
+		atomic.StoreInt32(&m.on, 0)
+		close(m.resumed)
+	}
+	logrus.WithField("enabled", enabled).Info("maintenance mode changed")
+	return nil
+}
+
+// wait blocks while the mode is enabled, reporting false if ctx is
+// cancelled first. Background workers call wait before each unit of
+// work, so that they pause in maintenance mode.
+func (m *maintenanceMode) wait(ctx context.Context) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	resumed := m.resumed
+	enabled := m.enabled()
+	m.mu.Unlock()
+	if !enabled {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// middleware labels transactions served in maintenance mode, and rejects
+// requests with 503, and the reason "maintenance", unless they are exempt
+// from maintenance mode.
+func (m *maintenanceMode) middleware(c *gin.Context) {
+	if !m.enabled() {
+		c.Next()
+		return
+	}
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("maintenance", true)
+	})
+	if isMaintenanceExempt(c.Request) {
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(maintenanceRetryAfter/time.Second)))
+	body := errorEnvelope(c, http.StatusServiceUnavailable)
+	body.Error.Reason = "maintenance"
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, body)
+}
+
+// isMaintenanceExempt reports whether req is served in maintenance mode:
+// the admin routes, so that the mode can be disabled, and the health
+// checks, metrics and profiles, so that the server can be observed.
+func isMaintenanceExempt(req *http.Request) bool {
+	return isAdminRequest(req) || isHealthCheck(req)
+}
+
+// writeFileAtomic writes data to path by renaming a temporary file over
+// it, so that readers never see a partial write.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// maintenanceRequest is the body of maintenance mode requests.
+type maintenanceRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// maintenanceStatus is the body of maintenance mode responses.
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleGetMaintenance reports whether maintenance mode is enabled.
+func handleGetMaintenance(m *maintenanceMode) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, maintenanceStatus{Enabled: m.enabled()})
+	}
+}
+
+// handleSetMaintenance enables or disables maintenance mode, as given by
+// the request body, recording the change in the audit log.
+func handleSetMaintenance(m *maintenanceMode, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req maintenanceRequest
+		if !bindJSON(c, &req) {
+			return
+		}
+		if err := m.set(*req.Enabled); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		action := auditActionDisableMaintenance
+		if *req.Enabled {
+			action = auditActionEnableMaintenance
+		}
+		auditAdminAction(c, db, action)
+		renderJSON(c, http.StatusOK, maintenanceStatus{Enabled: m.enabled()})
+	}
+}
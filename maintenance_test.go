@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+)
+
+func serveGet(r http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_MAINTENANCE_FILE", filepath.Join(t.TempDir(), "maintenance"))
+	cfg := loadTestConfig(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	health := &healthChecker{}
+	r, _, cleanup, err := startup(tracer, cfg, health)
+	require.NoError(t, err)
+	defer func() { cleanup() }()
+	health.serving()
+
+	assert.Equal(t, http.StatusOK, serveGet(r, "/api/products").Code)
+	assert.Equal(t, http.StatusOK, serveGet(r, readinessPath).Code)
+	w := serveAdmin(r, "POST", "/api/admin/maintenance", `{"enabled": true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"enabled": true}`, w.Body.String())
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	// API and frontend requests are rejected.
+	for _, path := range []string{"/api/products", "/api/about", "/", "/orders"} {
+		w := serveGet(r, path)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+		assert.Equal(t, "60", w.Header().Get("Retry-After"), path)
+		body := decodeErrorEnvelope(t, w.Body.Bytes())
+		assert.Equal(t, apperr.Unavailable, body.Code, path)
+		assert.Equal(t, "maintenance", body.Reason, path)
+	}
+
+	// Admin, health and metrics requests are served, but the server is
+	// not ready.
+	w = serveAdmin(r, "GET", "/api/admin/maintenance", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"enabled": true}`, w.Body.String())
+	assert.Equal(t, http.StatusOK, serveGet(r, livenessPath).Code)
+	assert.Equal(t, http.StatusOK, serveGet(r, metricsPath).Code)
+	w = serveGet(r, readinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var status healthStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, healthStatusMaintenance, status.Status)
+
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.NotEmpty(t, transactions)
+	for _, tx := range transactions {
+		assert.Equal(t, true, transactionLabels(tx)["maintenance"], tx.Name)
+	}
+
+	// The mode survives a restart. Cleaning up closes the tracer.
+	cleanup()
+	tracer, recorder = transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err = startup(tracer, cfg, health)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, serveGet(r, "/api/products").Code)
+
+	w = serveAdmin(r, "POST", "/api/admin/maintenance", `{"enabled": false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, http.StatusOK, serveGet(r, "/api/products").Code)
+	assert.Equal(t, http.StatusOK, serveGet(r, readinessPath).Code)
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+	serveGet(r, "/api/products")
+	tracer.Flush(nil)
+	transactions = recorder.Payloads().Transactions
+	require.Len(t, transactions, 1)
+	assert.NotContains(t, transactionLabels(transactions[0]), "maintenance")
+
+	var actions []string
+	for _, entry := range getTestAuditLog(t, r, "").Entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Contains(t, actions, auditActionDisableMaintenance)
+	assert.Equal(t, http.StatusBadRequest, serveAdmin(r, "POST", "/api/admin/maintenance", `{}`).Code)
+}
+
+func TestMaintenanceModeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "maintenance")
+	m, err := newMaintenanceMode(config.Maintenance{Enabled: true, File: path})
+	require.NoError(t, err)
+	assert.True(t, m.enabled())
+
+	// The persisted mode overrides the configured default.
+	require.NoError(t, m.set(false))
+	m, err = newMaintenanceMode(config.Maintenance{Enabled: true, File: path})
+	require.NoError(t, err)
+	assert.False(t, m.enabled())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("maybe\n"), 0644))
+	_, err = newMaintenanceMode(config.Maintenance{File: path})
+	assert.Error(t, err)
+}
+
+func TestMaintenanceWorkerPause(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	_, err := db.Exec("INSERT INTO jobs (order_id) VALUES (1)")
+	require.NoError(t, err)
+
+	m, err := newMaintenanceMode(config.Maintenance{Enabled: true})
+	require.NoError(t, err)
+	worker := newFulfillmentWorker(tracer, db, nil)
+	worker.maintenance = m
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		worker.run(ctx, 2, 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// No jobs are processed until the mode is disabled.
+	time.Sleep(100 * time.Millisecond)
+	jobs, err := getFulfillmentJobs(context.Background(), db, jobStatePending)
+	require.NoError(t, err)
+	assert.Len(t, jobs, 1)
+
+	require.NoError(t, m.set(false))
+	assert.Eventually(t, func() bool {
+		jobs, err := getFulfillmentJobs(context.Background(), db, jobStateDone)
+		require.NoError(t, err)
+		return len(jobs) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestMaintenanceWaitCancelled(t *testing.T) {
+	m, err := newMaintenanceMode(config.Maintenance{Enabled: true})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, m.wait(ctx))
+
+	var nilMode *maintenanceMode
+	assert.True(t, nilMode.wait(ctx))
+	assert.False(t, nilMode.enabled())
+}
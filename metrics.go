@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// businessMetrics holds counters and gauges describing the shop's
+// activity, updated by the API handlers and reported as Prometheus and
+// APM metrics.
+//
+// businessMetrics implements prometheus.Collector. Collecting reads only
+// the in-memory counters, and never queries the database.
+type businessMetrics struct {
+	ordersCreated int64
+	revenueCents  int64
+	cartsActive   int64
+	cacheHits     int64
+	cacheMisses   int64
+}
+
+var (
+	ordersCreatedDesc = prometheus.NewDesc("orders_created_total", "Number of orders created.", nil, nil)
+	revenueCentsDesc  = prometheus.NewDesc("revenue_cents_total", "Revenue of the orders created, in cents.", nil, nil)
+	cartsActiveDesc   = prometheus.NewDesc("carts_active", "Number of checkouts in progress.", nil, nil)
+	cacheHitsDesc     = prometheus.NewDesc("cache_hits_total", "Number of cache lookups which were hits.", []string{"cache"}, nil)
+	cacheMissesDesc   = prometheus.NewDesc("cache_misses_total", "Number of cache lookups which were misses.", []string{"cache"}, nil)
+	cacheHitRatioDesc = prometheus.NewDesc("cache_hit_ratio", "Ratio of cache lookups which were hits.", []string{"cache"}, nil)
+)
+
+// Describe sends the descriptors of the business metrics to ch.
+func (bm *businessMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		ordersCreatedDesc, revenueCentsDesc, cartsActiveDesc,
+		cacheHitsDesc, cacheMissesDesc, cacheHitRatioDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect sends the business metrics to ch.
+func (bm *businessMetrics) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(ordersCreatedDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&bm.ordersCreated)))
+	ch <- prometheus.MustNewConstMetric(revenueCentsDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&bm.revenueCents)))
+	ch <- prometheus.MustNewConstMetric(cartsActiveDesc, prometheus.GaugeValue, float64(atomic.LoadInt64(&bm.cartsActive)))
+
+	var hitRatio float64
+	hits := atomic.LoadInt64(&bm.cacheHits)
+	misses := atomic.LoadInt64(&bm.cacheMisses)
+	if lookups := hits + misses; lookups > 0 {
+		hitRatio = float64(hits) / float64(lookups)
+	}
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(hits), "stats")
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(misses), "stats")
+	ch <- prometheus.MustNewConstMetric(cacheHitRatioDesc, prometheus.GaugeValue, hitRatio, "stats")
+}
+
+// orderCreated records the creation of an order with the given revenue.
+func (bm *businessMetrics) orderCreated(revenueCents int) {
+	atomic.AddInt64(&bm.ordersCreated, 1)
+	atomic.AddInt64(&bm.revenueCents, int64(revenueCents))
+}
+
+// cartOpened records the start of a checkout, returning a function
+// which must be called when the checkout completes.
+func (bm *businessMetrics) cartOpened() (closed func()) {
+	atomic.AddInt64(&bm.cartsActive, 1)
+	return func() { atomic.AddInt64(&bm.cartsActive, -1) }
+}
+
+// cacheLookup records a cache lookup, and whether or not it was a hit.
+func (bm *businessMetrics) cacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&bm.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&bm.cacheMisses, 1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmprometheus"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestBusinessMetrics(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	var metrics businessMetrics
+	tracer.RegisterMetricsGatherer(apmprometheus.Wrap(newMetricsRegistry(&metrics)))
+
+	metrics.orderCreated(1500)
+	metrics.cacheLookup(true)
+	metrics.cacheLookup(false)
+	closed := metrics.cartOpened()
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+
+	samples, labels := gatheredBusinessMetrics(t, recorder)
+	assert.Equal(t, model.Metric{Value: 1}, samples["orders_created_total"])
+	assert.Equal(t, model.Metric{Value: 1500}, samples["revenue_cents_total"])
+	assert.Equal(t, model.Metric{Value: 1}, samples["carts_active"])
+	assert.Equal(t, model.Metric{Value: 0.5}, samples["cache_hit_ratio"])
+	assert.Equal(t, model.StringMap{{Key: "cache", Value: "stats"}}, labels["cache_hit_ratio"])
+
+	// Counters must accumulate across sends, while
+	// gauges reflect the current state.
+	recorder.ResetPayloads()
+	metrics.orderCreated(500)
+	closed()
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+
+	samples, _ = gatheredBusinessMetrics(t, recorder)
+	assert.Equal(t, model.Metric{Value: 2}, samples["orders_created_total"])
+	assert.Equal(t, model.Metric{Value: 2000}, samples["revenue_cents_total"])
+	assert.Equal(t, model.Metric{Value: 0}, samples["carts_active"])
+}
+
+func gatheredBusinessMetrics(t *testing.T, recorder *transporttest.RecorderTransport) (map[string]model.Metric, map[string]model.StringMap) {
+	samples := make(map[string]model.Metric)
+	labels := make(map[string]model.StringMap)
+	for _, m := range recorder.Payloads().Metrics {
+		for name, sample := range m.Samples {
+			samples[name] = sample
+			labels[name] = m.Labels
+		}
+	}
+	require.Contains(t, samples, "orders_created_total")
+	return samples, labels
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const (
+	// ndjsonMediaType is the media type of newline-delimited JSON
+	// streams.
+	ndjsonMediaType = "application/x-ndjson"
+
+	// ndjsonFlushRows is the number of rows written to NDJSON streams
+	// between flushes.
+	ndjsonFlushRows = 100
+)
+
+// streamNDJSON streams the values emitted by scan to the client as
+// newline-delimited JSON, one value per line, flushing the response
+// every flushRows values. scan should emit values as they are read from
+// the database, so that the stream uses constant memory.
+//
+// The context passed to scan is cancelled when the client disconnects,
+// which cancels the query. If emit fails, scan should stop and return the
+// error. The transaction is labelled with the number of rows streamed.
+func streamNDJSON(c *gin.Context, flushRows int, scan func(ctx context.Context, emit func(v interface{}) error) error) {
+	c.Header("Content-Type", ndjsonMediaType)
+	c.Header("Vary", "Accept")
+	c.Status(http.StatusOK)
+
+	var rows int
+	enc := json.NewEncoder(c.Writer)
+	err := scan(c.Request.Context(), func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return errors.Wrap(err, "failed to write NDJSON row")
+		}
+		rows++
+		if rows%flushRows == 0 {
+			c.Writer.Flush()
+		}
+		return nil
+	})
+
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("rows_streamed", rows)
+	})
+	switch {
+	case err == nil:
+		c.Writer.Flush()
+	case c.Request.Context().Err() != nil:
+		contextLogger(c).WithError(err).Debug("client disconnected from NDJSON stream")
+	case !c.Writer.Written():
+		c.Writer.Header().Del("Content-Type")
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
+	default:
+		// The status has been sent, so the error can only be
+		// reported, and the stream truncated.
+		if e := apm.CaptureError(c.Request.Context(), err); e != nil {
+			e.Send()
+		}
+		contextLogger(c).WithError(err).Error("NDJSON stream failed")
+	}
+}
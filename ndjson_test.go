@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// getNDJSON requests path from server, accepting NDJSON.
+func getNDJSON(t *testing.T, ctx context.Context, url string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", ndjsonMediaType)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, ndjsonMediaType, resp.Header.Get("Content-Type"))
+	return resp
+}
+
+func transactionLabels(tx model.Transaction) map[string]interface{} {
+	labels := make(map[string]interface{})
+	for _, item := range tx.Context.Tags {
+		labels[item.Key] = item.Value
+	}
+	return labels
+}
+
+func TestNDJSONListEndpoints(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	server := httptest.NewServer(newTestAPIRouter(tracer, newTestDB(t)))
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		new  func() interface{}
+
+		// unlimited is true if the JSON list is limited, but the
+		// stream is not.
+		unlimited bool
+	}{
+		{"/api/products", func() interface{} { return &Product{} }, false},
+		{"/api/orders", func() interface{} { return &Order{} }, true},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path)
+			require.NoError(t, err)
+			var list []json.RawMessage
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+			resp.Body.Close()
+			tracer.Flush(nil)
+			recorder.ResetPayloads()
+
+			resp = getNDJSON(t, context.Background(), server.URL+test.path)
+			defer resp.Body.Close()
+			var streamed []json.RawMessage
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				v := test.new()
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), v))
+				streamed = append(streamed, append(json.RawMessage(nil), scanner.Bytes()...))
+			}
+			require.NoError(t, scanner.Err())
+			rows := len(streamed)
+			require.NotEmpty(t, list)
+			if test.unlimited {
+				require.True(t, len(streamed) > len(list))
+				streamed = streamed[:len(list)]
+			}
+			assert.Equal(t, list, streamed)
+
+			tracer.Flush(nil)
+			transactions := recorder.Payloads().Transactions
+			require.Len(t, transactions, 1)
+			assert.Equal(t, "HTTP 2xx", transactions[0].Result)
+			assert.Equal(t, float64(rows), transactionLabels(transactions[0])["rows_streamed"])
+		})
+	}
+}
+
+func TestStreamNDJSONIncremental(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	// The scan emits two rows, and then blocks until released,
+	// standing in for a slow query.
+	release := make(chan struct{})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		streamNDJSON(c, 2, func(ctx context.Context, emit func(interface{}) error) error {
+			for i := 1; i <= 4; i++ {
+				if i == 3 {
+					<-release
+				}
+				if err := emit(gin.H{"row": i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp := getNDJSON(t, context.Background(), server.URL)
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	for _, expected := range []string{`{"row":1}`, `{"row":2}`} {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, expected+"\n", line)
+	}
+
+	// The transaction ends when streaming completes.
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Transactions)
+
+	close(release)
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"row\":3}\n{\"row\":4}\n", string(rest))
+
+	require.Eventually(t, func() bool {
+		tracer.Flush(nil)
+		return len(recorder.Payloads().Transactions) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	tx := recorder.Payloads().Transactions[0]
+	assert.Equal(t, float64(4), transactionLabels(tx)["rows_streamed"])
+}
+
+func TestStreamNDJSONClientDisconnect(t *testing.T) {
+	cancelled := make(chan error, 1)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		streamNDJSON(c, 1, func(ctx context.Context, emit func(interface{}) error) error {
+			if err := emit(gin.H{"row": 1}); err != nil {
+				return err
+			}
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return ctx.Err()
+		})
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := getNDJSON(t, ctx, server.URL)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "{\"row\":1}\n", line)
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the scan to be cancelled")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go.elastic.co/apm"
+)
+
+// Order event types.
+const (
+	orderEventCreated       = "order_created"
+	orderEventStatusChanged = "status_changed"
+)
+
+// orderEvent is a notification of a new order, or of a change in an
+// order's fulfillment status.
+type orderEvent struct {
+	Type    string `json:"type"`
+	OrderID int    `json:"order_id"`
+	Status  string `json:"status"`
+
+	// IdempotencyKey uniquely identifies an event dispatched through
+	// the outbox, so that receivers can discard redeliveries.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// traceContext holds the trace context in which the event was
+	// published, so that its processing, such as webhook delivery,
+	// can continue the trace.
+	traceContext apm.TraceContext
+}
+
+// orderEventHub broadcasts order events to its subscribers, for pushing
+// to clients of the live notification endpoints.
+//
+// A nil *orderEventHub discards published events.
+type orderEventHub struct {
+	mu            sync.Mutex
+	subscriptions map[*orderEventSubscription]struct{}
+	closed        bool
+}
+
+func newOrderEventHub() *orderEventHub {
+	return &orderEventHub{subscriptions: make(map[*orderEventSubscription]struct{})}
+}
+
+// publish sends e to each subscriber. Publishing never blocks: the event
+// is dropped for subscribers whose buffers are full.
+func (h *orderEventHub) publish(e orderEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscriptions {
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// subscribe returns a new subscription to the hub's events, buffering up
+// to bufferSize events. If the hub has been closed, the subscription's
+// events channel is closed.
+func (h *orderEventHub) subscribe(bufferSize int) *orderEventSubscription {
+	s := &orderEventSubscription{hub: h, events: make(chan orderEvent, bufferSize)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.events)
+	} else {
+		h.subscriptions[s] = struct{}{}
+	}
+	return s
+}
+
+// close closes the events channels of all subscriptions, signalling to
+// subscribers that the server is stopping.
+func (h *orderEventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for s := range h.subscriptions {
+		delete(h.subscriptions, s)
+		close(s.events)
+	}
+}
+
+// orderEventSubscription is a subscription to an orderEventHub.
+type orderEventSubscription struct {
+	hub     *orderEventHub
+	events  chan orderEvent
+	dropped uint64 // accessed atomically
+}
+
+// droppedEvents returns the number of events dropped because the
+// subscription's buffer was full.
+func (s *orderEventSubscription) droppedEvents() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// unsubscribe removes the subscription from the hub. Its events channel
+// is not closed, so it must not be received from afterwards.
+func (s *orderEventSubscription) unsubscribe() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	delete(s.hub.subscriptions, s)
+}
@@ -14,6 +14,7 @@ type Order struct {
 	CreatedAt    time.Time          `json:"created_at"`
 	CustomerID   int                `json:"customer_id"`
 	CustomerName string             `json:"customer_name,omitempty"`
+	ShippedAt    *time.Time         `json:"shipped_at,omitempty"`
 	Lines        []ProductOrderLine `json:"lines,omitempty"`
 }
 
@@ -24,26 +25,69 @@ type ProductOrderLine struct {
 
 func getOrders(ctx context.Context, db *sqlx.DB) ([]Order, error) {
 	const limit = 1000
+	var orders []Order
+	err := scanOrders(ctx, db, limit, func(o Order) error {
+		orders = append(orders, o)
+		return nil
+	})
+	return orders, err
+}
+
+// scanOrders calls f with each order, without its lines, as they are
+// scanned from the result set. At most limit orders are scanned, if limit
+// is positive. If f returns an error, scanning stops and the error is
+// returned.
+func scanOrders(ctx context.Context, db *sqlx.DB, limit int, f func(Order) error) error {
 	queryString := `SELECT
   orders.id, orders.created_at,
   customers.id, customers.full_name
 FROM orders JOIN customers ON orders.customer_id=customers.id
 `
-	queryString += fmt.Sprintf("LIMIT %d\n", limit)
+	if limit > 0 {
+		queryString += fmt.Sprintf("LIMIT %d\n", limit)
+	}
 
+	defer startQuery(ctx)()
 	rows, err := db.QueryContext(ctx, queryString)
 	if err != nil {
-		return nil, errors.Wrap(err, "querying orders")
+		return errors.Wrap(err, "querying orders")
 	}
 	defer rows.Close()
 
-	var orders []Order
 	for rows.Next() {
 		var o Order
 		if err := rows.Scan(
 			&o.ID, &o.CreatedAt,
 			&o.CustomerID, &o.CustomerName,
 		); err != nil {
+			return err
+		}
+		if err := f(o); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// getCustomerOrders returns the orders of the customer with the given
+// ID, without their lines, most recent first.
+func getCustomerOrders(ctx context.Context, db *sqlx.DB, customerID int) ([]Order, error) {
+	const limit = 1000
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(fmt.Sprintf(`SELECT
+  orders.id, orders.created_at, orders.shipped_at
+FROM orders WHERE orders.customer_id=?
+ORDER BY orders.id DESC
+LIMIT %d`, limit)), customerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying customer orders")
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		o := Order{CustomerID: customerID}
+		if err := rows.Scan(&o.ID, &o.CreatedAt, &o.ShippedAt); err != nil {
 			return nil, err
 		}
 		orders = append(orders, o)
@@ -53,48 +97,70 @@ FROM orders JOIN customers ON orders.customer_id=customers.id
 
 func getOrder(ctx context.Context, db *sqlx.DB, id int) (*Order, error) {
 	queryString := db.Rebind(`SELECT
-  orders.id, orders.created_at, customer_id
+  orders.id, orders.created_at, orders.shipped_at, customer_id
 FROM orders WHERE orders.id=?`)
 
+	defer startQuery(ctx)()
 	row := db.QueryRowContext(ctx, queryString, id)
 	var order Order
-	if err := row.Scan(&order.ID, &order.CreatedAt, &order.CustomerID); err != nil {
+	if err := row.Scan(&order.ID, &order.CreatedAt, &order.ShippedAt, &order.CustomerID); err != nil {
 		return nil, errors.Wrap(err, "querying order")
 	}
 
-	queryString = db.Rebind(`SELECT
-  product_id, amount,
+	lines, err := getOrderLines(ctx, db, []int{id})
+	if err != nil {
+		return nil, err
+	}
+	order.Lines = lines[id]
+	return &order, nil
+}
+
+// getOrderLines returns the product order lines of the orders with the
+// given IDs, keyed by order ID.
+func getOrderLines(ctx context.Context, db *sqlx.DB, orderIDs []int) (map[int][]ProductOrderLine, error) {
+	if len(orderIDs) == 0 {
+		return nil, nil
+	}
+	queryString, args, err := sqlx.In(`SELECT
+  order_lines.order_id, product_id, amount,
   products.sku, products.name, products.description,
-  products.type_id, products.stock, products.cost, products.selling_price
+  products.type_id, product_types.name,
+  products.stock, products.cost, products.selling_price
 FROM products JOIN order_lines ON products.id=order_lines.product_id
-WHERE order_lines.order_id=?`)
+JOIN product_types ON products.type_id=product_types.id
+WHERE order_lines.order_id IN (?)`, orderIDs)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := db.QueryContext(ctx, queryString, id)
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "querying product order lines")
 	}
 	defer rows.Close()
 
-	var lines []ProductOrderLine
+	lines := make(map[int][]ProductOrderLine)
 	for rows.Next() {
+		var orderID int
 		var l ProductOrderLine
 		if err := rows.Scan(
-			&l.ID, &l.Amount,
+			&orderID, &l.ID, &l.Amount,
 			&l.SKU, &l.Name, &l.Description,
-			&l.TypeID, &l.Stock, &l.Cost, &l.SellingPrice,
+			&l.TypeID, &l.TypeName,
+			&l.Stock, &l.Cost, &l.SellingPrice,
 		); err != nil {
 			return nil, err
 		}
-		lines = append(lines, l)
+		lines[orderID] = append(lines[orderID], l)
 	}
-	order.Lines = lines
-	return &order, rows.Err()
+	return lines, rows.Err()
 }
 
-func createOrder(ctx context.Context, db *sqlx.DB, customer *Customer, lines []ProductOrderLine) (int, error) {
+func createOrder(ctx context.Context, db *sqlx.DB, customer *Customer, lines []ProductOrderLine) (int, int, error) {
 	tx, err := db.BeginTxx(ctx, nil)
 	if err != nil {
-		return -1, err
+		return -1, 0, err
 	}
 	defer tx.Rollback()
 
@@ -105,38 +171,90 @@ func createOrder(ctx context.Context, db *sqlx.DB, customer *Customer, lines []P
 	}
 	insertOrderStmt := db.Rebind("INSERT INTO orders (customer_id) VALUES (?) " + returningID)
 
+	defer startQuery(ctx)()
 	insertOrderLineStmt, err := tx.PrepareContext(ctx, db.Rebind(
 		"INSERT INTO order_lines (order_id, product_id, amount) VALUES(?, ?, ?)",
 	))
 	if err != nil {
-		return -1, errors.Wrap(err, "failed to prepare insert order lines statement")
+		return -1, 0, errors.Wrap(err, "failed to prepare insert order lines statement")
 	}
 	defer insertOrderLineStmt.Close()
 
 	var orderID int
 	if returningID == "" {
+		defer startQuery(ctx)()
 		result, err := tx.ExecContext(ctx, insertOrderStmt, customer.ID)
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 		rowID, err := result.LastInsertId()
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 		orderID = int(rowID)
 	} else {
+		defer startQuery(ctx)()
 		err := tx.QueryRowContext(ctx, insertOrderStmt, customer.ID).Scan(&orderID)
 		if err != nil {
-			return -1, err
+			return -1, 0, err
 		}
 	}
 	for _, line := range lines {
-		if _, err := insertOrderLineStmt.ExecContext(ctx, orderID, line.Product.ID, line.Amount); err != nil {
-			return -1, err
+		endQuery := startQuery(ctx)
+		_, err := insertOrderLineStmt.ExecContext(ctx, orderID, line.Product.ID, line.Amount)
+		endQuery()
+		if err != nil {
+			return -1, 0, err
 		}
 	}
+	if err := enqueueFulfillment(ctx, db, tx, orderID); err != nil {
+		return -1, 0, err
+	}
+	if err := recordChange(ctx, db, tx, changeEntityOrder, orderID, changeOpCreate); err != nil {
+		return -1, 0, err
+	}
+	if err := recordAudit(ctx, db, tx, changeOpCreate, changeEntityOrder, orderID, nil, newAuditedOrder(customer.ID, lines)); err != nil {
+		return -1, 0, err
+	}
+	if err := enqueueOutboxEvent(ctx, db, tx, orderEvent{
+		Type:    orderEventCreated,
+		OrderID: orderID,
+		Status:  jobStatePending,
+	}); err != nil {
+		return -1, 0, err
+	}
+
+	var revenue *int
+	defer startQuery(ctx)()
+	if err := tx.QueryRowContext(ctx, db.Rebind(`
+SELECT SUM(products.selling_price*order_lines.amount)
+FROM products JOIN order_lines ON products.id=order_lines.product_id
+WHERE order_lines.order_id=?`), orderID).Scan(&revenue); err != nil {
+		return -1, 0, errors.Wrap(err, "querying order revenue")
+	}
 	if err := tx.Commit(); err != nil {
-		return -1, err
+		return -1, 0, err
+	}
+	loggerFromContext(ctx).Debugf("created order %d for customer %d", orderID, customer.ID)
+	return orderID, maybeInt(revenue), nil
+}
+
+// auditedOrder holds the fields of new orders recorded in the audit
+// log. Order lines are recorded without the details of their products.
+type auditedOrder struct {
+	CustomerID int                `json:"customer_id"`
+	Lines      []auditedOrderLine `json:"lines"`
+}
+
+type auditedOrderLine struct {
+	ID     int `json:"id"`
+	Amount int `json:"amount"`
+}
+
+func newAuditedOrder(customerID int, lines []ProductOrderLine) auditedOrder {
+	order := auditedOrder{CustomerID: customerID, Lines: make([]auditedOrderLine, len(lines))}
+	for i, line := range lines {
+		order.Lines[i] = auditedOrderLine{ID: line.Product.ID, Amount: line.Amount}
 	}
-	return orderID, nil
+	return order
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+const (
+	// outboxPollInterval is the interval at which the outbox dispatcher
+	// polls for unsent events when the outbox is empty, or dispatching
+	// has failed.
+	outboxPollInterval = time.Second
+
+	// outboxBatchSize is the maximum number of events read from the
+	// outbox at a time.
+	outboxBatchSize = 100
+)
+
+// outboxSink is a destination for events dispatched from the outbox,
+// implemented by kafkaPublisher and webhookSender.
+type outboxSink interface {
+	// publishEvent publishes e. Sinks ignore events of types they
+	// do not publish, and report the events they fail to publish
+	// rather than returning the failures, so that a failing sink
+	// holds up neither the other sinks nor the events behind e. An
+	// error is returned only if ctx is cancelled, in which case e is
+	// dispatched again.
+	publishEvent(ctx context.Context, e orderEvent) error
+}
+
+// enqueueOutboxEvent records e in the outbox within tx, so that it is
+// dispatched if and only if tx is committed. The event is given a new
+// idempotency key, and the trace context of the transaction in ctx.
+func enqueueOutboxEvent(ctx context.Context, db *sqlx.DB, tx *sqlx.Tx, e orderEvent) error {
+	var keyBytes [16]byte
+	if _, err := rand.Read(keyBytes[:]); err != nil {
+		return errors.Wrap(err, "failed to generate idempotency key")
+	}
+	e.IdempotencyKey = hex.EncodeToString(keyBytes[:])
+	payload, _ := json.Marshal(e) // orderEvent is always encodable
+
+	var traceparent sql.NullString
+	if apmTx := apm.TransactionFromContext(ctx); apmTx != nil {
+		traceparent.String = apmhttp.FormatTraceparentHeader(apmTx.TraceContext())
+		traceparent.Valid = true
+	}
+	defer startQuery(ctx)()
+	if _, err := tx.ExecContext(ctx, db.Rebind(`
+INSERT INTO outbox (event_type, idempotency_key, payload, traceparent, created_at)
+VALUES (?, ?, ?, ?, ?)`), e.Type, e.IdempotencyKey, string(payload), traceparent, time.Now().UTC()); err != nil {
+		return errors.Wrap(err, "enqueueing outbox event")
+	}
+	return nil
+}
+
+// outboxDispatcher publishes the events recorded in the outbox to its
+// sinks, marking them sent once every sink has published them.
+//
+// Delivery is at-least-once: an event is dispatched again if the
+// dispatcher stops before marking it sent, so sinks may receive an event
+// more than once, with the same idempotency key. Events which a sink
+// fails to publish are reported by the sink, and not dispatched again.
+type outboxDispatcher struct {
+	db        *sqlx.DB
+	sinks     []outboxSink
+	batchSize int
+
+	// maintenance pauses dispatching while enabled. It may be nil.
+	maintenance *maintenanceMode
+}
+
+func newOutboxDispatcher(db *sqlx.DB, sinks ...outboxSink) *outboxDispatcher {
+	return &outboxDispatcher{db: db, sinks: sinks, batchSize: outboxBatchSize}
+}
+
+// run dispatches events until ctx is cancelled, polling the outbox at
+// the given interval while it is empty, and pausing before each batch in
+// maintenance mode.
+func (d *outboxDispatcher) run(ctx context.Context, interval time.Duration) {
+	for {
+		if !d.maintenance.wait(ctx) {
+			return
+		}
+		n, err := d.dispatchBatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("failed to dispatch outbox events")
+		}
+		if err == nil && n == d.batchSize {
+			// There may be more events waiting.
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// outboxRow is an unsent event read from the outbox.
+type outboxRow struct {
+	ID          int            `db:"id"`
+	Payload     string         `db:"payload"`
+	Traceparent sql.NullString `db:"traceparent"`
+}
+
+// dispatchBatch publishes up to batchSize unsent events, in the order
+// they were recorded, returning the number marked sent. Dispatching
+// stops at the first event which fails to be published, so that events
+// are not published out of order, or if ctx is cancelled.
+func (d *outboxDispatcher) dispatchBatch(ctx context.Context) (int, error) {
+	var rows []outboxRow
+	if err := d.db.SelectContext(ctx, &rows, d.db.Rebind(
+		"SELECT id, payload, traceparent FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT ?",
+	), d.batchSize); err != nil {
+		return 0, errors.Wrap(err, "querying outbox")
+	}
+
+	var sent int
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		var e orderEvent
+		if err := json.Unmarshal([]byte(row.Payload), &e); err != nil {
+			// The event can never be published, so mark it sent
+			// rather than blocking the events behind it.
+			logrus.WithError(err).WithField("outbox_id", row.ID).Error("discarding undecodable outbox event")
+		} else {
+			e.traceContext, _ = parseTraceparent(row.Traceparent.String)
+			for _, sink := range d.sinks {
+				if err := sink.publishEvent(ctx, e); err != nil {
+					return sent, errors.Wrapf(err, "failed to publish outbox event %d", row.ID)
+				}
+			}
+		}
+		// The event has been published, so mark it sent even if ctx
+		// has been cancelled in the meantime, to avoid publishing it
+		// again.
+		if _, err := d.db.ExecContext(context.Background(), d.db.Rebind(
+			"UPDATE outbox SET sent_at=? WHERE id=? AND sent_at IS NULL",
+		), time.Now().UTC(), row.ID); err != nil {
+			return sent, errors.Wrapf(err, "failed to mark outbox event %d sent", row.ID)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+var (
+	outboxPendingDesc = prometheus.NewDesc("outbox_pending", "Number of unsent events in the outbox.", nil, nil)
+	outboxLagDesc     = prometheus.NewDesc("outbox_lag_seconds", "Age of the oldest unsent event in the outbox.", nil, nil)
+)
+
+// Describe sends the descriptors of the outbox metrics to ch.
+func (d *outboxDispatcher) Describe(ch chan<- *prometheus.Desc) {
+	ch <- outboxPendingDesc
+	ch <- outboxLagDesc
+}
+
+// Collect reports the number of unsent events in the outbox, and the age
+// of the oldest, as a measure of dispatch lag. Nothing is reported if the
+// outbox cannot be queried.
+func (d *outboxDispatcher) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	pending, lag, err := d.lag(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("failed to collect outbox metrics")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(outboxPendingDesc, prometheus.GaugeValue, float64(pending))
+	ch <- prometheus.MustNewConstMetric(outboxLagDesc, prometheus.GaugeValue, lag)
+}
+
+// lag returns the number of unsent events in the outbox, and the age of
+// the oldest in seconds.
+func (d *outboxDispatcher) lag(ctx context.Context) (pending int, lag float64, _ error) {
+	if err := d.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM outbox WHERE sent_at IS NULL",
+	).Scan(&pending); err != nil {
+		return 0, 0, errors.Wrap(err, "counting unsent outbox events")
+	}
+	if pending > 0 {
+		// MIN(created_at) would lose the column type in SQLite, so
+		// that it could not be scanned into a time.Time.
+		var oldest time.Time
+		err := d.db.QueryRowContext(ctx,
+			"SELECT created_at FROM outbox WHERE sent_at IS NULL ORDER BY id LIMIT 1",
+		).Scan(&oldest)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, 0, errors.Wrap(err, "querying oldest unsent outbox event")
+		}
+		if err == nil {
+			lag = time.Since(oldest).Seconds()
+		}
+	}
+	return pending, lag, nil
+}
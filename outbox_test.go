@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmprometheus"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// fakeOutboxSink records the events published to it. If set, publish is
+// called with the number of each publication, before it is recorded.
+type fakeOutboxSink struct {
+	mu      sync.Mutex
+	events  []orderEvent
+	publish func(n int) error
+}
+
+func (s *fakeOutboxSink) publishEvent(ctx context.Context, e orderEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.publish != nil {
+		if err := s.publish(len(s.events) + 1); err != nil {
+			return err
+		}
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *fakeOutboxSink) published() []orderEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]orderEvent(nil), s.events...)
+}
+
+// createTestOrders creates n orders for customer 1, returning their IDs.
+func createTestOrders(t *testing.T, db *sqlx.DB, n int) []int {
+	ctx := context.Background()
+	customer, err := getCustomer(ctx, db, 1)
+	require.NoError(t, err)
+	product, err := getProduct(ctx, db, 1)
+	require.NoError(t, err)
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i], _, err = createOrder(ctx, db, customer, []ProductOrderLine{{Product: *product, Amount: 1}})
+		require.NoError(t, err)
+	}
+	return ids
+}
+
+// outboxSentAt returns the sent_at times of the outbox events, keyed by
+// idempotency key. Unsent events have nil times.
+func outboxSentAt(t *testing.T, db *sqlx.DB) map[string]*time.Time {
+	var rows []struct {
+		IdempotencyKey string     `db:"idempotency_key"`
+		SentAt         *time.Time `db:"sent_at"`
+	}
+	require.NoError(t, db.Select(&rows, "SELECT idempotency_key, sent_at FROM outbox"))
+	sentAt := make(map[string]*time.Time)
+	for _, row := range rows {
+		sentAt[row.IdempotencyKey] = row.SentAt
+	}
+	return sentAt
+}
+
+func TestCreateOrderOutbox(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	r := newTestAPIRouter(tracer, db)
+	w := httptest.NewRecorder()
+	body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 2}]}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders", strings.NewReader(body)))
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	sink := &fakeOutboxSink{}
+	sent, err := newOutboxDispatcher(db, sink).dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	// The event carries an idempotency key, and the trace context of
+	// the request which created the order.
+	events := sink.published()
+	require.Len(t, events, 1)
+	assert.Equal(t, orderEventCreated, events[0].Type)
+	assert.Equal(t, jobStatePending, events[0].Status)
+	assert.Len(t, events[0].IdempotencyKey, 32)
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, model.TraceID(events[0].traceContext.Trace), payloads.Transactions[0].TraceID)
+	assert.Equal(t, model.SpanID(events[0].traceContext.Span), payloads.Transactions[0].ID)
+
+	// Sent events are not dispatched again.
+	sent, err = newOutboxDispatcher(db, sink).dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, sent)
+	assert.Len(t, sink.published(), 1)
+}
+
+func TestOutboxDispatcherCancelled(t *testing.T) {
+	db := newTestDB(t)
+	createTestOrders(t, db, 10)
+
+	// Kill the dispatcher while it is publishing the fourth event of
+	// the batch, after the sink has received it.
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &fakeOutboxSink{publish: func(n int) error {
+		if n == 4 {
+			cancel()
+		}
+		return nil
+	}}
+	d := newOutboxDispatcher(db, sink)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx, time.Millisecond)
+	}()
+	<-done
+
+	// The events published are marked sent, and the rest are not.
+	published := sink.published()
+	require.Len(t, published, 4)
+	sentAt := outboxSentAt(t, db)
+	require.Len(t, sentAt, 10)
+	firstSent := make(map[string]time.Time)
+	for _, e := range published {
+		require.NotNil(t, sentAt[e.IdempotencyKey], e.IdempotencyKey)
+		firstSent[e.IdempotencyKey] = *sentAt[e.IdempotencyKey]
+	}
+	var unsent int
+	for _, at := range sentAt {
+		if at == nil {
+			unsent++
+		}
+	}
+	assert.Equal(t, 6, unsent)
+
+	// A restarted dispatcher publishes only the remaining events, and
+	// does not mark the sent events again.
+	sink.publish = nil
+	sent, err := d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 6, sent)
+	published = sink.published()
+	require.Len(t, published, 10)
+	keys := make(map[string]bool)
+	for _, e := range published {
+		assert.False(t, keys[e.IdempotencyKey], "event %s published twice", e.IdempotencyKey)
+		keys[e.IdempotencyKey] = true
+	}
+	for key, sentAt := range outboxSentAt(t, db) {
+		require.NotNil(t, sentAt, key)
+		if first, ok := firstSent[key]; ok {
+			assert.Equal(t, first, *sentAt, key)
+		}
+	}
+}
+
+func TestOutboxDispatcherPublishFailure(t *testing.T) {
+	db := newTestDB(t)
+	createTestOrders(t, db, 5)
+
+	// The third event fails to be published, as if the dispatcher were
+	// killed before the sink acknowledged it, and dispatching stops.
+	sink := &fakeOutboxSink{publish: func(n int) error {
+		if n == 3 {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	}}
+	d := newOutboxDispatcher(db, sink)
+	sent, err := d.dispatchBatch(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broker unavailable")
+	assert.Equal(t, 2, sent)
+
+	// The event is published again, with the same idempotency key.
+	sink.publish = func(n int) error { return nil }
+	sent, err = d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	published := sink.published()
+	require.Len(t, published, 5)
+	sentAt := outboxSentAt(t, db)
+	for _, e := range published {
+		assert.NotNil(t, sentAt[e.IdempotencyKey])
+	}
+}
+
+func TestOutboxDispatcherMetrics(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	d := newOutboxDispatcher(db)
+	tracer.RegisterMetricsGatherer(apmprometheus.Wrap(newMetricsRegistry(d)))
+
+	gathered := func() map[string]model.Metric {
+		recorder.ResetPayloads()
+		tracer.SendMetrics(nil)
+		tracer.Flush(nil)
+		samples := make(map[string]model.Metric)
+		for _, m := range recorder.Payloads().Metrics {
+			for name, sample := range m.Samples {
+				samples[name] = sample
+			}
+		}
+		return samples
+	}
+	samples := gathered()
+	assert.Equal(t, model.Metric{Value: 0}, samples["outbox_pending"])
+	assert.Equal(t, model.Metric{Value: 0}, samples["outbox_lag_seconds"])
+
+	createTestOrders(t, db, 2)
+	_, err := db.Exec("UPDATE outbox SET created_at=? WHERE id=1", time.Now().UTC().Add(-time.Minute))
+	require.NoError(t, err)
+	samples = gathered()
+	assert.Equal(t, model.Metric{Value: 2}, samples["outbox_pending"])
+	assert.InDelta(t, 60, samples["outbox_lag_seconds"].Value, 5)
+
+	_, err = d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	samples = gathered()
+	assert.Equal(t, model.Metric{Value: 0}, samples["outbox_pending"])
+	assert.Equal(t, model.Metric{Value: 0}, samples["outbox_lag_seconds"])
+}
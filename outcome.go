@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+// Transaction outcomes, recorded as the "outcome" tag on transactions.
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// resultClientClosedRequest is the result recorded for requests aborted
+// by the client, after the non-standard 499 status code used by nginx.
+const resultClientClosedRequest = "HTTP 499"
+
+// resultRequestTooLarge is the result recorded for requests rejected for
+// the size of their body, distinguishing them from other client errors.
+const resultRequestTooLarge = "HTTP 413"
+
+// transactionOutcome returns the result and outcome to record for a
+// request which completed with the given status code. Requests aborted
+// by the client are given the result "HTTP 499", and are not considered
+// failures. Requests rejected with 413 (Request Entity Too Large) are
+// given the result "HTTP 413".
+//
+// 5xx responses are failures. 4xx responses are client errors, and so
+// are considered successes on the part of the server, with the
+// exception of 429 (Too Many Requests).
+func transactionOutcome(statusCode int, clientAborted bool) (result, outcome string) {
+	if clientAborted {
+		return resultClientClosedRequest, outcomeSuccess
+	}
+	if statusCode == http.StatusRequestEntityTooLarge {
+		return resultRequestTooLarge, outcomeSuccess
+	}
+	result = apmhttp.StatusCodeResult(statusCode)
+	switch {
+	case statusCode >= 500, statusCode == http.StatusTooManyRequests:
+		return result, outcomeFailure
+	default:
+		return result, outcomeSuccess
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestTransactionOutcome(t *testing.T) {
+	for _, test := range []struct {
+		statusCode int
+		result     string
+		outcome    string
+	}{
+		{100, "HTTP 1xx", "success"},
+		{200, "HTTP 2xx", "success"},
+		{204, "HTTP 2xx", "success"},
+		{301, "HTTP 3xx", "success"},
+		{304, "HTTP 3xx", "success"},
+		{400, "HTTP 4xx", "success"},
+		{404, "HTTP 4xx", "success"},
+		{413, "HTTP 413", "success"},
+		{428, "HTTP 4xx", "success"},
+		{429, "HTTP 4xx", "failure"},
+		{430, "HTTP 4xx", "success"},
+		{500, "HTTP 5xx", "failure"},
+		{503, "HTTP 5xx", "failure"},
+	} {
+		t.Run(strconv.Itoa(test.statusCode), func(t *testing.T) {
+			result, outcome := transactionOutcome(test.statusCode, false)
+			assert.Equal(t, test.result, result)
+			assert.Equal(t, test.outcome, outcome)
+		})
+	}
+}
+
+func TestTransactionOutcomeClientAborted(t *testing.T) {
+	for _, statusCode := range []int{200, 404, 500} {
+		result, outcome := transactionOutcome(statusCode, true)
+		assert.Equal(t, "HTTP 499", result)
+		assert.Equal(t, "success", outcome)
+	}
+}
+
+func TestTracingMiddlewareClientAborted(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		// Simulate the client going away mid-request.
+		cancel()
+		<-c.Request.Context().Done()
+		c.AbortWithStatus(500)
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "HTTP 499", tx.Result)
+	assert.Equal(t, model.IfaceMap{{Key: "outcome", Value: "success"}}, tx.Context.Tags)
+}
@@ -0,0 +1,225 @@
+// Package payment simulates an external payment provider authorizing
+// the payments of orders. The provider is served by the server itself,
+// and called over HTTP as a third-party gateway would be, so that
+// authorizations are traced as external requests.
+package payment
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// AuthorizePath is the path at which the provider authorizes payments.
+const AuthorizePath = "/internal/payments/authorize"
+
+// maxAttempts is the number of attempts to authorize a payment, so that
+// an authorization to which the provider does not respond is retried
+// once.
+const maxAttempts = 2
+
+// Reasons given by the provider for declining payments.
+const (
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonCardDeclined      = "card_declined"
+	ReasonExpiredCard       = "expired_card"
+)
+
+var declineReasons = []string{ReasonInsufficientFunds, ReasonCardDeclined, ReasonExpiredCard}
+
+// ErrTimeout is returned by Client.Authorize when the provider responds
+// to none of the attempts in time.
+var ErrTimeout = errors.New("payment provider timed out")
+
+// DeclinedError is returned by Client.Authorize for payments declined
+// by the provider.
+type DeclinedError struct {
+	reason string
+}
+
+func (e *DeclinedError) Error() string {
+	return "payment declined: " + e.reason
+}
+
+// Reason returns the reason for which the payment was declined, such as
+// ReasonInsufficientFunds.
+func (e *DeclinedError) Reason() string {
+	return e.reason
+}
+
+// Request is the body of authorization requests.
+type Request struct {
+	CustomerID int `json:"customer_id"`
+
+	// Amount is the amount to be paid, in cents.
+	Amount int `json:"amount"`
+}
+
+// Response is the body of authorization responses.
+type Response struct {
+	Approved        bool   `json:"approved"`
+	AuthorizationID string `json:"authorization_id,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+// Provider is an http.Handler simulating the payment provider, serving
+// authorizations at AuthorizePath. Authorizations are delayed by a
+// duration drawn from the configured latency distribution, and at the
+// configured rates are declined, responding with 402 (Payment Required)
+// and a reason, or not responded to until the client gives up.
+type Provider struct {
+	cfg config.Payment
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// NewProvider returns a Provider configured by cfg.
+func NewProvider(cfg config.Payment) *Provider {
+	return &Provider{cfg: cfg, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// outcome is the simulated outcome of an authorization.
+type outcome struct {
+	delay   time.Duration
+	timeout bool
+
+	// reason is the reason for declining the payment, if declined,
+	// and authorizationID the ID of the authorization otherwise.
+	reason          string
+	authorizationID string
+}
+
+func (p *Provider) sample() outcome {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o := outcome{delay: time.Duration(p.cfg.Latency.Sample(p.random) * float64(time.Millisecond))}
+	switch f := p.random.Float64(); {
+	case f < p.cfg.TimeoutRate:
+		o.timeout = true
+	case f < p.cfg.TimeoutRate+p.cfg.DeclineRate:
+		o.reason = declineReasons[p.random.Intn(len(declineReasons))]
+	default:
+		o.authorizationID = fmt.Sprintf("auth_%016x", p.random.Uint64())
+	}
+	return o
+}
+
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	o := p.sample()
+	if o.timeout {
+		// The provider hangs until the client gives up.
+		<-r.Context().Done()
+		return
+	}
+	timer := time.NewTimer(o.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	status, resp := http.StatusOK, Response{Approved: true, AuthorizationID: o.authorizationID}
+	if o.reason != "" {
+		status, resp = http.StatusPaymentRequired, Response{Reason: o.reason}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Client authorizes payments with the provider.
+type Client struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// NewClient returns a Client authorizing payments with the provider at
+// url, using client, which should be traced as by apmhttp.WrapClient.
+// Each attempt is bounded by timeout.
+func NewClient(url string, client *http.Client, timeout time.Duration) *Client {
+	return &Client{url: url, client: client, timeout: timeout}
+}
+
+// Authorize authorizes the payment of req, returning the ID of the
+// authorization. Payments declined by the provider return a
+// *DeclinedError. Attempts to which the provider does not respond in
+// time are retried once, after which ErrTimeout is returned.
+func (c *Client) Authorize(ctx context.Context, req Request) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		id, err := c.authorize(ctx, body)
+		if err != ErrTimeout || attempt == maxAttempts {
+			return id, err
+		}
+	}
+}
+
+// authorize makes an attempt to authorize a payment, given the request
+// body.
+func (c *Client) authorize(ctx context.Context, body []byte) (string, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	// The attempt timed out if its own deadline was exceeded, rather
+	// than that of ctx.
+	timedOut := func() bool {
+		return attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req.WithContext(attemptCtx))
+	if err != nil {
+		if timedOut() {
+			return "", ErrTimeout
+		}
+		return "", errors.Wrap(err, "failed to request payment authorization")
+	}
+	// The body is read to its end, so that the connection is reused.
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPaymentRequired {
+		return "", errors.Errorf("payment provider responded with %s", resp.Status)
+	}
+	var result Response
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		if timedOut() {
+			return "", ErrTimeout
+		}
+		return "", errors.Wrap(err, "failed to decode payment authorization")
+	}
+	if !result.Approved {
+		return "", &DeclinedError{reason: result.Reason}
+	}
+	return result.AuthorizationID, nil
+}
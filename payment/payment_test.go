@@ -0,0 +1,99 @@
+package payment_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+	"github.com/elastic/opbeans-go/payment"
+)
+
+// authorize authorizes a payment in a transaction with the provider
+// configured by cfg, returning the result, the spans reported for the
+// transaction and the number of requests served by the provider.
+func authorize(t *testing.T, cfg config.Payment) (string, []model.Span, int64, error) {
+	var requests int64
+	provider := payment.NewProvider(cfg)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		provider.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	client := payment.NewClient(srv.URL+payment.AuthorizePath, apmhttp.WrapClient(&http.Client{}), time.Duration(cfg.Timeout))
+	tx := tracer.StartTransaction("POST /api/orders", "request")
+	id, err := client.Authorize(apm.ContextWithTransaction(context.Background(), tx), payment.Request{CustomerID: 1, Amount: 4200})
+	tx.End()
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	spans := payloads.Spans
+	for _, span := range spans {
+		assert.Equal(t, "external", span.Type)
+		assert.Equal(t, "http", span.Subtype)
+		assert.Equal(t, payloads.Transactions[0].ID, span.ParentID)
+	}
+	return id, spans, atomic.LoadInt64(&requests), err
+}
+
+func TestAuthorize(t *testing.T) {
+	id, spans, requests, err := authorize(t, config.Payment{
+		Latency: config.Latency{Distribution: config.LatencyFixed, Min: 20, Max: 20},
+		Timeout: config.Duration(time.Second),
+	})
+	require.NoError(t, err)
+	assert.Regexp(t, "^auth_[0-9a-f]{16}$", id)
+	assert.EqualValues(t, 1, requests)
+	require.Len(t, spans, 1)
+	assert.Equal(t, "POST "+spans[0].Context.HTTP.URL.Host, spans[0].Name)
+	assert.True(t, spans[0].Duration >= 20, "%fms", spans[0].Duration)
+}
+
+func TestAuthorizeDeclined(t *testing.T) {
+	_, spans, requests, err := authorize(t, config.Payment{
+		DeclineRate: 1,
+		Timeout:     config.Duration(time.Second),
+	})
+	declined, ok := err.(*payment.DeclinedError)
+	require.True(t, ok, "%v", err)
+	assert.Contains(t, []string{
+		payment.ReasonInsufficientFunds, payment.ReasonCardDeclined, payment.ReasonExpiredCard,
+	}, declined.Reason())
+	assert.EqualError(t, err, "payment declined: "+declined.Reason())
+
+	// Declined payments are not retried.
+	assert.EqualValues(t, 1, requests)
+	assert.Len(t, spans, 1)
+}
+
+func TestAuthorizeTimeout(t *testing.T) {
+	start := time.Now()
+	_, spans, requests, err := authorize(t, config.Payment{
+		TimeoutRate: 1,
+		Timeout:     config.Duration(50 * time.Millisecond),
+	})
+	assert.Equal(t, payment.ErrTimeout, errors.Cause(err))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// The authorization is retried once, each attempt traced.
+	assert.EqualValues(t, 2, requests)
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.True(t, span.Duration >= 50, "%fms", span.Duration)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/payment"
+)
+
+// authorizePayment authorizes the payment of an order for customer with
+// the given lines, reporting whether it was authorized. Otherwise the
+// request is aborted: declined payments respond with 402 (Payment
+// Required) and the reason for which they were declined, and payments
+// the provider failed to authorize in time with 504 (Gateway Timeout).
+func (h apiHandlers) authorizePayment(c *gin.Context, customer *Customer, lines []ProductOrderLine) bool {
+	ctx := c.Request.Context()
+	amount, err := orderAmount(ctx, h.db, lines)
+	if err != nil {
+		err := errors.Wrap(err, "failed to price order")
+		abortWithError(c, apperr.Wrap(err, apperr.DB, "customer_id", customer.ID))
+		return false
+	}
+	authorizationID, err := h.payments.Authorize(ctx, payment.Request{CustomerID: customer.ID, Amount: amount})
+	if err != nil {
+		kind := apperr.Upstream
+		var message string
+		cause := errors.Cause(err)
+		if declined, ok := cause.(*payment.DeclinedError); ok {
+			kind = apperr.PaymentRequired
+			message = declined.Error()
+		} else if cause == payment.ErrTimeout {
+			kind = apperr.GatewayTimeout
+		}
+		abortWithError(c, apperr.WrapMessage(err, kind, message, "customer_id", customer.ID, "payment_amount", amount))
+		return false
+	}
+	tx := apm.TransactionFromContext(ctx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("payment_authorization_id", authorizationID)
+	})
+	return true
+}
+
+// orderAmount returns the amount to be paid for an order with the given
+// lines, at the selling prices of their products. Unknown products are
+// not charged for.
+func orderAmount(ctx context.Context, db *sqlx.DB, lines []ProductOrderLine) (int, error) {
+	ids := make([]int, len(lines))
+	for i, line := range lines {
+		ids[i] = line.Product.ID
+	}
+	queryString, args, err := sqlx.In("SELECT id, selling_price FROM products WHERE id IN (?)", ids)
+	if err != nil {
+		return 0, err
+	}
+	defer startQuery(ctx)()
+	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
+	if err != nil {
+		return 0, errors.Wrap(err, "querying selling prices")
+	}
+	defer rows.Close()
+	prices := make(map[int]int)
+	for rows.Next() {
+		var id, price int
+		if err := rows.Scan(&id, &price); err != nil {
+			return 0, err
+		}
+		prices[id] = price
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var amount int
+	for _, line := range lines {
+		amount += prices[line.Product.ID] * line.Amount
+	}
+	return amount, nil
+}
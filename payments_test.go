@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/payment"
+)
+
+func TestCheckoutPayment(t *testing.T) {
+	for name, test := range map[string]struct {
+		env      map[string]string
+		status   int
+		code     apperr.Kind
+		attempts int
+	}{
+		"approved": {
+			env:      map[string]string{"OPBEANS_PAYMENT_DECLINE_RATE": "0", "OPBEANS_PAYMENT_TIMEOUT_RATE": "0"},
+			status:   http.StatusOK,
+			attempts: 1,
+		},
+		"declined": {
+			env:      map[string]string{"OPBEANS_PAYMENT_DECLINE_RATE": "1", "OPBEANS_PAYMENT_TIMEOUT_RATE": "0"},
+			status:   http.StatusPaymentRequired,
+			code:     apperr.PaymentRequired,
+			attempts: 1,
+		},
+		"timeout": {
+			env:      map[string]string{"OPBEANS_PAYMENT_TIMEOUT_RATE": "1", "OPBEANS_PAYMENT_TIMEOUT": "50ms"},
+			status:   http.StatusGatewayTimeout,
+			code:     apperr.GatewayTimeout,
+			attempts: 2,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The server listens, so that the provider it serves can be
+			// called through its listener.
+			srv := httptest.NewUnstartedServer(nil)
+			defer srv.Close()
+			setTestStartupFlags(t)
+			t.Cleanup(setFlag(listenAddr, srv.Listener.Addr().String()))
+			t.Setenv("OPBEANS_PAYMENT", "true")
+			t.Setenv("OPBEANS_PAYMENT_LATENCY_MS", "0")
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+			r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+			require.NoError(t, err)
+			defer cleanup()
+			srv.Config.Handler = r
+			srv.Start()
+			tracer.Flush(nil)
+			recorder.ResetPayloads()
+
+			body := `{"customer_id": 1, "lines": [{"id": 1, "amount": 2}]}`
+			resp, err := http.Post(srv.URL+"/api/orders", "application/json", strings.NewReader(body))
+			require.NoError(t, err)
+			respBody, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, test.status, resp.StatusCode, string(respBody))
+			if test.code != "" {
+				envelope := decodeErrorEnvelope(t, respBody)
+				assert.Equal(t, test.code, envelope.Code)
+				if test.code == apperr.PaymentRequired {
+					assert.Contains(t, []string{
+						payment.ReasonInsufficientFunds, payment.ReasonCardDeclined, payment.ReasonExpiredCard,
+					}, envelope.Reason)
+					assert.Equal(t, "payment declined: "+envelope.Reason, envelope.Message)
+				}
+			}
+
+			// Each attempt is an external span of the checkout, the
+			// parent of the provider's transaction. The provider gives
+			// up on attempts timed out once it sees them cancelled.
+			isProvider := func(tx model.Transaction) bool { return tx.Name == "POST "+payment.AuthorizePath }
+			assert.Eventually(t, func() bool {
+				tracer.Flush(nil)
+				var n int
+				for _, tx := range recorder.Payloads().Transactions {
+					if isProvider(tx) {
+						n++
+					}
+				}
+				return n == test.attempts
+			}, 5*time.Second, 10*time.Millisecond)
+			payloads := recorder.Payloads()
+			var checkout model.Transaction
+			providerParents := make(map[model.SpanID]bool)
+			for _, tx := range payloads.Transactions {
+				switch {
+				case tx.Name == "POST /api/orders":
+					checkout = tx
+				case isProvider(tx):
+					providerParents[tx.ParentID] = true
+				}
+			}
+			var attempts int
+			for _, span := range payloads.Spans {
+				if span.Type != "external" {
+					continue
+				}
+				attempts++
+				assert.Equal(t, "http", span.Subtype)
+				assert.Equal(t, checkout.ID, span.ParentID)
+				assert.True(t, providerParents[span.ID], "span %s is not the parent of a provider transaction", span.Name)
+			}
+			assert.Equal(t, test.attempts, attempts)
+			assert.Len(t, providerParents, test.attempts)
+			if test.status == http.StatusOK {
+				assert.Contains(t, transactionLabels(checkout), "payment_authorization_id")
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// precomputedResponses holds the encoded responses of hot resources
+// whose data rarely changes, such as the product types, so that they are
+// written as is rather than encoded for each request. Responses are held
+// per resource and format, along with the data version they were encoded
+// at, so that they are recomputed once the data changes, as the ETags
+// are. A nil *precomputedResponses precomputes nothing.
+type precomputedResponses struct {
+	mu        sync.RWMutex
+	responses map[precomputedKey]precomputedResponse
+}
+
+type precomputedKey struct {
+	resource string
+	format   string
+}
+
+// precomputedResponse is an encoded response, as rendered by renderJSON
+// at version.
+type precomputedResponse struct {
+	version     uint64
+	contentType string
+	body        []byte
+}
+
+func newPrecomputedResponses() *precomputedResponses {
+	return &precomputedResponses{responses: make(map[precomputedKey]precomputedResponse)}
+}
+
+// render renders the resource for c with a status of 200, writing its
+// precomputed response with its Content-Length if it is current.
+// Otherwise the value returned by load is rendered with renderJSON, and
+// its response precomputed. Errors returned by load abort c.
+func (p *precomputedResponses) render(c *gin.Context, resource string, load func(context.Context) (interface{}, error)) {
+	ctx := c.Request.Context()
+	store := contextCacheStore(c)
+	if p == nil || store == nil {
+		renderLoaded(c, load)
+		return
+	}
+	version, err := dataVersion(ctx, store)
+	if err != nil {
+		err := errors.Wrap(err, "failed to get data version")
+		contextLogger(c).WithError(err).Warn("not precomputing response")
+		renderLoaded(c, load)
+		return
+	}
+	key := precomputedKey{resource: resource, format: responseFormat(c)}
+	p.mu.RLock()
+	response, ok := p.responses[key]
+	p.mu.RUnlock()
+	if ok && response.version == version {
+		c.Header("Vary", "Accept")
+		c.Header("Content-Type", response.contentType)
+		c.Header("Content-Length", strconv.Itoa(len(response.body)))
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.Write(response.body)
+		return
+	}
+
+	w := &responseCacheWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	defer func() { c.Writer = w.ResponseWriter }()
+	if !renderLoaded(c, load) || w.overflowed || ctx.Err() != nil {
+		return
+	}
+	response = precomputedResponse{
+		version:     version,
+		contentType: w.Header().Get("Content-Type"),
+		body:        w.body.Bytes(),
+	}
+	p.mu.Lock()
+	p.responses[key] = response
+	p.mu.Unlock()
+}
+
+// renderLoaded renders the value returned by load for c, reporting
+// whether it was rendered, or else aborting c with load's error.
+func renderLoaded(c *gin.Context, load func(context.Context) (interface{}, error)) bool {
+	v, err := load(c.Request.Context())
+	if err != nil {
+		abortWithError(c, apperr.Wrap(err, apperr.DB))
+		return false
+	}
+	renderJSON(c, http.StatusOK, v)
+	return true
+}
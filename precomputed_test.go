@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// precomputedPaths holds the paths whose responses are precomputed.
+var precomputedPaths = []string{"/api/types", "/api/products/top"}
+
+// newPrecomputedTestRouter returns a router serving the precomputed
+// resources from db, precomputing them with precomputed unless nil, and
+// its cache store.
+func newPrecomputedTestRouter(tracer *apm.Tracer, db *sqlx.DB, precomputed *precomputedResponses) (*gin.Engine, persistence.CacheStore) {
+	gin.SetMode(gin.TestMode)
+	store := persistence.CacheStore(persistence.NewInMemoryStore(0))
+	h := apiHandlers{db: db, lookups: newEntityLookups(), precomputed: precomputed}
+	r := gin.New()
+	r.Use(cache.Cache(&store))
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	r.GET("/api/types", h.getProductTypes)
+	r.GET("/api/products/:id", h.getProductDetails)
+	return r, store
+}
+
+func TestPrecomputedResponses(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	uncached, _ := newPrecomputedTestRouter(tracer, db, nil)
+	precomputed, _ := newPrecomputedTestRouter(tracer, db, newPrecomputedResponses())
+
+	serve := func(r *gin.Engine, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	// The precomputed responses, in each format, are byte-identical to
+	// those rendered per request, and written with their length.
+	for _, path := range precomputedPaths {
+		for _, accept := range []string{"", "application/json", jsonAPIMediaType, msgpackMediaType} {
+			want := serve(uncached, path, accept)
+			require.NotEmpty(t, want.Body.Bytes())
+			for i, name := range []string{"miss", "hit"} {
+				w := serve(precomputed, path, accept)
+				assert.Equal(t, want.Body.Bytes(), w.Body.Bytes(), "%s %s %s", path, accept, name)
+				for _, header := range []string{"Content-Type", "Vary"} {
+					assert.Equal(t, want.Header().Get(header), w.Header().Get(header), "%s %s %s", path, accept, header)
+				}
+				if i > 0 {
+					assert.Equal(t, strconv.Itoa(w.Body.Len()), w.Header().Get("Content-Length"))
+				}
+			}
+		}
+	}
+}
+
+func TestPrecomputedResponsesInvalidated(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	r, store := newPrecomputedTestRouter(tracer, db, newPrecomputedResponses())
+	get := func() string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/types", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	before := get()
+	_, err := db.Exec("UPDATE product_types SET name='Renamed Roasts' WHERE id=1")
+	require.NoError(t, err)
+	assert.Equal(t, before, get())
+
+	// Precomputed responses are recomputed once the data version changes.
+	require.NoError(t, rotateDataVersion(context.Background(), store))
+	assert.Contains(t, get(), "Renamed Roasts")
+}
+
+func BenchmarkPrecomputedResponses(b *testing.B) {
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(b, err)
+	defer tracer.Close()
+	tracer.Transport = transporttest.Discard
+	db := newTestDB(b)
+
+	for _, path := range precomputedPaths {
+		for _, mode := range []string{"uncached", "precomputed"} {
+			b.Run(path[len("/api/"):]+"/"+mode, func(b *testing.B) {
+				var precomputed *precomputedResponses
+				if mode == "precomputed" {
+					precomputed = newPrecomputedResponses()
+				}
+				r, _ := newPrecomputedTestRouter(tracer, db, precomputed)
+				req := httptest.NewRequest("GET", path, nil)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					w := httptest.NewRecorder()
+					r.ServeHTTP(w, req)
+					if w.Code != http.StatusOK {
+						b.Fatalf("unexpected status %d", w.Code)
+					}
+				}
+			})
+		}
+	}
+}
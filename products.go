@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
@@ -26,10 +28,40 @@ type ProductType struct {
 	Name string `json:"name"`
 }
 
+var (
+	// errProductNotFound is returned by getProduct if there is
+	// no product with the given ID.
+	errProductNotFound = errors.New("product not found")
+
+	// errInvalidProductSearch is returned by searchProducts if
+	// the search query or limit is invalid.
+	errInvalidProductSearch = errors.New("invalid product search")
+)
+
 func getProducts(ctx context.Context, db *sqlx.DB) ([]Product, error) {
-	return queryProducts(ctx, db, nil)
+	return queryProducts(ctx, db, "", 0)
+}
+
+// searchProducts returns the products whose name or description contains
+// query, ignoring case. At most limit products are returned, if limit is
+// positive.
+func searchProducts(ctx context.Context, db *sqlx.DB, query string, limit int) ([]Product, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.Wrap(errInvalidProductSearch, "query must not be empty")
+	}
+	if limit < 0 {
+		return nil, errors.Wrapf(errInvalidProductSearch, "limit must not be negative, got %d", limit)
+	}
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(query)) + "%"
+	return queryProducts(ctx, db, `WHERE LOWER(products.name) LIKE ? ESCAPE '\'
+  OR LOWER(products.description) LIKE ? ESCAPE '\'
+`, limit, pattern, pattern)
 }
 
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 func getTopProducts(ctx context.Context, db *sqlx.DB) ([]Product, error) {
 	const limit = 3 // top 3 best-selling products
 	queryString := `SELECT
@@ -38,6 +70,7 @@ FROM products JOIN order_lines ON id=product_id GROUP BY products.id ORDER BY so
 `
 	queryString += fmt.Sprintf("LIMIT %d\n", limit)
 
+	defer startQuery(ctx)()
 	rows, err := db.QueryContext(ctx, queryString)
 	if err != nil {
 		return nil, errors.Wrap(err, "querying top products")
@@ -55,34 +88,52 @@ FROM products JOIN order_lines ON id=product_id GROUP BY products.id ORDER BY so
 	return products, rows.Err()
 }
 
+// getProduct returns the product with the given ID, or
+// errProductNotFound if there is none.
 func getProduct(ctx context.Context, db *sqlx.DB, id int) (*Product, error) {
-	products, err := queryProducts(ctx, db, &id)
-	if err != nil || len(products) == 0 {
+	products, err := queryProducts(ctx, db, "WHERE products.id=?\n", 0, id)
+	if err != nil {
 		return nil, err
 	}
+	if len(products) == 0 {
+		return nil, errProductNotFound
+	}
 	return &products[0], nil
 }
 
-func queryProducts(ctx context.Context, db *sqlx.DB, id *int) ([]Product, error) {
-	var args []interface{}
+// queryProducts returns the products matching the where clause, if
+// non-empty, ordered by ID. At most limit products are returned, if
+// limit is positive.
+func queryProducts(ctx context.Context, db *sqlx.DB, where string, limit int, args ...interface{}) ([]Product, error) {
+	var products []Product
+	err := scanProducts(ctx, db, where, limit, args, func(p Product) error {
+		products = append(products, p)
+		return nil
+	})
+	return products, err
+}
+
+// scanProducts calls f with each of the products matching the where
+// clause, as for queryProducts, as they are scanned from the result set.
+// If f returns an error, scanning stops and the error is returned.
+func scanProducts(ctx context.Context, db *sqlx.DB, where string, limit int, args []interface{}, f func(Product) error) error {
 	queryString := `SELECT
   products.id, products.sku, products.name, products.description,
   products.stock, products.cost, products.selling_price,
   products.type_id, product_types.name
 FROM products JOIN product_types ON type_id=product_types.id
-`
-	if id != nil {
-		queryString += "WHERE products.id=?\n"
-		args = append(args, *id)
+` + where + "ORDER BY products.id\n"
+	if limit > 0 {
+		queryString += fmt.Sprintf("LIMIT %d\n", limit)
 	}
 
+	defer startQuery(ctx)()
 	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
 	if err != nil {
-		return nil, errors.Wrap(err, "querying products")
+		return errors.Wrap(err, "querying products")
 	}
 	defer rows.Close()
 
-	var products []Product
 	for rows.Next() {
 		var p Product
 		if err := rows.Scan(
@@ -90,11 +141,13 @@ FROM products JOIN product_types ON type_id=product_types.id
 			&p.Stock, &p.Cost, &p.SellingPrice,
 			&p.TypeID, &p.TypeName,
 		); err != nil {
-			return nil, err
+			return err
+		}
+		if err := f(p); err != nil {
+			return err
 		}
-		products = append(products, p)
 	}
-	return products, rows.Err()
+	return rows.Err()
 }
 
 func getProductTypes(ctx context.Context, db *sqlx.DB) ([]ProductType, error) {
@@ -117,6 +170,7 @@ func queryProductTypes(ctx context.Context, db *sqlx.DB, id *int) ([]ProductType
 		args = append(args, *id)
 	}
 
+	defer startQuery(ctx)()
 	rows, err := db.QueryContext(ctx, db.Rebind(queryString), args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "querying product types")
@@ -133,3 +187,84 @@ func queryProductTypes(ctx context.Context, db *sqlx.DB, id *int) ([]ProductType
 	}
 	return productTypes, rows.Err()
 }
+
+// getProductIDBySKU returns the ID of the product with the given SKU,
+// or 0 if there is none.
+func getProductIDBySKU(ctx context.Context, db *sqlx.DB, sku string) (int, error) {
+	var id int
+	defer startQuery(ctx)()
+	err := db.QueryRowContext(ctx, db.Rebind("SELECT id FROM products WHERE sku=?"), sku).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, errors.Wrap(err, "querying product by SKU")
+}
+
+// createProduct creates a product with the fields of p, other than its
+// ID and type name, returning the new product's ID.
+func createProduct(ctx context.Context, db *sqlx.DB, p *Product) (int, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertNextID(ctx, db, tx, "products",
+		[]string{"sku", "name", "description", "type_id", "stock", "cost", "selling_price"},
+		p.SKU, p.Name, p.Description, p.TypeID, p.Stock, p.Cost, p.SellingPrice,
+	)
+	if err != nil {
+		return -1, errors.Wrap(err, "inserting product")
+	}
+	if err := recordChange(ctx, db, tx, changeEntityProduct, id, changeOpCreate); err != nil {
+		return -1, err
+	}
+	if err := recordAudit(ctx, db, tx, changeOpCreate, changeEntityProduct, id, nil, p); err != nil {
+		return -1, err
+	}
+	return id, tx.Commit()
+}
+
+// updateProduct updates the product with p's ID with the fields of p,
+// other than its type name, returning errProductNotFound if there is no
+// such product.
+func updateProduct(ctx context.Context, db *sqlx.DB, p *Product) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var before Product
+	defer startQuery(ctx)()
+	if err := tx.QueryRowContext(ctx, db.Rebind(`SELECT
+  sku, name, description, type_id, stock, cost, selling_price
+FROM products WHERE id=?`), p.ID).Scan(
+		&before.SKU, &before.Name, &before.Description, &before.TypeID,
+		&before.Stock, &before.Cost, &before.SellingPrice,
+	); err == sql.ErrNoRows {
+		return errProductNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "querying product")
+	}
+
+	defer startQuery(ctx)()
+	result, err := tx.ExecContext(ctx, db.Rebind(`UPDATE products SET
+  sku=?, name=?, description=?, type_id=?, stock=?, cost=?, selling_price=?
+WHERE id=?`), p.SKU, p.Name, p.Description, p.TypeID, p.Stock, p.Cost, p.SellingPrice, p.ID)
+	if err != nil {
+		return errors.Wrap(err, "updating product")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errProductNotFound
+	}
+	if err := recordChange(ctx, db, tx, changeEntityProduct, p.ID, changeOpUpdate); err != nil {
+		return err
+	}
+	if err := recordAudit(ctx, db, tx, changeOpUpdate, changeEntityProduct, p.ID, &before, p); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestQueryProductsRowsReturned(t *testing.T) {
+	db := newTestDB(t)
+	var count int
+	require.NoError(t, db.Get(&count, "SELECT COUNT(*) FROM products"))
+
+	_, spans, _ := apmtest.WithTransaction(func(ctx context.Context) {
+		products, err := getProducts(ctx, db)
+		require.NoError(t, err)
+		assert.Len(t, products, count)
+	})
+	require.Len(t, spans, 1)
+	assert.Equal(t, model.StringMap{
+		{Key: "rows_returned", Value: strconv.Itoa(count)},
+	}, spans[0].Context.Tags)
+}
+
+func TestUpdateProductsRowsAffected(t *testing.T) {
+	db := newTestDB(t)
+	var count int
+	require.NoError(t, db.Get(&count, "SELECT COUNT(*) FROM products WHERE type_id=1"))
+	require.NotZero(t, count)
+
+	_, spans, _ := apmtest.WithTransaction(func(ctx context.Context) {
+		_, err := db.ExecContext(ctx, "UPDATE products SET stock=stock+1 WHERE type_id=1")
+		require.NoError(t, err)
+	})
+	require.Len(t, spans, 1)
+	assert.Equal(t, model.StringMap{
+		{Key: "rows_affected", Value: strconv.Itoa(count)},
+	}, spans[0].Context.Tags)
+}
+
+func TestQueryRowsStreamed(t *testing.T) {
+	db := newTestDB(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	tx := tracer.StartTransaction("name", "type")
+	ctx := apm.ContextWithTransaction(context.Background(), tx)
+	rows, err := db.QueryContext(ctx, "SELECT id FROM products")
+	require.NoError(t, err)
+	require.True(t, rows.Next())
+
+	// The query span remains open while rows are being read.
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Spans)
+
+	n := 1
+	for rows.Next() {
+		n++
+	}
+	require.NoError(t, rows.Close())
+	tx.End()
+	tracer.Flush(nil)
+
+	spans := recorder.Payloads().Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, model.StringMap{
+		{Key: "rows_returned", Value: strconv.Itoa(n)},
+	}, spans[0].Context.Tags)
+}
+
+func TestSearchProducts(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	_, err := db.Exec("UPDATE products SET name='100% Arabica_Blend' WHERE id=2")
+	require.NoError(t, err)
+
+	searchIDs := func(query string, limit int) []int {
+		products, err := searchProducts(ctx, db, query, limit)
+		require.NoError(t, err)
+		var ids []int
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []int{1, 4}, searchIDs("Chocolate", 0))
+	assert.Equal(t, []int{1}, searchIDs("chocolate", 1))
+
+	// LIKE wildcards in the query are matched literally.
+	assert.Equal(t, []int{2}, searchIDs("0% a", 0))
+	assert.Equal(t, []int{2}, searchIDs("a_b", 0))
+	assert.Empty(t, searchIDs("%_", 0))
+
+	_, err = searchProducts(ctx, db, " ", 0)
+	assert.Equal(t, errInvalidProductSearch, errors.Cause(err))
+	_, err = searchProducts(ctx, db, "roast", -1)
+	assert.EqualError(t, err, "limit must not be negative, got -1: invalid product search")
+}
+
+func TestGetProductNotFound(t *testing.T) {
+	_, err := getProduct(context.Background(), newTestDB(t), 999)
+	assert.Equal(t, errProductNotFound, err)
+}
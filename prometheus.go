@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// metricsPath is the path on which metrics are served, in the Prometheus
+// text format.
+const metricsPath = "/metrics"
+
+// collectTimeout bounds the database queries made to collect metrics.
+const collectTimeout = 5 * time.Second
+
+// unmatchedRoute is the route label of requests which match no route.
+const unmatchedRoute = "unmatched"
+
+// httpMetrics is a prometheus.Collector recording the number and
+// duration of HTTP requests, by method, route and status.
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func newHTTPMetrics() *httpMetrics {
+	labels := []string{"method", "route", "status"}
+	return &httpMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests served.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Duration of HTTP requests served.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+	}
+}
+
+// Describe sends the descriptors of the HTTP metrics to ch.
+func (m *httpMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+// Collect sends the HTTP metrics to ch.
+func (m *httpMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+}
+
+// middleware records each request, labelled with its matched route
+// pattern, so that the number of series is bounded.
+func (m *httpMetrics) middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	labels := prometheus.Labels{
+		"method": c.Request.Method,
+		"route":  route,
+		"status": strconv.Itoa(c.Writer.Status()),
+	}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(time.Since(start).Seconds())
+}
+
+var (
+	dbMaxOpenDesc      = prometheus.NewDesc("db_connections_max_open", "Maximum number of open database connections.", nil, nil)
+	dbOpenDesc         = prometheus.NewDesc("db_connections_open", "Number of open database connections.", nil, nil)
+	dbInUseDesc        = prometheus.NewDesc("db_connections_in_use", "Number of database connections in use.", nil, nil)
+	dbIdleDesc         = prometheus.NewDesc("db_connections_idle", "Number of idle database connections.", nil, nil)
+	dbWaitCountDesc    = prometheus.NewDesc("db_connections_wait_total", "Number of waits for a database connection.", nil, nil)
+	dbWaitDurationDesc = prometheus.NewDesc("db_connections_wait_seconds_total", "Time spent waiting for a database connection.", nil, nil)
+)
+
+// dbStatsCollector is a prometheus.Collector reporting the statistics of
+// a database connection pool.
+type dbStatsCollector struct {
+	db *sqlx.DB
+}
+
+// Describe sends the descriptors of the pool metrics to ch.
+func (dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		dbMaxOpenDesc, dbOpenDesc, dbInUseDesc, dbIdleDesc, dbWaitCountDesc, dbWaitDurationDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect sends the pool metrics to ch.
+func (s dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := s.db.Stats()
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
+
+// newMetricsRegistry returns a registry holding collectors. The registry
+// is the single source of the server's metrics: it is served to
+// Prometheus, and gathered by the tracer as APM metrics.
+func newMetricsRegistry(collectors ...prometheus.Collector) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors...)
+	return registry
+}
+
+// handleMetrics returns a handler which serves the metrics gathered from
+// g in the Prometheus text format. Metrics which cannot be gathered are
+// logged and omitted.
+func handleMetrics(g prometheus.Gatherer) gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		ErrorLog:      logrus.StandardLogger(),
+		ErrorHandling: promhttp.ContinueOnError,
+	}))
+}
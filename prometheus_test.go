@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// scrapeMetrics scrapes the metrics served by r, returning the metric
+// families by name.
+func scrapeMetrics(t *testing.T, r http.Handler, req *http.Request) map[string]*dto.MetricFamily {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(w.Body)
+	require.NoError(t, err)
+	return families
+}
+
+// findMetric returns the metric of family with the given labels, or nil.
+func findMetric(family *dto.MetricFamily, labels map[string]string) *dto.Metric {
+	if family == nil {
+		return nil
+	}
+	for _, m := range family.GetMetric() {
+		matched := 0
+		for _, lp := range m.GetLabel() {
+			if value, ok := labels[lp.GetName()]; ok && value == lp.GetValue() {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	for _, path := range []string{"/api/stats", "/api/stats", "/api/nope"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	families := scrapeMetrics(t, r, httptest.NewRequest("GET", metricsPath, nil))
+	for _, name := range []string{
+		"http_requests_total",
+		"http_request_duration_seconds",
+		"db_connections_open",
+		"db_connections_in_use",
+		"db_connections_wait_total",
+		"cache_hits_total",
+		"cache_misses_total",
+		"orders_created_total",
+		"outbox_pending",
+		"fulfillment_jobs",
+	} {
+		assert.Contains(t, families, name)
+	}
+
+	stats := map[string]string{"method": "GET", "route": "/api/stats", "status": "200"}
+	requests := findMetric(families["http_requests_total"], stats)
+	require.NotNil(t, requests)
+	assert.Equal(t, 2.0, requests.GetCounter().GetValue())
+	duration := findMetric(families["http_request_duration_seconds"], stats)
+	require.NotNil(t, duration)
+	assert.Equal(t, uint64(2), duration.GetHistogram().GetSampleCount())
+
+	// Requests matching no route share a label, so that arbitrary paths
+	// cannot create series.
+	unmatched := findMetric(families["http_requests_total"], map[string]string{"route": unmatchedRoute, "status": "404"})
+	require.NotNil(t, unmatched)
+	assert.Equal(t, 1.0, unmatched.GetCounter().GetValue())
+
+	cache := map[string]string{"cache": "stats"}
+	assert.Equal(t, 1.0, findMetric(families["cache_hits_total"], cache).GetCounter().GetValue())
+	assert.Equal(t, 1.0, findMetric(families["cache_misses_total"], cache).GetCounter().GetValue())
+	pending := findMetric(families["fulfillment_jobs"], map[string]string{"state": jobStatePending})
+	assert.Equal(t, 0.0, pending.GetGauge().GetValue())
+
+	// Scrapes are not traced, and the same counters are gathered by
+	// the tracer.
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	assert.Empty(t, payloads.Transactions)
+	var gathered float64
+	for _, m := range payloads.Metrics {
+		labels := make(map[string]string)
+		for _, label := range m.Labels {
+			labels[label.Key] = label.Value
+		}
+		if assert.ObjectsAreEqual(stats, labels) {
+			gathered = m.Samples["http_requests_total"].Value
+		}
+	}
+	assert.Equal(t, 2.0, gathered)
+}
+
+func TestMetricsEndpointAuth(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_METRICS_AUTH", "true")
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", metricsPath, nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest("GET", metricsPath, nil)
+	req.SetBasicAuth("admin", "secret")
+	assert.Contains(t, scrapeMetrics(t, r, req), "http_requests_total")
+}
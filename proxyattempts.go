@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// maxProxyAttempts is the number of times a proxied request is sent, if
+// the backend cannot be dialed.
+const maxProxyAttempts = 2
+
+// backendTimeoutError is the cause of the errors of proxied requests
+// which timed out, or ran out of their budget. It implements net.Error,
+// reporting a timeout.
+type backendTimeoutError struct {
+	backend string
+	attempt int           // the attempt which ran out of the budget, or 0
+	after   time.Duration // the timeout of a single attempt
+}
+
+func (e backendTimeoutError) Error() string {
+	if e.attempt > 0 {
+		return fmt.Sprintf("proxy budget exhausted awaiting %s, on attempt %d", e.backend, e.attempt)
+	}
+	return fmt.Sprintf("proxied request to %s timed out after %s", e.backend, e.after)
+}
+
+func (backendTimeoutError) Timeout() bool   { return true }
+func (backendTimeoutError) Temporary() bool { return true }
+
+// proxyAttempts is an http.RoundTripper bounding each request proxied to
+// a backend by a timeout, and sending it again once if the backend
+// cannot be dialed. Responses, including server errors, are never
+// retried, as the request may have been processed. The total time of
+// the attempts is bounded by the request's context, which must hold the
+// budget of the inbound request. It must wrap apmhttp.WrapRoundTripper,
+// so that each attempt is recorded as a span.
+//
+// Timeouts fail with an apperr.GatewayTimeout error, with the "backend"
+// field naming the backend.
+type proxyAttempts struct {
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t proxyAttempts) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body is buffered, so that it can be sent again.
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, t.timeout)
+		attemptReq := req.Clone(attemptCtx)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+			attemptReq.ContentLength = int64(len(body))
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if err == nil {
+			resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+		cancel()
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return nil, apperr.Wrap(backendTimeoutError{backend: req.URL.Host, attempt: attempt},
+				apperr.GatewayTimeout, "backend", req.URL.Host,
+			)
+		case ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded:
+			return nil, apperr.Wrap(backendTimeoutError{backend: req.URL.Host, after: t.timeout},
+				apperr.GatewayTimeout, "backend", req.URL.Host,
+			)
+		case attempt < maxProxyAttempts && isDialError(err):
+			logrus.WithError(err).WithField("backend", req.URL.Host).Warn("failed to dial backend, retrying proxied request")
+			continue
+		}
+		return nil, err
+	}
+}
+
+// proxyBudget returns a context bounding the attempts of a request
+// proxied in ctx by the time remaining until the inbound request's
+// deadline, if any, capped by timeout unless zero.
+func proxyBudget(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if timeout > 0 {
+		if capped := time.Now().Add(timeout); !ok || capped.Before(deadline) {
+			deadline, ok = capped, true
+		}
+	}
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// isDialError reports whether err is caused by a failure to connect, in
+// which case the request was not sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// cancelBody is a response body cancelling the context of its request
+// once closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
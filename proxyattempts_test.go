@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestProxyAttemptsDialError(t *testing.T) {
+	var served int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&served, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	// The first attempt fails to dial, and the second is sent with the
+	// same body.
+	var attempts int
+	refuseFirst := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	post := func(transport http.RoundTripper, body string) (*http.Response, error) {
+		req, err := http.NewRequest("POST", backend.URL, strings.NewReader(body))
+		require.NoError(t, err)
+		return proxyAttempts{timeout: time.Second, next: transport}.RoundTrip(req)
+	}
+	resp, err := post(refuseFirst, "hello")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, 2, attempts)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&served))
+
+	// Server errors are not retried.
+	attempts = 1
+	resp, err = post(refuseFirst, "fail")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 2, attempts)
+	assert.EqualValues(t, 2, atomic.LoadInt64(&served))
+
+	// Nor are other errors, nor dial errors more than once.
+	attempts = 0
+	reset := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	})
+	_, err = post(reset, "hello")
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+	attempts = 0
+	refuse := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	})
+	_, err = post(refuse, "hello")
+	assert.True(t, isDialError(err))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestProxyTimeout(t *testing.T) {
+	for name, test := range map[string]struct {
+		env     map[string]string
+		message string
+	}{
+		"timeout": {
+			env:     map[string]string{"OPBEANS_DT_TIMEOUT": "50ms"},
+			message: "proxied request to %s timed out after 50ms",
+		},
+		"budget": {
+			env:     map[string]string{"OPBEANS_DT_TIMEOUT": "5s", "OPBEANS_HANDLER_TIMEOUT": "100ms"},
+			message: "proxy budget exhausted awaiting %s, on attempt 1",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var served int64
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				atomic.AddInt64(&served, 1)
+				select {
+				case <-req.Context().Done():
+				case <-time.After(10 * time.Second):
+				}
+			}))
+			defer backend.Close()
+			setTestStartupFlags(t)
+			t.Setenv("OPBEANS_SERVICES", backend.URL)
+			t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+			r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+			require.NoError(t, err)
+			defer cleanup()
+			srv := newTestProxyServer(t, r)
+			tracer.Flush(nil)
+			recorder.ResetPayloads()
+
+			resp, err := http.Get(srv.URL + "/api/stats")
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+			assert.Equal(t, apperr.GatewayTimeout, decodeErrorEnvelope(t, body).Code)
+			assert.EqualValues(t, 1, atomic.LoadInt64(&served))
+
+			// The timeout is reported as an error naming the backend.
+			tracer.Flush(nil)
+			host := hostOf(t, backend.URL)
+			apmErrors := recorder.Payloads().Errors
+			require.Len(t, apmErrors, 1)
+			assert.Equal(t, strings.Replace(test.message, "%s", host, 1), apmErrors[0].Exception.Message)
+			assert.Equal(t, "proxyAttempts.RoundTrip", apmErrors[0].Culprit)
+			assert.Equal(t, model.IfaceMap{{Key: "kind", Value: "gateway_timeout"}}, apmErrors[0].Context.Tags)
+			assert.Equal(t, model.IfaceMap{{Key: "backend", Value: host}}, apmErrors[0].Context.Custom)
+		})
+	}
+}
+
+func TestProxyAttemptsBudget(t *testing.T) {
+	// The budget is spent by a dial error, leaving none for the retry.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var attempts int
+	slowRefusal := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		<-req.Context().Done()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: req.Context().Err()}
+	})
+	req, err := http.NewRequest("GET", "http://opbeans-python:3000/api/stats", nil)
+	require.NoError(t, err)
+	_, err = proxyAttempts{timeout: time.Second, next: slowRefusal}.RoundTrip(req.WithContext(ctx))
+	require.Error(t, err)
+	assert.EqualError(t, err, "proxy budget exhausted awaiting opbeans-python:3000, on attempt 1")
+	assert.Equal(t, 1, attempts)
+	appErr, ok := apperr.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperr.GatewayTimeout, appErr.Kind)
+}
+
+func TestProxyBudget(t *testing.T) {
+	inbound, cancelInbound := context.WithTimeout(context.Background(), time.Second)
+	defer cancelInbound()
+	inboundDeadline, _ := inbound.Deadline()
+	for name, test := range map[string]struct {
+		ctx     context.Context
+		timeout time.Duration
+		within  time.Duration // of now, or of the inbound deadline if zero
+	}{
+		"timeout":          {ctx: context.Background(), timeout: 100 * time.Millisecond, within: 100 * time.Millisecond},
+		"inbound_deadline": {ctx: inbound, timeout: time.Minute},
+		"capped":           {ctx: inbound, timeout: 100 * time.Millisecond, within: 100 * time.Millisecond},
+		"unlimited":        {ctx: inbound},
+	} {
+		ctx, cancel := proxyBudget(test.ctx, test.timeout)
+		deadline, ok := ctx.Deadline()
+		require.True(t, ok, name)
+		if test.within > 0 {
+			assert.WithinDuration(t, time.Now().Add(test.within), deadline, 50*time.Millisecond, name)
+		} else {
+			assert.Equal(t, inboundDeadline, deadline, name)
+		}
+		cancel()
+		assert.Error(t, ctx.Err(), name)
+	}
+
+	// Without a timeout or an inbound deadline, the budget is unlimited.
+	ctx, cancel := proxyBudget(context.Background(), 0)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// isFallbackMethod reports whether requests with the given method may
+// fall back to the local handler when their backend fails: only those
+// which do not write, so that writes are never applied twice.
+func isFallbackMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// backendFailed returns the error of a backend responding to a proxied
+// request with a server error.
+func backendFailed(resp *http.Response) error {
+	return errors.Errorf("%s responded with %s", resp.Request.URL.Host, resp.Status)
+}
+
+// fallBack records that the request of c, proxied with attempt, failed
+// with err and is served by the local handler instead: its transaction
+// is labeled proxy_fallback=true, and err is reported as a handled
+// error naming the backend, unless the failure was simulated, as those
+// are reported by proxyFaults.
+func fallBack(c *gin.Context, attempt *backendAttempt, err error) {
+	ctx := c.Request.Context()
+	contextLogger(c).WithError(err).Warnf("failed to proxy API request to %s, serving it locally", attempt.backend.url)
+	tx := apm.TransactionFromContext(ctx)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("proxy_fallback", true)
+	})
+	if attempt.simulated {
+		return
+	}
+	if e := apm.CaptureError(ctx, err); e != nil {
+		e.Context.SetHTTPRequest(contextRequest(c))
+		e.Context.SetLabel("backend", attempt.backend.url.Host)
+		e.Send()
+	}
+}
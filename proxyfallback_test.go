@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestProxyFallback(t *testing.T) {
+	var served int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&served, 1)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("from backend"))
+	}))
+	defer backend.Close()
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	t.Setenv("OPBEANS_DT_FALLBACK", "true")
+	t.Setenv("OPBEANS_DT_FAILURE_THRESHOLD", "100")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	srv := newTestProxyServer(t, r)
+	host := hostOf(t, backend.URL)
+
+	// serve sends a request, returning its status and body, and the
+	// transaction and errors recorded for it.
+	serve := func(method, path, body string) (int, string, model.Transaction, []model.Error) {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		tracer.Flush(nil)
+		payloads := recorder.Payloads()
+		require.Len(t, payloads.Transactions, 1)
+		return resp.StatusCode, string(respBody), payloads.Transactions[0], payloads.Errors
+	}
+	assertBackendError := func(e model.Error) {
+		assert.True(t, e.Exception.Handled)
+		assert.Equal(t, host+" responded with 502 Bad Gateway", e.Exception.Message)
+		assert.Equal(t, "backendFailed", e.Culprit)
+		assert.Equal(t, model.IfaceMap{{Key: "backend", Value: host}}, e.Context.Tags)
+	}
+
+	// The backend fails, and the request is served from local data.
+	status, body, tx, apmErrors := serve("GET", "/api/products", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotContains(t, body, "from backend")
+	assert.Contains(t, body, `"name"`)
+	assert.Equal(t, true, transactionLabels(tx)["proxy_fallback"])
+	require.Len(t, apmErrors, 1)
+	assertBackendError(apmErrors[0])
+
+	// The local handler may fail too, its response replacing the
+	// backend's.
+	status, body, tx, apmErrors = serve("GET", "/api/products/999999", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, apperr.NotFound, decodeErrorEnvelope(t, []byte(body)).Code)
+	assert.Equal(t, true, transactionLabels(tx)["proxy_fallback"])
+	require.Len(t, apmErrors, 1)
+	assertBackendError(apmErrors[0])
+
+	// Writes never fall back: the backend's response is relayed.
+	status, body, tx, apmErrors = serve("POST", "/api/orders", `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, "from backend", body)
+	assert.NotContains(t, transactionLabels(tx), "proxy_fallback")
+	assert.Empty(t, apmErrors)
+	assert.EqualValues(t, 3, atomic.LoadInt64(&served))
+
+	// Nor do they if the backend is unreachable, while reads do.
+	backend.Close()
+	status, _, _, _ = serve("POST", "/api/orders", `{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`)
+	assert.Equal(t, http.StatusBadGateway, status)
+	status, _, tx, apmErrors = serve("GET", "/api/stats", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, transactionLabels(tx)["proxy_fallback"])
+	require.Len(t, apmErrors, 1)
+	assert.Contains(t, apmErrors[0].Exception.Message, "connection refused")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// Failures simulated for proxied requests.
+const (
+	// proxyFailureBadGateway responds with 502, as though the service
+	// had failed.
+	proxyFailureBadGateway = "bad_gateway"
+
+	// proxyFailureTimeout fails with a timeout, as though the service
+	// had not responded.
+	proxyFailureTimeout = "timeout"
+)
+
+// proxyFaults is an http.RoundTripper failing a proportion of proxied
+// requests on purpose, before dialing the service, so that errors
+// propagating through distributed traces can be demonstrated without
+// breaking the service. It must be wrapped by apmhttp.WrapRoundTripper,
+// so that the failures are recorded on the requests' spans.
+type proxyFaults struct {
+	settings *runtimeSettings
+	next     http.RoundTripper
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// newProxyFaults returns a proxyFaults failing requests at the proxy
+// failure rate held by settings, and otherwise sending them with next.
+// The requests failed are chosen with a source seeded by seed, or by the
+// time if seed is zero.
+func newProxyFaults(settings *runtimeSettings, next http.RoundTripper, seed int64) *proxyFaults {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &proxyFaults{settings: settings, next: next, random: rand.New(rand.NewSource(seed))}
+}
+
+// RoundTrip sends req with f.next, unless a failure is sampled for it.
+// Simulated failures tag the request's span, if any, with the outcome
+// "failure" and "proxy_failure_simulated", are recorded on the request's
+// backend attempt, if any, and are reported as errors naming the
+// service.
+func (f *proxyFaults) RoundTrip(req *http.Request) (*http.Response, error) {
+	failure := f.sample()
+	if failure == "" {
+		return f.next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	if span := apm.SpanFromContext(ctx); span != nil {
+		span.Context.SetTag("outcome", outcomeFailure)
+		span.Context.SetTag("proxy_failure_simulated", failure)
+	}
+	if a, ok := ctx.Value(backendKey{}).(*backendAttempt); ok {
+		a.simulated = true
+	}
+
+	var err error
+	var resp *http.Response
+	switch failure {
+	case proxyFailureBadGateway:
+		err = simulateProxyBadGateway(req.URL.Host)
+		resp = &http.Response{
+			Status:     "502 Bad Gateway",
+			StatusCode: http.StatusBadGateway,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader(http.StatusText(http.StatusBadGateway) + "\n")),
+			Request:    req,
+		}
+	case proxyFailureTimeout:
+		err = simulateProxyTimeout(req.URL.Host)
+	}
+	if e := apm.CaptureError(ctx, err); e != nil {
+		e.Context.SetLabel("proxy_failure_simulated", failure)
+		e.Send()
+	}
+	if resp == nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// sample returns a failure, chosen with equal probability, for the
+// proportion of requests given by the proxy failure rate, and otherwise
+// "".
+func (f *proxyFaults) sample() string {
+	rate := f.settings.proxyFailureRate()
+	if rate <= 0 {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.random.Float64() >= rate {
+		return ""
+	}
+	if f.random.Intn(2) == 0 {
+		return proxyFailureBadGateway
+	}
+	return proxyFailureTimeout
+}
+
+// proxyTimeoutError is the cause of the errors of simulated proxy
+// timeouts. It implements net.Error, reporting a timeout.
+type proxyTimeoutError string
+
+func (e proxyTimeoutError) Error() string { return string(e) }
+func (proxyTimeoutError) Timeout() bool   { return true }
+func (proxyTimeoutError) Temporary() bool { return true }
+
+// The failures are created by functions of their own, which are the
+// culprits of their errors.
+
+func simulateProxyBadGateway(service string) error {
+	return errors.Errorf("simulated bad gateway from %s", service)
+}
+
+func simulateProxyTimeout(service string) error {
+	return errors.WithStack(proxyTimeoutError("simulated timeout awaiting " + service))
+}
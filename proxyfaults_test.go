@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// sendProxyFaultRequests sends n requests for opbeans-python through
+// proxyFaults failing them at rate with a source seeded by seed, each in
+// a transaction of tracer, returning the sequence of failures simulated
+// ("" for requests sent) and the number of requests sent.
+func sendProxyFaultRequests(t *testing.T, tracer *apm.Tracer, rate float64, seed int64, n int) ([]string, int64) {
+	var sent int64
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt64(&sent, 1)
+		w := httptest.NewRecorder()
+		w.WriteHeader(http.StatusOK)
+		return w.Result(), nil
+	})
+	settings := newRuntimeSettings(&config.Config{Proxy: config.Proxy{FailureRate: rate}})
+	rt := apmhttp.WrapRoundTripper(newProxyFaults(settings, next, seed))
+
+	sequence := make([]string, n)
+	for i := range sequence {
+		tx := tracer.StartTransaction("GET /api/stats", "request")
+		req := httptest.NewRequest("GET", "http://opbeans-python:8000/api/stats", nil)
+		req = req.WithContext(apm.ContextWithTransaction(req.Context(), tx))
+		resp, err := rt.RoundTrip(req)
+		switch {
+		case err != nil:
+			nerr, ok := errors.Cause(err).(net.Error)
+			require.True(t, ok, err)
+			assert.True(t, nerr.Timeout())
+			sequence[i] = proxyFailureTimeout
+		case resp.StatusCode == http.StatusBadGateway:
+			sequence[i] = proxyFailureBadGateway
+			resp.Body.Close()
+		default:
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}
+		tx.End()
+	}
+	return sequence, atomic.LoadInt64(&sent)
+}
+
+func TestProxyFaults(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	const n, rate = 1000, 0.3
+	sequence, sent := sendProxyFaultRequests(t, tracer, rate, 42, n)
+
+	// About 30% of the requests fail without being sent, equally as bad
+	// gateways and timeouts.
+	failures := make(map[string]int)
+	for _, failure := range sequence {
+		failures[failure]++
+	}
+	simulated := n - failures[""]
+	assert.InDelta(t, n*rate, simulated, n*rate*0.2, failures)
+	assert.InDelta(t, simulated/2, failures[proxyFailureBadGateway], float64(simulated)*0.15, failures)
+	assert.EqualValues(t, failures[""], sent)
+
+	// The spans of simulated failures are tagged with their outcome,
+	// and their errors, reported as their children, name the service.
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Spans, n)
+	require.Len(t, payloads.Errors, simulated)
+	failedSpans := make(map[model.SpanID]string)
+	for _, span := range payloads.Spans {
+		assert.Equal(t, "external", span.Type)
+		assert.Equal(t, "http", span.Subtype)
+		assert.Equal(t, "GET opbeans-python:8000", span.Name)
+		tags := make(map[string]string)
+		for _, item := range span.Context.Tags {
+			tags[item.Key] = item.Value
+		}
+		failure, ok := tags["proxy_failure_simulated"]
+		if !ok {
+			assert.NotContains(t, tags, "outcome")
+			assert.Equal(t, http.StatusOK, span.Context.HTTP.StatusCode)
+			continue
+		}
+		assert.Equal(t, outcomeFailure, tags["outcome"])
+		if failure == proxyFailureBadGateway {
+			assert.Equal(t, http.StatusBadGateway, span.Context.HTTP.StatusCode)
+		}
+		failedSpans[span.ID] = failure
+	}
+	assert.Len(t, failedSpans, simulated)
+	for _, e := range payloads.Errors {
+		failure, ok := failedSpans[e.ParentID]
+		require.True(t, ok, "error %q is not a child of a failed span", e.Exception.Message)
+		switch failure {
+		case proxyFailureBadGateway:
+			assert.Equal(t, "simulated bad gateway from opbeans-python:8000", e.Exception.Message)
+			assert.Equal(t, "simulateProxyBadGateway", e.Culprit)
+		case proxyFailureTimeout:
+			assert.Equal(t, "simulated timeout awaiting opbeans-python:8000", e.Exception.Message)
+			assert.Equal(t, "simulateProxyTimeout", e.Culprit)
+		}
+	}
+
+	// The same seed fails the same requests in the same way.
+	again, _ := sendProxyFaultRequests(t, tracer, rate, 42, n)
+	assert.Equal(t, sequence, again)
+}
+
+func TestProxyFaultsReload(t *testing.T) {
+	setTestStartupFlags(t)
+	var proxied int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&proxied, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	t.Setenv("OPBEANS_DT_FAILURE_RATE", "1")
+	r, _ := startTestReloadableServer(t)
+
+	srv := newTestProxyServer(t, r)
+	serveStats := func() int {
+		resp, err := http.Get(srv.URL + "/api/stats")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Every proxied request fails, as a bad gateway or a timeout,
+	// without reaching the service.
+	for i := 0; i < 20; i++ {
+		assert.Contains(t, []int{http.StatusBadGateway, http.StatusGatewayTimeout}, serveStats())
+	}
+	assert.Zero(t, atomic.LoadInt64(&proxied))
+
+	// Reloading changes the failure rate without a restart.
+	t.Setenv("OPBEANS_DT_FAILURE_RATE", "0")
+	assert.Equal(t, []string{"proxy.failure_rate"}, reloadTestConfig(t, r).Reloaded)
+	assert.Equal(t, http.StatusOK, serveStats())
+	assert.EqualValues(t, 1, atomic.LoadInt64(&proxied))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders holds the hop-by-hop headers defined by RFC 7230,
+// which apply to a single connection and so are never relayed, along
+// with those named by the Connection header.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxiedRequestHeaders holds the canonical names of the request headers
+// forwarded to the backends: those describing the content and its
+// negotiation, the trace context and demo baggage, the request ID and
+// the forwarding headers. Others, notably credentials and cookies, are dropped, as they
+// are meant for this service.
+var proxiedRequestHeaders = map[string]bool{
+	"Accept":                  true,
+	"Accept-Encoding":         true,
+	"Accept-Language":         true,
+	"Baggage":                 true,
+	"Cache-Control":           true,
+	"Content-Encoding":        true,
+	"Content-Type":            true,
+	"Elastic-Apm-Traceparent": true,
+	"If-Match":                true,
+	"If-Modified-Since":       true,
+	"If-None-Match":           true,
+	"If-Unmodified-Since":     true,
+	"Traceparent":             true,
+	"Tracestate":              true,
+	"User-Agent":              true,
+	"X-Forwarded-For":         true,
+	"X-Forwarded-Host":        true,
+	"X-Forwarded-Proto":       true,
+	errorInjectionHeader:      true,
+	requestIDHeader:           true,
+}
+
+// droppedResponseHeaders holds the canonical names of the backend
+// response headers which are not relayed, as they are set by this
+// service's own middleware, or are meant for the backend's clients.
+var droppedResponseHeaders = []string{
+	"Server",
+	"Server-Timing",
+	"Set-Cookie",
+	"Strict-Transport-Security",
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"X-Powered-By",
+	"X-Trace-Id",
+	requestIDHeader,
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from h, including
+// those named by its Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// filterProxiedRequest limits the headers of req, a request about to be
+// proxied to a backend, to proxiedRequestHeaders, and appends this hop
+// to X-Forwarded-Proto and X-Forwarded-Host, before req.Host is
+// replaced with the backend's. httputil.ReverseProxy
+// appends the client's address to X-Forwarded-For. The forwarding
+// headers of the inbound request are dropped if not trusted, so that
+// the chain starts here.
+func filterProxiedRequest(req *http.Request, trustForwarded bool) {
+	h := req.Header
+	removeHopByHopHeaders(h)
+	if !trustForwarded {
+		for _, name := range forwardingHeaders {
+			h.Del(name)
+		}
+	}
+	for name := range h {
+		if !proxiedRequestHeaders[name] {
+			delete(h, name)
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	appendHeader(h, "X-Forwarded-Proto", proto)
+	appendHeader(h, "X-Forwarded-Host", req.Host)
+}
+
+// filterProxiedResponse removes the hop-by-hop headers and
+// droppedResponseHeaders from resp, a backend's response, and the CORS
+// headers, which are set by this service.
+func filterProxiedResponse(resp *http.Response) {
+	h := resp.Header
+	removeHopByHopHeaders(h)
+	for _, name := range droppedResponseHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+}
+
+// appendHeader appends value to the comma-separated list held by the
+// header name of h.
+func appendHeader(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// startTestProxy starts a server proxying every API request to the
+// service at serviceURL, returning its URL.
+func startTestProxy(t *testing.T, serviceURL string) string {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_SERVICES", serviceURL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	tracer, _ := transporttest.NewRecorderTracer()
+	t.Cleanup(tracer.Close)
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	srv := newTestProxyServer(t, r)
+	return srv.URL
+}
+
+func TestProxyHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+		h := w.Header()
+		h.Set("Connection", "X-Backend-Hop")
+		h.Set("X-Backend-Hop", "1")
+		h.Set("Set-Cookie", "session=backend")
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set(requestIDHeader, "backend-request-id")
+		h.Set("Content-Type", "application/json")
+		h.Set("ETag", `"v1"`)
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+	proxyURL := startTestProxy(t, backend.URL)
+
+	req, err := http.NewRequest("GET", proxyURL+"/api/stats", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("Cookie", "session=ours")
+	req.Header.Set("Connection", "Accept-Language, X-Hop")
+	req.Header.Set("Accept-Language", "en")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(requestIDHeader, "client-request-id")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Credentials, cookies and the headers listed by Connection are not
+	// forwarded, while the trace context and request ID are.
+	forwarded := <-received
+	for _, name := range []string{"Authorization", "Cookie", "Accept-Language", "X-Hop"} {
+		assert.NotContains(t, forwarded, name)
+	}
+	assert.Equal(t, "application/json", forwarded.Get("Accept"))
+	assert.Equal(t, "client-request-id", forwarded.Get(requestIDHeader))
+	assert.NotEmpty(t, forwarded.Get("Elastic-Apm-Traceparent"))
+	assert.Equal(t, "http", forwarded.Get("X-Forwarded-Proto"))
+	assert.Equal(t, hostOf(t, proxyURL), forwarded.Get("X-Forwarded-Host"))
+
+	// The backend's cookies, CORS and hop-by-hop headers are not
+	// relayed, and the request ID is this service's.
+	for _, name := range []string{"X-Backend-Hop", "Set-Cookie", "Access-Control-Allow-Origin"} {
+		assert.NotContains(t, resp.Header, name)
+	}
+	assert.Equal(t, []string{"client-request-id"}, resp.Header.Values(requestIDHeader))
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+}
+
+func TestProxyForwardedChain(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+		w.Write([]byte(`{}`))
+	}))
+	defer backend.Close()
+
+	// The client's request passes through two proxies, each appending
+	// its hop to the forwarding headers.
+	secondURL := startTestProxy(t, backend.URL)
+	firstURL := startTestProxy(t, secondURL)
+	req, err := http.NewRequest("GET", firstURL+"/api/stats", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "shop.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	forwarded := <-received
+	assert.Equal(t, "203.0.113.7, 127.0.0.1, 127.0.0.1", forwarded.Get("X-Forwarded-For"))
+	assert.Equal(t, "https, http, http", forwarded.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "shop.example.com, "+hostOf(t, firstURL)+", "+hostOf(t, secondURL), forwarded.Get("X-Forwarded-Host"))
+	assert.Len(t, forwarded.Values("X-Forwarded-For"), 1)
+
+	// Forwarding headers are dropped if not trusted.
+	t.Setenv("OPBEANS_TRUST_FORWARDED_HEADERS", "false")
+	untrustedURL := startTestProxy(t, backend.URL)
+	req, err = http.NewRequest("GET", untrustedURL+"/api/stats", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Forwarded-Host", "shop.example.com")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	forwarded = <-received
+	assert.Equal(t, "127.0.0.1", forwarded.Get("X-Forwarded-For"))
+	assert.Equal(t, hostOf(t, untrustedURL), forwarded.Get("X-Forwarded-Host"))
+}
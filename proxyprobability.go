@@ -0,0 +1,69 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.elastic.co/apm"
+)
+
+// Proxy decisions, labeled as "proxy_decision" on API transactions.
+const (
+	proxyDecisionProxy = "proxy"
+	proxyDecisionLocal = "local"
+)
+
+// proxyDecider decides which API requests are proxied, at the
+// probabilities of their route classes held by settings.
+type proxyDecider struct {
+	settings *runtimeSettings
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// newProxyDecider returns a proxyDecider drawing its decisions from a
+// source seeded by seed, or by the time if seed is zero.
+func newProxyDecider(settings *runtimeSettings, seed int64) *proxyDecider {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &proxyDecider{settings: settings, random: rand.New(rand.NewSource(seed))}
+}
+
+// routeClass returns the class of the route pattern: its first segment
+// after /api, such as "products" for "/api/products/:id".
+func routeClass(route string) string {
+	class := strings.TrimPrefix(route, "/api/")
+	if i := strings.IndexByte(class, '/'); i >= 0 {
+		class = class[:i]
+	}
+	return class
+}
+
+// decide reports whether the request of c is proxied, labeling its
+// transaction with the decision and the probability of its class. It
+// is called after route matching, so that the class is known.
+func (d *proxyDecider) decide(c *gin.Context) bool {
+	p := d.settings.proxyProbability(routeClass(c.FullPath()))
+	// Probabilities of 0 and 1 are exact, drawing no random numbers.
+	proxied := p >= 1
+	if p > 0 && p < 1 {
+		d.mu.Lock()
+		proxied = d.random.Float64() < p
+		d.mu.Unlock()
+	}
+	decision := proxyDecisionLocal
+	if proxied {
+		decision = proxyDecisionProxy
+	}
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("proxy_decision", decision)
+		tx.Context.SetLabel("proxy_probability", p)
+	})
+	return proxied
+}
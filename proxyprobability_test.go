@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestRouteClass(t *testing.T) {
+	for route, class := range map[string]string{
+		"/api/products":               "products",
+		"/api/products/:id":           "products",
+		"/api/products/:id/customers": "products",
+		"/api/stats":                  "stats",
+		"":                            "",
+	} {
+		assert.Equal(t, class, routeClass(route), route)
+	}
+}
+
+func TestProxyDeciderRates(t *testing.T) {
+	var cfg config.Config
+	cfg.Proxy.Probability = 0.2
+	cfg.Proxy.ClassProbabilities = map[string]float64{"products": 0.5, "orders": 0.1, "stats": 0}
+	decider := newProxyDecider(newRuntimeSettings(&cfg), 42)
+
+	proxied := make(map[string]int)
+	r := gin.New()
+	for _, route := range []string{"/api/products/:id", "/api/orders", "/api/stats", "/api/customers"} {
+		route := route
+		r.GET(route, func(c *gin.Context) {
+			if decider.decide(c) {
+				proxied[route]++
+			}
+		})
+	}
+	const n = 2000
+	for _, path := range []string{"/api/products/1", "/api/orders", "/api/stats", "/api/customers"} {
+		for i := 0; i < n; i++ {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+
+	// The rates are those of the classes, within about three standard
+	// deviations; classes without their own take the default.
+	assert.InDelta(t, 0.5, float64(proxied["/api/products/:id"])/n, 0.035)
+	assert.InDelta(t, 0.1, float64(proxied["/api/orders"])/n, 0.02)
+	assert.InDelta(t, 0.2, float64(proxied["/api/customers"])/n, 0.027)
+	assert.Zero(t, proxied["/api/stats"])
+}
+
+func TestProxyDecisionLabels(t *testing.T) {
+	var proxied int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&proxied, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "stats:0,default:1")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	serve := func(path string) map[string]interface{} {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, 1)
+		return transactionLabels(transactions[0])
+	}
+
+	labels := serve("/api/stats")
+	assert.Equal(t, proxyDecisionLocal, labels["proxy_decision"])
+	assert.EqualValues(t, 0, labels["proxy_probability"])
+	assert.Zero(t, atomic.LoadInt64(&proxied))
+
+	labels = serve("/api/products")
+	assert.Equal(t, proxyDecisionProxy, labels["proxy_decision"])
+	assert.EqualValues(t, 1, labels["proxy_probability"])
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxied))
+
+	// The probabilities of the classes are reloaded.
+	t.Setenv("OPBEANS_DT_PROBABILITY", "stats:1,default:1")
+	assert.Equal(t, []string{"proxy.class_probabilities"}, reloadTestConfig(t, r).Reloaded)
+	labels = serve("/api/stats")
+	assert.Equal(t, proxyDecisionProxy, labels["proxy_decision"])
+	assert.Equal(t, int64(2), atomic.LoadInt64(&proxied))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"strconv"
+)
+
+// proxyFlushInterval is the interval at which proxied responses are
+// flushed to the client while copied: negative, flushing each chunk as
+// it is copied, so that large responses such as exports are streamed.
+const proxyFlushInterval = -1
+
+// transferBody is the body of a response proxied to a backend, counting
+// the bytes read for its attempt. It must be wrapped by
+// apmhttp.WrapRoundTripper, so that the span is tagged by endTransfer
+// before it ends at the end of the body.
+type transferBody struct {
+	io.ReadCloser
+	attempt *backendAttempt
+}
+
+func (b transferBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.attempt.transferred += int64(n)
+	if err != nil {
+		b.attempt.endTransfer()
+	}
+	return n, err
+}
+
+// transferCloser is the body of a proxied response as copied to the
+// client, ending the transfer of its attempt when closed, before the
+// body wrapped by apmhttp.WrapRoundTripper ends the span, so that copies
+// aborted as the client disconnected are tagged.
+type transferCloser struct {
+	io.ReadCloser
+	attempt *backendAttempt
+}
+
+func (b transferCloser) Close() error {
+	b.attempt.endTransfer()
+	return b.ReadCloser.Close()
+}
+
+// endTransfer tags the span of a with "bytes_transferred", the bytes of
+// the response read, once the copy completes: at the end of the body,
+// on failing to read it, or when the copy is aborted.
+func (a *backendAttempt) endTransfer() {
+	if a.transferEnded {
+		return
+	}
+	a.transferEnded = true
+	if a.span != nil {
+		a.span.Context.SetTag("bytes_transferred", strconv.FormatInt(a.transferred, 10))
+	}
+}
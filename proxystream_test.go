@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// startTestStreamingProxy starts a server proxying every API request to
+// backend, returning its URL and a function returning the external spans
+// it recorded.
+func startTestStreamingProxy(t *testing.T, backend http.Handler) (string, func() []model.Span) {
+	upstream := httptest.NewServer(backend)
+	t.Cleanup(upstream.Close)
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_SERVICES", upstream.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	t.Cleanup(tracer.Close)
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	srv := newTestProxyServer(t, r)
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+	externalSpans := func() []model.Span {
+		tracer.Flush(nil)
+		var spans []model.Span
+		for _, span := range recorder.Payloads().Spans {
+			if span.Type == "external" {
+				spans = append(spans, span)
+			}
+		}
+		return spans
+	}
+	return srv.URL, externalSpans
+}
+
+func TestProxyStreaming(t *testing.T) {
+	const chunkSize, chunks = 32 << 10, 2048 // 64MB
+	firstChunk := make(chan struct{})
+	proxyURL, externalSpans := startTestStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Length", strconv.Itoa(chunkSize*chunks))
+		chunk := make([]byte, chunkSize)
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+			if i == 0 {
+				// The rest is sent only once the client has received
+				// the first chunk, which it cannot if the response is
+				// buffered.
+				w.(http.Flusher).Flush()
+				select {
+				case <-firstChunk:
+				case <-time.After(10 * time.Second):
+					return
+				}
+			}
+		}
+	}))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	resp, err := http.Get(proxyURL + "/api/orders")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	assert.EqualValues(t, chunkSize*chunks, resp.ContentLength)
+	_, err = io.ReadFull(resp.Body, make([]byte, chunkSize))
+	require.NoError(t, err)
+	close(firstChunk)
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	require.NoError(t, err)
+	assert.EqualValues(t, chunkSize*(chunks-1), n)
+	runtime.ReadMemStats(&after)
+
+	// The response is copied through a fixed buffer, allocating far
+	// less than its size.
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(chunkSize*chunks/4))
+
+	// The span ends once the copy completes, tagged with its size.
+	var spans []model.Span
+	require.Eventually(t, func() bool {
+		spans = externalSpans()
+		return len(spans) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, strconv.Itoa(chunkSize*chunks), spanTag(spans[0], "bytes_transferred"))
+}
+
+func TestProxyStreamingCancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	proxyURL, externalSpans := startTestStreamingProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		chunk := make([]byte, 32<<10)
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				break
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-req.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+		<-req.Context().Done()
+		close(cancelled)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest("GET", proxyURL+"/api/orders", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	require.NoError(t, err)
+	_, err = io.ReadFull(resp.Body, make([]byte, 64<<10))
+	require.NoError(t, err)
+
+	// Disconnecting the client cancels the backend request.
+	cancel()
+	resp.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend request not cancelled")
+	}
+
+	// The span of the aborted copy is tagged with the bytes copied.
+	var spans []model.Span
+	require.Eventually(t, func() bool {
+		spans = externalSpans()
+		return len(spans) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	transferred, err := strconv.Atoi(spanTag(spans[0], "bytes_transferred"))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, transferred, 64<<10)
+}
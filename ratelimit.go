@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// rateLimitMaxClients is the maximum number of clients whose buckets are
+// held by a rateLimiter. The least recently seen clients are forgotten,
+// and start again with a full bucket.
+const rateLimitMaxClients = 10000
+
+// rateLimit holds the rate at which a client's token bucket is refilled,
+// in requests per second, and the size of the bucket. A zero rate is
+// unlimited.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// newRateLimit returns the rate limit configured by limit.
+func newRateLimit(limit config.RateLimit) rateLimit {
+	return rateLimit{rate: limit.Rate, burst: limit.Burst}
+}
+
+// rateLimiter limits the rate of requests from each client with a token
+// bucket. Clients are identified by their API key, subject to the
+// apiKeys limit, or else by the authenticated customer or admin user, or
+// their address, subject to the clients limit.
+//
+// The limits may be changed with setLimits while requests are served.
+//
+// rateLimiter implements apm.MetricsGatherer.
+type rateLimiter struct {
+	tracer         *apm.Tracer
+	trustForwarded bool
+	maxClients     int
+	now            func() time.Time
+	rejected       int64
+
+	mu      sync.Mutex
+	clients rateLimit
+	apiKeys rateLimit
+	buckets map[string]*list.Element
+	lru     *list.List // of *rateBucket, most recently seen first
+}
+
+type rateBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitDecision describes the outcome of taking a token from a
+// client's bucket.
+type rateLimitDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until a token is available
+	reset      time.Duration // until the bucket is full
+}
+
+// newRateLimiter returns a rateLimiter. The client address is taken from proxy forwarding headers if
+// trustForwarded is true, as recorded by tracer.
+func newRateLimiter(tracer *apm.Tracer, clients, apiKeys rateLimit, trustForwarded bool) *rateLimiter {
+	return &rateLimiter{
+		tracer:         tracer,
+		clients:        clients,
+		apiKeys:        apiKeys,
+		trustForwarded: trustForwarded,
+		maxClients:     rateLimitMaxClients,
+		now:            time.Now,
+		buckets:        make(map[string]*list.Element),
+		lru:            list.New(),
+	}
+}
+
+// setLimits replaces the limits to which clients are subject. Buckets
+// are refilled subject to the new limits when next taken from.
+func (l *rateLimiter) setLimits(clients, apiKeys rateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients, l.apiKeys = clients, apiKeys
+}
+
+// limits returns the limits to which clients and API keys are subject.
+func (l *rateLimiter) limits() (clients, apiKeys rateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clients, l.apiKeys
+}
+
+// take takes a token from the bucket of the client identified by key,
+// subject to limit, if there is one.
+func (l *rateLimiter) take(key string, limit rateLimit) rateLimitDecision {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *rateBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		bucket = elem.Value.(*rateBucket)
+		elapsed := now.Sub(bucket.updated).Seconds()
+		bucket.tokens = math.Min(float64(limit.burst), bucket.tokens+elapsed*limit.rate)
+		bucket.updated = now
+	} else {
+		if l.lru.Len() >= l.maxClients {
+			oldest := l.lru.Remove(l.lru.Back()).(*rateBucket)
+			delete(l.buckets, oldest.key)
+		}
+		bucket = &rateBucket{key: key, tokens: float64(limit.burst), updated: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+
+	var d rateLimitDecision
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = limit.duration(1 - bucket.tokens)
+	}
+	d.remaining = int(bucket.tokens)
+	d.reset = limit.duration(float64(limit.burst) - bucket.tokens)
+	return d
+}
+
+// duration returns the time taken to refill the given number of tokens.
+func (limit rateLimit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / limit.rate * float64(time.Second))
+}
+
+// clientKey returns the key identifying the client of c, and the limit
+// to which it is subject.
+func (l *rateLimiter) clientKey(c *gin.Context) (string, rateLimit) {
+	clients, apiKeys := l.limits()
+	if name := authenticatedAPIClient(c); name != "" {
+		return "apikey:" + name, apiKeys
+	}
+	if claims := authenticatedCustomer(c); claims != nil {
+		return "customer:" + strconv.Itoa(claims.CustomerID), clients
+	}
+	if username := c.GetString(authenticatedUsernameKey); username != "" {
+		return "user:" + username, clients
+	}
+	req := c.Request
+	if !l.trustForwarded {
+		req = withoutForwardingHeaders(req)
+	}
+	return "ip:" + l.tracer.RemoteAddr(req), clients
+}
+
+// middleware rejects requests from clients which have exceeded the rate
+// limit with 429, and sets the RateLimit-* headers on all responses. It
+// must be installed after any authentication middleware, so that
+// authenticated clients are limited individually. If l is nil, requests
+// are not limited.
+//
+// Rejected requests are labeled on the transaction and counted, but are
+// not reported as errors.
+func (l *rateLimiter) middleware(c *gin.Context) {
+	if l == nil {
+		c.Next()
+		return
+	}
+	key, limit := l.clientKey(c)
+	if limit.rate == 0 {
+		c.Next()
+		return
+	}
+	d := l.take(key, limit)
+	c.Header("RateLimit-Limit", strconv.Itoa(limit.burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	if d.allowed {
+		c.Next()
+		return
+	}
+	atomic.AddInt64(&l.rejected, 1)
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("rate_limited", true)
+	})
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(d.retryAfter)))
+	abortWithStatus(c, http.StatusTooManyRequests)
+}
+
+// ceilSeconds returns d in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// GatherMetrics gathers the rate limiter's metrics, adding them to m.
+func (l *rateLimiter) GatherMetrics(ctx context.Context, m *apm.Metrics) error {
+	l.mu.Lock()
+	clients := l.lru.Len()
+	l.mu.Unlock()
+	m.Add("rate_limit_rejected_total", nil, float64(atomic.LoadInt64(&l.rejected)))
+	m.Add("rate_limit_clients", nil, float64(clients))
+	return nil
+}
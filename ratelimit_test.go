@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// newTestRateLimiter returns a rateLimiter allowing bursts of three
+// requests, refilled at one request per second, with a clock which only
+// moves when the returned function is called.
+func newTestRateLimiter(tracer *apm.Tracer) (*rateLimiter, func(time.Duration)) {
+	l := newRateLimiter(tracer, rateLimit{rate: 1, burst: 3}, rateLimit{}, true)
+	now := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func newTestRateLimitRouter(tracer *apm.Tracer, l *rateLimiter) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	r.GET("/healthz", func(c *gin.Context) {})
+	limited := r.Group("/api", jwtAuth(testJWTSecret), l.middleware)
+	limited.GET("/", func(c *gin.Context) {})
+	return r
+}
+
+func serveFrom(r http.Handler, path, clientIP string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("X-Forwarded-For", clientIP)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, advance := newTestRateLimiter(apm.DefaultTracer)
+	r := newTestRateLimitRouter(apm.DefaultTracer, l)
+
+	for i := 0; i < 3; i++ {
+		w := serveFrom(r, "/api/", "203.0.113.1")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, []string{"2", "1", "0"}[i], w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, []string{"1", "2", "3"}[i], w.Header().Get("RateLimit-Reset"))
+		assert.Empty(t, w.Header().Get("Retry-After"))
+	}
+	w := serveFrom(r, "/api/", "203.0.113.1")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.RateLimited, body.Code)
+	assert.Equal(t, "Too Many Requests", body.Message)
+
+	// Other clients, and excluded routes, are not limited.
+	w = serveFrom(r, "/api/", "203.0.113.2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	for i := 0; i < 5; i++ {
+		w = serveFrom(r, "/healthz", "203.0.113.1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+
+	// The bucket refills over time, up to the burst size.
+	advance(500 * time.Millisecond)
+	w = serveFrom(r, "/api/", "203.0.113.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	advance(500 * time.Millisecond)
+	w = serveFrom(r, "/api/", "203.0.113.1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		w = serveFrom(r, "/api/", "203.0.113.1")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = serveFrom(r, "/api/", "203.0.113.1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestRateLimiterClientKey(t *testing.T) {
+	l, _ := newTestRateLimiter(apm.DefaultTracer)
+	r := newTestRateLimitRouter(apm.DefaultTracer, l)
+	for i := 0; i < 3; i++ {
+		serveFrom(r, "/api/", "203.0.113.1")
+	}
+
+	// Authenticated customers are limited individually, regardless of
+	// their address.
+	token := newTestToken(t, testJWTSecret, 1, "", time.Now().Add(time.Hour))
+	req := httptest.NewRequest("GET", "/api/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+
+	// Untrusted forwarding headers are ignored, and clients are
+	// identified by the connection's address.
+	l.trustForwarded = false
+	for _, clientIP := range []string{"203.0.113.3", "203.0.113.4", "203.0.113.5"} {
+		w := serveFrom(r, "/api/", clientIP)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = serveFrom(r, "/api/", "203.0.113.6")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, l.buckets, "ip:192.0.2.1") // httptest.NewRequest's address
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l, _ := newTestRateLimiter(apm.DefaultTracer)
+	l.maxClients = 2
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.take("a", l.clients).allowed)
+	}
+	assert.False(t, l.take("a", l.clients).allowed)
+	l.take("b", l.clients)
+	l.take("c", l.clients)
+
+	// "a" was least recently seen, so its bucket was evicted and it
+	// starts again with a full bucket.
+	assert.Len(t, l.buckets, 2)
+	assert.NotContains(t, l.buckets, "a")
+	assert.Equal(t, 2, l.take("a", l.clients).remaining)
+	assert.NotContains(t, l.buckets, "b")
+}
+
+func TestRateLimiterTracing(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	l, _ := newTestRateLimiter(tracer)
+	tracer.RegisterMetricsGatherer(l)
+	r := newTestRateLimitRouter(tracer, l)
+	for i := 0; i < 4; i++ {
+		serveFrom(r, "/api/", "203.0.113.1")
+	}
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+
+	// Rejected requests are labeled, but not reported as errors.
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 4)
+	for i, tx := range payloads.Transactions {
+		if i < 3 {
+			assert.Equal(t, "HTTP 2xx", tx.Result)
+			assert.NotContains(t, transactionLabels(tx), "rate_limited")
+		} else {
+			assert.Equal(t, "HTTP 4xx", tx.Result)
+			assert.Equal(t, true, transactionLabels(tx)["rate_limited"])
+		}
+	}
+	assert.Empty(t, payloads.Errors)
+
+	samples := make(map[string]model.Metric)
+	for _, m := range payloads.Metrics {
+		for name, sample := range m.Samples {
+			samples[name] = sample
+		}
+	}
+	assert.Equal(t, model.Metric{Value: 1}, samples["rate_limit_rejected_total"])
+	assert.Equal(t, model.Metric{Value: 1}, samples["rate_limit_clients"])
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	r := newTestRateLimitRouter(apm.DefaultTracer, newRateLimiter(apm.DefaultTracer, rateLimit{}, rateLimit{}, true))
+	for i := 0; i < 10; i++ {
+		w := serveFrom(r, "/api/", "203.0.113.1")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+)
+
+// recoveryMiddleware returns a middleware which recovers panics raised by
+// handlers, reporting them to tracer along with application-specific
+// context: the route pattern, the request ID, and the customer or order ID.
+//
+// The middleware must be installed after tracingMiddleware, so that panics
+// are recovered here before they reach the tracingMiddleware recovery path,
+// and after requestIDMiddleware, so that the request ID is recorded.
+func recoveryMiddleware(tracer *apm.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			tx := apm.TransactionFromContext(c.Request.Context())
+			e := tracer.Recovered(v)
+			if tx != nil {
+				e.SetTransaction(tx)
+			}
+			e.Context.SetHTTPRequest(contextRequest(c))
+			e.Context.SetHTTPStatusCode(http.StatusInternalServerError)
+			setPanicContext(&e.Context, c)
+			e.Send()
+
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			abortWithStatus(c, http.StatusInternalServerError)
+		}()
+		c.Next()
+	}
+}
+
+// setPanicContext records the context of the panicking request in ctx:
+// the route, request ID and customer or order ID as custom context, and
+// the label panic=true.
+func setPanicContext(ctx *apm.Context, c *gin.Context) {
+	ctx.SetLabel("panic", true)
+	route := c.FullPath()
+	if route != "" {
+		ctx.SetCustom("route", route)
+	}
+	if requestID := requestIDFromContext(c.Request.Context()); requestID != "" {
+		ctx.SetCustom("request_id", requestID)
+	}
+	if id := c.Param("id"); id != "" {
+		switch {
+		case strings.HasPrefix(route, "/api/customers/"):
+			ctx.SetCustom("customer_id", id)
+		case strings.HasPrefix(route, "/api/orders/"):
+			ctx.SetCustom("order_id", id)
+		}
+	}
+}
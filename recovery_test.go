@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(requestIDMiddleware)
+	r.Use(recoveryMiddleware(tracer))
+	r.GET("/api/customers/:id", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/customers/123", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	r.ServeHTTP(w, req)
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	require.Len(t, payloads.Errors, 1)
+	tx := payloads.Transactions[0]
+	e := payloads.Errors[0]
+	assert.Equal(t, tx.ID, e.TransactionID)
+	assert.Equal(t, "boom", e.Exception.Message)
+	assert.Equal(t, model.IfaceMap{{Key: "panic", Value: true}}, e.Context.Tags)
+	assert.Equal(t, model.IfaceMap{
+		{Key: "customer_id", Value: "123"},
+		{Key: "request_id", Value: "abc-123"},
+		{Key: "route", Value: "/api/customers/:id"},
+	}, e.Context.Custom)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.Internal, body.Code)
+	assert.Equal(t, fmt.Sprintf("%x", tx.TraceID[:]), body.TraceID)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// runtimeSettings holds the reloadable settings which are read per
+// request, rather than captured at startup. A nil *runtimeSettings
+// holds the defaults.
+type runtimeSettings struct {
+	cacheTTLNanos         int64  // accessed atomically
+	responseCacheTTLNanos int64  // accessed atomically
+	proxyProbabilityBits  uint64 // math.Float64bits, accessed atomically
+	proxyFailureRateBits  uint64 // math.Float64bits, accessed atomically
+	errorRateBits         uint64 // math.Float64bits, accessed atomically
+	stockShortageRateBits uint64 // math.Float64bits, accessed atomically
+
+	// nPlusOneFlag is set while the N+1 demo mode is enabled. It is
+	// toggled through the admin API, and so not reset by reloading.
+	nPlusOneFlag uint32 // accessed atomically
+
+	// errorBurstRateBits holds the error rate raised by the active error
+	// bursts, or zero if none is active. It is set by the error burst
+	// scheduler, and so not reset by reloading.
+	errorBurstRateBits uint64 // math.Float64bits, accessed atomically
+
+	// proxyClassProbabilities holds the proxy probabilities of route
+	// classes, as a map[string]float64 which is never modified.
+	proxyClassProbabilities atomic.Value
+
+	// scenarioValue holds the active chaos scenario, if any, as a
+	// *chaosScenario. Its preset values override the configured ones.
+	// It is activated through the admin API, and so not reset by
+	// reloading.
+	scenarioValue atomic.Value
+}
+
+// newRuntimeSettings returns the runtime settings configured by cfg.
+// The N+1 demo mode is enabled unless the GraphQL dataloader is.
+func newRuntimeSettings(cfg *config.Config) *runtimeSettings {
+	s := &runtimeSettings{}
+	s.set(cfg)
+	s.setNPlusOne(!cfg.GraphQL.Dataloader)
+	return s
+}
+
+func (s *runtimeSettings) set(cfg *config.Config) {
+	atomic.StoreInt64(&s.cacheTTLNanos, int64(cfg.CacheTTL))
+	atomic.StoreInt64(&s.responseCacheTTLNanos, int64(cfg.ResponseCacheTTL))
+	atomic.StoreUint64(&s.proxyProbabilityBits, math.Float64bits(cfg.Proxy.Probability))
+	s.proxyClassProbabilities.Store(cfg.Proxy.ClassProbabilities)
+	atomic.StoreUint64(&s.proxyFailureRateBits, math.Float64bits(cfg.Proxy.FailureRate))
+	atomic.StoreUint64(&s.errorRateBits, math.Float64bits(cfg.ErrorInjection.Rate))
+	atomic.StoreUint64(&s.stockShortageRateBits, math.Float64bits(cfg.ErrorInjection.StockShortageRate))
+}
+
+// cacheTTL returns the time for which cached stats are served.
+func (s *runtimeSettings) cacheTTL() time.Duration {
+	if s == nil {
+		return config.DefaultCacheTTL
+	}
+	return time.Duration(atomic.LoadInt64(&s.cacheTTLNanos))
+}
+
+// responseCacheTTL returns the time for which responses to product
+// reads are cached, or zero if they are not.
+func (s *runtimeSettings) responseCacheTTL() time.Duration {
+	if s == nil {
+		return config.DefaultResponseCacheTTL
+	}
+	return time.Duration(atomic.LoadInt64(&s.responseCacheTTLNanos))
+}
+
+// proxyProbability returns the probability of proxying an API request
+// of the route class, or of any class without its own probability.
+func (s *runtimeSettings) proxyProbability(class string) float64 {
+	if s == nil {
+		return config.DefaultProxyProbability
+	}
+	classes, _ := s.proxyClassProbabilities.Load().(map[string]float64)
+	if p, ok := classes[class]; ok {
+		return p
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.proxyProbabilityBits))
+}
+
+// proxyFailureRate returns the proportion of proxied requests failed
+// on purpose.
+func (s *runtimeSettings) proxyFailureRate() float64 {
+	if s == nil {
+		return 0
+	}
+	if sc := s.scenario(); sc != nil && sc.preset.proxyFailureRate > 0 {
+		return sc.preset.proxyFailureRate
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.proxyFailureRateBits))
+}
+
+// errorRate returns the proportion of requests failed on purpose: that
+// of the active error bursts, if any, or else that of the active chaos
+// scenario, or else the configured rate.
+func (s *runtimeSettings) errorRate() float64 {
+	if s == nil {
+		return 0
+	}
+	if rate := s.errorBurstRate(); rate > 0 {
+		return rate
+	}
+	if sc := s.scenario(); sc != nil && sc.preset.errorRate > 0 {
+		return sc.preset.errorRate
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.errorRateBits))
+}
+
+// stockShortageRate returns the proportion of checkouts reporting
+// insufficient stock on purpose.
+func (s *runtimeSettings) stockShortageRate() float64 {
+	if s == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&s.stockShortageRateBits))
+}
+
+// errorBurstRate returns the error rate raised by the active error
+// bursts, or zero if none is active.
+func (s *runtimeSettings) errorBurstRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.errorBurstRateBits))
+}
+
+// setErrorBurstRate sets the error rate raised by the active error
+// bursts, zero if none is active.
+func (s *runtimeSettings) setErrorBurstRate(rate float64) {
+	atomic.StoreUint64(&s.errorBurstRateBits, math.Float64bits(rate))
+}
+
+// scenario returns the active chaos scenario, or nil if there is none.
+func (s *runtimeSettings) scenario() *chaosScenario {
+	if s == nil {
+		return nil
+	}
+	sc, _ := s.scenarioValue.Load().(*chaosScenario)
+	return sc
+}
+
+// setScenario activates sc, or deactivates the active scenario if sc is
+// nil.
+func (s *runtimeSettings) setScenario(sc *chaosScenario) {
+	s.scenarioValue.Store(sc)
+}
+
+// nPlusOne reports whether the N+1 demo mode is enabled, in which the
+// lines and customers of orders queried through GraphQL are loaded per
+// order rather than batched.
+func (s *runtimeSettings) nPlusOne() bool {
+	if s == nil {
+		// The dataloader is disabled by default.
+		return true
+	}
+	return atomic.LoadUint32(&s.nPlusOneFlag) != 0
+}
+
+// setNPlusOne enables or disables the N+1 demo mode.
+func (s *runtimeSettings) setNPlusOne(enabled bool) {
+	var flag uint32
+	if enabled {
+		flag = 1
+	}
+	atomic.StoreUint32(&s.nPlusOneFlag, flag)
+}
+
+// configReloader reloads the configuration, applying the options which
+// may be changed at runtime: the log level, stats and response cache
+// TTLs, proxy probabilities and failure rate, error and stock shortage
+// rates, and rate limits. Changes to other options are reported, but
+// require a restart.
+type configReloader struct {
+	load     func() (*config.Config, error)
+	settings *runtimeSettings
+	limiter  *rateLimiter
+
+	mu      sync.Mutex
+	current *config.Config
+}
+
+// reloadResult reports the options changed by reloading the
+// configuration, named as by config.Diff.
+type reloadResult struct {
+	Reloaded        []string `json:"reloaded"`
+	RequiresRestart []string `json:"requires_restart"`
+}
+
+// config returns the effective configuration.
+func (r *configReloader) config() *config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// reload loads the configuration and applies the reloadable options.
+// Other options keep their running values. If the configuration is
+// invalid, nothing is changed.
+func (r *configReloader) reload() (reloadResult, error) {
+	loaded, err := r.load()
+	if err != nil {
+		return reloadResult{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := *r.current
+	next.CacheTTL = loaded.CacheTTL
+	next.ResponseCacheTTL = loaded.ResponseCacheTTL
+	next.Proxy.Probability = loaded.Proxy.Probability
+	next.Proxy.ClassProbabilities = loaded.Proxy.ClassProbabilities
+	next.Proxy.FailureRate = loaded.Proxy.FailureRate
+	next.ErrorInjection.Rate = loaded.ErrorInjection.Rate
+	next.ErrorInjection.StockShortageRate = loaded.ErrorInjection.StockShortageRate
+	next.Limits = loaded.Limits
+	next.Diagnostics.LogLevel = loaded.Diagnostics.LogLevel
+	result := reloadResult{
+		Reloaded:        append([]string{}, config.Diff(r.current, &next)...),
+		RequiresRestart: append([]string{}, config.Diff(&next, loaded)...),
+	}
+
+	r.settings.set(&next)
+	r.limiter.setLimits(newRateLimit(next.Limits.RateLimit), newRateLimit(next.Limits.APIKeyRateLimit))
+	logrus.SetLevel(next.Diagnostics.LogLevel)
+	r.current = &next
+
+	logrus.WithField("options", result.Reloaded).Info("reloaded configuration")
+	if len(result.RequiresRestart) > 0 {
+		logrus.WithField("options", result.RequiresRestart).Warn("configuration changes require a restart")
+	}
+	return result, nil
+}
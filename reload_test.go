@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// startTestReloadableServer starts up a server configured by the flags
+// and environment set by the test, returning its router and reloader.
+func startTestReloadableServer(t *testing.T) (*gin.Engine, *configReloader) {
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	tracer, _ := transporttest.NewRecorderTracer()
+	t.Cleanup(tracer.Close)
+	r, reloader, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	return r, reloader
+}
+
+func reloadTestConfig(t *testing.T, r http.Handler) reloadResult {
+	w := serveAdmin(r, "POST", "/api/admin/config/reload", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result reloadResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+func TestReloadProxyProbability(t *testing.T) {
+	setTestStartupFlags(t)
+	var proxied int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&proxied, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "0")
+	r, reloader := startTestReloadableServer(t)
+
+	srv := newTestProxyServer(t, r)
+	serveStats := func() {
+		resp, err := http.Get(srv.URL + "/api/stats")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	for i := 0; i < 5; i++ {
+		serveStats()
+	}
+	assert.Zero(t, atomic.LoadInt64(&proxied))
+
+	// New requests observe the holder's probability without a restart.
+	cfg := *reloader.config()
+	cfg.Proxy.Probability = 1
+	reloader.settings.set(&cfg)
+	for i := 0; i < 5; i++ {
+		serveStats()
+	}
+	assert.Equal(t, int64(5), atomic.LoadInt64(&proxied))
+
+	// Reloading restores the configured probability.
+	assert.Empty(t, reloadTestConfig(t, r).Reloaded)
+	serveStats()
+	assert.Equal(t, int64(5), atomic.LoadInt64(&proxied))
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	assert.Equal(t, []string{"proxy.probability"}, reloadTestConfig(t, r).Reloaded)
+	serveStats()
+	assert.Equal(t, int64(6), atomic.LoadInt64(&proxied))
+}
+
+func TestReloadRateLimit(t *testing.T) {
+	setTestStartupFlags(t)
+	r, reloader := startTestReloadableServer(t)
+
+	serveStats := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/stats", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serveStats().Code)
+	}
+
+	// Rate limits are reloadable; other options require a restart, and
+	// keep their running values.
+	t.Setenv("OPBEANS_RATE_LIMIT", "0.001")
+	t.Setenv("OPBEANS_RATE_LIMIT_BURST", "1")
+	t.Setenv("OPBEANS_GRAPHQL_DATALOADER", "true")
+	result := reloadTestConfig(t, r)
+	assert.Equal(t, []string{
+		"limits.rate_limit.rate",
+		"limits.rate_limit.burst",
+		"limits.api_key_rate_limit.rate",
+		"limits.api_key_rate_limit.burst",
+	}, result.Reloaded)
+	assert.Equal(t, []string{"graphql.dataloader"}, result.RequiresRestart)
+	assert.False(t, reloader.config().GraphQL.Dataloader)
+	assert.Equal(t, 0.001, reloader.config().Limits.RateLimit.Rate)
+
+	assert.Equal(t, http.StatusOK, serveStats().Code)
+	assert.Equal(t, http.StatusTooManyRequests, serveStats().Code)
+
+	// The admin's reloads are audited.
+	var found bool
+	for _, entry := range getTestAuditLog(t, r, "").Entries {
+		found = found || entry.Action == auditActionReloadConfig
+	}
+	assert.True(t, found)
+}
+
+func TestReloadInvalid(t *testing.T) {
+	setTestStartupFlags(t)
+	r, reloader := startTestReloadableServer(t)
+
+	t.Setenv("OPBEANS_CACHE_TTL", "5s")
+	t.Setenv("OPBEANS_RATE_LIMIT", "fast")
+	w := serveAdmin(r, "POST", "/api/admin/config/reload", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, time.Minute, reloader.settings.cacheTTL())
+}
+
+func TestReloadEnvFile(t *testing.T) {
+	setTestStartupFlags(t)
+	path := filepath.Join(t.TempDir(), "opbeans.env")
+	require.NoError(t, ioutil.WriteFile(path, []byte("OPBEANS_CACHE_TTL=10s\n"), 0644))
+	t.Cleanup(setFlag(envFile, path))
+	t.Setenv("OPBEANS_CACHE_TTL", "20s")
+	_, reloader := startTestReloadableServer(t)
+	assert.Equal(t, 10*time.Second, reloader.settings.cacheTTL())
+
+	// The file is re-read on reload, and overrides the environment.
+	require.NoError(t, ioutil.WriteFile(path, []byte("OPBEANS_CACHE_TTL=30s\nKAFKA_TOPIC=renamed\n"), 0644))
+	result, err := reloader.reload()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cache_ttl"}, result.Reloaded)
+	assert.Equal(t, []string{"events.kafka.topic"}, result.RequiresRestart)
+	assert.Equal(t, 30*time.Second, reloader.settings.cacheTTL())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+
+	"go.elastic.co/apm"
+)
+
+const (
+	// jsonAPIMediaType is the media type of JSON:API documents.
+	jsonAPIMediaType = "application/vnd.api+json"
+
+	// msgpackMediaType is the media type of MessagePack responses.
+	msgpackMediaType = "application/x-msgpack"
+)
+
+// msgpackHandle encodes MessagePack responses. Struct fields are named
+// by their json tags, so the encoding mirrors the JSON responses; times
+// are encoded with the timestamp extension type.
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// renderJSON renders v as the JSON response body, with the given status
+// code. Rendering is recorded as a span for sampled transactions, and
+// timed for the Server-Timing header.
+//
+// The body is encoded in the format returned by responseFormat: JSON:API
+// documents wrap v as described for jsonAPIDocument, and MessagePack
+// falls back to JSON if v cannot be encoded. Bodies are encoded in
+// pooled buffers, released once written.
+func renderJSON(c *gin.Context, code int, v interface{}) {
+	defer startTiming(c.Request.Context(), serverTimingRender)()
+	if tx := apm.TransactionFromContext(c.Request.Context()); tx.Sampled() {
+		span, _ := apm.StartSpan(c.Request.Context(), "render JSON", "app.render")
+		defer span.End()
+	}
+	c.Header("Vary", "Accept")
+	buf := getBuffer()
+	defer putBuffer(buf)
+	switch responseFormat(c) {
+	case jsonAPIMediaType:
+		c.Header("Content-Type", jsonAPIMediaType)
+		v = jsonAPIDocument(v)
+	case msgpackMediaType:
+		if err := codec.NewEncoder(buf, msgpackHandle).Encode(v); err != nil {
+			contextLogger(c).WithError(err).Debug("failed to encode MessagePack response, falling back to JSON")
+			buf.Reset()
+			break
+		}
+		c.Data(code, msgpackMediaType, buf.Bytes())
+		return
+	}
+	// The body is encoded as by c.JSON, without the newline terminating
+	// encoded values. c.JSON records the error if v cannot be encoded.
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		c.JSON(code, v)
+		return
+	}
+	c.Data(code, "application/json; charset=utf-8", bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// responseFormat returns the media type in which the response to c is
+// encoded. JSON:API documents are rendered for clients accepting them in
+// preference to plain JSON. MessagePack and NDJSON are rendered for
+// clients accepting them in preference to JSON, for GET and HEAD
+// requests only. NDJSON is only streamed by the list endpoints which
+// support it (see streamNDJSON); renderJSON renders plain JSON instead.
+func responseFormat(c *gin.Context) string {
+	format := c.NegotiateFormat(gin.MIMEJSON, jsonAPIMediaType, msgpackMediaType, ndjsonMediaType)
+	switch format {
+	case msgpackMediaType, ndjsonMediaType:
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			return gin.MIMEJSON
+		}
+	}
+	return format
+}
+
+// jsonAPIDocument returns a JSON:API document with v as its primary data.
+// Lists are rendered as {"data": [...], "meta": {"total": n}}, and other
+// values as {"data": {...}}.
+func jsonAPIDocument(v interface{}) gin.H {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return gin.H{"data": v}
+	}
+	if rv.Kind() == reflect.Slice && rv.IsNil() {
+		// Empty lists are rendered as [], not null.
+		v = reflect.MakeSlice(rv.Type(), 0, 0).Interface()
+	}
+	return gin.H{"data": v, "meta": gin.H{"total": rv.Len()}}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestRenderJSONSampled(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	r := newRenderTestRouter(tracer)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	require.Len(t, payloads.Spans, 1)
+	assert.Equal(t, "render JSON", payloads.Spans[0].Name)
+	assert.Equal(t, model.IfaceMap{
+		{Key: "label", Value: "value"},
+		{Key: "outcome", Value: "success"},
+	}, payloads.Transactions[0].Context.Tags)
+}
+
+func TestRenderJSONUnsampled(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	tracer.SetSampler(apm.NewRatioSampler(0))
+
+	r := newRenderTestRouter(tracer)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+
+	assert.Equal(t, `{"hello":"world"}`, w.Body.String())
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Empty(t, payloads.Spans)
+	assert.Nil(t, payloads.Transactions[0].Context)
+}
+
+func TestRenderJSONAPI(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	get := func(t *testing.T, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Accept", w.Header().Get("Vary"))
+		return w
+	}
+
+	for _, test := range []struct {
+		path string
+		list bool
+	}{
+		{path: "/api/products", list: true},
+		{path: "/api/customers", list: true},
+		{path: "/api/products/1"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			var plain interface{}
+			for _, accept := range []string{"", "*/*", "application/json"} {
+				w := get(t, test.path, accept)
+				assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plain))
+				if test.list {
+					assert.IsType(t, []interface{}{}, plain)
+				} else {
+					assert.Contains(t, plain, "sku")
+				}
+			}
+
+			w := get(t, test.path, jsonAPIMediaType)
+			assert.Equal(t, jsonAPIMediaType, w.Header().Get("Content-Type"))
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+			assert.Equal(t, plain, doc["data"])
+			if test.list {
+				assert.Equal(t, map[string]interface{}{
+					"total": float64(len(plain.([]interface{}))),
+				}, doc["meta"])
+			} else {
+				assert.NotContains(t, doc, "meta")
+			}
+		})
+	}
+}
+
+func TestRenderJSONEncoding(t *testing.T) {
+	// Bodies are encoded as by encoding/json, escaping HTML.
+	v := gin.H{"name": "Roast <1> & \u2028", "products": newTestProductList(3)}
+	want, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, v)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, string(want), w.Body.String())
+}
+
+func TestJSONAPIDocument(t *testing.T) {
+	assert.Equal(t, gin.H{"data": []int{}, "meta": gin.H{"total": 0}}, jsonAPIDocument([]int(nil)))
+	assert.Equal(t, gin.H{"data": [2]int{1, 2}, "meta": gin.H{"total": 2}}, jsonAPIDocument([2]int{1, 2}))
+	assert.Equal(t, gin.H{"data": (*Product)(nil)}, jsonAPIDocument((*Product)(nil)))
+}
+
+func TestRenderMsgpack(t *testing.T) {
+	r := newTestAPIRouter(apm.DefaultTracer, newTestDB(t))
+	get := func(t *testing.T, path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	// roundTrip decodes the JSON and MessagePack responses for path into
+	// jsonOut and msgpackOut respectively.
+	roundTrip := func(t *testing.T, path string, jsonOut, msgpackOut interface{}) {
+		w := get(t, path, "application/json")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), jsonOut))
+
+		w = get(t, path, msgpackMediaType)
+		assert.Equal(t, msgpackMediaType, w.Header().Get("Content-Type"))
+		require.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), msgpackHandle).Decode(msgpackOut))
+	}
+
+	t.Run("products", func(t *testing.T) {
+		var fromJSON, fromMsgpack []Product
+		roundTrip(t, "/api/products", &fromJSON, &fromMsgpack)
+		assert.NotEmpty(t, fromMsgpack)
+		assert.Equal(t, fromJSON, fromMsgpack)
+	})
+	t.Run("product", func(t *testing.T) {
+		var fromJSON, fromMsgpack Product
+		roundTrip(t, "/api/products/1", &fromJSON, &fromMsgpack)
+		assert.Equal(t, 1, fromMsgpack.ID)
+		assert.Equal(t, fromJSON, fromMsgpack)
+	})
+	t.Run("order", func(t *testing.T) {
+		var fromJSON, fromMsgpack Order
+		roundTrip(t, "/api/orders/1", &fromJSON, &fromMsgpack)
+		assert.NotEmpty(t, fromMsgpack.Lines)
+		assert.True(t, fromJSON.CreatedAt.Equal(fromMsgpack.CreatedAt))
+		fromJSON.CreatedAt = fromMsgpack.CreatedAt
+		assert.Equal(t, fromJSON, fromMsgpack)
+	})
+	t.Run("post", func(t *testing.T) {
+		// Only responses to read-only requests are encoded as MessagePack.
+		req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(
+			`{"customer_id": 1, "lines": [{"id": 1, "amount": 1}]}`,
+		))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", msgpackMediaType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	})
+}
+
+// unencodableMsgpack has a JSON encoding, but no MessagePack mapping.
+type unencodableMsgpack struct {
+	Value complex128
+}
+
+func (v unencodableMsgpack) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"value": fmt.Sprint(v.Value)})
+}
+
+func TestRenderMsgpackFallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(apm.DefaultTracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, unencodableMsgpack{Value: 1 + 2i})
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", msgpackMediaType)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"value":"(1+2i)"}`, w.Body.String())
+}
+
+func BenchmarkRenderProducts(b *testing.B) {
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(b, err)
+	defer tracer.Close()
+	tracer.Transport = transporttest.Discard
+
+	r := newTestAPIRouter(tracer, newTestDB(b))
+	for _, accept := range []string{"application/json", msgpackMediaType} {
+		b.Run(accept, func(b *testing.B) {
+			req := httptest.NewRequest("GET", "/api/products", nil)
+			req.Header.Set("Accept", accept)
+			var size int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				size = w.Body.Len()
+			}
+			b.ReportMetric(float64(size), "bytes/response")
+		})
+	}
+}
+
+func BenchmarkRenderLargeProductList(b *testing.B) {
+	tracer, err := apm.NewTracer("", "")
+	require.NoError(b, err)
+	defer tracer.Close()
+	tracer.Transport = transporttest.Discard
+
+	products := newTestProductList(2000)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, products)
+	})
+	for _, accept := range []string{"application/json", jsonAPIMediaType, msgpackMediaType} {
+		b.Run(accept, func(b *testing.B) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", accept)
+			var size int
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				size = w.Body.Len()
+			}
+			b.ReportMetric(float64(size), "bytes/response")
+		})
+	}
+}
+
+// newTestProductList returns n products, for rendering large responses.
+func newTestProductList(n int) []Product {
+	products := make([]Product, n)
+	for i := range products {
+		products[i] = Product{
+			ID:           i + 1,
+			SKU:          fmt.Sprintf("OP-%06d", i+1),
+			Name:         fmt.Sprintf("Roast <%d>", i+1),
+			Description:  "A full-bodied roast & a smooth finish",
+			Stock:        i % 100,
+			Cost:         500 + i%300,
+			SellingPrice: 900 + i%500,
+		}
+	}
+	return products
+}
+
+func BenchmarkRenderJSON(b *testing.B) {
+	for _, ratio := range []float64{1, 0.01} {
+		b.Run("ratio="+strconv.FormatFloat(ratio, 'g', -1, 64), func(b *testing.B) {
+			tracer, err := apm.NewTracer("", "")
+			require.NoError(b, err)
+			defer tracer.Close()
+			tracer.Transport = transporttest.Discard
+			tracer.SetSampler(apm.NewRatioSampler(ratio))
+
+			r := newRenderTestRouter(tracer)
+			req := httptest.NewRequest("GET", "/", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func newRenderTestRouter(tracer *apm.Tracer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) {
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetTag("label", "value")
+		})
+		renderJSON(c, http.StatusOK, gin.H{"hello": "world"})
+	})
+	return r
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+)
+
+const (
+	// reportMaxAttempts is the number of attempts made to send a
+	// report: the first, and three retries. The delay between attempts
+	// starts at reportInitialBackoff and doubles with each failure.
+	reportMaxAttempts    = 4
+	reportInitialBackoff = 10 * time.Second
+
+	// reportSMTPTimeout bounds each attempt to send a report.
+	reportSMTPTimeout = 30 * time.Second
+)
+
+// reportConfig holds the configuration of the daily report email.
+type reportConfig struct {
+	smtpURL    *url.URL
+	from       string
+	recipients []string
+	schedule   cron.Schedule
+}
+
+// newReportConfig returns the daily report configuration for reports,
+// or nil if no SMTP server is configured, and no report is sent.
+func newReportConfig(reports config.Reports) (*reportConfig, error) {
+	if reports.SMTPURL.URL == nil {
+		return nil, nil
+	}
+	schedule, err := cron.ParseStandard(reports.Schedule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid OPBEANS_REPORT_SCHEDULE value %q", reports.Schedule)
+	}
+	return &reportConfig{
+		smtpURL:    reports.SMTPURL.URL,
+		from:       reports.From,
+		recipients: reports.Recipients,
+		schedule:   schedule,
+	}, nil
+}
+
+// dailyReport is a rendered summary of the shop's stats.
+type dailyReport struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+var (
+	reportTextTemplate = template.Must(template.New("text").Parse(`Opbeans daily report for {{.Date}}
+
+Products:  {{.Stats.Products}}
+Customers: {{.Stats.Customers}}
+Orders:    {{.Stats.Orders}}
+
+Revenue:   {{.Revenue}}
+Cost:      {{.Cost}}
+Profit:    {{.Profit}}
+`))
+
+	reportHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<h1>Opbeans daily report for {{.Date}}</h1>
+<table>
+<tr><th align="left">Products</th><td align="right">{{.Stats.Products}}</td></tr>
+<tr><th align="left">Customers</th><td align="right">{{.Stats.Customers}}</td></tr>
+<tr><th align="left">Orders</th><td align="right">{{.Stats.Orders}}</td></tr>
+<tr><th align="left">Revenue</th><td align="right">{{.Revenue}}</td></tr>
+<tr><th align="left">Cost</th><td align="right">{{.Cost}}</td></tr>
+<tr><th align="left">Profit</th><td align="right">{{.Profit}}</td></tr>
+</table>
+</body>
+</html>
+`))
+)
+
+// renderReport renders the report of stats for the given day.
+func renderReport(stats Stats, day time.Time) dailyReport {
+	data := struct {
+		Date                  string
+		Stats                 Stats
+		Revenue, Cost, Profit string
+	}{
+		Date:    day.Format("2006-01-02"),
+		Stats:   stats,
+		Revenue: formatCents(stats.Numbers.Revenue),
+		Cost:    formatCents(stats.Numbers.Cost),
+		Profit:  formatCents(stats.Numbers.Profit),
+	}
+	var text, html bytes.Buffer
+	// The templates only fail to execute if their writers fail.
+	reportTextTemplate.Execute(&text, data)
+	reportHTMLTemplate.Execute(&html, data)
+	return dailyReport{
+		Subject: "Opbeans daily report for " + data.Date,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}
+}
+
+// formatCents formats an amount in cents with two decimal places.
+func formatCents(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// reportMessage encodes r as a multipart/alternative message from from
+// to recipients.
+func reportMessage(r dailyReport, from string, recipients []string, date time.Time) []byte {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", r.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", r.Text},
+		{"text/html; charset=utf-8", r.HTML},
+	} {
+		// Writes to a bytes.Buffer never fail.
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qw := quotedprintable.NewWriter(pw)
+		qw.Write([]byte(part.body))
+		qw.Close()
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+// reporter sends the daily report, on its schedule or on demand.
+type reporter struct {
+	tracer *apm.Tracer
+	db     *sqlx.DB
+	config *reportConfig
+
+	// maintenance delays scheduled reports while enabled. It may be nil.
+	maintenance *maintenanceMode
+
+	// send sends a message to the recipients. It is replaced in tests.
+	send func(ctx context.Context, msg []byte) error
+
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+func newReporter(tracer *apm.Tracer, db *sqlx.DB, config *reportConfig) *reporter {
+	r := &reporter{
+		tracer:         tracer,
+		db:             db,
+		config:         config,
+		maxAttempts:    reportMaxAttempts,
+		initialBackoff: reportInitialBackoff,
+	}
+	r.send = r.sendSMTP
+	return r
+}
+
+// run sends the report on its schedule until ctx is cancelled. A report
+// being sent when ctx is cancelled is abandoned. Reports falling due in
+// maintenance mode are sent once it is disabled.
+func (r *reporter) run(ctx context.Context) {
+	for {
+		next := r.config.schedule.Next(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if !r.maintenance.wait(ctx) {
+			return
+		}
+		r.runScheduled(ctx)
+	}
+}
+
+// runScheduled sends the report in a "task" transaction, reporting the
+// error if it cannot be sent.
+func (r *reporter) runScheduled(ctx context.Context) {
+	tx := r.tracer.StartTransaction("send daily report", "task")
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	if err := r.sendReport(ctx); err != nil {
+		tx.Result = "failure"
+		logrus.WithError(err).Error("failed to send daily report")
+		if e := apm.CaptureError(ctx, err); e != nil {
+			e.Send()
+		}
+		return
+	}
+	tx.Result = "success"
+}
+
+// sendReport renders the report of the current stats and sends it,
+// retrying with exponential backoff. Errors are *apperr.Errors, with the
+// Upstream kind if every attempt to send the report failed.
+func (r *reporter) sendReport(ctx context.Context) error {
+	stats, err := getStats(ctx, r.db)
+	if err != nil {
+		err := errors.Wrap(err, "failed to query stats for report")
+		return apperr.Wrap(err, apperr.DB)
+	}
+	now := time.Now()
+	msg := reportMessage(renderReport(*stats, now), r.config.from, r.config.recipients, now)
+
+	attempts := 0
+	backoff := r.initialBackoff
+	for {
+		attempts++
+		err = r.send(ctx, msg)
+		if err == nil || attempts == r.maxAttempts {
+			break
+		}
+		logrus.WithError(err).WithField("attempt", attempts).Warn("retrying report email")
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+	if tx := apm.TransactionFromContext(ctx); tx != nil {
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("report_recipients", len(r.config.recipients))
+			tx.Context.SetLabel("report_attempts", attempts)
+		})
+	}
+	if err != nil {
+		err := errors.Wrapf(err, "failed to send report email after %d attempts", attempts)
+		return apperr.Wrap(err, apperr.Upstream)
+	}
+	logrus.Infof("sent daily report to %d recipients", len(r.config.recipients))
+	return nil
+}
+
+// sendSMTP makes a single attempt to send msg to the recipients through
+// the SMTP server, traced as a span. Connections to smtp URLs are
+// upgraded with STARTTLS if the server supports it.
+func (r *reporter) sendSMTP(ctx context.Context, msg []byte) error {
+	u := r.config.smtpURL
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "25"
+		if u.Scheme == "smtps" {
+			port = "465"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	span, ctx := apm.StartSpan(ctx, "SMTP send to "+addr, "external.smtp.send")
+	defer span.End()
+	if !span.Dropped() {
+		span.Context.SetDestinationService(apm.DestinationServiceSpanContext{
+			Name:     "smtp",
+			Resource: addr,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reportSMTPTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	tlsConfig := &tls.Config{ServerName: host}
+	if u.Scheme == "smtps" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if u.Scheme == "smtp" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		if err := c.Auth(smtp.PlainAuth("", u.User.Username(), password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(r.config.from); err != nil {
+		return err
+	}
+	for _, recipient := range r.config.recipients {
+		if err := c.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// handleSendReport returns a handler which sends the report on demand,
+// within the request transaction. If reports are not configured, r is
+// nil and the handler responds with 404.
+func handleSendReport(r *reporter, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if r == nil {
+			abortWithError(c, apperr.New(apperr.NotFound, "report email is not configured"))
+			return
+		}
+		if err := r.sendReport(c.Request.Context()); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		auditAdminAction(c, db, auditActionSendReport)
+		renderJSON(c, http.StatusOK, gin.H{"recipients": len(r.config.recipients)})
+	}
+}
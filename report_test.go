@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func reportFixtureStats() Stats {
+	stats := Stats{Products: 12, Customers: 345, Orders: 6789}
+	stats.Numbers.Revenue = 1234567
+	stats.Numbers.Cost = 1250000
+	stats.Numbers.Profit = -15433
+	return stats
+}
+
+func TestRenderReport(t *testing.T) {
+	day := time.Date(2019, 7, 1, 23, 59, 0, 0, time.UTC)
+	report := renderReport(reportFixtureStats(), day)
+	assert.Equal(t, "Opbeans daily report for 2019-07-01", report.Subject)
+	assert.Equal(t, `Opbeans daily report for 2019-07-01
+
+Products:  12
+Customers: 345
+Orders:    6789
+
+Revenue:   12345.67
+Cost:      12500.00
+Profit:    -154.33
+`, report.Text)
+	assert.Contains(t, report.HTML, "<h1>Opbeans daily report for 2019-07-01</h1>")
+	assert.Contains(t, report.HTML, `<tr><th align="left">Orders</th><td align="right">6789</td></tr>`)
+	assert.Contains(t, report.HTML, `<tr><th align="left">Profit</th><td align="right">-154.33</td></tr>`)
+
+	// Rendering is deterministic.
+	assert.Equal(t, report, renderReport(reportFixtureStats(), day))
+}
+
+func TestReportMessage(t *testing.T) {
+	day := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	report := renderReport(reportFixtureStats(), day)
+	raw := reportMessage(report, "opbeans@example.com", []string{"a@example.com", "b@example.com"}, day)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	require.NoError(t, err)
+	assert.Equal(t, "opbeans@example.com", msg.Header.Get("From"))
+	assert.Equal(t, "a@example.com, b@example.com", msg.Header.Get("To"))
+	assert.Equal(t, report.Subject, msg.Header.Get("Subject"))
+	date, err := msg.Header.Date()
+	require.NoError(t, err)
+	assert.True(t, day.Equal(date))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(part))
+		require.NoError(t, err)
+		// Line breaks are encoded as CRLF.
+		bodies = append(bodies, strings.Replace(string(body), "\r\n", "\n", -1))
+	}
+	assert.Equal(t, []string{report.Text, report.HTML}, bodies)
+}
+
+// newTestReporter returns a reporter sending reports of the stats in a
+// test database with send, retrying without delay.
+func newTestReporter(t *testing.T, tracer *apm.Tracer, send func(ctx context.Context, msg []byte) error) *reporter {
+	r := newReporter(tracer, newTestDB(t), &reportConfig{
+		smtpURL:    &url.URL{Scheme: "smtp", Host: "localhost"},
+		from:       "opbeans@example.com",
+		recipients: []string{"a@example.com"},
+	})
+	r.initialBackoff = time.Millisecond
+	if send != nil {
+		r.send = send
+	}
+	return r
+}
+
+func TestReporterRetry(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	var attempts int
+	r := newTestReporter(t, tracer, func(ctx context.Context, msg []byte) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	r.runScheduled(context.Background())
+	assert.Equal(t, 3, attempts)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "send daily report", tx.Name)
+	assert.Equal(t, "task", tx.Type)
+	assert.Equal(t, "success", tx.Result)
+	assert.Equal(t, float64(3), transactionLabels(tx)["report_attempts"])
+	assert.Empty(t, payloads.Errors)
+}
+
+func TestReporterFailure(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	var attempts int
+	r := newTestReporter(t, tracer, func(ctx context.Context, msg []byte) error {
+		attempts++
+		return errors.New("connection refused")
+	})
+	r.runScheduled(context.Background())
+
+	// The first attempt is retried three times.
+	assert.Equal(t, 4, attempts)
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "failure", payloads.Transactions[0].Result)
+	require.Len(t, payloads.Errors, 1)
+	assert.Equal(t,
+		"failed to send report email after 4 attempts: connection refused",
+		payloads.Errors[0].Exception.Message,
+	)
+	assert.Equal(t, payloads.Transactions[0].ID, payloads.Errors[0].TransactionID)
+}
+
+// smtpReceiver is a minimal SMTP server, accepting a single message.
+type smtpReceiver struct {
+	addr string
+	done chan struct{}
+
+	mu         sync.Mutex
+	from       string
+	recipients []string
+	data       []byte
+}
+
+func newSMTPReceiver(t *testing.T) *smtpReceiver {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	r := &smtpReceiver{addr: l.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r.serve(textproto.NewConn(conn))
+	}()
+	return r
+}
+
+func (r *smtpReceiver) serve(c *textproto.Conn) {
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		r.mu.Lock()
+		switch verb {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 localhost")
+		case "MAIL":
+			r.from = line
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			r.recipients = append(r.recipients, line)
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			r.data, _ = c.ReadDotBytes()
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			r.mu.Unlock()
+			return
+		default:
+			c.PrintfLine("502 Not implemented")
+		}
+		r.mu.Unlock()
+	}
+}
+
+func TestReporterSMTP(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	receiver := newSMTPReceiver(t)
+	r := newTestReporter(t, tracer, nil)
+	r.config.smtpURL = &url.URL{Scheme: "smtp", Host: receiver.addr}
+	r.runScheduled(context.Background())
+	<-receiver.done
+
+	receiver.mu.Lock()
+	assert.Equal(t, "MAIL FROM:<opbeans@example.com>", receiver.from)
+	assert.Equal(t, []string{"RCPT TO:<a@example.com>"}, receiver.recipients)
+	msg, err := mail.ReadMessage(bytes.NewReader(receiver.data))
+	receiver.mu.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com", msg.Header.Get("To"))
+	assert.True(t, strings.HasPrefix(msg.Header.Get("Subject"), "Opbeans daily report for "))
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "success", payloads.Transactions[0].Result)
+	var smtpSpans int
+	for _, span := range payloads.Spans {
+		if span.Subtype != "smtp" {
+			continue
+		}
+		smtpSpans++
+		assert.Equal(t, "SMTP send to "+receiver.addr, span.Name)
+		assert.Equal(t, "external", span.Type)
+		assert.Equal(t, "send", span.Action)
+		assert.Equal(t, receiver.addr, span.Context.Destination.Service.Resource)
+	}
+	assert.Equal(t, 1, smtpSpans)
+}
+
+func TestSendReportHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := newTestDB(t)
+	newRouter := func(reports *reporter) *gin.Engine {
+		r := gin.New()
+		r.Use(errorMiddleware(apm.DefaultTracer))
+		adminGroup := r.Group("/api/admin", adminAuth("admin", "secret"), auditActorMiddleware)
+		addAdminHandlers(make(routeOptionsMap).group(adminGroup), apm.DefaultTracer, nil, db, nil, reports, nil, nil, nil)
+		return r
+	}
+	send := func(r http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/admin/reports/send", nil)
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Reports are not configured.
+	w := send(newRouter(nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var sent [][]byte
+	reports := newTestReporter(t, apm.DefaultTracer, func(ctx context.Context, msg []byte) error {
+		sent = append(sent, msg)
+		return nil
+	})
+	w = send(newRouter(reports))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"recipients": 1}`, w.Body.String())
+	assert.Len(t, sent, 1)
+
+	reports.send = func(ctx context.Context, msg []byte) error { return errors.New("connection refused") }
+	w = send(newRouter(reports))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	// Only the report which was sent is audited.
+	entries, err := getAuditLog(context.Background(), db, "", 0, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "admin:admin", entries[0].Actor)
+	assert.Equal(t, auditActionSendReport, entries[0].Action)
+	assert.Empty(t, entries[0].Entity)
+	assert.Nil(t, entries[0].Diff)
+}
+
+func TestNewReportConfig(t *testing.T) {
+	reports := config.Reports{
+		Recipients: []string{"a@example.com", "b@example.com"},
+		From:       config.DefaultReportFrom,
+		Schedule:   config.DefaultReportSchedule,
+	}
+	rc, err := newReportConfig(reports)
+	require.NoError(t, err)
+	assert.Nil(t, rc)
+
+	reports.SMTPURL.URL = &url.URL{Scheme: "smtp", User: url.UserPassword("user", "hunter2"), Host: "mail.example.com:587"}
+	rc, err = newReportConfig(reports)
+	require.NoError(t, err)
+	assert.Equal(t, "mail.example.com:587", rc.smtpURL.Host)
+	assert.Equal(t, config.DefaultReportFrom, rc.from)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, rc.recipients)
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2019, 7, 2, 0, 0, 0, 0, time.Local), rc.schedule.Next(now))
+
+	reports.Schedule = "30 6 * * 1-5"
+	rc, err = newReportConfig(reports)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 7, 2, 6, 30, 0, 0, time.Local), rc.schedule.Next(now))
+}
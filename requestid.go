@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// requestIDHeader is the header holding the ID of a request, in both
+// requests and responses.
+const requestIDHeader = "X-Request-Id"
+
+// requestIDField is the log field holding the ID of a request, as named
+// by the Elastic Common Schema.
+const requestIDField = "http.request.id"
+
+// safeRequestID matches the incoming request IDs which are honored. IDs
+// are restricted to characters which cannot break out of a header or log
+// line, and to a length which cannot bloat them.
+var safeRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// requestIDMiddleware assigns each request an ID, taken from its
+// X-Request-Id header if that is safe, and otherwise generated. The ID is
+// set in the response's X-Request-Id header, recorded in the custom
+// context of the request's transaction and the fields of its log lines,
+// and replaces the request's header, so that proxied requests carry it.
+// The middleware must be installed after tracingMiddleware.
+func requestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !safeRequestID.MatchString(id) {
+		var err error
+		if id, err = newRequestID(); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+	c.Request.Header.Set(requestIDHeader, id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+	c.Header(requestIDHeader, id)
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetCustom("request_id", id)
+	})
+	c.Next()
+}
+
+// requestIDFromContext returns the ID assigned to the request with
+// context ctx by requestIDMiddleware, or "" if there is none.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errors.Wrap(err, "failed to generate request ID")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// newTestRequestIDRouter returns a router traced by tracer, which
+// assigns request IDs and logs a line for each request.
+func newTestRequestIDRouter(tracer *apm.Tracer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(requestIDMiddleware)
+	r.GET("/", func(c *gin.Context) {
+		contextLogger(c).Info("handled")
+		c.Status(http.StatusNoContent)
+	})
+	return r
+}
+
+// captureLogs captures the JSON log entries of the standard logger
+// until the test completes.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	origOutput, origFormatter := logger.Out, logger.Formatter
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	t.Cleanup(func() {
+		logger.SetOutput(origOutput)
+		logger.SetFormatter(origFormatter)
+	})
+	return &buf
+}
+
+func serveRequestID(r http.Handler, id string) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Header().Get(requestIDHeader)
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	logs := captureLogs(t)
+	r := newTestRequestIDRouter(tracer)
+
+	id := serveRequestID(r, "")
+	assert.Regexp(t, uuidV4, id)
+	assert.NotEqual(t, id, serveRequestID(r, ""))
+
+	// The ID is recorded in the transaction and the request's log lines.
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 2)
+	assert.Equal(t, model.IfaceMap{{Key: "request_id", Value: id}}, transactions[0].Context.Custom)
+	var entry map[string]interface{}
+	require.NoError(t, json.NewDecoder(logs).Decode(&entry))
+	assert.Equal(t, "handled", entry["msg"])
+	assert.Equal(t, id, entry[requestIDField])
+}
+
+func TestRequestIDPassthrough(t *testing.T) {
+	r := newTestRequestIDRouter(apm.DefaultTracer)
+	for _, id := range []string{
+		"3f1c7a52-9a0e-4d8b-8f5e-2b6d1c0e9a47",
+		"loadgen.42:retry-1",
+		"ABC_def",
+	} {
+		assert.Equal(t, id, serveRequestID(r, id))
+	}
+}
+
+func TestRequestIDUnsafeRejected(t *testing.T) {
+	r := newTestRequestIDRouter(apm.DefaultTracer)
+	for _, id := range []string{
+		"<script>alert(1)</script>",
+		"id with spaces",
+		`"quoted"`,
+		strings.Repeat("a", 129),
+	} {
+		replaced := serveRequestID(r, id)
+		assert.Regexp(t, uuidV4, replaced, id)
+	}
+}
+
+func TestRequestIDProxied(t *testing.T) {
+	setTestStartupFlags(t)
+	forwarded := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		forwarded <- req.Header.Get(requestIDHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	t.Setenv("OPBEANS_SERVICES", backend.URL)
+	t.Setenv("OPBEANS_DT_PROBABILITY", "1")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	srv := newTestProxyServer(t, r)
+	for _, incoming := range []string{"", "loadgen-7"} {
+		req, err := http.NewRequest("GET", srv.URL+"/api/stats", nil)
+		require.NoError(t, err)
+		if incoming != "" {
+			req.Header.Set(requestIDHeader, incoming)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		id := <-forwarded
+		assert.Equal(t, resp.Header.Get(requestIDHeader), id)
+		if incoming == "" {
+			assert.Regexp(t, uuidV4, id)
+		} else {
+			assert.Equal(t, incoming, id)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// productResponsesVersionKey is the cache key of the version token of
+// the cached product responses, from which their keys are derived, so
+// that rotating it invalidates them all.
+const productResponsesVersionKey = "product-responses-version"
+
+// maxCachedResponseSize bounds the size of the responses cached by
+// responseCacheMiddleware. Larger responses are served, but not cached.
+const maxCachedResponseSize = 1 << 20
+
+// cachedResponseRoutes holds the routes whose responses are cached.
+var cachedResponseRoutes = map[string]bool{
+	"/api/products":     true,
+	"/api/products/:id": true,
+	"/api/types":        true,
+}
+
+// cachedResponseHeaders holds the response headers cached along with
+// the body. Others are set per request by the middleware.
+var cachedResponseHeaders = []string{"Content-Type", "ETag", "Vary"}
+
+// cachedResponse is a successful response held in the cache.
+type cachedResponse struct {
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+// responseCacheMiddleware caches the successful responses of the routes
+// in cachedResponseRoutes, keyed by their path, query and format, for
+// the response cache TTL held by settings, or until the product
+// responses are invalidated by invalidateProductResponses. Cached
+// responses are served with an Age header, and the transactions of the
+// requests looked up are labeled with cache_hit.
+//
+// Requests of authenticated customers or API clients are neither served
+// from nor stored in the cache, nor are conditional requests, which are
+// left to the handlers' ETags. The middleware must be installed after
+// the cache middleware, and after route matching.
+func responseCacheMiddleware(settings *runtimeSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ttl := settings.responseCacheTTL()
+		store := contextCacheStore(c)
+		if ttl <= 0 || store == nil || c.Request.Method != http.MethodGet || !cachedResponseRoutes[c.FullPath()] ||
+			isPersonalized(c) || c.GetHeader("If-None-Match") != "" {
+			c.Next()
+			return
+		}
+		ctx := c.Request.Context()
+		version, err := cacheVersion(ctx, store, productResponsesVersionKey)
+		if err != nil {
+			err := errors.Wrap(err, "failed to get product responses version")
+			contextLogger(c).WithError(err).Warn("not caching response")
+			c.Next()
+			return
+		}
+		key := fmt.Sprintf("response-%x-%s-%s", version, strings.Replace(responseFormat(c), "/", "+", -1), c.Request.URL.RequestURI())
+
+		var cached cachedResponse
+		switch err := cacheGet(ctx, store, key, &cached); err {
+		case nil:
+			labelCacheHit(c, true)
+			for name, values := range cached.Header {
+				c.Writer.Header()[name] = values
+			}
+			c.Header("Age", strconv.Itoa(int(time.Since(cached.Stored)/time.Second)))
+			c.Writer.WriteHeader(http.StatusOK)
+			c.Writer.Write(cached.Body)
+			c.Abort()
+			return
+		case persistence.ErrCacheMiss:
+			labelCacheHit(c, false)
+		default:
+			err := errors.Wrap(err, "failed to get cached response")
+			contextLogger(c).WithError(err).Warn("not caching response")
+			c.Next()
+			return
+		}
+
+		w := &responseCacheWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		// Errors, and responses of requests timed out or cancelled,
+		// are never stored.
+		if w.Status() != http.StatusOK || w.overflowed || ctx.Err() != nil {
+			return
+		}
+		cached = cachedResponse{Header: make(http.Header), Body: w.body.Bytes(), Stored: time.Now()}
+		for _, name := range cachedResponseHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				cached.Header[name] = values
+			}
+		}
+		if err := cacheSet(ctx, store, key, cached, ttl); err != nil {
+			err := errors.Wrap(err, "failed to cache response")
+			contextLogger(c).WithError(err).Warn("response not cached")
+		}
+	}
+}
+
+// isPersonalized reports whether the request of c may be served a
+// response personalized for its client: whether it carries credentials.
+func isPersonalized(c *gin.Context) bool {
+	return c.GetHeader("Authorization") != "" || authenticatedCustomer(c) != nil || authenticatedAPIClient(c) != ""
+}
+
+// labelCacheHit labels the transaction of c with whether its response
+// was served from the cache.
+func labelCacheHit(c *gin.Context, hit bool) {
+	tx := apm.TransactionFromContext(c.Request.Context())
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("cache_hit", hit)
+	})
+}
+
+// invalidateProductResponses invalidates the cached product responses
+// after a successful write of products or their stock, or of orders,
+// which rank the top products. The write is not failed if they cannot be
+// invalidated.
+func invalidateProductResponses(c *gin.Context) {
+	invalidateCachedProductResponses(c.Request.Context(), contextCacheStore(c))
+}
+
+// invalidateCachedProductResponses invalidates the product responses
+// cached in store, unless nil, as invalidateProductResponses does for
+// writes outside of requests.
+func invalidateCachedProductResponses(ctx context.Context, store persistence.CacheStore) {
+	if err := rotateCacheVersion(ctx, store, productResponsesVersionKey); err != nil {
+		err := errors.Wrap(err, "failed to rotate product responses version")
+		loggerFromContext(ctx).WithError(err).Error("stale product responses may be served")
+	}
+}
+
+// responseCacheWriter is a gin.ResponseWriter which copies the body of
+// the response, up to maxCachedResponseSize, for caching.
+type responseCacheWriter struct {
+	gin.ResponseWriter
+	body       bytes.Buffer
+	overflowed bool
+}
+
+func (w *responseCacheWriter) Write(data []byte) (int, error) {
+	w.copy(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseCacheWriter) WriteString(s string) (int, error) {
+	w.copy([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *responseCacheWriter) copy(data []byte) {
+	if w.overflowed {
+		return
+	}
+	if w.body.Len()+len(data) > maxCachedResponseSize {
+		w.overflowed = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestResponseCache(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_JWT_SECRET", string(testJWTSecret))
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	// serve sends the request, returning the response and the labels
+	// of its transaction.
+	serve := func(req *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, 1)
+		return w, transactionLabels(transactions[0])
+	}
+	get := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		return serve(httptest.NewRequest("GET", path, nil))
+	}
+
+	// The first read is a miss, and the next ones are served from the
+	// cache, with their age.
+	miss, labels := get("/api/products/1")
+	require.Equal(t, http.StatusOK, miss.Code)
+	assert.Equal(t, false, labels["cache_hit"])
+	assert.Empty(t, miss.Header().Get("Age"))
+	hit, labels := get("/api/products/1")
+	require.Equal(t, http.StatusOK, hit.Code)
+	assert.Equal(t, true, labels["cache_hit"])
+	assert.Equal(t, "0", hit.Header().Get("Age"))
+	assert.Equal(t, miss.Body.String(), hit.Body.String())
+	for _, name := range []string{"Content-Type", "ETag", "Vary"} {
+		assert.Equal(t, miss.Header().Get(name), hit.Header().Get(name), name)
+	}
+	assert.NotEmpty(t, hit.Header().Get(requestIDHeader))
+
+	// Responses are keyed by their query and format.
+	_, labels = get("/api/products?page=1")
+	assert.Equal(t, false, labels["cache_hit"])
+	_, labels = get("/api/products")
+	assert.Equal(t, false, labels["cache_hit"])
+	req := httptest.NewRequest("GET", "/api/products", nil)
+	req.Header.Set("Accept", ndjsonMediaType)
+	w, labels := serve(req)
+	assert.Equal(t, false, labels["cache_hit"])
+	assert.Equal(t, ndjsonMediaType, w.Header().Get("Content-Type"))
+
+	// Error responses are never stored.
+	for i := 0; i < 2; i++ {
+		w, labels := get("/api/products/999999")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, false, labels["cache_hit"])
+	}
+
+	// Writes to products, including their stock, invalidate the cached
+	// responses.
+	w = serveAdmin(r, "PUT", "/api/admin/products/1", strings.Replace(testProductJSON, `"stock": 10`, `"stock": 7`, 1))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w, labels = get("/api/products/1")
+	assert.Equal(t, false, labels["cache_hit"])
+	assert.Contains(t, w.Body.String(), `"stock":7`)
+	_, labels = get("/api/products/1")
+	assert.Equal(t, true, labels["cache_hit"])
+
+	// Authenticated and conditional requests bypass the cache, and
+	// their responses are not stored.
+	req = httptest.NewRequest("GET", "/api/types", nil)
+	req.Header.Set("Authorization", "Bearer "+newTestToken(t, testJWTSecret, 1, "", time.Now().Add(time.Hour)))
+	w, labels = serve(req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, labels, "cache_hit")
+	assert.Empty(t, w.Header().Get("Age"))
+	req = httptest.NewRequest("GET", "/api/types", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	_, labels = serve(req)
+	assert.NotContains(t, labels, "cache_hit")
+	_, labels = get("/api/types")
+	assert.Equal(t, false, labels["cache_hit"])
+}
+
+func TestResponseCacheOrderInvalidation(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	// getTop returns the top products, and whether they were served
+	// from the cache.
+	getTop := func() ([]Product, interface{}) {
+		tracer.Flush(nil)
+		recorder.ResetPayloads()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/top", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, 1)
+		var products []Product
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &products))
+		require.NotEmpty(t, products)
+		return products, transactionLabels(transactions[0])["cache_hit"]
+	}
+	top, _ := getTop()
+	_, hit := getTop()
+	require.Equal(t, true, hit)
+
+	// Orders change the ranking of the top products, so the cached
+	// responses are invalidated once an order is placed.
+	cookie := openTestCart(t, r)
+	body := fmt.Sprintf(`{"customer_id": 1, "lines": [{"id": %d, "amount": 1}]}`, top[0].ID)
+	req := httptest.NewRequest("POST", "/api/orders", strings.NewReader(body))
+	req.AddCookie(cookie)
+	req.Header.Set(csrfHeaderName, cookie.Value)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	after, hit := getTop()
+	assert.Equal(t, false, hit)
+	assert.Equal(t, top[0].ID, after[0].ID)
+	assert.Equal(t, top[0].Sold+1, after[0].Sold)
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_RESPONSE_CACHE_TTL", "0")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/types", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Age"))
+	}
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 2)
+	for _, tx := range transactions {
+		assert.NotContains(t, transactionLabels(tx), "cache_hit")
+	}
+}
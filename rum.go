@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// rumConfig is the configuration of the frontend's RUM agent, as passed
+// to its init function.
+type rumConfig struct {
+	ServerURL                 string   `json:"serverUrl"`
+	ServiceName               string   `json:"serviceName"`
+	TransactionSampleRate     float64  `json:"transactionSampleRate"`
+	DistributedTracingOrigins []string `json:"distributedTracingOrigins"`
+
+	// PageLoadTraceID, PageLoadSpanID and PageLoadSampled are set in
+	// pages served in a traced request, so that the agent's page load
+	// transaction continues the trace as the parent of the request's
+	// transaction.
+	PageLoadTraceID string `json:"pageLoadTraceId,omitempty"`
+	PageLoadSpanID  string `json:"pageLoadSpanId,omitempty"`
+	PageLoadSampled bool   `json:"pageLoadSampled,omitempty"`
+}
+
+// newRUMConfig returns the RUM agent configuration configured by cfg.
+func newRUMConfig(cfg config.APM) rumConfig {
+	origins := cfg.RUMDistributedTracingOrigins
+	if origins == nil {
+		origins = []string{}
+	}
+	return rumConfig{
+		ServerURL:                 cfg.RUMServerURL.String(),
+		ServiceName:               cfg.RUMServiceName,
+		TransactionSampleRate:     cfg.RUMTransactionSampleRate,
+		DistributedTracingOrigins: origins,
+	}
+}
+
+// indexPage holds the properties injected into index.html for a request.
+type indexPage struct {
+	// RUM is the RUM agent configuration, with the page load
+	// properties of tx.
+	RUM rumConfig
+
+	// Traceparent is the W3C traceparent of the page load, if the
+	// request is traced.
+	Traceparent string
+}
+
+// newIndexPage returns the page properties for a request traced by tx,
+// which may be nil.
+func newIndexPage(rum rumConfig, tx *apm.Transaction) indexPage {
+	if tx == nil {
+		return indexPage{RUM: rum}
+	}
+	traceContext := tx.TraceContext()
+	parentID := tx.EnsureParent()
+	rum.PageLoadTraceID = traceContext.Trace.String()
+	rum.PageLoadSpanID = parentID.String()
+	rum.PageLoadSampled = tx.Sampled()
+	return indexPage{
+		RUM: rum,
+		Traceparent: apmhttp.FormatTraceparentHeader(apm.TraceContext{
+			Trace:   traceContext.Trace,
+			Span:    parentID,
+			Options: traceContext.Options,
+		}),
+	}
+}
+
+// parseIndexTemplate parses the frontend's index.html file, read from
+// frontend, as a template, executed with the request's transaction, injecting the RUM
+// agent configuration rum and the page load properties: the agent's
+// configuration is set as window.elasticApmConfig, and as
+// window.rumConfig for older frontend builds, and the trace context is
+// given in traceparent and trace.id meta tags.
+func parseIndexTemplate(frontend fs.FS, rum rumConfig) (*template.Template, error) {
+	indexFileBytes, err := fs.ReadFile(frontend, "index.html")
+	if err != nil {
+		return nil, err
+	}
+	indexFileContent := strings.Replace(string(indexFileBytes), "<head>", `<head>
+{{- with page . }}
+{{- if .Traceparent }}
+<meta name="traceparent" content="{{ .Traceparent }}">
+<meta name="trace.id" content="{{ .RUM.PageLoadTraceID }}">
+{{- end }}
+<script type="text/javascript">
+  window.elasticApmConfig = {{ .RUM }};
+  window.rumConfig = window.elasticApmConfig;
+</script>
+{{- end }}`, 1)
+	return template.New(indexTemplateName).Funcs(template.FuncMap{
+		"page": func(tx *apm.Transaction) indexPage {
+			return newIndexPage(rum, tx)
+		},
+	}).Parse(indexFileContent)
+}
+
+func handleIndex(c *gin.Context) {
+	// The page refers to the current assets, and holds the trace context
+	// of the page load, so must not be reused.
+	c.Header("Cache-Control", cacheControlRevalidate)
+	c.HTML(200, indexTemplateName, apm.TransactionFromContext(c.Request.Context()))
+}
+
+func handleRUMConfig(apmServerURL *url.URL) gin.HandlerFunc {
+	content := fmt.Sprintf(
+		"window.elasticApmJsBaseServerUrl = '%s';\n",
+		template.JSEscapeString(apmServerURL.String()),
+	)
+	return func(c *gin.Context) {
+		c.Data(200, "application/javascript", []byte(content))
+	}
+}
+
+// handleRUMConfigJSON serves the RUM agent configuration rum, without
+// page load properties, for frontends fetching it at runtime.
+func handleRUMConfigJSON(rum rumConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, rum)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+var (
+	traceparentMeta = regexp.MustCompile(`<meta name="traceparent" content="([^"]*)">`)
+	traceIDMeta     = regexp.MustCompile(`<meta name="trace.id" content="([^"]*)">`)
+	elasticAPMJS    = regexp.MustCompile(`window.elasticApmConfig = (.*);`)
+)
+
+// decodeIndexRUMConfig decodes the RUM agent configuration injected into
+// the index page body.
+func decodeIndexRUMConfig(t *testing.T, body string) rumConfig {
+	match := elasticAPMJS.FindStringSubmatch(body)
+	require.NotNil(t, match, body)
+	var rum rumConfig
+	require.NoError(t, json.Unmarshal([]byte(match[1]), &rum), match[1])
+	return rum
+}
+
+func TestIndexRUMConfig(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("ELASTIC_APM_JS_SERVER_URL", "https://apm.example.com:8200")
+	t.Setenv("ELASTIC_APM_JS_SERVICE_NAME", "shop-frontend")
+	t.Setenv("ELASTIC_APM_JS_TRANSACTION_SAMPLE_RATE", "0.5")
+	t.Setenv("ELASTIC_APM_JS_DISTRIBUTED_TRACING_ORIGINS", "https://api.example.com")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	for _, path := range []string{"/", "/products/1"} {
+		recorder.ResetPayloads()
+		w := serveGet(r, path)
+		require.Equal(t, http.StatusOK, w.Code, path)
+		body := w.Body.String()
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, 1)
+		tx := transactions[0]
+
+		// The page load is the parent of the request's transaction.
+		match := traceparentMeta.FindStringSubmatch(body)
+		require.NotNil(t, match, body)
+		traceContext, err := apmhttp.ParseTraceparentHeader(match[1])
+		require.NoError(t, err)
+		assert.Equal(t, tx.TraceID, model.TraceID(traceContext.Trace), path)
+		assert.Equal(t, tx.ParentID, model.SpanID(traceContext.Span), path)
+		assert.True(t, traceContext.Options.Recorded())
+		traceIDMatch := traceIDMeta.FindStringSubmatch(body)
+		require.NotNil(t, traceIDMatch, body)
+		assert.Equal(t, traceContext.Trace.String(), traceIDMatch[1])
+
+		assert.Equal(t, rumConfig{
+			ServerURL:                 "https://apm.example.com:8200",
+			ServiceName:               "shop-frontend",
+			TransactionSampleRate:     0.5,
+			DistributedTracingOrigins: []string{"https://api.example.com"},
+			PageLoadTraceID:           traceContext.Trace.String(),
+			PageLoadSpanID:            traceContext.Span.String(),
+			PageLoadSampled:           true,
+		}, decodeIndexRUMConfig(t, body), path)
+		assert.Contains(t, body, "window.rumConfig = window.elasticApmConfig;")
+	}
+
+	// The configuration is also served as JSON, without page load
+	// properties.
+	w := serveGet(r, "/rum-config.json")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"serverUrl": "https://apm.example.com:8200",
+		"serviceName": "shop-frontend",
+		"transactionSampleRate": 0.5,
+		"distributedTracingOrigins": ["https://api.example.com"]
+	}`, w.Body.String())
+}
+
+func TestIndexRUMConfigContinuesTrace(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	// A page requested in an existing trace is loaded in that trace.
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", traceparent)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, traceparent, traceparentMeta.FindStringSubmatch(w.Body.String())[1])
+}
+
+func TestIndexRUMConfigUntraced(t *testing.T) {
+	frontend := fstest.MapFS{"index.html": {Data: []byte("<html><head></head></html>")}}
+	template, err := parseIndexTemplate(frontend, rumConfig{ServiceName: "opbeans-rum"})
+	require.NoError(t, err)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.SetHTMLTemplate(template)
+	r.GET("/", handleIndex)
+
+	// Without a transaction, there is no page load trace to continue.
+	body := serveGet(r, "/").Body.String()
+	assert.NotContains(t, body, "<meta")
+	assert.Equal(t, rumConfig{ServiceName: "opbeans-rum"}, decodeIndexRUMConfig(t, body))
+}
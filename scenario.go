@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// Limits of chaos scenarios. Scenarios expire after their TTL, so that
+// demos heal themselves.
+const (
+	defaultScenarioTTL = 2 * time.Minute
+	maxScenarioTTL     = maxContentionDuration
+
+	// scenarioExpiryInterval is the interval at which the active
+	// scenario is checked for expiry.
+	scenarioExpiryInterval = time.Second
+)
+
+// scenarioField is the log field, and transaction label, naming the
+// active chaos scenario.
+const scenarioField = "demo.scenario"
+
+// scenarioPreset holds the values of the fault injection knobs set by a
+// chaos scenario. Zero values leave a knob as it is.
+type scenarioPreset struct {
+	// errorRate overrides the proportion of requests failed.
+	errorRate float64
+
+	// proxyFailureRate overrides the proportion of proxied requests
+	// failed.
+	proxyFailureRate float64
+
+	// leakRate enables the goroutine leak at the rate.
+	leakRate float64
+
+	// contentionProducts locks the best-selling products, as by the
+	// contention simulation.
+	contentionProducts int
+}
+
+// scenarioPresets holds the chaos scenarios by name.
+var scenarioPresets = map[string]scenarioPreset{
+	"slow-db":         {contentionProducts: 10},
+	"flaky-upstream":  {proxyFailureRate: 0.5},
+	"error-spike":     {errorRate: 0.3},
+	"memory-pressure": {leakRate: 0.5},
+}
+
+// lookupScenario returns the preset of the scenario name, failing with
+// a not found error if there is none.
+func lookupScenario(name string) (scenarioPreset, error) {
+	preset, ok := scenarioPresets[name]
+	if !ok {
+		return scenarioPreset{}, apperr.New(apperr.NotFound, "unknown scenario", "scenario", name)
+	}
+	return preset, nil
+}
+
+// chaosScenario is an active chaos scenario.
+type chaosScenario struct {
+	name      string
+	preset    scenarioPreset
+	expiresAt time.Time
+}
+
+// scenarioStatus is the body of scenario responses.
+type scenarioStatus struct {
+	Active    bool       `json:"active"`
+	Name      string     `json:"name,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// status reports sc, which may be nil.
+func (sc *chaosScenario) status() scenarioStatus {
+	if sc == nil {
+		return scenarioStatus{}
+	}
+	expiresAt := sc.expiresAt.UTC()
+	return scenarioStatus{Active: true, Name: sc.name, ExpiresAt: &expiresAt}
+}
+
+// scenarioController activates chaos scenarios, setting the knobs of
+// their presets, and resets the knobs when they expire. At most one
+// scenario is active at a time; activating another replaces it.
+type scenarioController struct {
+	settings   *runtimeSettings
+	leak       *goroutineLeak
+	contention *contentionSimulator
+	now        func() time.Time
+
+	mu sync.Mutex
+}
+
+func newScenarioController(settings *runtimeSettings, leak *goroutineLeak, contention *contentionSimulator) *scenarioController {
+	return &scenarioController{
+		settings:   settings,
+		leak:       leak,
+		contention: contention,
+		now:        time.Now,
+	}
+}
+
+// activate activates the scenario name until ttl has elapsed, replacing
+// the active scenario, if any. Products locked by the scenario are
+// locked in a transaction traced as a child of the transaction in ctx.
+func (s *scenarioController) activate(ctx context.Context, name string, ttl time.Duration) (scenarioStatus, error) {
+	preset, err := lookupScenario(name)
+	if err != nil {
+		return scenarioStatus{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deactivateLocked()
+
+	if preset.contentionProducts > 0 {
+		if _, err := s.contention.start(ctx, preset.contentionProducts, ttl); err != nil {
+			return scenarioStatus{}, err
+		}
+	}
+	if preset.leakRate > 0 {
+		s.leak.set(true, preset.leakRate)
+	}
+	sc := &chaosScenario{name: name, preset: preset, expiresAt: s.now().Add(ttl)}
+	s.settings.setScenario(sc)
+	logrus.WithFields(logrus.Fields{
+		scenarioField: name,
+		"expires_at":  sc.expiresAt,
+	}).Info("activated chaos scenario")
+	return sc.status(), nil
+}
+
+// deactivate deactivates the active scenario, if any.
+func (s *scenarioController) deactivate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deactivateLocked()
+}
+
+// deactivateLocked deactivates the active scenario, if any, resetting
+// the knobs it set: the goroutine leak is stopped, and product locks
+// released. s.mu must be held.
+func (s *scenarioController) deactivateLocked() {
+	sc := s.settings.scenario()
+	if sc == nil {
+		return
+	}
+	s.settings.setScenario(nil)
+	if sc.preset.leakRate > 0 {
+		s.leak.stop()
+	}
+	if sc.preset.contentionProducts > 0 {
+		s.contention.stop()
+	}
+	logrus.WithField(scenarioField, sc.name).Info("deactivated chaos scenario")
+}
+
+// expire deactivates the active scenario if its TTL has elapsed.
+func (s *scenarioController) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc := s.settings.scenario(); sc != nil && !s.now().Before(sc.expiresAt) {
+		s.deactivateLocked()
+	}
+}
+
+// run checks the active scenario for expiry every interval until ctx
+// is cancelled.
+func (s *scenarioController) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expire()
+		}
+	}
+}
+
+type scenarioKey struct{}
+
+// scenarioMiddleware labels the transactions of requests served while
+// a chaos scenario is active with scenarioField, and records it in the
+// request's context, so that it is included in the fields of its log
+// lines. The middleware must be installed after tracingMiddleware.
+func scenarioMiddleware(settings *runtimeSettings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sc := settings.scenario()
+		if sc == nil {
+			c.Next()
+			return
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), scenarioKey{}, sc.name))
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel(scenarioField, sc.name)
+		})
+		c.Next()
+	}
+}
+
+// scenarioFromContext returns the name of the chaos scenario active when
+// the request with context ctx was received, or "" if there was none.
+func scenarioFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(scenarioKey{}).(string)
+	return name
+}
+
+// handleGetScenario reports the active chaos scenario, if any.
+func handleGetScenario(s *scenarioController) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderJSON(c, http.StatusOK, s.settings.scenario().status())
+	}
+}
+
+// handleActivateScenario activates the chaos scenario "name" for "ttl",
+// 2m by default, recording it in the audit log. The active scenario is
+// replaced before auditing, as on SQLite the audit log cannot be
+// written while products are locked.
+func handleActivateScenario(s *scenarioController, db *sqlx.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		preset, err := lookupScenario(name)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		ttl, ok := queryDuration(c, "ttl", defaultScenarioTTL, maxScenarioTTL)
+		if !ok {
+			return
+		}
+		s.deactivate()
+		if preset.contentionProducts > 0 {
+			if err := s.contention.checkInactive(); err != nil {
+				abortWithError(c, err)
+				return
+			}
+		}
+		auditAdminAction(c, db, auditActionActivateScenario)
+		status, err := s.activate(c.Request.Context(), name, ttl)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		renderJSON(c, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestScenarioController(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	cfg := &config.Config{ErrorInjection: config.ErrorInjection{Rate: 0.01}}
+	settings := newRuntimeSettings(cfg)
+	leak := newGoroutineLeak()
+	defer leak.stop()
+	locks := &mockProductLocks{}
+	contention := newContentionSimulator(tracer, nil)
+	contention.lock = locks.lock
+	defer contention.stop()
+	s := newScenarioController(settings, leak, contention)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// Scenarios override the knobs of their presets until they expire.
+	status, err := s.activate(context.Background(), "error-spike", time.Minute)
+	require.NoError(t, err)
+	expiresAt := now.Add(time.Minute)
+	assert.Equal(t, scenarioStatus{Active: true, Name: "error-spike", ExpiresAt: &expiresAt}, status)
+	assert.Equal(t, 0.3, settings.errorRate())
+	assert.Zero(t, settings.proxyFailureRate())
+
+	// Reloading the configuration does not reset the scenario.
+	settings.set(cfg)
+	assert.Equal(t, 0.3, settings.errorRate())
+
+	now = now.Add(59 * time.Second)
+	s.expire()
+	assert.Equal(t, "error-spike", settings.scenario().status().Name)
+	now = now.Add(time.Second)
+	s.expire()
+	assert.Nil(t, settings.scenario())
+	assert.Equal(t, 0.01, settings.errorRate())
+
+	_, err = s.activate(context.Background(), "flaky-upstream", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, settings.proxyFailureRate())
+	assert.Equal(t, 0.01, settings.errorRate())
+
+	// Activating a scenario replaces the active one.
+	_, err = s.activate(context.Background(), "memory-pressure", time.Minute)
+	require.NoError(t, err)
+	assert.Zero(t, settings.proxyFailureRate())
+	assert.Equal(t, goroutineLeakStatus{Enabled: true, Rate: 0.5}, leak.status())
+	now = now.Add(time.Minute)
+	s.expire()
+	assert.False(t, leak.enabled())
+
+	_, err = s.activate(context.Background(), "slow-db", time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, contention.status().ProductIDs, 10)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&locks.held))
+	now = now.Add(time.Hour)
+	s.expire()
+	assert.False(t, contention.status().Active)
+	assert.EqualValues(t, 0, atomic.LoadInt64(&locks.held))
+
+	// Scenarios which fail to set their knobs are not active.
+	locks.err = apperr.New(apperr.NotFound, "no products have been sold")
+	_, err = s.activate(context.Background(), "slow-db", time.Minute)
+	assert.Error(t, err)
+	assert.Nil(t, settings.scenario())
+
+	_, err = s.activate(context.Background(), "meteor-strike", time.Minute)
+	e, ok := apperr.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperr.NotFound, e.Kind)
+}
+
+func TestScenarioMiddleware(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	logs := captureLogs(t)
+	settings := newRuntimeSettings(&config.Config{})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(scenarioMiddleware(settings))
+	r.GET("/", func(c *gin.Context) {
+		contextLogger(c).Info("handled")
+	})
+
+	// Requests served while a scenario is active are labeled with it,
+	// as are their log lines.
+	serveGet(r, "/")
+	settings.setScenario(&chaosScenario{name: "error-spike", expiresAt: time.Now().Add(time.Minute)})
+	serveGet(r, "/")
+
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 2)
+	assert.NotContains(t, transactionLabels(transactions[0]), "demo_scenario")
+	assert.Equal(t, "error-spike", transactionLabels(transactions[1])["demo_scenario"])
+	var entries []map[string]interface{}
+	for decoder := json.NewDecoder(logs); decoder.More(); {
+		var entry map[string]interface{}
+		require.NoError(t, decoder.Decode(&entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2)
+	assert.NotContains(t, entries[0], scenarioField)
+	assert.Equal(t, "error-spike", entries[1][scenarioField])
+}
+
+func TestScenarioHandlers(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	r, _, cleanup, err := startup(apm.DefaultTracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	w := serveAdmin(r, "POST", "/api/admin/demo/scenario/error-spike?ttl=1m", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status scenarioStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.True(t, status.Active)
+	assert.Equal(t, "error-spike", status.Name)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *status.ExpiresAt, 10*time.Second)
+	assert.JSONEq(t, w.Body.String(), serveAdmin(r, "GET", "/api/admin/demo/scenario", "").Body.String())
+
+	// The active scenario is described by the about endpoint, which is
+	// exempted from the scenario's injected errors.
+	req := httptest.NewRequest("GET", "/api/about", nil)
+	req.Header.Set(errorInjectionHeader, "none")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var about struct {
+		Scenario scenarioStatus `json:"scenario"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &about))
+	assert.Equal(t, status, about.Scenario)
+
+	// Replacing a scenario which locks products does not wait for them.
+	w = serveAdmin(r, "POST", "/api/admin/demo/scenario/slow-db", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	start := time.Now()
+	w = serveAdmin(r, "POST", "/api/admin/demo/scenario/flaky-upstream", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.JSONEq(t, `{"active": false}`, serveAdmin(r, "GET", "/api/admin/demo/contention", "").Body.String())
+
+	assert.Equal(t, http.StatusNotFound, serveAdmin(r, "POST", "/api/admin/demo/scenario/meteor-strike", "").Code)
+	for _, ttl := range []string{"0s", "6m", "long"} {
+		w := serveAdmin(r, "POST", "/api/admin/demo/scenario/error-spike?ttl="+ttl, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, ttl)
+	}
+}
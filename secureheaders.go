@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hstsMaxAge is the max-age of the Strict-Transport-Security header, in
+// seconds.
+const hstsMaxAge = 365 * 24 * 60 * 60
+
+// secureHeaders holds the security headers set on responses by its
+// middleware.
+type secureHeaders struct {
+	csp string
+
+	// api applies the headers to the JSON API, in addition to the
+	// frontend's HTML and static assets.
+	api bool
+}
+
+// newSecureHeaders returns the security headers for the frontend, whose
+// RUM agent reports to rumServerURL. The Content-Security-Policy allows
+// connections to the frontend's origin, the RUM agent's APM Server, and
+// connectSrc. If api is true, the headers are also set on API responses.
+func newSecureHeaders(rumServerURL *url.URL, api bool, connectSrc []string) *secureHeaders {
+	sources := append([]string{"'self'", rumServerURL.Scheme + "://" + rumServerURL.Host}, connectSrc...)
+	csp := strings.Join([]string{
+		"default-src 'self'",
+		// index.html has an inline script injecting the RUM page load
+		// properties, and the frontend build inlines its styles.
+		"script-src 'self' 'unsafe-inline'",
+		"style-src 'self' 'unsafe-inline'",
+		"img-src 'self' data:",
+		"connect-src " + strings.Join(sources, " "),
+		"object-src 'none'",
+		"base-uri 'self'",
+		"frame-ancestors 'self'",
+	}, "; ")
+	return &secureHeaders{csp: csp, api: api}
+}
+
+// isAPIPath reports whether path is served by the JSON API, rather than
+// the frontend.
+func isAPIPath(path string) bool {
+	return path == "/api" || strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/ws/")
+}
+
+// middleware sets the security headers on responses to the frontend
+// and, if configured, the API. Strict-Transport-Security is only set on
+// requests received over TLS.
+func (h *secureHeaders) middleware(c *gin.Context) {
+	if !h.api && isAPIPath(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+	header := c.Writer.Header()
+	header.Set("Content-Security-Policy", h.csp)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+	if c.Request.TLS != nil {
+		header.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(hstsMaxAge))
+	}
+	c.Next()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestSecureHeadersRouteClasses(t *testing.T) {
+	t.Setenv("ELASTIC_APM_JS_SERVER_URL", "https://apm.example.com:8200/prefix")
+	t.Setenv("OPBEANS_CSP_CONNECT_SRC", "https://api.example.com wss://ws.example.com")
+	setTestStartupFlags(t)
+	cfg := loadTestConfig(t)
+	require.NoError(t, os.Mkdir(filepath.Join(cfg.Server.Frontend, "static"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cfg.Server.Frontend, "static", "app.js"), []byte("app()"), 0644))
+
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, cfg, &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	const csp = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data:; connect-src 'self' https://apm.example.com:8200 https://api.example.com wss://ws.example.com; " +
+		"object-src 'none'; base-uri 'self'; frame-ancestors 'self'"
+	for _, path := range []string{"/", "/products/1", "/static/app.js", "/rum-config.js"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, csp, w.Header().Get("Content-Security-Policy"), path)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), path)
+		assert.Equal(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"), path)
+		assert.Empty(t, w.Header().Get("Strict-Transport-Security"), path)
+	}
+
+	// The RUM agent is configured with the same APM Server.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/rum-config.js", nil))
+	assert.Equal(t, "window.elasticApmJsBaseServerUrl = 'https://apm.example.com:8200/prefix';\n", w.Body.String())
+
+	// The API is unaffected by default.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Security-Policy"))
+	assert.Empty(t, w.Header().Get("X-Content-Type-Options"))
+
+	// HSTS is only set on requests received over TLS.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "max-age=31536000", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestSecureHeadersAPI(t *testing.T) {
+	h := newSecureHeaders(&url.URL{Scheme: "http", Host: "localhost:8200"}, true, nil)
+	assert.Contains(t, h.csp, "connect-src 'self' http://localhost:8200;")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(h.middleware)
+	r.GET("/api/stats", func(c *gin.Context) {})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	assert.Equal(t, h.csp, w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+}
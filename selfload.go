@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+
+	"github.com/elastic/opbeans-go/httpclient"
+)
+
+// selfLoadTransactionType is the type of the transactions in which the
+// self load generator issues its requests, so that they are traced end
+// to end: the generator's spans are the parents of the server's
+// transactions.
+const selfLoadTransactionType = "loadgen"
+
+// selfLoadGenerator issues a mix of requests to the server's listener,
+// for standalone demos without an external load generator. IDs of
+// products, orders and customers are learned from the responses to
+// listing requests, as a client browsing the shop would.
+type selfLoadGenerator struct {
+	tracer      *apm.Tracer
+	url         string
+	rps         float64
+	client      *http.Client
+	maintenance *maintenanceMode
+
+	// random and the learned IDs are used only by the goroutine
+	// running the generator.
+	random     *rand.Rand
+	productIDs []int
+	orders     []selfLoadOrder
+}
+
+// selfLoadOrder holds the fields of listed orders used by the generator.
+type selfLoadOrder struct {
+	ID         int `json:"id"`
+	CustomerID int `json:"customer_id"`
+}
+
+// newSelfLoadGenerator returns a selfLoadGenerator issuing rps requests
+// per second to the server at url, such as by listenerURL.
+func newSelfLoadGenerator(tracer *apm.Tracer, url string, rps float64) *selfLoadGenerator {
+	return &selfLoadGenerator{
+		tracer: tracer,
+		url:    url,
+		rps:    rps,
+		client: httpclient.LocalClient(),
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// selfLoadRequest is a request issued by the generator.
+type selfLoadRequest struct {
+	// name names the transaction issuing the request, after the route.
+	name         string
+	method, path string
+	body         []byte
+}
+
+// selfLoadMix holds the requests issued by the generator, with their
+// relative weights. Reads dominate, with occasional writes.
+var selfLoadMix = []struct {
+	weight  int
+	request func(g *selfLoadGenerator) selfLoadRequest
+}{
+	{4, (*selfLoadGenerator).listProducts},
+	{4, (*selfLoadGenerator).getProduct},
+	{1, (*selfLoadGenerator).getProductCustomers},
+	{1, func(*selfLoadGenerator) selfLoadRequest {
+		return selfLoadRequest{name: "GET /api/types", method: "GET", path: "/api/types"}
+	}},
+	{3, func(*selfLoadGenerator) selfLoadRequest {
+		return selfLoadRequest{name: "GET /api/stats", method: "GET", path: "/api/stats"}
+	}},
+	{2, (*selfLoadGenerator).listOrders},
+	{2, (*selfLoadGenerator).getOrder},
+	{2, (*selfLoadGenerator).getCustomer},
+	{1, (*selfLoadGenerator).postOrder},
+}
+
+// The requests for entities are replaced by listing requests until the
+// IDs of the entities have been learned.
+
+func (g *selfLoadGenerator) listProducts() selfLoadRequest {
+	return selfLoadRequest{name: "GET /api/products", method: "GET", path: "/api/products"}
+}
+
+func (g *selfLoadGenerator) getProduct() selfLoadRequest {
+	if len(g.productIDs) == 0 {
+		return g.listProducts()
+	}
+	id := g.productIDs[g.random.Intn(len(g.productIDs))]
+	return selfLoadRequest{name: "GET /api/products/:id", method: "GET", path: "/api/products/" + strconv.Itoa(id)}
+}
+
+func (g *selfLoadGenerator) getProductCustomers() selfLoadRequest {
+	if len(g.productIDs) == 0 {
+		return g.listProducts()
+	}
+	id := g.productIDs[g.random.Intn(len(g.productIDs))]
+	return selfLoadRequest{name: "GET /api/products/:id/customers", method: "GET", path: "/api/products/" + strconv.Itoa(id) + "/customers"}
+}
+
+func (g *selfLoadGenerator) listOrders() selfLoadRequest {
+	return selfLoadRequest{name: "GET /api/orders", method: "GET", path: "/api/orders"}
+}
+
+func (g *selfLoadGenerator) getOrder() selfLoadRequest {
+	if len(g.orders) == 0 {
+		return g.listOrders()
+	}
+	id := g.orders[g.random.Intn(len(g.orders))].ID
+	return selfLoadRequest{name: "GET /api/orders/:id", method: "GET", path: "/api/orders/" + strconv.Itoa(id)}
+}
+
+func (g *selfLoadGenerator) getCustomer() selfLoadRequest {
+	if len(g.orders) == 0 {
+		return g.listOrders()
+	}
+	id := g.orders[g.random.Intn(len(g.orders))].CustomerID
+	return selfLoadRequest{name: "GET /api/customers/:id", method: "GET", path: "/api/customers/" + strconv.Itoa(id)}
+}
+
+// postOrder orders one to three units of up to three products, for a
+// customer of a listed order.
+func (g *selfLoadGenerator) postOrder() selfLoadRequest {
+	switch {
+	case len(g.productIDs) == 0:
+		return g.listProducts()
+	case len(g.orders) == 0:
+		return g.listOrders()
+	}
+	order := auditedOrder{CustomerID: g.orders[g.random.Intn(len(g.orders))].CustomerID}
+	for i := g.random.Intn(3); i >= 0; i-- {
+		order.Lines = append(order.Lines, auditedOrderLine{
+			ID:     g.productIDs[g.random.Intn(len(g.productIDs))],
+			Amount: 1 + g.random.Intn(3),
+		})
+	}
+	body, _ := json.Marshal(order)
+	return selfLoadRequest{name: "POST /api/orders", method: "POST", path: "/api/orders", body: body}
+}
+
+// choose returns a request chosen from selfLoadMix by weight.
+func (g *selfLoadGenerator) choose() selfLoadRequest {
+	var total int
+	for _, r := range selfLoadMix {
+		total += r.weight
+	}
+	n := g.random.Intn(total)
+	for _, r := range selfLoadMix {
+		if n < r.weight {
+			return r.request(g)
+		}
+		n -= r.weight
+	}
+	panic("unreachable")
+}
+
+// run issues requests at the generator's rate until ctx is cancelled,
+// pausing in maintenance mode.
+func (g *selfLoadGenerator) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / g.rps))
+	defer ticker.Stop()
+	for {
+		if !g.maintenance.wait(ctx) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Requests may have been waiting on the ticker while the
+		// maintenance mode was enabled.
+		if g.maintenance.enabled() {
+			continue
+		}
+		g.issue(ctx, g.choose())
+	}
+}
+
+// issue issues r in a transaction of its own, learning the IDs listed by
+// the response. Failures are logged, but otherwise ignored.
+func (g *selfLoadGenerator) issue(ctx context.Context, r selfLoadRequest) {
+	tx := g.tracer.StartTransaction(r.name, selfLoadTransactionType)
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(r.method, g.url+r.path, body)
+	if err != nil {
+		tx.Result = "failure"
+		logrus.WithError(err).Warn("failed to create self load request")
+		return
+	}
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := g.client.Do(req.WithContext(ctx))
+	if err != nil {
+		tx.Result = "failure"
+		if ctx.Err() == nil {
+			loggerFromContext(ctx).WithError(err).Warn("self load request failed")
+		}
+		return
+	}
+	defer resp.Body.Close()
+	tx.Result = apmhttp.StatusCodeResult(resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+	switch r.name {
+	case "GET /api/products":
+		var products []struct {
+			ID int `json:"id"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&products) == nil && len(products) > 0 {
+			g.productIDs = g.productIDs[:0]
+			for _, p := range products {
+				g.productIDs = append(g.productIDs, p.ID)
+			}
+		}
+	case "GET /api/orders":
+		var orders []selfLoadOrder
+		if json.NewDecoder(resp.Body).Decode(&orders) == nil && len(orders) > 0 {
+			g.orders = orders
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestSelfLoadGenerator(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	maintenance, err := newMaintenanceMode(config.Maintenance{Enabled: true})
+	require.NoError(t, err)
+	g := newSelfLoadGenerator(tracer, srv.URL, 20)
+	g.maintenance = maintenance
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.run(ctx)
+	}()
+
+	// The generator pauses in maintenance mode.
+	time.Sleep(200 * time.Millisecond)
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Transactions)
+
+	require.NoError(t, maintenance.set(false))
+	time.Sleep(time.Second)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generator did not stop")
+	}
+
+	// Each request is traced from the generator's transaction, through
+	// its span, to the server's transaction, across routes of several
+	// types.
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	generated := make(map[model.SpanID]model.Transaction)
+	served := make(map[string]int)
+	var failed int
+	for _, tx := range payloads.Transactions {
+		switch tx.Type {
+		case selfLoadTransactionType:
+			generated[tx.ID] = tx
+			if tx.Result == "failure" {
+				failed++
+			} else {
+				assert.Regexp(t, "^HTTP [23]xx$", tx.Result, tx.Name)
+			}
+		case "request":
+			served[tx.Name]++
+		}
+	}
+	assert.True(t, len(generated) >= 10, "%d transactions generated", len(generated))
+	// Only the request in flight when the generator was stopped fails.
+	assert.True(t, failed <= 1, "%d generated requests failed", failed)
+	assert.True(t, len(served) >= 3, "served %v", served)
+	parents := make(map[model.SpanID]model.SpanID)
+	for _, span := range payloads.Spans {
+		parents[span.ID] = span.ParentID
+	}
+	for _, tx := range payloads.Transactions {
+		if tx.Type != "request" {
+			continue
+		}
+		spanParent, ok := parents[tx.ParentID]
+		if assert.True(t, ok, "%s has no parent span", tx.Name) {
+			assert.Contains(t, generated, spanParent)
+		}
+	}
+}
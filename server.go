@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// readHeaderTimeout bounds the time taken by clients to send request
+// headers. Request bodies are bounded separately, by bodyLimits, as a
+// server-wide read timeout would also apply to streaming responses.
+const readHeaderTimeout = 10 * time.Second
+
+// newHTTPServer returns a server serving handler on addr. HTTP/2 is
+// always negotiated with TLS clients; if enableH2C is true, HTTP/2 is
+// also served over cleartext (h2c), both to clients with prior knowledge
+// and to clients upgrading from HTTP/1.1.
+func newHTTPServer(addr string, handler http.Handler, enableH2C bool) *http.Server {
+	if enableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: readHeaderTimeout}
+}
+
+// adminListenerKey is the context key marking requests received by the
+// server returned by newAdminServer.
+type adminListenerKey struct{}
+
+// newAdminServer returns a server serving handler on addr, as does
+// newHTTPServer, marking its requests as received on the admin listener,
+// so that partitionListeners serves them the admin routes.
+func newAdminServer(addr string, handler http.Handler, enableH2C bool) *http.Server {
+	srv := newHTTPServer(addr, handler, enableH2C)
+	srv.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), adminListenerKey{}, true)
+	}
+	return srv
+}
+
+// partitionListeners returns a middleware for servers with a separate
+// admin listener, which serves the admin routes, as reported by
+// isAdminRequest, only on that listener, and other routes only on the
+// public listener. Requests for the other listener's routes are handled
+// by notFound, as for unknown routes. The health checks are served on
+// both listeners.
+func partitionListeners(notFound gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		adminListener, _ := req.Context().Value(adminListenerKey{}).(bool)
+		if !isHealthCheck(req) && isAdminRequest(req) != adminListener {
+			notFound(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// switchHandler is an http.Handler serving requests with the handler
+// most recently passed to set, so that the server can begin serving
+// health checks before it has started up.
+type switchHandler struct {
+	handler atomic.Value // handlerValue
+}
+
+type handlerValue struct {
+	http.Handler
+}
+
+func newSwitchHandler(handler http.Handler) *switchHandler {
+	h := &switchHandler{}
+	h.set(handler)
+	return h
+}
+
+// set serves subsequent requests with handler.
+func (h *switchHandler) set(handler http.Handler) {
+	h.handler.Store(handlerValue{handler})
+}
+
+func (h *switchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.handler.Load().(handlerValue).ServeHTTP(w, req)
+}
+
+// listenAndServe serves srv over TLS if srv.TLSConfig is set, as by
+// newTLSConfig, and over cleartext otherwise.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig == nil {
+		return srv.ListenAndServe()
+	}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestHTTPServerH2C(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	srv := newHTTPServer("", newTestAPIRouter(tracer, newTestDB(t)), true)
+	server := httptest.NewServer(srv.Handler)
+	defer server.Close()
+
+	var localAddr *net.TCPAddr
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				localAddr = conn.LocalAddr().(*net.TCPAddr)
+			}
+			return conn, err
+		},
+	}}
+	resp, err := client.Get(server.URL + "/api/products")
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	tracer.Flush(nil)
+
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 1)
+	request := transactions[0].Context.Request
+	assert.Equal(t, "2.0", request.HTTPVersion)
+	assert.Equal(t, &model.RequestSocket{RemoteAddress: localAddr.IP.String()}, request.Socket)
+}
+
+func TestHTTPServerH2CAcceptsHTTP1(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	srv := newHTTPServer("", newTestAPIRouter(tracer, newTestDB(t)), true)
+	server := httptest.NewServer(srv.Handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/products")
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor)
+	tracer.Flush(nil)
+
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 1)
+	assert.Equal(t, "1.1", transactions[0].Context.Request.HTTPVersion)
+}
+
+func TestHTTPServerTLS(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	srv := newHTTPServer("", newTestAPIRouter(tracer, newTestDB(t)), false)
+	server := httptest.NewUnstartedServer(srv.Handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/api/products")
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor)
+	tracer.Flush(nil)
+
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 1)
+	request := transactions[0].Context.Request
+	assert.Equal(t, "2.0", request.HTTPVersion)
+	assert.Equal(t, "https", request.URL.Protocol)
+	assert.True(t, request.Socket.Encrypted)
+}
+
+// serveTestListener serves srv on an ephemeral port, returning its URL.
+func serveTestListener(t *testing.T, srv *http.Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+func TestAdminListener(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_ADDR", "127.0.0.1:0")
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_ENABLE_PPROF", "true")
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	health := &healthChecker{}
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), health)
+	require.NoError(t, err)
+	defer cleanup()
+	health.serving()
+
+	publicSrv := newHTTPServer("", r, false)
+	adminSrv := newAdminServer("", r, false)
+	publicURL := serveTestListener(t, publicSrv)
+	adminURL := serveTestListener(t, adminSrv)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(url string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Each listener serves only its own routes, and both serve the
+	// health checks.
+	for path, admin := range map[string]bool{
+		"/":                       false,
+		"/api/products":           false,
+		"/orders":                 false,
+		"/api/admin/runtime":      true,
+		"/api/admin/audit":        true,
+		metricsPath:               true,
+		pprofPathPrefix + "/":     true,
+		pprofPathPrefix + "/heap": true,
+	} {
+		publicStatus, adminStatus := http.StatusOK, http.StatusNotFound
+		if admin {
+			publicStatus, adminStatus = adminStatus, publicStatus
+		}
+		assert.Equal(t, publicStatus, get(publicURL+path), path)
+		assert.Equal(t, adminStatus, get(adminURL+path), path)
+	}
+	assert.Equal(t, http.StatusOK, get(publicURL+readinessPath))
+	assert.Equal(t, http.StatusOK, get(adminURL+readinessPath))
+
+	// Draining stops both listeners.
+	require.NoError(t, drainServer(health, 10*time.Second, publicSrv, adminSrv))
+	for _, url := range []string{publicURL, adminURL} {
+		_, err := client.Get(url + livenessPath)
+		assert.Error(t, err)
+	}
+}
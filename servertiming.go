@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Server-Timing metrics, in the order in which they are reported.
+const (
+	serverTimingDB     = "db"
+	serverTimingCache  = "cache"
+	serverTimingRender = "render"
+)
+
+var serverTimingMetrics = []string{serverTimingDB, serverTimingCache, serverTimingRender}
+
+type serverTimingsKey struct{}
+
+// serverTimings accumulates the time spent in each phase of serving a
+// request, for the Server-Timing header. Concurrent or nested periods
+// of the same phase are counted once.
+type serverTimings struct {
+	mu     sync.Mutex
+	phases map[string]*serverTimingPhase
+}
+
+type serverTimingPhase struct {
+	total  time.Duration
+	active int
+	since  time.Time
+}
+
+// startTiming records the start of a period of the named phase of the
+// request served in ctx, if timed, and returns a function recording its
+// end.
+func startTiming(ctx context.Context, name string) (end func()) {
+	t, ok := ctx.Value(serverTimingsKey{}).(*serverTimings)
+	if !ok {
+		return func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.phases[name]
+	if p == nil {
+		p = &serverTimingPhase{}
+		t.phases[name] = p
+	}
+	if p.active == 0 {
+		p.since = time.Now()
+	}
+	p.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if p.active--; p.active == 0 {
+				p.total += time.Since(p.since)
+			}
+		})
+	}
+}
+
+// header returns the Server-Timing header value, with the durations of
+// the phases recorded so far in milliseconds. Phases in progress are
+// counted up to now.
+func (t *serverTimings) header(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var entries []string
+	for _, name := range serverTimingMetrics {
+		p := t.phases[name]
+		if p == nil {
+			continue
+		}
+		d := p.total
+		if p.active > 0 {
+			d += now.Sub(p.since)
+		}
+		ms := float64(d) / float64(time.Millisecond)
+		entries = append(entries, name+";dur="+strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// serverTimingMiddleware sets the Server-Timing header on API responses,
+// reporting the time spent querying the database, calling the cache
+// and rendering the response, as recorded with startTiming. The header
+// is set when the response's header is written, so covers only the
+// time spent before the body, or its first part if streamed.
+func serverTimingMiddleware(c *gin.Context) {
+	if !isAPIPath(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+	t := &serverTimings{phases: make(map[string]*serverTimingPhase)}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), serverTimingsKey{}, t))
+	c.Writer = &serverTimingWriter{ResponseWriter: c.Writer, timings: t}
+	c.Next()
+}
+
+// serverTimingWriter is a gin.ResponseWriter which sets the
+// Server-Timing header before the response's header is written.
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	timings *serverTimings
+	set     bool
+}
+
+func (w *serverTimingWriter) setHeader() {
+	if w.set || w.ResponseWriter.Written() {
+		return
+	}
+	w.set = true
+	if value := w.timings.header(time.Now()); value != "" {
+		w.Header().Set("Server-Timing", value)
+	}
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *serverTimingWriter) Flush() {
+	w.setHeader()
+	w.ResponseWriter.Flush()
+}
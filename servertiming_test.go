@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// parseServerTiming parses a Server-Timing header value into the
+// durations of its metrics.
+func parseServerTiming(t *testing.T, value string) map[string]time.Duration {
+	metrics := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		params := strings.Split(strings.TrimSpace(entry), ";")
+		require.Len(t, params, 2, value)
+		require.True(t, strings.HasPrefix(params[1], "dur="), value)
+		ms, err := strconv.ParseFloat(strings.TrimPrefix(params[1], "dur="), 64)
+		require.NoError(t, err, value)
+		metrics[params[0]] = time.Duration(ms * float64(time.Millisecond))
+	}
+	return metrics
+}
+
+func TestServerTiming(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The stats are queried and cached on the first request, and read
+	// from the cache on the next.
+	w := serveGet(r, "/api/stats")
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics := parseServerTiming(t, w.Header().Get("Server-Timing"))
+	assert.Contains(t, metrics, "cache")
+	assert.Contains(t, metrics, "render")
+	assert.NotZero(t, metrics["db"])
+
+	w = serveGet(r, "/api/stats")
+	require.Equal(t, http.StatusOK, w.Code)
+	metrics = parseServerTiming(t, w.Header().Get("Server-Timing"))
+	assert.Contains(t, metrics, "cache")
+	assert.NotContains(t, metrics, "db")
+
+	// Only API responses are timed.
+	assert.Empty(t, serveGet(r, "/").Header().Get("Server-Timing"))
+	assert.Empty(t, serveGet(r, livenessPath).Header().Get("Server-Timing"))
+}
+
+func TestServerTimingsOverlap(t *testing.T) {
+	timings := &serverTimings{phases: make(map[string]*serverTimingPhase)}
+	ctx := context.WithValue(context.Background(), serverTimingsKey{}, timings)
+
+	// Overlapping periods of a phase are counted once, and ending a
+	// period twice has no effect.
+	start := time.Now()
+	endOuter := startTiming(ctx, serverTimingDB)
+	endInner := startTiming(ctx, serverTimingDB)
+	time.Sleep(10 * time.Millisecond)
+	endInner()
+	endInner()
+	time.Sleep(10 * time.Millisecond)
+	endOuter()
+	elapsed := time.Since(start)
+	metrics := parseServerTiming(t, timings.header(time.Now()))
+	assert.Len(t, metrics, 1)
+	assert.True(t, metrics["db"] >= 20*time.Millisecond && metrics["db"] <= elapsed, metrics["db"])
+
+	// Phases in progress are counted up to the time of the header, and
+	// untimed requests are ignored.
+	startTiming(ctx, serverTimingRender)
+	metrics = parseServerTiming(t, timings.header(time.Now().Add(time.Second)))
+	assert.True(t, metrics["render"] >= time.Second, metrics["render"])
+	startTiming(context.Background(), serverTimingDB)()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// drainServer stops servers gracefully: it marks the server as draining,
+// stops accepting connections on each listener, and waits up to timeout
+// for in-flight requests to complete. Requests still in flight after the
+// timeout are cut off, and an error is returned.
+//
+// Hijacked connections, such as WebSockets, are not waited for; they
+// are closed along with the server's other resources.
+func drainServer(health *healthChecker, timeout time.Duration, servers ...*http.Server) error {
+	health.drain()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var result error
+	for range servers {
+		if err := <-errs; err != nil && result == nil {
+			result = errors.Wrapf(err, "requests still in flight after %s", timeout)
+		}
+	}
+	return result
+}
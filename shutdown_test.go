@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closeNotifyListener is a net.Listener which closes closed once it
+// has been closed.
+type closeNotifyListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *closeNotifyListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.closed) })
+	return err
+}
+
+// newTestDrainServer serves a router with the health checks, and a
+// "/slow" route which signals started and then waits for release, until
+// the returned server is shut down.
+func newTestDrainServer(t *testing.T, health *healthChecker, started chan<- struct{}, release <-chan struct{}) (*http.Server, *closeNotifyListener) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	addHealthHandlers(r, health)
+	r.GET("/slow", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.String(http.StatusOK, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	notify := &closeNotifyListener{Listener: ln, closed: make(chan struct{})}
+	srv := newHTTPServer("", r, false)
+	go srv.Serve(notify)
+	t.Cleanup(func() { srv.Close() })
+	return srv, notify
+}
+
+func TestDrainServer(t *testing.T) {
+	health := &healthChecker{}
+	health.setMigrated()
+	health.serving()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv, ln := newTestDrainServer(t, health, started, release)
+	url := "http://" + ln.Addr().String()
+
+	// Keep-alives are disabled, so that the transport opens no spare
+	// connections, which Shutdown would wait for as new connections.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url + "/healthz/live")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	type result struct {
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	drained := make(chan error, 1)
+	go func() { drained <- drainServer(health, 10*time.Second, srv) }()
+
+	// The server reports that it is draining as soon as draining begins, and
+	// refuses new connections while the slow request is in flight.
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/healthz/live", nil))
+		return w.Code == http.StatusServiceUnavailable
+	}, time.Second, time.Millisecond)
+	<-ln.closed
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.Error(t, err)
+	select {
+	case err := <-drained:
+		t.Fatalf("drainServer returned while a request was in flight: %v", err)
+	default:
+	}
+
+	close(release)
+	res := <-slow
+	require.NoError(t, res.err)
+	assert.Equal(t, "done", res.body)
+	assert.NoError(t, <-drained)
+}
+
+func TestDrainServerTimeout(t *testing.T) {
+	health := &healthChecker{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv, ln := newTestDrainServer(t, health, started, release)
+	url := "http://" + ln.Addr().String()
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	<-started
+
+	// Requests still in flight after the timeout are cut off.
+	err := drainServer(health, 50*time.Millisecond, srv)
+	assert.EqualError(t, err, "requests still in flight after 50ms: context deadline exceeded")
+	assert.Error(t, <-slow)
+}
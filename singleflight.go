@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+)
+
+// flightGroup shares the result of a call among the concurrent calls
+// with the same key, so that hot lookups are made once at a time.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is a call in flight, awaited by its followers.
+type flightCall struct {
+	done      chan struct{}
+	followers int // guarded by flightGroup.mu
+	value     interface{}
+	err       error
+}
+
+// do calls f with ctx, unless a call with the same key is in flight, in
+// which case it waits for that call's result instead, returning shared
+// as true. Results, including errors, are only shared with the calls
+// made while in flight, so that errors do not affect later calls.
+//
+// Followers stop waiting if ctx is done. If the call they awaited was
+// cancelled, as its caller's context was done, they call again.
+func (g *flightGroup) do(ctx context.Context, key string, f func(context.Context) (interface{}, error)) (value interface{}, shared bool, err error) {
+	for {
+		g.mu.Lock()
+		if g.calls == nil {
+			g.calls = make(map[string]*flightCall)
+		}
+		if call, ok := g.calls[key]; ok {
+			call.followers++
+			g.mu.Unlock()
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, true, ctx.Err()
+			}
+			if cause := errors.Cause(call.err); cause == context.Canceled || cause == context.DeadlineExceeded {
+				if ctx.Err() == nil {
+					continue
+				}
+			}
+			return call.value, true, call.err
+		}
+		call := &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.mu.Unlock()
+
+		call.value, call.err = f(ctx)
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+		return call.value, false, call.err
+	}
+}
+
+// followers returns the number of calls awaiting the call with key in
+// flight, if any.
+func (g *flightGroup) followers(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call.followers
+	}
+	return 0
+}
+
+// entityLookups makes the lookups of products and orders by ID, sharing
+// the queries of concurrent lookups of the same entity. Lookups which
+// share another's query label their transaction singleflight_shared.
+type entityLookups struct {
+	group   flightGroup
+	product func(context.Context, *sqlx.DB, int) (*Product, error)
+	order   func(context.Context, *sqlx.DB, int) (*Order, error)
+}
+
+func newEntityLookups() *entityLookups {
+	return &entityLookups{product: getProduct, order: getOrder}
+}
+
+// getProduct returns the product with the given ID, as getProduct does.
+func (l *entityLookups) getProduct(c *gin.Context, db *sqlx.DB, id int) (*Product, error) {
+	v, err := l.do(c, "product:"+strconv.Itoa(id), func(ctx context.Context) (interface{}, error) {
+		return l.product(ctx, db, id)
+	})
+	product, _ := v.(*Product)
+	return product, err
+}
+
+// getOrder returns the order with the given ID, as getOrder does.
+func (l *entityLookups) getOrder(c *gin.Context, db *sqlx.DB, id int) (*Order, error) {
+	v, err := l.do(c, "order:"+strconv.Itoa(id), func(ctx context.Context) (interface{}, error) {
+		return l.order(ctx, db, id)
+	})
+	order, _ := v.(*Order)
+	return order, err
+}
+
+func (l *entityLookups) do(c *gin.Context, key string, f func(context.Context) (interface{}, error)) (interface{}, error) {
+	v, shared, err := l.group.do(c.Request.Context(), key, f)
+	if shared {
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("singleflight_shared", true)
+		})
+	}
+	return v, err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// slowProductStore is a fake product store, whose lookups block until
+// released.
+type slowProductStore struct {
+	queries int64
+	release chan struct{}
+	err     error
+}
+
+func (s *slowProductStore) getProduct(ctx context.Context, db *sqlx.DB, id int) (*Product, error) {
+	atomic.AddInt64(&s.queries, 1)
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &Product{ID: id, Name: "Hot Roast"}, nil
+}
+
+func TestSingleflightProductLookups(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	gin.SetMode(gin.TestMode)
+	store := &slowProductStore{release: make(chan struct{})}
+	h := apiHandlers{lookups: newEntityLookups()}
+	h.lookups.product = store.getProduct
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(errorMiddleware(tracer))
+	r.GET("/api/products/:id", h.getProductDetails)
+
+	// serveConcurrently serves n concurrent requests for the product,
+	// releasing the store once all but the first await its lookup, and
+	// returns their statuses.
+	serveConcurrently := func(n int) []int {
+		statuses := make([]int, n)
+		var wg sync.WaitGroup
+		for i := range statuses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/7", nil))
+				statuses[i] = w.Code
+			}(i)
+		}
+		require.Eventually(t, func() bool {
+			return h.lookups.group.followers("product:7") == n-1
+		}, 5*time.Second, time.Millisecond)
+		close(store.release)
+		wg.Wait()
+		return statuses
+	}
+	all := func(n, status int) []int {
+		statuses := make([]int, n)
+		for i := range statuses {
+			statuses[i] = status
+		}
+		return statuses
+	}
+
+	// The concurrent lookups share a single query, and the followers'
+	// transactions are labeled.
+	const n = 100
+	assert.Equal(t, all(n, http.StatusOK), serveConcurrently(n))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&store.queries))
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, n)
+	var shared int
+	for _, tx := range transactions {
+		if v, ok := transactionLabels(tx)["singleflight_shared"]; ok {
+			assert.Equal(t, true, v)
+			shared++
+		}
+	}
+	assert.Equal(t, n-1, shared)
+
+	// Errors are shared by the lookups in flight, but not by later ones.
+	store.queries = 0
+	store.release = make(chan struct{})
+	store.err = errors.New("database is locked")
+	assert.Equal(t, all(10, http.StatusInternalServerError), serveConcurrently(10))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&store.queries))
+	store.err = nil
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/products/7", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&store.queries))
+}
+
+func TestFlightGroupCancelledLeader(t *testing.T) {
+	var g flightGroup
+	var calls int64
+	release := make(chan struct{})
+	f := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		select {
+		case <-release:
+			return "value", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, _, err := g.do(leaderCtx, "key", f)
+		leaderDone <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&calls) == 1 }, 5*time.Second, time.Millisecond)
+	followerDone := make(chan interface{})
+	go func() {
+		v, _, err := g.do(context.Background(), "key", f)
+		assert.NoError(t, err)
+		followerDone <- v
+	}()
+	require.Eventually(t, func() bool { return g.followers("key") == 1 }, 5*time.Second, time.Millisecond)
+
+	// The follower calls again once the leader is cancelled, rather than
+	// sharing its cancellation.
+	cancel()
+	assert.Equal(t, context.Canceled, <-leaderDone)
+	require.Eventually(t, func() bool { return atomic.LoadInt64(&calls) == 2 }, 5*time.Second, time.Millisecond)
+	close(release)
+	assert.Equal(t, "value", <-followerDone)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+)
+
+// spaRoute is the route pattern after which requests served by
+// spaFallback are named, so that the frontend's deep links share one
+// transaction name.
+const spaRoute = "/*spa"
+
+// isSPARequest reports whether req is for a client-side route of the
+// frontend: a GET request for a path outside the API, the static assets
+// and the operational routes, which is not for a file.
+func isSPARequest(req *http.Request) bool {
+	p := req.URL.Path
+	switch {
+	case req.Method != "GET", isAPIPath(p), isAdminRequest(req), isHealthCheck(req), isStaticAsset(req):
+		return false
+	}
+	return path.Ext(p) == ""
+}
+
+// spaFallback returns a handler for requests matching no route, which
+// serves index.html for the frontend's client-side routes, as reported
+// by isSPARequest, and handles other requests with notFound.
+func spaFallback(notFound gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isSPARequest(c.Request) {
+			notFound(c)
+			return
+		}
+		tx := apm.TransactionFromContext(c.Request.Context())
+		if tx != nil {
+			tx.Name = c.Request.Method + " " + spaRoute
+		}
+		handleIndex(c)
+	}
+}
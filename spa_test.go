@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestSPAFallback(t *testing.T) {
+	setTestStartupFlags(t)
+	cfg := loadTestConfig(t)
+	staticDir := filepath.Join(cfg.Server.Frontend, "static")
+	require.NoError(t, os.Mkdir(staticDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(staticDir, "app.js"), []byte("app()"), 0644))
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, cfg, &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	// Deep links are served index.html, in transactions sharing a name.
+	deepLinks := []string{"/products/42", "/customers/7/orders", "/cart", "/dashboard?tab=orders"}
+	for _, path := range deepLinks {
+		w := serveGet(r, path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"), path)
+		assert.Contains(t, w.Body.String(), "window.elasticApmConfig", path)
+	}
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, len(deepLinks))
+	for _, tx := range transactions {
+		assert.Equal(t, "GET /*spa", tx.Name)
+	}
+
+	// Static assets are served as they are, and missing API routes,
+	// assets and files are not found.
+	w := serveGet(r, "/static/app.js")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "app()", w.Body.String())
+	for _, path := range []string{"/api/products/42/nonexistent", "/api", "/static/missing.js", "/images/missing.png", "/robots.txt"} {
+		w := serveGet(r, path)
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+		assert.Equal(t, apperr.NotFound, decodeErrorEnvelope(t, w.Body.Bytes()).Code, path)
+	}
+
+	// Only GET requests fall back to the frontend.
+	w = serveJSON(r, "POST", "/products/42", "{}")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.NotContains(t, w.Body.String(), "<html>")
+}
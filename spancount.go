@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+)
+
+type queryCounterKey struct{}
+
+// queryCounter counts the database calls made by the repository layer
+// while serving a request. Each call is recorded as a span by apmsql.
+type queryCounter struct {
+	n int64
+}
+
+// startQuery records a database call made within ctx, and returns a
+// function recording its end, for the request's Server-Timing header.
+// The call ends once its results have been read.
+func startQuery(ctx context.Context) (end func()) {
+	if counter, ok := ctx.Value(queryCounterKey{}).(*queryCounter); ok {
+		atomic.AddInt64(&counter.n, 1)
+	}
+	return startTiming(ctx, serverTimingDB)
+}
+
+// spanAccountingMiddleware returns a middleware which counts the
+// repository calls made while serving each request. When the count
+// exceeds maxSpans, the agent will have dropped spans; the middleware
+// records the excess in the "spans.dropped_estimate" transaction tag
+// (reported as "spans_dropped_estimate"), and logs a warning.
+//
+// The middleware must be installed after tracingMiddleware.
+func spanAccountingMiddleware(maxSpans int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		counter := &queryCounter{}
+		ctx := context.WithValue(c.Request.Context(), queryCounterKey{}, counter)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		dropped := atomic.LoadInt64(&counter.n) - int64(maxSpans)
+		if maxSpans < 0 || dropped <= 0 {
+			return
+		}
+		contextLogger(c).Warnf(
+			"%d repository calls exceeded the limit of %d spans per transaction; ~%d spans dropped",
+			counter.n, maxSpans, dropped,
+		)
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetTag("spans.dropped_estimate", strconv.FormatInt(dropped, 10))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+func TestSpanAccountingMiddleware(t *testing.T) {
+	const maxSpans = 3
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	tracer.SetMaxSpans(maxSpans)
+
+	var logs bytes.Buffer
+	logger := logrus.StandardLogger()
+	origOutput := logger.Out
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(origOutput)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(spanAccountingMiddleware(maxSpans))
+	r.Use(errorMiddleware(tracer))
+	addAPIHandlers(r.Group("/api"), newTestDB(t), &businessMetrics{}, nil, nil, nil, nil)
+
+	// Creating an order makes one repository call per order line, in
+	// addition to fetching the customer, inserting the order, preparing
+	// the order line statement, enqueueing the fulfillment job,
+	// recording the change and audit entry, enqueueing the outbox
+	// event, and querying the revenue.
+	type line struct {
+		ID     int `json:"id"`
+		Amount int `json:"amount"`
+	}
+	lines := []line{{1, 1}, {2, 1}, {3, 1}, {4, 1}, {5, 1}}
+	body, err := json.Marshal(map[string]interface{}{"customer_id": 1, "lines": lines})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/api/orders", bytes.NewReader(body)))
+	require.Equal(t, 200, w.Code, w.Body.String())
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	tags := make(map[string]interface{})
+	for _, tag := range tx.Context.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	assert.Equal(t, "10", tags["spans_dropped_estimate"])
+	assert.NotZero(t, tx.SpanCount.Dropped)
+	assert.Contains(t, logs.String(), "~10 spans dropped")
+}
+
+func TestSpanAccountingMiddlewareWithinLimit(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(spanAccountingMiddleware(config.DefaultTransactionMaxSpans))
+	addAPIHandlers(r.Group("/api"), newTestDB(t), &businessMetrics{}, nil, nil, nil, nil)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/orders/1", nil))
+	tracer.Flush(nil)
+
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, model.IfaceMap{{Key: "outcome", Value: "success"}}, payloads.Transactions[0].Context.Tags)
+}
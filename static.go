@@ -0,0 +1,225 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cacheControlImmutable is the Cache-Control of assets whose names
+	// hold a content hash, which change name when their content does.
+	cacheControlImmutable = "public, max-age=31536000, immutable"
+
+	// cacheControlRevalidate is the Cache-Control of index.html and of
+	// assets whose names hold no content hash, which clients must
+	// revalidate before use.
+	cacheControlRevalidate = "no-cache"
+)
+
+// hashedAssetName matches the names of assets holding a content hash,
+// as produced by the frontend's build, such as "main.1a2b3c4d.js".
+var hashedAssetName = regexp.MustCompile(`\.[0-9a-f]{8,}\.`)
+
+// assetEncodings holds the content encodings for which assets may have
+// precompressed siblings, and their file extensions, in the order in
+// which they are preferred.
+var assetEncodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// isStaticAsset reports whether req is for the frontend's static
+// assets, which are served by staticAssets.
+func isStaticAsset(req *http.Request) bool {
+	return isStaticAssetPath(req.URL.Path)
+}
+
+func isStaticAssetPath(p string) bool {
+	return strings.HasPrefix(p, "/static/") || strings.HasPrefix(p, "/images/") || p == "/favicon.ico"
+}
+
+// staticAsset describes an asset found by newStaticAssets.
+type staticAsset struct {
+	cacheControl string
+
+	// encodings holds the content encodings of the asset's
+	// precompressed siblings, in the order of assetEncodings.
+	encodings []string
+}
+
+// staticAssets serves the frontend's static assets, found when it is
+// created. Assets are served with their precompressed siblings, if any,
+// when the client accepts their encoding.
+type staticAssets struct {
+	frontend fs.FS
+	assets   map[string]staticAsset
+}
+
+// newStaticAssets returns a staticAssets serving the files of frontend,
+// other than precompressed siblings. Files created afterwards are not
+// served.
+func newStaticAssets(frontend fs.FS) (*staticAssets, error) {
+	s := &staticAssets{frontend: frontend, assets: make(map[string]staticAsset)}
+	siblings := make(map[string]bool)
+	err := fs.WalkDir(frontend, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			siblings[file] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find static assets")
+	}
+	for file := range siblings {
+		if isPrecompressed(file) {
+			continue
+		}
+		asset := staticAsset{cacheControl: cacheControlRevalidate}
+		if hashedAssetName.MatchString(path.Base(file)) {
+			asset.cacheControl = cacheControlImmutable
+		}
+		for _, enc := range assetEncodings {
+			if siblings[file+enc.ext] {
+				asset.encodings = append(asset.encodings, enc.name)
+			}
+		}
+		s.assets["/"+file] = asset
+	}
+	return s, nil
+}
+
+func isPrecompressed(file string) bool {
+	for _, enc := range assetEncodings {
+		if strings.HasSuffix(file, enc.ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns a handler serving the asset at the request's path,
+// and handling requests for other paths with notFound.
+func (s *staticAssets) handler(notFound gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Paths are cleaned, but must remain within the assets' routes.
+		name := path.Clean(c.Request.URL.Path)
+		asset, ok := s.assets[name]
+		if !ok || !isStaticAssetPath(name) {
+			notFound(c)
+			return
+		}
+
+		file := name[1:]
+		header := c.Writer.Header()
+		header.Set("Cache-Control", asset.cacheControl)
+		if len(asset.encodings) > 0 {
+			header.Add("Vary", "Accept-Encoding")
+			if enc := negotiateEncoding(c.Request.Header.Get("Accept-Encoding"), asset.encodings); enc != "" {
+				// The type is that of the asset, not of its
+				// precompressed sibling.
+				header.Set("Content-Type", assetContentType(name))
+				header.Set("Content-Encoding", enc)
+				file += encodingExt(enc)
+			}
+		}
+		f, info, err := openAsset(s.frontend, file)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		defer f.Close()
+		// Embedded assets have no modification time, and so are served
+		// without Last-Modified.
+		http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f.(io.ReadSeeker))
+	}
+}
+
+// openAsset opens the file named name in frontend, which must be
+// seekable, as are files on disk and embedded files.
+func openAsset(frontend fs.FS, name string) (fs.File, fs.FileInfo, error) {
+	f, err := frontend.Open(name)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to open static asset")
+	}
+	info, err := f.Stat()
+	if err == nil {
+		if _, ok := f.(io.ReadSeeker); !ok {
+			err = errors.Errorf("%s is not seekable", name)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrap(err, "failed to open static asset")
+	}
+	return f, info, nil
+}
+
+// assetContentType returns the media type of the asset named name,
+// determined from its extension.
+func assetContentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func encodingExt(name string) string {
+	for _, enc := range assetEncodings {
+		if enc.name == name {
+			return enc.ext
+		}
+	}
+	return ""
+}
+
+// negotiateEncoding returns the first of the available encodings which
+// is accepted according to the Accept-Encoding header value accept, or
+// "" if none is. Encodings are accepted if listed, or matched by "*",
+// with a non-zero quality.
+func negotiateEncoding(accept string, available []string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		coding, params := part, ""
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			coding, params = part[:i], part[i+1:]
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			v, err := strconv.ParseFloat(params[2:], 64)
+			if err != nil {
+				continue
+			}
+			q = v
+		}
+		qualities[coding] = q
+	}
+	for _, enc := range available {
+		q, ok := qualities[enc]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > 0 {
+			return enc
+		}
+	}
+	return ""
+}
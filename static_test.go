@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+func TestStaticAssets(t *testing.T) {
+	setTestStartupFlags(t)
+	cfg := loadTestConfig(t)
+	jsDir := filepath.Join(cfg.Server.Frontend, "static", "js")
+	require.NoError(t, os.MkdirAll(jsDir, 0755))
+	for name, content := range map[string]string{
+		"main.1a2b3c4d.js":    "main()",
+		"main.1a2b3c4d.js.br": "brotli",
+		"main.1a2b3c4d.js.gz": "gzip",
+		"vendor.js":           "vendor()",
+		"vendor.js.gz":        "gzip",
+	} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(jsDir, name), []byte(content), 0644))
+	}
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, cfg, &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	for _, test := range []struct {
+		path, acceptEncoding string
+		body, encoding       string
+	}{
+		{"/static/js/main.1a2b3c4d.js", "", "main()", ""},
+		{"/static/js/main.1a2b3c4d.js", "gzip, deflate, br", "brotli", "br"},
+		{"/static/js/main.1a2b3c4d.js", "gzip", "gzip", "gzip"},
+		{"/static/js/main.1a2b3c4d.js", "br;q=0, gzip;q=0.5", "gzip", "gzip"},
+		{"/static/js/main.1a2b3c4d.js", "*", "brotli", "br"},
+		{"/static/js/main.1a2b3c4d.js", "identity", "main()", ""},
+		{"/static/js/vendor.js", "br", "vendor()", ""},
+		{"/static/js/vendor.js", "br, gzip", "gzip", "gzip"},
+	} {
+		w := serve(test.path, test.acceptEncoding)
+		require.Equal(t, http.StatusOK, w.Code, test)
+		assert.Equal(t, test.body, w.Body.String(), test)
+		assert.Equal(t, test.encoding, w.Header().Get("Content-Encoding"), test)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), test)
+		assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"), test)
+	}
+
+	// Hashed assets are cached indefinitely, and other assets and the
+	// index page revalidated.
+	assert.Equal(t, "public, max-age=31536000, immutable", serve("/static/js/main.1a2b3c4d.js", "").Header().Get("Cache-Control"))
+	assert.Equal(t, "no-cache", serve("/static/js/vendor.js", "").Header().Get("Cache-Control"))
+	assert.Equal(t, "no-cache", serve("/", "").Header().Get("Cache-Control"))
+	assert.Equal(t, "no-cache", serve("/products/1", "").Header().Get("Cache-Control"))
+
+	// Precompressed siblings are not served as assets in their own
+	// right, nor are files outside the assets' routes.
+	for _, path := range []string{"/static/js/main.1a2b3c4d.js.gz", "/static/js/missing.js", "/static/../index.html", "/index.html"} {
+		assert.Equal(t, http.StatusNotFound, serve(path, "gzip").Code, path)
+	}
+
+	// Asset requests are not traced.
+	tracer.Flush(nil)
+	var names []string
+	for _, tx := range recorder.Payloads().Transactions {
+		names = append(names, tx.Name)
+	}
+	assert.Contains(t, names, "GET /")
+	assert.NotContains(t, names, "GET /static/*filepath")
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	available := []string{"br", "gzip"}
+	for accept, expected := range map[string]string{
+		"":                   "",
+		"deflate":            "",
+		"GZIP":               "gzip",
+		"gzip, br":           "br",
+		"br;q=0, *":          "gzip",
+		"*;q=0":              "",
+		"gzip;q=0.1, br;q=0": "gzip",
+		"br;q=invalid, gzip": "gzip",
+	} {
+		assert.Equal(t, expected, negotiateEncoding(accept, available), accept)
+	}
+}
@@ -29,13 +29,16 @@ func getStats(ctx context.Context, db *sqlx.DB) (*Stats, error) {
 		{"orders", &stats.Orders},
 	}
 	for _, p := range countParams {
-		row := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+p.table)
-		if err := row.Scan(p.result); err != nil {
+		endQuery := startQuery(ctx)
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+p.table).Scan(p.result)
+		endQuery()
+		if err != nil {
 			return nil, errors.Wrap(err, "querying "+p.table)
 		}
 	}
 
 	var revenue, cost, profit *int
+	defer startQuery(ctx)()
 	row := db.QueryRowContext(ctx, `
 SELECT
   SUM(selling_price), SUM(cost), SUM(selling_price-cost)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+// reasonInsufficientStock is the reason of the error envelope of
+// checkouts failed for insufficient stock.
+const reasonInsufficientStock = "insufficient_stock"
+
+// insufficientStockError is the cause of checkouts failed for
+// insufficient stock of a product.
+type insufficientStockError struct {
+	productID int
+	synthetic bool
+}
+
+func (e insufficientStockError) Error() string {
+	return fmt.Sprintf("insufficient stock of product %d", e.productID)
+}
+
+// Reason returns the reason of the error envelope.
+func (insufficientStockError) Reason() string {
+	return reasonInsufficientStock
+}
+
+// Synthetic reports whether the shortage was injected on purpose.
+func (e insufficientStockError) Synthetic() bool {
+	return e.synthetic
+}
+
+// stockShortageInjector makes a proportion of checkouts report
+// insufficient stock on purpose, regardless of the actual stock, for
+// demos of handled conflicts at a predictable rate.
+type stockShortageInjector struct {
+	settings *runtimeSettings
+
+	mu     sync.Mutex
+	random *rand.Rand
+}
+
+// newStockShortageInjector returns a stockShortageInjector failing
+// checkouts at the rate held by settings, choosing them with a source
+// seeded by seed, or by the time if seed is zero.
+func newStockShortageInjector(settings *runtimeSettings, seed int64) *stockShortageInjector {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &stockShortageInjector{settings: settings, random: rand.New(rand.NewSource(seed))}
+}
+
+// check returns a synthetic shortage of the first product of lines for
+// sampled checkouts, or nil. The error is a conflict, caused by a
+// synthetic insufficientStockError. A nil *stockShortageInjector never
+// fails checkouts.
+func (inj *stockShortageInjector) check(lines []ProductOrderLine) error {
+	if inj == nil || len(lines) == 0 {
+		return nil
+	}
+	// Rates of 0 and 1 are exact, drawing no random numbers.
+	switch rate := inj.settings.stockShortageRate(); {
+	case rate <= 0:
+		return nil
+	case rate < 1:
+		inj.mu.Lock()
+		sampled := inj.random.Float64() < rate
+		inj.mu.Unlock()
+		if !sampled {
+			return nil
+		}
+	}
+	productID := lines[0].Product.ID
+	err := insufficientStockError{productID: productID, synthetic: true}
+	return apperr.WrapMessage(err, apperr.Conflict, err.Error(), "product_id", productID)
+}
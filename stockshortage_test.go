@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestStockShortage(t *testing.T) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	t.Setenv("OPBEANS_STOCK_SHORTAGE_RATE", "1")
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+	tracer.Flush(nil)
+	recorder.ResetPayloads()
+
+	const checkouts = 20
+	checkout := func() []int {
+		statuses := make([]int, checkouts)
+		for i := range statuses {
+			w := serveJSON(r, "POST", "/api/orders", `{"customer_id": 1, "lines": [{"id": 3, "amount": 1}, {"id": 1, "amount": 2}]}`)
+			statuses[i] = w.Code
+			if w.Code == http.StatusConflict {
+				body := decodeErrorEnvelope(t, w.Body.Bytes())
+				assert.Equal(t, apperr.Conflict, body.Code)
+				assert.Equal(t, reasonInsufficientStock, body.Reason)
+				assert.Equal(t, "insufficient stock of product 3", body.Message)
+			}
+		}
+		return statuses
+	}
+	all := func(status int) []int {
+		statuses := make([]int, checkouts)
+		for i := range statuses {
+			statuses[i] = status
+		}
+		return statuses
+	}
+
+	// Every checkout fails, reported as a handled error labeled as
+	// synthetic.
+	assert.Equal(t, all(http.StatusConflict), checkout())
+	tracer.Flush(nil)
+	apmErrors := recorder.Payloads().Errors
+	require.Len(t, apmErrors, checkouts)
+	for _, e := range apmErrors {
+		assert.True(t, e.Exception.Handled)
+		assert.Equal(t, "(*stockShortageInjector).check", e.Culprit)
+		assert.Equal(t, model.IfaceMap{
+			{Key: "kind", Value: "conflict"},
+			{Key: "synthetic", Value: true},
+		}, e.Context.Tags)
+		assert.Equal(t, model.IfaceMap{{Key: "product_id", Value: float64(3)}}, e.Context.Custom)
+	}
+
+	// The rate is reloaded, and no checkout fails once it is zero.
+	t.Setenv("OPBEANS_STOCK_SHORTAGE_RATE", "0")
+	assert.Equal(t, []string{"error_injection.stock_shortage_rate"}, reloadTestConfig(t, r).Reloaded)
+	recorder.ResetPayloads()
+	assert.Equal(t, all(http.StatusOK), checkout())
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Errors)
+}
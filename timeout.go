@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/stacktrace"
+)
+
+// timeoutBufferSize is the size to which responses are buffered by
+// handlerTimeout. Larger responses are sent as they are written, after
+// which a timeout can no longer be reported to the client.
+const timeoutBufferSize = 64 << 10
+
+// handlerTimeout returns a middleware which bounds the time taken by the
+// remaining handlers to timeout. A zero timeout is unlimited.
+//
+// The handlers run in their own goroutine, with a context that is
+// cancelled at the deadline, so that database queries stop. Their
+// responses are buffered until flushed, or until they exceed
+// timeoutBufferSize; if the deadline passes first, the client is sent
+// 503 (Service Unavailable) with the JSON error envelope, with the
+// reason "timeout", and the buffered response is discarded; otherwise
+// the response is truncated. Either way, the middleware returns only
+// once the handlers have, as the gin context cannot be used
+// concurrently. The transaction is labeled timeout=true, and the
+// timeout is reported as a handled error in place of any errors
+// recorded by the handlers, as those are its consequences.
+//
+// Handlers which hijack the connection, such as WebSocket upgrades, must
+// not be bounded by the middleware.
+func handlerTimeout(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+		req := c.Request
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+
+		// The timeout response is prepared up front, as the gin
+		// context cannot be read while the handlers run.
+		body := errorEnvelope(c, http.StatusServiceUnavailable)
+		body.Error.Reason = "timeout"
+		w := newTimeoutWriter(c.Writer)
+		defer w.release()
+		c.Writer = w
+		c.Request = req.WithContext(ctx)
+
+		done := make(chan struct{})
+		var panicked interface{}
+		go func() {
+			defer close(done)
+			defer func() {
+				if v := recover(); v != nil {
+					panicked = newHandlerPanic(v)
+				}
+			}()
+			c.Next()
+		}()
+		var timedOut bool
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// Requests cancelled by the client are not timeouts.
+			if ctx.Err() == context.DeadlineExceeded && req.Context().Err() == nil {
+				timedOut = true
+				w.timeout(body)
+			}
+			<-done
+		}
+
+		c.Writer, c.Request = w.ResponseWriter, req
+		if panicked != nil {
+			// Panics are recovered by the recovery middleware, and
+			// reported with the stacktrace of the handlers.
+			panic(panicked)
+		}
+		w.commit()
+		if !timedOut {
+			return
+		}
+		c.Abort()
+		c.Errors = c.Errors[:0]
+		c.Error(errors.Wrapf(context.DeadlineExceeded, "%s %s timed out after %s", req.Method, c.FullPath(), timeout))
+		tx := apm.TransactionFromContext(req.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("timeout", true)
+		})
+	}
+}
+
+// handlerPanic is a panic recovered from the handlers run by
+// handlerTimeout, to be raised again on the request's goroutine. It
+// carries the stacktrace of the handlers, so that tracer.Recovered
+// reports it with the frames which raised the panic, rather than those
+// of handlerTimeout.
+type handlerPanic struct {
+	value interface{}
+	stack []stacktrace.Frame
+}
+
+// newHandlerPanic returns a handlerPanic for the value v, recovered by
+// the deferred function calling newHandlerPanic.
+func newHandlerPanic(v interface{}) *handlerPanic {
+	// Skip stacktrace.AppendStacktrace, newHandlerPanic, the deferred
+	// function, and runtime.gopanic.
+	return &handlerPanic{value: v, stack: stacktrace.AppendStacktrace(nil, 4, -1)}
+}
+
+func (p *handlerPanic) Error() string {
+	return p.Cause().Error()
+}
+
+// Cause returns the panic value if it is an error, and otherwise an
+// error describing it, as tracer.Recovered would.
+func (p *handlerPanic) Cause() error {
+	if err, ok := p.value.(error); ok {
+		return err
+	}
+	return fmt.Errorf("%v", p.value)
+}
+
+// StackTrace returns the stacktrace of the handlers when they panicked.
+func (p *handlerPanic) StackTrace() []stacktrace.Frame {
+	return p.stack
+}
+
+// timeoutWriter buffers a response for handlerTimeout, so that it can be
+// replaced with a timeout response. Its methods are safe to call
+// concurrently with timeout.
+type timeoutWriter struct {
+	gin.ResponseWriter
+
+	mu          sync.Mutex
+	header      http.Header
+	status      int
+	wroteHeader bool
+	buf         *bytes.Buffer // pooled, until released
+	committed   bool
+	timedOut    bool
+}
+
+func newTimeoutWriter(w gin.ResponseWriter) *timeoutWriter {
+	return &timeoutWriter{
+		ResponseWriter: w,
+		header:         w.Header().Clone(),
+		status:         w.Status(),
+		buf:            getBuffer(),
+	}
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.committed:
+		w.ResponseWriter.WriteHeader(code)
+	case code > 0 && !w.wroteHeader:
+		w.status = code
+	}
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.wroteHeader = true
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.timedOut:
+		return 0, http.ErrHandlerTimeout
+	case w.committed:
+		return w.ResponseWriter.Write(data)
+	}
+	w.wroteHeader = true
+	if w.buf.Len()+len(data) > timeoutBufferSize {
+		w.commitLocked()
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buf.Write(data)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *timeoutWriter) Status() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *timeoutWriter) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.committed:
+		return w.ResponseWriter.Size()
+	case !w.wroteHeader:
+		return -1
+	}
+	return w.buf.Len()
+}
+
+func (w *timeoutWriter) Written() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		return w.ResponseWriter.Written()
+	}
+	return w.wroteHeader
+}
+
+// Flush sends the buffered response, after which the response can no
+// longer be replaced.
+func (w *timeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.commitLocked()
+	w.ResponseWriter.Flush()
+}
+
+// Hijack fails, as the connection cannot be hijacked from a response
+// which may be replaced.
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errors.New("cannot hijack a connection with a handler timeout")
+}
+
+func (w *timeoutWriter) Pusher() http.Pusher {
+	return nil
+}
+
+// commit sends the buffered response, unless it has been replaced.
+func (w *timeoutWriter) commit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.timedOut {
+		w.commitLocked()
+	}
+}
+
+// commitLocked sends the buffered headers, status and body. Headers and
+// body are not sent if nothing was written, so that the error middleware
+// can still render errors.
+func (w *timeoutWriter) commitLocked() {
+	if w.committed {
+		return
+	}
+	w.committed = true
+	header := w.ResponseWriter.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, v := range w.header {
+		header[k] = v
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeaderNow()
+		w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+}
+
+// release returns the buffer to the pool. It must be called once the
+// handlers have returned, and the buffered response has been sent.
+func (w *timeoutWriter) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	putBuffer(w.buf)
+	w.buf = nil
+}
+
+// timeout sends the timeout response with the JSON body, unless the
+// response has already been committed. Subsequent writes by the
+// handlers fail with http.ErrHandlerTimeout.
+func (w *timeoutWriter) timeout(body interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timedOut = true
+	if w.committed {
+		return
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	w.ResponseWriter.Write(data)
+	w.ResponseWriter.Flush()
+}
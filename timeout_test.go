@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+const testHandlerTimeout = 50 * time.Millisecond
+
+// newTestTimeoutRouter returns a router traced by tracer, serving h at
+// "/" with a handler timeout of testHandlerTimeout.
+func newTestTimeoutRouter(tracer *apm.Tracer, h gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.Use(recoveryMiddleware(tracer))
+	r.Use(errorMiddleware(tracer))
+	r.Use(func(c *gin.Context) {
+		c.Header("X-Outer", "kept")
+		c.Next()
+	})
+	r.GET("/", handlerTimeout(testHandlerTimeout), h)
+	return r
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	cancelled := make(chan error, 1)
+	r := newTestTimeoutRouter(tracer, func(c *gin.Context) {
+		<-c.Request.Context().Done()
+		cancelled <- c.Request.Context().Err()
+		c.Header("X-Inner", "discarded")
+		c.Writer.WriteString("too late")
+		abortWithError(c, apperr.Wrap(c.Request.Context().Err(), apperr.DB))
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, context.DeadlineExceeded, <-cancelled)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "kept", w.Header().Get("X-Outer"))
+	assert.Empty(t, w.Header().Get("X-Inner"))
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.Unavailable, body.Code)
+	assert.Equal(t, "timeout", body.Reason)
+	assert.Equal(t, http.StatusText(http.StatusServiceUnavailable), body.Message)
+
+	// The timeout is reported in place of the handler's error.
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "HTTP 5xx", tx.Result)
+	assert.Equal(t, true, transactionLabels(tx)["timeout"])
+	assert.Equal(t, body.TraceID, fmt.Sprintf("%x", tx.TraceID[:]))
+	require.Len(t, payloads.Errors, 1)
+	e := payloads.Errors[0]
+	assert.True(t, e.Exception.Handled)
+	assert.Equal(t, "GET / timed out after 50ms: context deadline exceeded", e.Exception.Message)
+	assert.Equal(t, tx.ID, e.TransactionID)
+}
+
+func TestHandlerTimeoutCompleted(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestTimeoutRouter(tracer, func(c *gin.Context) {
+		c.Header("X-Inner", "sent")
+		c.JSON(http.StatusCreated, gin.H{"ok": true})
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"ok": true}`, w.Body.String())
+	assert.Equal(t, "kept", w.Header().Get("X-Outer"))
+	assert.Equal(t, "sent", w.Header().Get("X-Inner"))
+
+	// The request's own context is restored, so the transaction is not
+	// mistaken for one aborted by the client.
+	tracer.Flush(nil)
+	tx := recorder.Payloads().Transactions[0]
+	assert.Equal(t, "HTTP 2xx", tx.Result)
+	assert.NotContains(t, transactionLabels(tx), "timeout")
+}
+
+func TestHandlerTimeoutErrorRendered(t *testing.T) {
+	r := newTestTimeoutRouter(apm.DefaultTracer, func(c *gin.Context) {
+		abortWithError(c, apperr.New(apperr.NotFound, "no such thing"))
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	body := decodeErrorEnvelope(t, w.Body.Bytes())
+	assert.Equal(t, apperr.NotFound, body.Code)
+	assert.Equal(t, "no such thing", body.Message)
+}
+
+func TestHandlerTimeoutStreamed(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestTimeoutRouter(tracer, func(c *gin.Context) {
+		c.Writer.WriteString("partial")
+		c.Writer.Flush()
+		<-c.Request.Context().Done()
+	})
+
+	// Once flushed, the response can only be truncated.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "partial", w.Body.String())
+	tracer.Flush(nil)
+	tx := recorder.Payloads().Transactions[0]
+	assert.Equal(t, true, transactionLabels(tx)["timeout"])
+	assert.Len(t, recorder.Payloads().Errors, 1)
+}
+
+func TestHandlerTimeoutLargeResponse(t *testing.T) {
+	large := strings.Repeat("x", timeoutBufferSize+1)
+	r := newTestTimeoutRouter(apm.DefaultTracer, func(c *gin.Context) {
+		c.Writer.WriteString("small")
+		c.Writer.WriteString(large)
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "small"+large, w.Body.String())
+}
+
+func TestHandlerTimeoutCancelsQuery(t *testing.T) {
+	db := newTestDB(t)
+	queryErr := make(chan error, 1)
+	r := newTestTimeoutRouter(apm.DefaultTracer, func(c *gin.Context) {
+		var n int
+		queryErr <- db.QueryRowContext(c.Request.Context(), `
+WITH RECURSIVE r(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM r)
+SELECT count(*) FROM r`).Scan(&n)
+	})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Error(t, <-queryErr)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestHandlerTimeoutPanic(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r := newTestTimeoutRouter(tracer, func(c *gin.Context) {
+		panic("boom")
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// The panic is reported with the stacktrace of the handler.
+	tracer.Flush(nil)
+	apmErrors := recorder.Payloads().Errors
+	require.Len(t, apmErrors, 1)
+	e := apmErrors[0]
+	assert.Equal(t, "boom", e.Exception.Message)
+	assert.Equal(t, "TestHandlerTimeoutPanic.func1", e.Culprit)
+	require.NotEmpty(t, e.Exception.Stacktrace)
+	assert.Equal(t, "TestHandlerTimeoutPanic.func1", e.Exception.Stacktrace[0].Function)
+}
+
+func TestHandlerTimeoutServer(t *testing.T) {
+	tracer, _ := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	release := make(chan struct{})
+	r := newTestTimeoutRouter(tracer, func(c *gin.Context) {
+		// The handler ignores the cancellation, but the client is
+		// still sent the timeout response on time.
+		<-release
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	defer close(release)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "timeout", decodeErrorEnvelope(t, respBody).Reason)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// newTLSConfig returns the TLS configuration for serving HTTPS with the
+// certificate and key in certFile and keyFile. If clientCAFile is set,
+// client certificates are requested and, if given, verified against the
+// CA certificates it holds; requireClientCert enforces their presence.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load TLS certificate")
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read TLS client CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in TLS client CA bundle %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// requireClientCert rejects requests with 403 unless their connection
+// presented a client certificate verified against the configured CAs.
+// The certificate's subject is recorded in the gin context, for logging.
+func requireClientCert(c *gin.Context) {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		abortWithStatus(c, http.StatusForbidden)
+		return
+	}
+	contextLogger(c).WithField("client_cert", state.VerifiedChains[0][0].Subject.String()).Debug("verified client certificate")
+	c.Next()
+}
+
+// newRedirectServer returns a server on addr, redirecting all requests
+// to HTTPS on the port of httpsAddr.
+func newRedirectServer(addr, httpsAddr string) *http.Server {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           redirectToHTTPS(port),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+}
+
+// redirectToHTTPS returns a handler which permanently redirects requests
+// to the same host and path over HTTPS, on the given port. The method
+// and body are preserved.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		u := *req.URL
+		u.Scheme, u.Host = "https", host
+		http.Redirect(w, req, u.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// testCertificates holds certificates generated for a test: a CA, a
+// server certificate for 127.0.0.1 and a client certificate signed by
+// the CA, and a self-signed client certificate.
+type testCertificates struct {
+	caFile, certFile, keyFile string
+	ca                        *x509.CertPool
+	client, untrusted         tls.Certificate
+}
+
+func newTestCertificates(t *testing.T) testCertificates {
+	dir := t.TempDir()
+	certs := testCertificates{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "cert.pem"),
+		keyFile:  filepath.Join(dir, "key.pem"),
+		ca:       x509.NewCertPool(),
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "opbeans test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert, caKey := newTestCertificate(t, caTemplate, nil, nil)
+	certs.ca.AddCert(caCert.Leaf)
+	writePEM(t, certs.caFile, "CERTIFICATE", caCert.Certificate[0])
+
+	serverCert, serverKey := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "opbeans"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert.Leaf, caKey)
+	writePEM(t, certs.certFile, "CERTIFICATE", serverCert.Certificate[0])
+	keyDER, err := x509.MarshalECPrivateKey(serverKey)
+	require.NoError(t, err)
+	writePEM(t, certs.keyFile, "EC PRIVATE KEY", keyDER)
+
+	clientUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certs.client, _ = newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "admin"},
+		ExtKeyUsage: clientUsage,
+	}, caCert.Leaf, caKey)
+	certs.untrusted, _ = newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "intruder"},
+		ExtKeyUsage: clientUsage,
+	}, nil, nil)
+	return certs
+}
+
+// newTestCertificate returns a certificate from template, signed by
+// parent, or self-signed if parent is nil, and its private key.
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+}
+
+// startTestTLSServer starts up a server using certs, verifying client
+// certificates if clientCA is true, and returns it with its tracer and
+// recorder.
+func startTestTLSServer(t *testing.T, certs testCertificates, clientCA bool) (*httptest.Server, *apm.Tracer, *transporttest.RecorderTransport) {
+	setTestStartupFlags(t)
+	t.Setenv("OPBEANS_TLS_CERT", certs.certFile)
+	t.Setenv("OPBEANS_TLS_KEY", certs.keyFile)
+	t.Setenv("OPBEANS_ADMIN_PASSWORD", "secret")
+	if clientCA {
+		t.Setenv("OPBEANS_TLS_CLIENT_CA", certs.caFile)
+	}
+	cfg := loadTestConfig(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	t.Cleanup(tracer.Close)
+	r, _, cleanup, err := startup(tracer, cfg, &healthChecker{})
+	require.NoError(t, err)
+	t.Cleanup(cleanup)
+	tlsConfig, err := newTLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey, cfg.Server.TLSClientCA)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(r)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	recorder.ResetPayloads()
+	return server, tracer, recorder
+}
+
+// newTestTLSClient returns a client trusting the CA of certs, which
+// presents clientCert if given, even if the server does not accept its
+// issuer.
+func newTestTLSClient(certs testCertificates, clientCert ...tls.Certificate) *http.Client {
+	config := &tls.Config{RootCAs: certs.ca}
+	if len(clientCert) > 0 {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert[0], nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func getTLS(t *testing.T, client *http.Client, url string, admin bool) int {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if admin {
+		req.SetBasicAuth("admin", "secret")
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTLS(t *testing.T) {
+	certs := newTestCertificates(t)
+	server, tracer, recorder := startTestTLSServer(t, certs, false)
+	client := newTestTLSClient(certs)
+	assert.Equal(t, http.StatusOK, getTLS(t, client, server.URL+"/api/products", false))
+	assert.Equal(t, http.StatusOK, getTLS(t, client, server.URL+"/api/admin/runtime", true))
+
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	require.Len(t, transactions, 2)
+	request := transactions[0].Context.Request
+	assert.Equal(t, "https", request.URL.Protocol)
+	assert.True(t, request.Socket.Encrypted)
+}
+
+func TestMutualTLSAccept(t *testing.T) {
+	certs := newTestCertificates(t)
+	server, _, _ := startTestTLSServer(t, certs, true)
+	client := newTestTLSClient(certs, certs.client)
+	assert.Equal(t, http.StatusOK, getTLS(t, client, server.URL+"/api/admin/runtime", true))
+	assert.Equal(t, http.StatusOK, getTLS(t, client, server.URL+"/api/products", false))
+}
+
+func TestMutualTLSReject(t *testing.T) {
+	certs := newTestCertificates(t)
+	server, _, _ := startTestTLSServer(t, certs, true)
+
+	// Client certificates are only required for the admin routes.
+	client := newTestTLSClient(certs)
+	assert.Equal(t, http.StatusForbidden, getTLS(t, client, server.URL+"/api/admin/runtime", true))
+	assert.Equal(t, http.StatusOK, getTLS(t, client, server.URL+"/api/products", false))
+
+	// Certificates which cannot be verified fail the handshake.
+	client = newTestTLSClient(certs, certs.untrusted)
+	_, err := client.Get(server.URL + "/api/products")
+	assert.Error(t, err)
+}
+
+func TestNewTLSConfigInvalidClientCA(t *testing.T) {
+	certs := newTestCertificates(t)
+	_, err := newTLSConfig(certs.certFile, certs.keyFile, certs.keyFile)
+	assert.EqualError(t, err, "no certificates found in TLS client CA bundle "+certs.keyFile)
+	_, err = newTLSConfig(certs.certFile, certs.keyFile, filepath.Join(t.TempDir(), "missing.pem"))
+	assert.Error(t, err)
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for port, expect := range map[string]string{
+		"8443": "https://example.com:8443/api/orders?limit=5",
+		"443":  "https://example.com/api/orders?limit=5",
+	} {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(port).ServeHTTP(w, httptest.NewRequest("POST", "http://example.com:8080/api/orders?limit=5", nil))
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		assert.Equal(t, expect, w.Header().Get("Location"))
+	}
+	srv := newRedirectServer(":8080", ":8443")
+	assert.Equal(t, ":8080", srv.Addr)
+}
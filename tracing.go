@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+	"go.elastic.co/apm/stacktrace"
+)
+
+// w3cTraceparentHeader is the W3C Trace-Context traceparent header.
+// It takes precedence over apmhttp.TraceparentHeader, which is still
+// sent by older agents.
+const w3cTraceparentHeader = "Traceparent"
+
+func init() {
+	stacktrace.RegisterLibraryPackage(
+		"github.com/gin-gonic",
+		"github.com/gin-contrib",
+	)
+}
+
+// Transaction types for the routes traced by tracingMiddleware.
+const (
+	transactionTypeRequest   = "request"
+	transactionTypeStreaming = "request.streaming"
+	transactionTypeWebSocket = "request.websocket"
+)
+
+// routeOptions holds tracing options for a route.
+type routeOptions struct {
+	// transactionType overrides the transaction type, which
+	// defaults to transactionTypeRequest.
+	transactionType string
+
+	// endOnFirstByte ends the transaction when the first byte of the
+	// response body is written, rather than when the handler returns.
+	// This is intended for streaming responses, which may remain open
+	// indefinitely. Once the transaction has ended, nothing further is
+	// recorded for the request; handlers must not modify the
+	// transaction's fields.
+	endOnFirstByte bool
+
+	// captureBody, if non-nil, overrides the tracer's configured
+	// request body capture mode for the route.
+	captureBody *apm.CaptureBodyMode
+}
+
+// tracingOptions holds options for tracingMiddleware.
+type tracingOptions struct {
+	// routes holds the tracing options for each route, and may be nil.
+	routes routeOptionsMap
+
+	// headers, if non-nil, captures the request and response headers
+	// of sampled transactions.
+	headers *headerCapture
+
+	// ignoreForwardedHeaders ignores proxy forwarding headers when
+	// recording the request URL and client address, for deployments
+	// which are not behind a trusted proxy. See forwardingHeaders.
+	ignoreForwardedHeaders bool
+
+	// ignore, if non-nil, reports whether a request should not be
+	// traced, in addition to those matching $ELASTIC_APM_IGNORE_URLS.
+	ignore apmhttp.RequestIgnorerFunc
+}
+
+// routeOptionsMap maps "<method> <route pattern>" to the tracing
+// options for the route. The map must not be modified once the
+// server has started.
+type routeOptionsMap map[string]routeOptions
+
+// handle registers handlers for the given method and path in group,
+// traced according to opts.
+func (m routeOptionsMap) handle(group *gin.RouterGroup, method, relativePath string, opts routeOptions, handlers ...gin.HandlerFunc) tracedRoute {
+	group.Handle(method, relativePath, handlers...)
+	key := method + " " + joinRoutePaths(group.BasePath(), relativePath)
+	m[key] = opts
+	return tracedRoute{routes: m, key: key}
+}
+
+// group returns a tracedGroup which registers routes in group,
+// recording their tracing options in m.
+func (m routeOptionsMap) group(group *gin.RouterGroup) tracedGroup {
+	return tracedGroup{RouterGroup: group, routes: m}
+}
+
+// tracedGroup wraps a gin.RouterGroup, registering routes with
+// tracing options which may be overridden through the returned
+// tracedRoute.
+type tracedGroup struct {
+	*gin.RouterGroup
+	routes routeOptionsMap
+}
+
+// GET registers handlers for GET requests to relativePath.
+func (g tracedGroup) GET(relativePath string, handlers ...gin.HandlerFunc) tracedRoute {
+	return g.routes.handle(g.RouterGroup, "GET", relativePath, routeOptions{}, handlers...)
+}
+
+// POST registers handlers for POST requests to relativePath.
+func (g tracedGroup) POST(relativePath string, handlers ...gin.HandlerFunc) tracedRoute {
+	return g.routes.handle(g.RouterGroup, "POST", relativePath, routeOptions{}, handlers...)
+}
+
+// PUT registers handlers for PUT requests to relativePath.
+func (g tracedGroup) PUT(relativePath string, handlers ...gin.HandlerFunc) tracedRoute {
+	return g.routes.handle(g.RouterGroup, "PUT", relativePath, routeOptions{}, handlers...)
+}
+
+// tracedRoute identifies a route registered through routeOptionsMap,
+// for overriding its tracing options.
+type tracedRoute struct {
+	routes routeOptionsMap
+	key    string
+}
+
+// CaptureBody overrides the request body capture mode for the route,
+// regardless of $ELASTIC_APM_CAPTURE_BODY.
+func (r tracedRoute) CaptureBody(mode apm.CaptureBodyMode) tracedRoute {
+	opts := r.routes[r.key]
+	opts.captureBody = &mode
+	r.routes[r.key] = opts
+	return r
+}
+
+// joinRoutePaths joins paths in the same manner as gin does when
+// computing the full path of a route.
+func joinRoutePaths(absolutePath, relativePath string) string {
+	if relativePath == "" {
+		return absolutePath
+	}
+	joined := path.Join(absolutePath, relativePath)
+	if strings.HasSuffix(relativePath, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// tracingMiddleware returns a middleware which traces requests with
+// tracer, continuing traces from the inbound W3C traceparent header or,
+// failing that, the Elastic-Apm-Traceparent header. A malformed header
+// starts a new trace. The tracestate header is not propagated, as the
+// agent has no means of carrying it.
+//
+// Transactions are named after the matched route pattern, and traced
+// according to the route's options in opts.routes, including any
+// override of the request body capture mode.
+//
+// Panics are reported by recoveryMiddleware, which must be installed
+// after this middleware; this middleware only ensures that the
+// transaction of a panicking request records a 500 result.
+func tracingMiddleware(tracer *apm.Tracer, opts tracingOptions) gin.HandlerFunc {
+	requestIgnorer := apmhttp.DefaultServerRequestIgnorer()
+	return func(c *gin.Context) {
+		if !tracer.Active() || requestIgnorer(c.Request) || (opts.ignore != nil && opts.ignore(c.Request)) {
+			c.Next()
+			return
+		}
+
+		name := c.Request.Method
+		if route := c.FullPath(); route != "" {
+			name += " " + route
+		}
+		routeOpts := opts.routes[name]
+		transactionType := routeOpts.transactionType
+		if transactionType == "" {
+			transactionType = transactionTypeRequest
+		}
+		tx := tracer.StartTransactionOptions(name, transactionType, apm.TransactionOptions{
+			TraceContext: requestTraceContext(c.Request.Header),
+		})
+		ctx := apm.ContextWithTransaction(c.Request.Context(), tx)
+		c.Request = apmhttp.RequestWithContext(ctx, c.Request)
+		if opts.ignoreForwardedHeaders {
+			c.Set(ignoreForwardedHeadersKey, true)
+		}
+
+		var body *apm.BodyCapturer
+		if routeOpts.captureBody != nil {
+			body = tracer.CaptureHTTPRequestBodyMode(c.Request, *routeOpts.captureBody)
+		} else {
+			body = tracer.CaptureHTTPRequestBody(c.Request)
+		}
+		var ended bool
+		endTransaction := func() {
+			if ended {
+				return
+			}
+			ended = true
+			c.Writer.WriteHeaderNow()
+			// The request's context is also canceled when the body's
+			// read deadline expires, but the client is then told so.
+			clientAborted := c.Request.Context().Err() == context.Canceled &&
+				c.Writer.Status() != http.StatusRequestTimeout
+			result, outcome := transactionOutcome(c.Writer.Status(), clientAborted)
+			tx.Result = result
+			ifSampled(tx, func() {
+				setTracingContext(&tx.Context, c, body)
+				tx.Context.SetTag("outcome", outcome)
+				if opts.headers != nil {
+					opts.headers.setCustomContext(&tx.Context, c.Request.Header, c.Writer.Header())
+				}
+			})
+			tx.End()
+		}
+		if routeOpts.endOnFirstByte {
+			c.Writer = &firstByteWriter{ResponseWriter: c.Writer, onFirstByte: endTransaction}
+		}
+		defer func() {
+			if v := recover(); v != nil {
+				if !c.Writer.Written() {
+					abortWithStatus(c, http.StatusInternalServerError)
+				} else {
+					c.Abort()
+				}
+				e := tracer.Recovered(v)
+				e.SetTransaction(tx)
+				if !ended {
+					setTracingContext(&e.Context, c, body)
+				}
+				e.Send()
+			}
+			endTransaction()
+		}()
+		c.Next()
+	}
+}
+
+// unknownRouteHandler returns a handler for requests matching no route,
+// or no method of a route, which responds with status and the JSON error
+// envelope. The request's transaction is named after the method and the
+// given name rather than the path, so that scanners probing random paths
+// do not create a transaction name per path; the path is recorded as the
+// "path" label instead.
+func unknownRouteHandler(name string, status int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tx := apm.TransactionFromContext(c.Request.Context())
+		if tx != nil {
+			tx.Name = c.Request.Method + " " + name
+		}
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("path", c.Request.URL.Path)
+		})
+		abortWithStatus(c, status)
+	}
+}
+
+// traceIDMiddleware sets the X-Trace-Id response header to the trace ID
+// of the request's transaction, so that users reporting problems can
+// refer us to the exact trace. The header is omitted for requests which
+// are not traced. The middleware must be installed after
+// tracingMiddleware.
+func traceIDMiddleware(c *gin.Context) {
+	tx := apm.TransactionFromContext(c.Request.Context())
+	if traceContext := tx.TraceContext(); traceContext.Trace.Validate() == nil {
+		c.Header("X-Trace-Id", traceContext.Trace.String())
+	}
+	c.Next()
+}
+
+// firstByteWriter is a gin.ResponseWriter which calls onFirstByte
+// before the first byte of the response body is written.
+type firstByteWriter struct {
+	gin.ResponseWriter
+	onFirstByte func()
+}
+
+func (w *firstByteWriter) Write(data []byte) (int, error) {
+	w.firstByte(len(data))
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *firstByteWriter) WriteString(s string) (int, error) {
+	w.firstByte(len(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *firstByteWriter) firstByte(n int) {
+	if n > 0 && w.onFirstByte != nil {
+		w.onFirstByte()
+		w.onFirstByte = nil
+	}
+}
+
+// requestTraceContext returns the trace context to continue from the
+// request headers h, or the zero value if a new trace should be started.
+func requestTraceContext(h http.Header) apm.TraceContext {
+	for _, name := range []string{w3cTraceparentHeader, apmhttp.TraceparentHeader} {
+		values := h[name]
+		if len(values) == 0 {
+			continue
+		}
+		if len(values) == 1 {
+			if traceContext, ok := parseTraceparent(values[0]); ok {
+				return traceContext
+			}
+		}
+		break
+	}
+	return apm.TraceContext{}
+}
+
+// parseTraceparent parses a traceparent header value, reporting whether
+// it is valid. In addition to the checks made by
+// apmhttp.ParseTraceparentHeader, the value must be lower-case and the
+// trace and parent IDs must be non-zero.
+func parseTraceparent(h string) (apm.TraceContext, bool) {
+	if strings.ToLower(h) != h {
+		return apm.TraceContext{}, false
+	}
+	traceContext, err := apmhttp.ParseTraceparentHeader(h)
+	if err != nil || traceContext.Trace.Validate() != nil || traceContext.Span.Validate() != nil {
+		return apm.TraceContext{}, false
+	}
+	return traceContext, true
+}
+
+func setTracingContext(ctx *apm.Context, c *gin.Context, body *apm.BodyCapturer) {
+	ctx.SetFramework("gin", gin.Version)
+	ctx.SetHTTPRequest(contextRequest(c))
+	setContextUser(ctx, c)
+	ctx.SetHTTPRequestBody(body)
+	ctx.SetHTTPStatusCode(c.Writer.Status())
+	ctx.SetHTTPResponseHeaders(c.Writer.Header())
+}
+
+// setContextUser records the user authenticated by adminAuth, jwtAuth or
+// apiKeyAuth, if any, in ctx. It must be called after
+// ctx.SetHTTPRequest, which records the basic authentication username
+// whether or not it was verified.
+func setContextUser(ctx *apm.Context, c *gin.Context) {
+	ctx.SetUsername(c.GetString(authenticatedUsernameKey))
+	if claims := authenticatedCustomer(c); claims != nil {
+		ctx.SetUserID(strconv.Itoa(claims.CustomerID))
+		ctx.SetUserEmail(claims.Email)
+	}
+	if name := authenticatedAPIClient(c); name != "" {
+		ctx.SetUserID(name)
+	}
+}
+
+// ifSampled calls f if tx is sampled. Context recorded on unsampled
+// transactions is discarded, so anything more than trivial context
+// assembly should be guarded with ifSampled.
+func ifSampled(tx *apm.Transaction, f func()) {
+	if tx.Sampled() {
+		f()
+	}
+}
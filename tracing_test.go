@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/apperr"
+)
+
+func TestTracingMiddlewareTraceContext(t *testing.T) {
+	const (
+		w3cTraceparent     = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+		elasticTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	)
+	type expectation struct {
+		traceID  string
+		parentID string
+	}
+	w3c := expectation{"0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"}
+	elastic := expectation{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"}
+
+	for name, test := range map[string]struct {
+		headers map[string]string
+		expect  *expectation
+	}{
+		"w3c": {
+			headers: map[string]string{"Traceparent": w3cTraceparent, "Tracestate": "es=s:1"},
+			expect:  &w3c,
+		},
+		"elastic": {
+			headers: map[string]string{"Elastic-Apm-Traceparent": elasticTraceparent},
+			expect:  &elastic,
+		},
+		"both": {
+			headers: map[string]string{"Traceparent": w3cTraceparent, "Elastic-Apm-Traceparent": elasticTraceparent},
+			expect:  &w3c,
+		},
+		"none":          {},
+		"malformed":     {headers: map[string]string{"Traceparent": "00-0af7651916cd43dd-b7ad6b7169203331-01"}},
+		"version_ff":    {headers: map[string]string{"Traceparent": "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+		"invalid_flags": {headers: map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-zz"}},
+		"upper_case":    {headers: map[string]string{"Traceparent": "00-0AF7651916CD43DD8448EB211C80319C-B7AD6B7169203331-01"}},
+		"zero_trace_id": {headers: map[string]string{"Traceparent": "00-00000000000000000000000000000000-b7ad6b7169203331-01"}},
+		"malformed_w3c_and_elastic": {
+			headers: map[string]string{"Traceparent": "garbage", "Elastic-Apm-Traceparent": elasticTraceparent},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(tracingMiddleware(tracer, tracingOptions{}))
+			r.GET("/products/:id", func(c *gin.Context) {})
+
+			req := httptest.NewRequest("GET", "/products/1", nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			tracer.Flush(nil)
+
+			assert.Equal(t, 200, w.Code)
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Transactions, 1)
+			tx := payloads.Transactions[0]
+			assert.Equal(t, "GET /products/:id", tx.Name)
+			assert.Equal(t, "HTTP 2xx", tx.Result)
+			if test.expect != nil {
+				assert.Equal(t, test.expect.traceID, fmt.Sprintf("%x", tx.TraceID[:]))
+				assert.Equal(t, test.expect.parentID, fmt.Sprintf("%x", tx.ParentID[:]))
+			} else {
+				assert.NotEqual(t, w3c.traceID, fmt.Sprintf("%x", tx.TraceID[:]))
+				assert.NotEqual(t, elastic.traceID, fmt.Sprintf("%x", tx.TraceID[:]))
+				assert.Zero(t, tx.ParentID)
+			}
+		})
+	}
+}
+
+func TestTracingMiddlewarePanic(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(tracingMiddleware(tracer, tracingOptions{}))
+	r.GET("/", func(c *gin.Context) { panic("boom") })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	tracer.Flush(nil)
+
+	assert.Equal(t, 500, w.Code)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	require.Len(t, payloads.Errors, 1)
+	assert.Equal(t, "HTTP 5xx", payloads.Transactions[0].Result)
+	assert.Equal(t, &model.Framework{Name: "gin", Version: gin.Version}, payloads.Transactions[0].Context.Service.Framework)
+}
+
+func TestTracingMiddlewareRouteOptions(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	routes := make(routeOptionsMap)
+	r.Use(tracingMiddleware(tracer, tracingOptions{routes: routes}))
+	api := r.Group("/api")
+	api.GET("/products", func(c *gin.Context) {})
+
+	written := make(chan struct{})
+	release := make(chan struct{})
+	routes.handle(api, "GET", "/events", routeOptions{
+		transactionType: transactionTypeStreaming,
+		endOnFirstByte:  true,
+	}, func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.String(200, "data: hello\n\n")
+		c.Writer.Flush()
+		close(written)
+		<-release
+		c.String(200, "data: goodbye\n\n")
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/products", nil))
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "request", payloads.Transactions[0].Type)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/events", nil))
+	}()
+
+	// The streaming transaction must be recorded while the
+	// handler is still running.
+	<-written
+	tracer.Flush(nil)
+	payloads = recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	tx := payloads.Transactions[1]
+	assert.Equal(t, "GET /api/events", tx.Name)
+	assert.Equal(t, "request.streaming", tx.Type)
+	assert.Equal(t, "HTTP 2xx", tx.Result)
+	close(release)
+	<-done
+
+	tracer.Flush(nil)
+	assert.Len(t, recorder.Payloads().Transactions, 2)
+	assert.Equal(t, "data: hello\n\ndata: goodbye\n\n", w.Body.String())
+}
+
+func TestTracingMiddlewareCaptureBody(t *testing.T) {
+	for _, env := range []string{"off", "all"} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv("ELASTIC_APM_CAPTURE_BODY", env)
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			routes := make(routeOptionsMap)
+			r.Use(tracingMiddleware(tracer, tracingOptions{routes: routes}))
+			handler := func(c *gin.Context) {
+				ioutil.ReadAll(c.Request.Body)
+			}
+			api := routes.group(r.Group("/api"))
+			api.POST("/default", handler)
+			api.POST("/orders", handler).CaptureBody(apm.CaptureBodyTransactions)
+			api.POST("/login", handler).CaptureBody(apm.CaptureBodyOff)
+
+			bodies := make(map[string]*model.RequestBody)
+			for _, path := range []string{"/api/default", "/api/orders", "/api/login"} {
+				req := httptest.NewRequest("POST", path, strings.NewReader("secret"))
+				req.Header.Set("Content-Type", "text/plain")
+				r.ServeHTTP(httptest.NewRecorder(), req)
+				tracer.Flush(nil)
+				payloads := recorder.Payloads()
+				tx := payloads.Transactions[len(payloads.Transactions)-1]
+				bodies[path] = tx.Context.Request.Body
+			}
+
+			if env == "all" {
+				assert.Equal(t, &model.RequestBody{Raw: "secret"}, bodies["/api/default"])
+			} else {
+				assert.Nil(t, bodies["/api/default"])
+			}
+			assert.Equal(t, &model.RequestBody{Raw: "secret"}, bodies["/api/orders"])
+			assert.Nil(t, bodies["/api/login"])
+		})
+	}
+}
+
+func TestTraceIDMiddleware(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/untraced", traceIDMiddleware, func(c *gin.Context) {})
+	traced := r.Group("/", tracingMiddleware(tracer, tracingOptions{}), traceIDMiddleware)
+	traced.GET("/traced", func(c *gin.Context) {})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/traced", nil))
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, fmt.Sprintf("%x", payloads.Transactions[0].TraceID[:]), w.Header().Get("X-Trace-Id"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/untraced", nil))
+	assert.NotContains(t, w.Header(), "X-Trace-Id")
+}
+
+func TestTracingMiddlewareSanitizesRequest(t *testing.T) {
+	for name, test := range map[string]struct {
+		target  string
+		cookies []*http.Cookie
+		search  string
+		expect  model.Cookies
+	}{
+		"url": {
+			target: "/?q=shoes&token=abc&api_key=def",
+			search: "q=shoes&token=[REDACTED]&api_key=[REDACTED]",
+		},
+		"cookie": {
+			target:  "/",
+			cookies: []*http.Cookie{{Name: "sessionid", Value: "abc"}, {Name: "theme", Value: "dark"}},
+			expect:  model.Cookies{{Name: "sessionid", Value: "[REDACTED]"}, {Name: "theme", Value: "dark"}},
+		},
+		"combined": {
+			target:  "/?password=hunter2&page=2",
+			cookies: []*http.Cookie{{Name: "auth_token", Value: "abc"}},
+			search:  "password=[REDACTED]&page=2",
+			expect:  model.Cookies{{Name: "auth_token", Value: "[REDACTED]"}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tracer, recorder := transporttest.NewRecorderTracer()
+			defer tracer.Close()
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.Use(tracingMiddleware(tracer, tracingOptions{}))
+			r.GET("/", func(c *gin.Context) {})
+
+			req := httptest.NewRequest("GET", test.target, nil)
+			for _, c := range test.cookies {
+				req.AddCookie(c)
+			}
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			tracer.Flush(nil)
+
+			payloads := recorder.Payloads()
+			require.Len(t, payloads.Transactions, 1)
+			request := payloads.Transactions[0].Context.Request
+			assert.Equal(t, test.search, request.URL.Search)
+			expectFull := "http://example.com/"
+			if test.search != "" {
+				expectFull += "?" + test.search
+			}
+			assert.Equal(t, expectFull, request.URL.Full)
+			assert.Equal(t, test.expect, request.Cookies)
+		})
+	}
+}
+
+func TestUnknownRouteTransactionName(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), &healthChecker{})
+	require.NoError(t, err)
+	defer cleanup()
+
+	for _, test := range []struct {
+		method string
+		paths  []string
+		status int
+		name   string
+	}{{
+		method: "GET",
+		paths:  []string{"/wp-login.php", "/.env", "/cgi-bin/test.cgi", "/api/v2/orders", "/api/orders/1/nonexistent"},
+		status: http.StatusNotFound,
+		name:   "GET unknown route",
+	}, {
+		method: "POST",
+		paths:  []string{"/api/stats", "/api/about", "/api/customers/1"},
+		status: http.StatusMethodNotAllowed,
+		name:   "POST method not allowed",
+	}} {
+		recorder.ResetPayloads()
+		for _, path := range test.paths {
+			w := serveJSON(r, test.method, path, "{}")
+			assert.Equal(t, test.status, w.Code, path)
+			body := decodeErrorEnvelope(t, w.Body.Bytes())
+			assert.Equal(t, apperr.KindForStatus(test.status), body.Code, path)
+		}
+
+		// The transactions share one name, and record the path as a
+		// label.
+		tracer.Flush(nil)
+		transactions := recorder.Payloads().Transactions
+		require.Len(t, transactions, len(test.paths))
+		for i, tx := range transactions {
+			assert.Equal(t, test.name, tx.Name)
+			assert.Equal(t, test.paths[i], transactionLabels(tx)["path"])
+		}
+	}
+}
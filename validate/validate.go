@@ -0,0 +1,182 @@
+// Package validate validates input against rules, collecting an error
+// for each invalid field.
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error codes of the rules provided by this package.
+const (
+	CodeRequired = "required"
+	CodeRange    = "range"
+	CodeLength   = "length"
+	CodeEnum     = "enum"
+)
+
+// FieldError describes why the value of a field is invalid.
+type FieldError struct {
+	// Field holds the name of the field, as given by the client.
+	Field string `json:"field"`
+
+	// Code identifies the rule which the value failed, for clients.
+	Code string `json:"code"`
+
+	// Message describes the failure, for people.
+	Message string `json:"message"`
+}
+
+// Errors is an error holding the field errors found by a Validator,
+// in the order in which the fields were checked.
+type Errors []FieldError
+
+// Error returns the messages of the field errors, joined by "; ".
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Rule checks a value, returning the error code and a message
+// describing the failure if it is invalid, or "" if it is valid. The
+// message is prefixed with the field name by Validator.Check.
+type Rule func(value interface{}) (code, message string)
+
+// Required returns a Rule requiring a non-zero value. Strings must have
+// non-space characters, and slices and maps must be non-empty.
+func Required() Rule {
+	return func(value interface{}) (string, string) {
+		v := reflect.ValueOf(value)
+		var missing bool
+		switch v.Kind() {
+		case reflect.Invalid:
+			missing = true
+		case reflect.String:
+			missing = strings.TrimSpace(v.String()) == ""
+		case reflect.Slice, reflect.Map:
+			missing = v.Len() == 0
+		default:
+			missing = v.IsZero()
+		}
+		if missing {
+			return CodeRequired, "is required"
+		}
+		return "", ""
+	}
+}
+
+// Range returns a Rule requiring an integer between min and max,
+// inclusive.
+func Range(min, max int64) Rule {
+	return func(value interface{}) (string, string) {
+		v := reflect.ValueOf(value)
+		var n int64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = v.Int()
+		default:
+			return CodeRange, "must be an integer"
+		}
+		if n < min || n > max {
+			return CodeRange, fmt.Sprintf("must be between %d and %d", min, max)
+		}
+		return "", ""
+	}
+}
+
+// Length returns a Rule requiring a string of between min and max
+// characters, or a slice of between min and max elements, inclusive.
+func Length(min, max int) Rule {
+	return func(value interface{}) (string, string) {
+		v := reflect.ValueOf(value)
+		var n int
+		unit := "characters long"
+		switch v.Kind() {
+		case reflect.String:
+			n = utf8.RuneCountInString(v.String())
+		case reflect.Slice:
+			n = v.Len()
+			unit = "elements"
+		default:
+			return CodeLength, "must be a string or list"
+		}
+		if n < min || n > max {
+			return CodeLength, fmt.Sprintf("must be between %d and %d %s", min, max, unit)
+		}
+		return "", ""
+	}
+}
+
+// OneOf returns a Rule requiring a string equal to one of values.
+func OneOf(values ...string) Rule {
+	return func(value interface{}) (string, string) {
+		s, _ := value.(string)
+		for _, v := range values {
+			if s == v {
+				return "", ""
+			}
+		}
+		return CodeEnum, "must be one of " + strings.Join(values, ", ")
+	}
+}
+
+// Func returns a Rule failing with code and message if valid returns
+// false, for checks not covered by the other rules.
+func Func(code, message string, valid func(value interface{}) bool) Rule {
+	return func(value interface{}) (string, string) {
+		if !valid(value) {
+			return code, message
+		}
+		return "", ""
+	}
+}
+
+// Validator checks fields against rules, collecting their errors. The
+// zero value is ready to use.
+type Validator struct {
+	errs   Errors
+	failed map[string]bool
+}
+
+// Check checks value against rules, in order, recording an error for
+// the first rule it fails. Fields which have already failed a check are
+// not checked again.
+func (v *Validator) Check(field string, value interface{}, rules ...Rule) {
+	if v.failed[field] {
+		return
+	}
+	for _, rule := range rules {
+		if code, message := rule(value); code != "" {
+			v.Add(field, code, field+" "+message)
+			return
+		}
+	}
+}
+
+// Add records an error for field, for checks made outside of rules,
+// such as those requiring a database lookup.
+func (v *Validator) Add(field, code, message string) {
+	if v.failed == nil {
+		v.failed = make(map[string]bool)
+	}
+	v.failed[field] = true
+	v.errs = append(v.errs, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Valid reports whether no errors have been recorded for field.
+func (v *Validator) Valid(field string) bool {
+	return !v.failed[field]
+}
+
+// Err returns the errors recorded, or nil if there are none.
+func (v *Validator) Err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
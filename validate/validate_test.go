@@ -0,0 +1,74 @@
+package validate_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/opbeans-go/validate"
+)
+
+func TestRules(t *testing.T) {
+	isUpper := validate.Func("case", "must be upper case", func(value interface{}) bool {
+		s := value.(string)
+		return strings.ToUpper(s) == s
+	})
+	for name, test := range map[string]struct {
+		value interface{}
+		rule  validate.Rule
+		code  string
+		msg   string
+	}{
+		"required_string":      {value: "x", rule: validate.Required()},
+		"required_blank":       {value: " ", rule: validate.Required(), code: "required", msg: "is required"},
+		"required_zero":        {value: 0, rule: validate.Required(), code: "required", msg: "is required"},
+		"required_nil":         {value: nil, rule: validate.Required(), code: "required", msg: "is required"},
+		"required_empty_slice": {value: []int{}, rule: validate.Required(), code: "required", msg: "is required"},
+		"range":                {value: 5, rule: validate.Range(0, 5)},
+		"range_below":          {value: -1, rule: validate.Range(0, 5), code: "range", msg: "must be between 0 and 5"},
+		"range_above":          {value: int64(6), rule: validate.Range(0, 5), code: "range", msg: "must be between 0 and 5"},
+		"range_not_integer":    {value: "5", rule: validate.Range(0, 5), code: "range", msg: "must be an integer"},
+		"length":               {value: "ééé", rule: validate.Length(1, 3)},
+		"length_too_long":      {value: "abcd", rule: validate.Length(1, 3), code: "length", msg: "must be between 1 and 3 characters long"},
+		"length_slice":         {value: []int{1, 2}, rule: validate.Length(1, 1), code: "length", msg: "must be between 1 and 1 elements"},
+		"length_not_string":    {value: 1, rule: validate.Length(1, 3), code: "length", msg: "must be a string or list"},
+		"enum":                 {value: "b", rule: validate.OneOf("a", "b")},
+		"enum_invalid":         {value: "c", rule: validate.OneOf("a", "b"), code: "enum", msg: "must be one of a, b"},
+		"func":                 {value: "ABC", rule: isUpper},
+		"func_invalid":         {value: "abc", rule: isUpper, code: "case", msg: "must be upper case"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			code, msg := test.rule(test.value)
+			assert.Equal(t, test.code, code)
+			assert.Equal(t, test.msg, msg)
+		})
+	}
+}
+
+func TestValidator(t *testing.T) {
+	var v validate.Validator
+	v.Check("name", "", validate.Required(), validate.Length(1, 10))
+	v.Check("stock", 3, validate.Range(0, 10))
+	v.Check("price", -1, validate.Range(0, 10))
+	v.Check("name", "again", validate.Required())
+	assert.True(t, v.Valid("stock"))
+	assert.False(t, v.Valid("name"))
+	v.Add("type_id", "not_found", "type_id must refer to an existing type")
+
+	err := v.Err()
+	require.Error(t, err)
+	assert.Equal(t, validate.Errors{
+		{Field: "name", Code: "required", Message: "name is required"},
+		{Field: "price", Code: "range", Message: "price must be between 0 and 10"},
+		{Field: "type_id", Code: "not_found", Message: "type_id must refer to an existing type"},
+	}, err)
+	assert.EqualError(t, err, "name is required; price must be between 0 and 10; type_id must refer to an existing type")
+}
+
+func TestValidatorValid(t *testing.T) {
+	var v validate.Validator
+	v.Check("name", "ok", validate.Required())
+	assert.NoError(t, v.Err())
+}
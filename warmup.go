@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/config"
+	"github.com/elastic/opbeans-go/httpclient"
+)
+
+// warmer warms the server up after startup, so that the latency of the
+// first requests, which fill connection pools and caches, is not
+// recorded in the traces of real requests.
+type warmer struct {
+	tracer   *apm.Tracer
+	db       *sqlx.DB
+	cache    persistence.CacheStore
+	settings *runtimeSettings
+
+	// url is the base URL of the server's listener, to which a request
+	// is sent through client. If empty, no request is sent.
+	url    string
+	client *http.Client
+}
+
+// newWarmer returns a warmer for the server configured by cfg.
+func newWarmer(tracer *apm.Tracer, db *sqlx.DB, cache persistence.CacheStore, settings *runtimeSettings, cfg config.Server) *warmer {
+	return &warmer{
+		tracer:   tracer,
+		db:       db,
+		cache:    cache,
+		settings: settings,
+		url:      listenerURL(cfg),
+		client:   httpclient.LocalClient(),
+	}
+}
+
+// listenerURL returns the base URL of the listener configured by cfg,
+// addressed through localhost if it listens on all addresses.
+func listenerURL(cfg config.Server) string {
+	host, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// run warms the server up in a "task" transaction, with a span for each
+// step. The steps are independent, so each is run even if others fail;
+// failures are logged and reported, but otherwise ignored, as the server
+// can serve requests regardless.
+func (w *warmer) run(ctx context.Context) {
+	tx := w.tracer.StartTransaction("warm up", "task")
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	tx.Result = "success"
+	for _, step := range []struct {
+		name string
+		f    func(ctx context.Context) error
+	}{
+		{"prime stats cache", w.primeStatsCache},
+		{"query products", func(ctx context.Context) error {
+			_, err := getProducts(ctx, w.db)
+			return err
+		}},
+		{"query customers", func(ctx context.Context) error {
+			_, err := getCustomer(ctx, w.db, 1)
+			return err
+		}},
+		{"query orders", func(ctx context.Context) error {
+			_, err := getOrders(ctx, w.db)
+			return err
+		}},
+		{"self-request", w.selfRequest},
+	} {
+		span, ctx := apm.StartSpan(ctx, step.name, "app.warmup")
+		if err := step.f(ctx); err != nil {
+			tx.Result = "failure"
+			err = errors.Wrapf(err, "warm-up step %q failed", step.name)
+			logrus.WithError(err).Warn("failed to warm up")
+			if e := apm.CaptureError(ctx, err); e != nil {
+				e.Send()
+			}
+		}
+		span.End()
+	}
+}
+
+// primeStatsCache caches the stats, as served by the stats API.
+func (w *warmer) primeStatsCache(ctx context.Context) error {
+	stats, err := getStats(ctx, w.db)
+	if err != nil {
+		return errors.Wrap(err, "failed to query stats")
+	}
+	return cacheSet(ctx, w.cache, statsCacheKey, stats, w.settings.cacheTTL())
+}
+
+// selfRequest requests the frontend through the server's listener, so
+// that the request is handled by the full middleware chain.
+func (w *warmer) selfRequest(ctx context.Context) error {
+	if w.url == "" {
+		return nil
+	}
+	req, err := http.NewRequest("GET", w.url+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// warmUp warms the server up with the warmer set by setWarmer, if any,
+// and then marks the server as serving. The server is reported as
+// warming up in the meantime. If the warm-up does not complete within
+// timeout, or ctx is cancelled, the server is marked as serving without
+// waiting for it, with a warning. A zero timeout skips the warm-up.
+func (h *healthChecker) warmUp(ctx context.Context, timeout time.Duration) {
+	h.mu.Lock()
+	w := h.warmer
+	h.mu.Unlock()
+	if w == nil || timeout <= 0 || !atomic.CompareAndSwapInt32(&h.state, healthStarting, healthWarmingUp) {
+		h.serving()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("warm-up did not complete within %s, serving anyway", timeout)
+	}
+	h.serving()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+
+	"github.com/elastic/opbeans-go/config"
+)
+
+// newTestWarmer returns a warmer whose self-request is served by h, and
+// a health checker to which it is set, with its dependencies set up.
+func newTestWarmer(t *testing.T, tracer *apm.Tracer, h http.Handler) (*warmer, *healthChecker) {
+	db := newTestDB(t)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	settings := newRuntimeSettings(&config.Config{CacheTTL: config.Duration(time.Minute)})
+	w := newWarmer(tracer, db, persistence.NewInMemoryStore(time.Minute), settings, config.Server{})
+	w.url = srv.URL
+
+	health := &healthChecker{}
+	health.setDatabase(db)
+	health.setMigrated()
+	health.setWarmer(w)
+	return w, health
+}
+
+func readinessStatus(h *healthChecker) string {
+	return h.check(context.Background()).Status
+}
+
+func TestWarmUp(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	w, health := newTestWarmer(t, tracer, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(requested)
+		<-release
+	}))
+
+	// The server is not ready until the warm-up completes.
+	assert.Equal(t, healthStatusStarting, readinessStatus(health))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		health.warmUp(context.Background(), time.Minute)
+	}()
+
+	<-requested
+	assert.Equal(t, healthStatusWarmingUp, readinessStatus(health))
+	close(release)
+	<-done
+	assert.Equal(t, healthStatusOK, readinessStatus(health))
+
+	var stats *Stats
+	require.NoError(t, w.cache.Get(statsCacheKey, &stats))
+	assert.NotNil(t, stats)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "warm up", tx.Name)
+	assert.Equal(t, "task", tx.Type)
+	assert.Equal(t, "success", tx.Result)
+	var steps []string
+	for _, span := range payloads.Spans {
+		if span.Type == "app" && span.Subtype == "warmup" {
+			steps = append(steps, span.Name)
+		}
+	}
+	assert.Equal(t, []string{
+		"prime stats cache",
+		"query products",
+		"query customers",
+		"query orders",
+		"self-request",
+	}, steps)
+	assert.Empty(t, payloads.Errors)
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	logs := captureLogs(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	release := make(chan struct{})
+	defer close(release)
+	_, health := newTestWarmer(t, tracer, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+
+	// The server is ready once the timeout passes, with a warning.
+	start := time.Now()
+	health.warmUp(context.Background(), 100*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, healthStatusOK, readinessStatus(health))
+
+	// The warm-up itself is cancelled. Its transaction ends after its
+	// last log line.
+	require.Eventually(t, func() bool {
+		tracer.Flush(nil)
+		return len(recorder.Payloads().Transactions) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "failure", recorder.Payloads().Transactions[0].Result)
+	assert.Contains(t, logs.String(), "warm-up did not complete within 100ms, serving anyway")
+}
+
+func TestWarmUpFailure(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	_, health := newTestWarmer(t, tracer, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	// Failed steps do not prevent the server from becoming ready.
+	health.warmUp(context.Background(), time.Minute)
+	assert.Equal(t, healthStatusOK, readinessStatus(health))
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "failure", payloads.Transactions[0].Result)
+	require.Len(t, payloads.Errors, 1)
+	assert.Equal(t, `warm-up step "self-request" failed: unexpected status 500 Internal Server Error`, payloads.Errors[0].Exception.Message)
+}
+
+func TestWarmUpDisabled(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	_, health := newTestWarmer(t, tracer, http.NotFoundHandler())
+
+	health.warmUp(context.Background(), 0)
+	assert.Equal(t, healthStatusOK, readinessStatus(health))
+	tracer.Flush(nil)
+	assert.Empty(t, recorder.Payloads().Transactions)
+}
+
+func TestWarmUpServer(t *testing.T) {
+	setTestStartupFlags(t)
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	health := &healthChecker{}
+	r, _, cleanup, err := startup(tracer, loadTestConfig(t), health)
+	require.NoError(t, err)
+	defer cleanup()
+
+	// The self-request is handled by the router, continuing the trace of
+	// the warm-up.
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	health.warmer.url = srv.URL
+	health.warmUp(context.Background(), time.Minute)
+	assert.Equal(t, http.StatusOK, serveGet(r, readinessPath).Code)
+
+	tracer.Flush(nil)
+	transactions := recorder.Payloads().Transactions
+	names := make(map[string]string)
+	for _, tx := range transactions {
+		names[tx.Name] = string(tx.TraceID[:])
+	}
+	require.Contains(t, names, "warm up")
+	require.Contains(t, names, "GET /")
+	assert.Equal(t, names["warm up"], names["GET /"])
+}
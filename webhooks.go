@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"go.elastic.co/apm"
+
+	"github.com/elastic/opbeans-go/httpclient"
+)
+
+const (
+	// webhookSignatureHeader holds the hex-encoded HMAC-SHA256 of the
+	// webhook payload, keyed with $OPBEANS_WEBHOOK_SECRET and prefixed
+	// with "sha256=".
+	webhookSignatureHeader = "X-Opbeans-Signature"
+
+	// webhookEventHeader holds the type of the event in the payload.
+	webhookEventHeader = "X-Opbeans-Event"
+)
+
+// webhookEventTypes holds the order event types delivered to webhooks.
+// Fulfillment status changes are not delivered.
+var webhookEventTypes = map[string]bool{
+	orderEventCreated: true,
+}
+
+// redactURL returns u as a string, with any user info removed.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	return redacted.String()
+}
+
+// webhookSignature returns the value of webhookSignatureHeader for
+// payload, signed with secret.
+func webhookSignature(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSender delivers order events to webhooks.
+type webhookSender struct {
+	tracer *apm.Tracer
+	client *http.Client
+	urls   []*url.URL
+	secret []byte
+
+	// maxAttempts is the number of attempts made to deliver each
+	// event to each webhook.
+	maxAttempts int
+
+	// initialBackoff is the delay before the first retry. The delay
+	// doubles with each further retry, up to maxBackoff.
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// newWebhookSender returns a webhookSender delivering events to urls,
+// signed with secret, and traced by tracer.
+func newWebhookSender(tracer *apm.Tracer, urls []*url.URL, secret []byte) *webhookSender {
+	return &webhookSender{
+		tracer:         tracer,
+		client:         httpclient.Client(10 * time.Second),
+		urls:           urls,
+		secret:         secret,
+		maxAttempts:    5,
+		initialBackoff: time.Second,
+		maxBackoff:     30 * time.Second,
+	}
+}
+
+// publishEvent delivers e to each webhook, if it is of a type delivered
+// to webhooks. Deliveries which fail once their attempts are exhausted
+// are reported by deliver, and not dispatched again, so that a webhook
+// which is down neither holds up the events behind e, nor has them sent
+// again to the webhooks which received them. An error is returned only
+// if ctx is cancelled, in which case e is dispatched again.
+func (s *webhookSender) publishEvent(ctx context.Context, e orderEvent) error {
+	if !webhookEventTypes[e.Type] {
+		return nil
+	}
+	for _, u := range s.urls {
+		s.deliver(ctx, u, e)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver delivers e to the webhook at u, retrying with exponential
+// backoff, and returns the error of the last attempt if all failed.
+//
+// The delivery is traced as a "task" transaction, continuing the trace
+// in which the event was published, with a span for each attempt. If
+// every attempt fails, an error is reported with the webhook URL,
+// without any credentials.
+func (s *webhookSender) deliver(ctx context.Context, u *url.URL, e orderEvent) error {
+	tx := s.tracer.StartTransactionOptions("deliver webhook", "task", apm.TransactionOptions{
+		TraceContext: e.traceContext,
+	})
+	defer tx.End()
+	ctx = apm.ContextWithTransaction(ctx, tx)
+
+	payload, _ := json.Marshal(e) // orderEvent is always encodable
+	var err error
+	attempts := 0
+	backoff := s.initialBackoff
+	for {
+		attempts++
+		err = s.post(ctx, u, e.Type, payload)
+		if err == nil || attempts == s.maxAttempts || !retryableWebhookError(err) {
+			break
+		}
+		logrus.WithError(err).WithField("attempt", attempts).Debug("retrying webhook delivery")
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(backoff):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+
+	redactedURL := redactURL(u)
+	ifSampled(tx, func() {
+		tx.Context.SetLabel("event_type", e.Type)
+		tx.Context.SetLabel("order_id", e.OrderID)
+		tx.Context.SetLabel("webhook_url", redactedURL)
+		tx.Context.SetLabel("attempts", attempts)
+	})
+	if err == nil {
+		tx.Result = "success"
+		return nil
+	}
+	tx.Result = "failure"
+	err = errors.Wrapf(err, "failed to deliver webhook to %s after %d attempts", redactedURL, attempts)
+	logrus.WithError(err).Error("webhook delivery failed")
+	if apmErr := s.tracer.NewError(err); apmErr != nil {
+		apmErr.SetTransaction(tx)
+		apmErr.Context.SetLabel("webhook_url", redactedURL)
+		apmErr.Send()
+	}
+	return err
+}
+
+// webhookStatusError is returned by webhookSender.post for responses
+// with a non-2xx status.
+type webhookStatusError struct {
+	statusCode int
+}
+
+func (e webhookStatusError) Error() string {
+	return "unexpected status " + strconv.Itoa(e.statusCode)
+}
+
+// retryableWebhookError reports whether a delivery which failed with err
+// should be retried: after network errors, 429 (Too Many Requests), and
+// 5xx statuses.
+func retryableWebhookError(err error) bool {
+	if statusErr, ok := err.(webhookStatusError); ok {
+		return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+	}
+	return true
+}
+
+// post makes a single delivery attempt. Errors do not include the URL,
+// which may hold credentials.
+func (s *webhookSender) post(ctx context.Context, u *url.URL, eventType string, payload []byte) error {
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(s.secret, payload))
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// webhookReceiver is a test webhook endpoint, which responds to the
+// requests it receives with the statuses in order, and then with 200.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, receivedWebhook{header: req.Header, body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.requests...)
+}
+
+// verifyWebhookSignature verifies the signature of a received webhook,
+// as a receiver would.
+func verifyWebhookSignature(secret []byte, w receivedWebhook) bool {
+	expected := webhookSignature(secret, w.body)
+	return hmac.Equal([]byte(expected), []byte(w.header.Get(webhookSignatureHeader)))
+}
+
+func newTestWebhookSender(t *testing.T, tracer *apm.Tracer, rawurls ...string) *webhookSender {
+	urls := make([]*url.URL, len(rawurls))
+	for i, rawurl := range rawurls {
+		u, err := url.Parse(rawurl)
+		require.NoError(t, err)
+		urls[i] = u
+	}
+	s := newWebhookSender(tracer, urls, []byte("secret"))
+	s.maxAttempts = 3
+	s.initialBackoff = time.Millisecond
+	s.maxBackoff = 2 * time.Millisecond
+	return s
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	receiver := newWebhookReceiver(t)
+	s := newTestWebhookSender(t, tracer, receiver.URL)
+
+	checkout := tracer.StartTransaction("POST /api/orders", "request")
+	err := s.deliver(context.Background(), s.urls[0], orderEvent{
+		Type:         orderEventCreated,
+		OrderID:      123,
+		Status:       jobStatePending,
+		traceContext: checkout.TraceContext(),
+	})
+	checkout.End()
+	require.NoError(t, err)
+
+	received := receiver.received()
+	require.Len(t, received, 1)
+	assert.JSONEq(t, `{"type":"order_created","order_id":123,"status":"pending"}`, string(received[0].body))
+	assert.Equal(t, "application/json", received[0].header.Get("Content-Type"))
+	assert.Equal(t, orderEventCreated, received[0].header.Get(webhookEventHeader))
+	assert.True(t, verifyWebhookSignature([]byte("secret"), received[0]))
+	assert.False(t, verifyWebhookSignature([]byte("wrong"), received[0]))
+	assert.NotEmpty(t, received[0].header.Get("Elastic-Apm-Traceparent"))
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "deliver webhook", tx.Name)
+	assert.Equal(t, "task", tx.Type)
+	assert.Equal(t, "success", tx.Result)
+	assert.Equal(t, payloads.Transactions[1].TraceID, tx.TraceID)
+	assert.Equal(t, payloads.Transactions[1].ID, tx.ParentID)
+	require.Len(t, payloads.Spans, 1)
+	assert.Equal(t, "external", payloads.Spans[0].Type)
+	assert.Equal(t, "http", payloads.Spans[0].Subtype)
+	assert.Equal(t, tx.ID, payloads.Spans[0].ParentID)
+}
+
+func TestWebhookRetryThenSuccess(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	s := newTestWebhookSender(t, tracer, receiver.URL)
+
+	require.NoError(t, s.deliver(context.Background(), s.urls[0], orderEvent{Type: orderEventCreated, OrderID: 1}))
+	received := receiver.received()
+	require.Len(t, received, 3)
+	for _, w := range received {
+		assert.Equal(t, received[0].body, w.body)
+		assert.True(t, verifyWebhookSignature([]byte("secret"), w))
+	}
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "success", payloads.Transactions[0].Result)
+	assert.Equal(t, float64(3), transactionLabels(payloads.Transactions[0])["attempts"])
+	assert.Len(t, payloads.Spans, 3)
+	assert.Empty(t, payloads.Errors)
+}
+
+func TestWebhookPermanentFailure(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	receiver := newWebhookReceiver(t,
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable,
+	)
+	webhookURL := strings.Replace(receiver.URL, "http://", "http://user:hunter2@", 1)
+	s := newTestWebhookSender(t, tracer, webhookURL)
+
+	assert.Error(t, s.deliver(context.Background(), s.urls[0], orderEvent{Type: orderEventCreated, OrderID: 1}))
+	assert.Len(t, receiver.received(), 3)
+
+	tracer.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	assert.Equal(t, "failure", payloads.Transactions[0].Result)
+	require.Len(t, payloads.Errors, 1)
+	e := payloads.Errors[0]
+	assert.Equal(t, payloads.Transactions[0].ID, e.TransactionID)
+	assert.Equal(t,
+		"failed to deliver webhook to "+receiver.URL+" after 3 attempts: unexpected status 503",
+		e.Exception.Message,
+	)
+	assert.Equal(t, receiver.URL, e.Context.Tags[0].Value)
+	assert.NotContains(t, e.Exception.Message, "hunter2")
+}
+
+func TestWebhookNotRetried(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	receiver := newWebhookReceiver(t, http.StatusBadRequest)
+	s := newTestWebhookSender(t, tracer, receiver.URL)
+
+	assert.Error(t, s.deliver(context.Background(), s.urls[0], orderEvent{Type: orderEventCreated, OrderID: 1}))
+	assert.Len(t, receiver.received(), 1)
+	tracer.Flush(nil)
+	assert.Len(t, recorder.Payloads().Errors, 1)
+}
+
+func TestWebhookPublishEvent(t *testing.T) {
+	rejecting := newWebhookReceiver(t, http.StatusBadRequest)
+	receiver := newWebhookReceiver(t)
+	s := newTestWebhookSender(t, apm.DefaultTracer, rejecting.URL, receiver.URL)
+
+	// Status changes are not delivered, and events rejected by a
+	// webhook are not dispatched again.
+	require.NoError(t, s.publishEvent(context.Background(), orderEvent{Type: orderEventStatusChanged, OrderID: 1, Status: jobStateDone}))
+	require.NoError(t, s.publishEvent(context.Background(), orderEvent{Type: orderEventCreated, OrderID: 2, Status: jobStatePending}))
+	assert.Len(t, rejecting.received(), 1)
+	received := receiver.received()
+	require.Len(t, received, 1)
+	assert.JSONEq(t, `{"type":"order_created","order_id":2,"status":"pending"}`, string(received[0].body))
+
+	// Events which fail to be delivered to a webhook once its attempts
+	// are exhausted are not dispatched again, and are delivered to the
+	// others.
+	failing := newWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	s = newTestWebhookSender(t, apm.DefaultTracer, failing.URL, receiver.URL)
+	require.NoError(t, s.publishEvent(context.Background(), orderEvent{Type: orderEventCreated, OrderID: 3, Status: jobStatePending}))
+	assert.Len(t, failing.received(), 3)
+	assert.Len(t, receiver.received(), 2)
+
+	// Events are dispatched again if delivery is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.publishEvent(ctx, orderEvent{Type: orderEventCreated, OrderID: 4, Status: jobStatePending}))
+}
+
+func TestWebhookOutboxDeadURL(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	live := newWebhookReceiver(t)
+	other := &fakeOutboxSink{}
+	d := newOutboxDispatcher(db, newTestWebhookSender(t, tracer, dead.URL, live.URL), other)
+
+	// A webhook which is down holds up neither the events behind those
+	// it fails to receive, nor the other webhooks and sinks, which
+	// receive each event once.
+	ids := createTestOrders(t, db, 2)
+	sent, err := d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	ids = append(ids, createTestOrders(t, db, 1)...)
+	sent, err = d.dispatchBatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	received := live.received()
+	require.Len(t, received, len(ids))
+	for i, w := range received {
+		var e orderEvent
+		require.NoError(t, json.Unmarshal(w.body, &e))
+		assert.Equal(t, ids[i], e.OrderID)
+	}
+	assert.Len(t, other.published(), len(ids))
+	for key, sentAt := range outboxSentAt(t, db) {
+		assert.NotNil(t, sentAt, key)
+	}
+
+	// Each failed delivery is reported.
+	tracer.Flush(nil)
+	assert.Len(t, recorder.Payloads().Errors, len(ids))
+}
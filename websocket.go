@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"go.elastic.co/apm"
+)
+
+const (
+	// orderEventsPingPeriod is the interval at which pings are sent
+	// to order event WebSocket clients.
+	orderEventsPingPeriod = 30 * time.Second
+
+	// orderEventsBufferSize is the number of events buffered for each
+	// order event WebSocket connection. Events are dropped for clients
+	// which fall further behind.
+	orderEventsBufferSize = 64
+
+	webSocketWriteWait = 10 * time.Second
+)
+
+// handleOrderEventsWebSocket returns a handler which upgrades requests to
+// WebSocket connections, and pushes the events published to hub to the
+// client as JSON text messages.
+//
+// The connection is kept alive by sending pings every pingPeriod, and is
+// closed if no pong is received from the client for two ping periods.
+// When hub is closed, the connection is closed with the "going away"
+// close code.
+//
+// The connection is traced by the request's transaction, which ends when
+// the connection is closed, and is labelled with the number of messages
+// sent and dropped, and the connection's duration in milliseconds.
+func handleOrderEventsWebSocket(hub *orderEventHub, pingPeriod time.Duration) gin.HandlerFunc {
+	var upgrader websocket.Upgrader
+	return func(c *gin.Context) {
+		// The status is recorded for the transaction result; Upgrade
+		// writes the response itself once the connection is hijacked,
+		// and otherwise replaces the status with an error status.
+		c.Writer.WriteHeader(http.StatusSwitchingProtocols)
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+
+		sub := hub.subscribe(orderEventsBufferSize)
+		defer sub.unsubscribe()
+		sent := serveOrderEvents(conn, sub, pingPeriod)
+
+		tx := apm.TransactionFromContext(c.Request.Context())
+		ifSampled(tx, func() {
+			tx.Context.SetLabel("messages_sent", sent)
+			tx.Context.SetLabel("messages_dropped", sub.droppedEvents())
+			tx.Context.SetLabel("connection_duration_ms", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+		})
+	}
+}
+
+// serveOrderEvents writes the events received from sub to conn until the
+// connection fails, the client closes it, or sub's events channel is
+// closed, returning the number of events sent. conn is closed before
+// serveOrderEvents returns.
+func serveOrderEvents(conn *websocket.Conn, sub *orderEventSubscription, pingPeriod time.Duration) int {
+	pongWait := 2 * pingPeriod
+	readDone := make(chan struct{})
+	defer func() {
+		conn.Close()
+		<-readDone
+	}()
+
+	// Read in the background to process pongs and close messages.
+	// Clients are not expected to send data messages.
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer close(readDone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	var sent int
+	for {
+		select {
+		case e, ok := <-sub.events:
+			conn.SetWriteDeadline(time.Now().Add(webSocketWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(
+					websocket.CloseGoingAway, "server stopping",
+				))
+				return sent
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				return sent
+			}
+			sent++
+		case <-ticker.C:
+			if err := conn.WriteControl(
+				websocket.PingMessage, nil, time.Now().Add(webSocketWriteWait),
+			); err != nil {
+				return sent
+			}
+		case <-readDone:
+			return sent
+		}
+	}
+}
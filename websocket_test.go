@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/model"
+	"go.elastic.co/apm/transport/transporttest"
+)
+
+// newTestOrderEventsServer returns a server serving the API handlers and
+// the order event WebSocket endpoint, traced by tracer.
+func newTestOrderEventsServer(t *testing.T, tracer *apm.Tracer, db *sqlx.DB, hub *orderEventHub, pingPeriod time.Duration) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	routes := make(routeOptionsMap)
+	r.Use(tracingMiddleware(tracer, tracingOptions{routes: routes}))
+	addAPIHandlers(r.Group("/api"), db, &businessMetrics{}, hub, nil, nil, nil)
+	routes.handle(&r.RouterGroup, "GET", "/ws/orders", routeOptions{
+		transactionType: transactionTypeWebSocket,
+	}, handleOrderEventsWebSocket(hub, pingPeriod))
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialOrderEvents connects to the order event WebSocket endpoint of
+// server, waiting for the connection to be subscribed to hub.
+func dialOrderEvents(t *testing.T, server *httptest.Server, hub *orderEventHub) *websocket.Conn {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/orders", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	t.Cleanup(func() { conn.Close() })
+	require.Eventually(t, func() bool {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		return len(hub.subscriptions) == 1
+	}, 10*time.Second, time.Millisecond)
+	return conn
+}
+
+// waitTransactions flushes tracer until recorder has recorded n
+// transactions, returning them.
+func waitTransactions(t *testing.T, tracer *apm.Tracer, recorder *transporttest.RecorderTransport, n int) []model.Transaction {
+	require.Eventually(t, func() bool {
+		tracer.Flush(nil)
+		return len(recorder.Payloads().Transactions) >= n
+	}, 10*time.Second, 10*time.Millisecond)
+	return recorder.Payloads().Transactions
+}
+
+func TestOrderEventsWebSocket(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	db := newTestDB(t)
+	hub := newOrderEventHub()
+	server := newTestOrderEventsServer(t, tracer, db, hub, time.Minute)
+	conn := dialOrderEvents(t, server, hub)
+
+	resp, err := http.Post(server.URL+"/api/orders", "application/json", strings.NewReader(
+		`{"customer_id": 1, "lines": [{"id": 1, "amount": 2}]}`,
+	))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	processed, err := newFulfillmentWorker(tracer, db, hub).processJob(context.Background())
+	require.NoError(t, err)
+	require.True(t, processed)
+
+	var created, fulfilled orderEvent
+	require.NoError(t, conn.ReadJSON(&created))
+	require.NoError(t, conn.ReadJSON(&fulfilled))
+	assert.Equal(t, orderEventCreated, created.Type)
+	assert.Equal(t, jobStatePending, created.Status)
+	assert.NotZero(t, created.OrderID)
+	assert.Equal(t, orderEvent{Type: orderEventStatusChanged, OrderID: created.OrderID, Status: jobStateDone}, fulfilled)
+
+	// The connection's transaction is recorded when it is closed,
+	// and not for each message.
+	tracer.Flush(nil)
+	assert.Len(t, recorder.Payloads().Transactions, 2) // checkout and fulfillment
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	transactions := waitTransactions(t, tracer, recorder, 3)
+	require.Len(t, transactions, 3)
+
+	tx := transactions[2]
+	assert.Equal(t, "GET /ws/orders", tx.Name)
+	assert.Equal(t, "request.websocket", tx.Type)
+	assert.Equal(t, "HTTP 1xx", tx.Result)
+	labels := make(map[string]interface{})
+	for _, item := range tx.Context.Tags {
+		labels[item.Key] = item.Value
+	}
+	assert.Equal(t, float64(2), labels["messages_sent"])
+	assert.Equal(t, float64(0), labels["messages_dropped"])
+	require.IsType(t, float64(0), labels["connection_duration_ms"])
+	assert.InDelta(t, tx.Duration, labels["connection_duration_ms"], 100)
+}
+
+func TestOrderEventsWebSocketPing(t *testing.T) {
+	tracer := apm.DefaultTracer
+	hub := newOrderEventHub()
+	server := newTestOrderEventsServer(t, tracer, newTestDB(t), hub, 10*time.Millisecond)
+	conn := dialOrderEvents(t, server, hub)
+
+	// The client must read to process pings.
+	var pings int64
+	conn.SetPingHandler(func(string) error {
+		atomic.AddInt64(&pings, 1)
+		return conn.WriteControl(websocket.PongMessage, nil, time.Now().Add(time.Second))
+	})
+	go conn.ReadMessage()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&pings) >= 3
+	}, 10*time.Second, time.Millisecond)
+}
+
+func TestOrderEventsWebSocketHubClosed(t *testing.T) {
+	tracer, recorder := transporttest.NewRecorderTracer()
+	defer tracer.Close()
+	hub := newOrderEventHub()
+	server := newTestOrderEventsServer(t, tracer, newTestDB(t), hub, time.Minute)
+	conn := dialOrderEvents(t, server, hub)
+
+	hub.close()
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+	transactions := waitTransactions(t, tracer, recorder, 1)
+	assert.Equal(t, "GET /ws/orders", transactions[0].Name)
+
+	// Connections made once the hub is closed are closed immediately.
+	conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/orders", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
+
+func TestOrderEventHubDropOnFull(t *testing.T) {
+	hub := newOrderEventHub()
+	full := hub.subscribe(1)
+	roomy := hub.subscribe(3)
+	for i := 1; i <= 3; i++ {
+		hub.publish(orderEvent{Type: orderEventCreated, OrderID: i})
+	}
+	assert.Equal(t, uint64(2), full.droppedEvents())
+	assert.Equal(t, uint64(0), roomy.droppedEvents())
+	assert.Equal(t, 1, (<-full.events).OrderID)
+
+	full.unsubscribe()
+	hub.publish(orderEvent{Type: orderEventCreated, OrderID: 4})
+	assert.Equal(t, uint64(2), full.droppedEvents())
+	assert.Len(t, full.events, 0)
+	assert.Len(t, roomy.events, 3)
+
+	hub.close()
+	for range roomy.events {
+	}
+}